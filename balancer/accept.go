@@ -0,0 +1,90 @@
+package balancer
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Backoff between failed accepts, doubling up to the maximum like net/http.
+const (
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+)
+
+type acceptErrorKind int
+
+const (
+	//acceptRetry is a connection the peer gave up on before it was accepted
+	acceptRetry acceptErrorKind = iota
+	//acceptExhausted is running out of file descriptors or kernel memory
+	acceptExhausted
+	//acceptTemporary is anything else that may go away on its own
+	acceptTemporary
+	//acceptFatal means the listener is unusable
+	acceptFatal
+)
+
+func classifyAcceptError(err error) acceptErrorKind {
+	switch {
+	case errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPROTO):
+		return acceptRetry
+	case errors.Is(err, syscall.EMFILE), errors.Is(err, syscall.ENFILE),
+		errors.Is(err, syscall.ENOBUFS), errors.Is(err, syscall.ENOMEM):
+		return acceptExhausted
+	case errors.Is(err, net.ErrClosed), errors.Is(err, syscall.EBADF),
+		errors.Is(err, syscall.EINVAL), errors.Is(err, syscall.ENOTSOCK), errors.Is(err, syscall.EOPNOTSUPP):
+		return acceptFatal
+	}
+	return acceptTemporary
+}
+
+// acceptBackoff tracks one accept loop's run of failed accepts, so that it
+// sleeps instead of spinning and logs the start and end of the run rather
+// than every error.
+type acceptBackoff struct {
+	delay  time.Duration
+	errors int
+}
+
+// acceptFailed records an accept error and returns how long to wait before the
+// next attempt, or false if the loop should stop.
+func (lb *LoadBalancer) acceptFailed(fe *frontend, b *acceptBackoff, err error) (time.Duration, bool) {
+	kind := classifyAcceptError(err)
+	switch kind {
+	case acceptRetry:
+		return 0, true
+	case acceptFatal:
+		return 0, false
+	}
+
+	fe.acceptErrors.Add(1)
+	if kind == acceptExhausted {
+		lb.fdPressure.Add(1)
+		fe.fdPressure.Store(true)
+	}
+
+	b.errors++
+	if b.delay == 0 {
+		b.delay = acceptBackoffMin
+		if kind == acceptExhausted {
+			lb.log.Warn("Accept out of file descriptors, backing off; raise the open files limit", "listener", fe.addr, "error", err)
+		} else {
+			lb.log.Warn("Error accepting connection, backing off", "listener", fe.addr, "error", err)
+		}
+	} else {
+		b.delay = min(2*b.delay, acceptBackoffMax)
+	}
+	return b.delay, true
+}
+
+// accepted ends a run of failed accepts.
+func (lb *LoadBalancer) accepted(fe *frontend, b *acceptBackoff) {
+	if b.delay == 0 {
+		return
+	}
+	lb.log.Info("Accept recovered", "listener", fe.addr, "attempts", b.errors)
+	fe.fdPressure.Store(false)
+	*b = acceptBackoff{}
+}
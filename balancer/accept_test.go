@@ -0,0 +1,68 @@
+package balancer
+
+import (
+	"log/slog"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"loadbalancer/balancer/clock"
+)
+
+// failingListener fails every accept with err until it has been called
+// len(at) times, then reports it closed; at records when each call came.
+type failingListener struct {
+	net.Listener
+	clock clock.Clock
+	err   error
+	at    []time.Time
+	n     int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.at[l.n] = l.clock.Now()
+	if l.n++; l.n == len(l.at) {
+		return nil, net.ErrClosed
+	}
+	return nil, l.err
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	f := clock.NewFake(time.Unix(0, 0))
+	lb, err := New(WithClock(f), WithLogger(slog.New(slog.DiscardHandler)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []time.Duration{5, 10, 20, 40, 80, 160, 320, 640, 1000, 1000}
+	ln := &failingListener{clock: f, err: syscall.EMFILE, at: make([]time.Time, len(want)+1)}
+	fe := &frontend{}
+	done := make(chan error)
+	go func() { done <- lb.acceptLoop(ln, fe) }()
+
+	for {
+		select {
+		case err := <-done:
+			if err != net.ErrClosed {
+				t.Fatalf("acceptLoop: %v, want net.ErrClosed", err)
+			}
+			for i, d := range want {
+				if got := ln.at[i+1].Sub(ln.at[i]); got != d*time.Millisecond {
+					t.Errorf("retry %d after %v, want %v", i+1, got, d*time.Millisecond)
+				}
+			}
+			if n := fe.acceptErrors.Load(); n != uint64(len(want)) || !fe.fdPressure.Load() {
+				t.Errorf("%d accept errors, fd pressure %v", n, fe.fdPressure.Load())
+			}
+			return
+		default:
+		}
+		//step a millisecond at a time so each retry lands on its delay
+		if f.Waiters() > 0 {
+			f.Advance(time.Millisecond)
+		} else {
+			time.Sleep(10 * time.Microsecond)
+		}
+	}
+}
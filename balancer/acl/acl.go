@@ -0,0 +1,95 @@
+package acl
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ACL holds CIDR allow and deny rules. Deny rules win; when there are allow
+// rules, an address must match one of them.
+type ACL struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// New parses allow and deny rules. Each rule is a CIDR ("10.0.0.0/8") or a
+// single address ("192.0.2.7").
+func New(allow, deny []string) (*ACL, error) {
+	a := &ACL{}
+	var err error
+
+	if a.allow, err = parseRules(allow); err != nil {
+		return nil, fmt.Errorf("allow: %w", err)
+	}
+	if a.deny, err = parseRules(deny); err != nil {
+		return nil, fmt.Errorf("deny: %w", err)
+	}
+	return a, nil
+}
+
+func parseRules(rules []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(rules))
+	for _, rule := range rules {
+		p, err := ParsePrefix(rule)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// ParsePrefix parses a CIDR or a bare address, normalising IPv4-mapped IPv6
+// forms to plain IPv4.
+func ParsePrefix(rule string) (netip.Prefix, error) {
+	rule = strings.TrimSpace(rule)
+
+	if !strings.Contains(rule, "/") {
+		addr, err := netip.ParseAddr(rule)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid rule %q: %w", rule, err)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	p, err := netip.ParsePrefix(rule)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid rule %q: %w", rule, err)
+	}
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), nil
+}
+
+// Check reports whether addr may connect and the rule that decided it. The
+// rule is empty when no rule applied.
+func (a *ACL) Check(addr netip.Addr) (bool, string) {
+	if a == nil {
+		return true, ""
+	}
+	addr = addr.Unmap()
+
+	for _, p := range a.deny {
+		if p.Contains(addr) {
+			return false, "deny " + p.String()
+		}
+	}
+
+	if len(a.allow) == 0 {
+		return true, ""
+	}
+
+	for _, p := range a.allow {
+		if p.Contains(addr) {
+			return true, "allow " + p.String()
+		}
+	}
+	return false, "not in allowlist"
+}
+
+func (a *ACL) Empty() bool {
+	return a == nil || (len(a.allow) == 0 && len(a.deny) == 0)
+}
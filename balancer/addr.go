@@ -0,0 +1,35 @@
+package balancer
+
+import (
+	"net"
+	"net/netip"
+
+	"loadbalancer/balancer/ratelimit"
+)
+
+// clientIP extracts the client address from a connection's remote address,
+// with IPv4-mapped IPv6 forms normalised to IPv4 and zones dropped, so a
+// v4 client of a dual-stack listener looks the same as on a v4 one.
+func clientIP(addr net.Addr) netip.Addr {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, _ := netip.AddrFromSlice(a.IP)
+		return ip.Unmap()
+	case *net.UDPAddr:
+		ip, _ := netip.AddrFromSlice(a.IP)
+		return ip.Unmap()
+	}
+
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap().WithZone("")
+}
+
+// clientKey identifies a client for hashing and sticky sessions: its
+// address, or for IPv6 its network of lb's prefix length, the same way
+// rate limits count it.
+func (lb *LoadBalancer) clientKey(addr net.Addr) string {
+	return ratelimit.ClientNet(clientIP(addr), lb.ipv6Prefix).String()
+}
@@ -0,0 +1,669 @@
+//go:build !nohttp
+
+package balancer
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"loadbalancer/balancer/acl"
+)
+
+// AdminConfig describes the admin HTTP API, which manages the backends of
+// a running balancer.
+type AdminConfig struct {
+	//Address is the TCP address to serve on, e.g. "127.0.0.1:9090"
+	Address string
+	//Token is the bearer token for every pool
+	Token []byte
+	//TenantTokens by tenant name only see and change that tenant's pools
+	TenantTokens map[string][]byte
+	//RegisterToken only lets backends register themselves, from their own
+	//address, see WithRegistration
+	RegisterToken []byte
+}
+
+// ListenAdmin serves the admin API until its listener fails or Shutdown:
+//
+//	GET    /backends                 members with health and connection stats
+//	POST   /backends                 add {"addr", "pool", "weight", "labels", "standby"}
+//	DELETE /backends/{addr}          drain, then remove
+//	PUT    /backends/{addr}/drain    stop new connections to addr
+//	DELETE /backends/{addr}/drain    resume
+//	PUT    /backends/{addr}/admit    let a standby take new connections
+//	DELETE /backends/{addr}/admit    return it to reserve
+//	PUT    /backends/{addr}/replace  move it to {"addr"}, see ReplaceBackend
+//	GET    /configs                  config versions, see RecordConfig
+//	GET    /configs/{version}        the config of a version, as written
+//	GET    /debug                    whether debugging is on, see SetDebug
+//	PUT    /debug                    turn it on
+//	DELETE /debug                    turn it off
+//	GET    /pins                     clients pinned to a backend, see PinClients
+//	PUT    /pins                     pin {"client", "backend", "pool", "ttl"}
+//	DELETE /pins?client=             unpin an IP or CIDR
+//	PUT    /register/{addr}          register or renew, {"weight", "labels"} optional
+//	DELETE /register/{addr}          deregister: drain, then remove
+//
+// Each takes ?pool=, the default pool for POST and DELETE and every pool
+// otherwise. Drains run in the background, see DrainBackend. Debugging
+// affects every listener and, like the config versions, needs Token.
+func (lb *LoadBalancer) ListenAdmin(cfg AdminConfig) error {
+	if len(cfg.Token) == 0 && len(cfg.TenantTokens) == 0 && len(cfg.RegisterToken) == 0 {
+		return errors.New("admin API: a token is required")
+	}
+	for name := range cfg.TenantTokens {
+		if lb.Tenant(name) == nil {
+			return fmt.Errorf("admin API: unknown tenant %s", name)
+		}
+	}
+
+	ln, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:           lb.adminHandler(cfg),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	if !lb.addServer(srv) {
+		ln.Close()
+		return nil
+	}
+	lb.log.Info("Admin API listening", "address", ln.Addr().String())
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// adminBackend is a backend as the admin API shows it.
+type adminBackend struct {
+	Pool        string            `json:"pool"`
+	Addr        string            `json:"addr"`
+	Healthy     bool              `json:"healthy"`
+	Draining    bool              `json:"draining"`
+	Standby     bool              `json:"standby,omitempty"`
+	Admitted    bool              `json:"admitted,omitempty"`
+	Weight      int               `json:"weight"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Active      int64             `json:"active"`
+	Connections uint64            `json:"connections"`
+	Failed      uint64            `json:"failed"`
+	BytesIn     uint64            `json:"bytes_in"`
+	BytesOut    uint64            `json:"bytes_out"`
+	Latency     string            `json:"latency,omitempty"`
+	//MaxConnections is the backend's connection limit, 0 for none
+	MaxConnections int `json:"max_connections,omitempty"`
+}
+
+func newAdminBackend(pool string, b *Backend) adminBackend {
+	s := b.Snapshot()
+	ab := adminBackend{
+		Pool:        pool,
+		Addr:        b.Addr,
+		Healthy:     b.Healthy(),
+		Draining:    b.Draining(),
+		Standby:     b.Standby(),
+		Admitted:    b.Admitted(),
+		Weight:      b.Weight(),
+		Labels:      b.Labels(),
+		Active:      s.Active,
+		Connections: s.Connections,
+		Failed:      s.Failed,
+		BytesIn:     s.BytesIn,
+		BytesOut:    s.BytesOut,
+
+		MaxConnections: b.MaxConnections(),
+	}
+	if l := b.Latency(); l > 0 {
+		ab.Latency = l.String()
+	}
+	return ab
+}
+
+// adminScope is what one token may manage: every pool, a tenant's, or
+// only the registration of backends.
+type adminScope struct {
+	lb     *LoadBalancer
+	tenant *Tenant
+	//registrar may only use the registration endpoints
+	registrar bool
+}
+
+func (s adminScope) pool(name string) *Pool {
+	if s.tenant != nil {
+		return s.tenant.Pool(name)
+	}
+	return s.lb.Pool(name)
+}
+
+// pools are the named pool, or every pool when name is empty.
+func (s adminScope) pools(name string) ([]*Pool, error) {
+	if name != "" {
+		p := s.pool(name)
+		if p == nil {
+			return nil, fmt.Errorf("unknown pool %s", name)
+		}
+		return []*Pool{p}, nil
+	}
+	if s.tenant != nil {
+		return s.tenant.Pools(), nil
+	}
+	return s.lb.Pools(), nil
+}
+
+func (lb *LoadBalancer) adminHandler(cfg AdminConfig) http.Handler {
+	mux := http.NewServeMux()
+	serve := func(pattern string, registration bool, fn func(adminScope, http.ResponseWriter, *http.Request)) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			scope, ok := lb.adminAuth(cfg, r)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				adminError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+				return
+			}
+			if scope.registrar && !registration {
+				adminError(w, http.StatusForbidden, errors.New("the register token may only register backends"))
+				return
+			}
+			fn(scope, w, r)
+		})
+	}
+	handle := func(pattern string, fn func(adminScope, http.ResponseWriter, *http.Request)) {
+		serve(pattern, false, fn)
+	}
+
+	handle("GET /backends", adminList)
+	handle("POST /backends", adminAdd)
+	handle("DELETE /backends/{addr}", adminRemove)
+	handle("PUT /backends/{addr}/drain", adminDrain)
+	handle("DELETE /backends/{addr}/drain", adminResume)
+	handle("PUT /backends/{addr}/admit", adminAdmit(true))
+	handle("DELETE /backends/{addr}/admit", adminAdmit(false))
+	handle("PUT /backends/{addr}/replace", adminReplace)
+	handle("GET /configs", adminConfigs)
+	handle("GET /configs/{version}", adminConfig)
+	handle("GET /debug", adminDebug)
+	handle("PUT /debug", adminDebug)
+	handle("DELETE /debug", adminDebug)
+	handle("GET /pins", adminClientPins)
+	handle("PUT /pins", adminPinClients)
+	handle("DELETE /pins", adminUnpinClients)
+	serve("PUT /register/{addr}", true, adminRegister)
+	serve("DELETE /register/{addr}", true, adminDeregister)
+	return mux
+}
+
+func (lb *LoadBalancer) adminAuth(cfg AdminConfig, r *http.Request) (adminScope, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return adminScope{}, false
+	}
+	if len(cfg.Token) > 0 && subtle.ConstantTimeCompare([]byte(token), cfg.Token) == 1 {
+		return adminScope{lb: lb}, true
+	}
+	for name, t := range cfg.TenantTokens {
+		if subtle.ConstantTimeCompare([]byte(token), t) == 1 {
+			if tenant := lb.Tenant(name); tenant != nil {
+				return adminScope{lb: lb, tenant: tenant}, true
+			}
+		}
+	}
+	if len(cfg.RegisterToken) > 0 && subtle.ConstantTimeCompare([]byte(token), cfg.RegisterToken) == 1 {
+		return adminScope{lb: lb, registrar: true}, true
+	}
+	return adminScope{}, false
+}
+
+func adminList(s adminScope, w http.ResponseWriter, r *http.Request) {
+	pools, err := s.pools(r.URL.Query().Get("pool"))
+	if err != nil {
+		adminError(w, http.StatusNotFound, err)
+		return
+	}
+	list := []adminBackend{}
+	for _, p := range pools {
+		for _, b := range p.Backends() {
+			list = append(list, newAdminBackend(p.name, b))
+		}
+	}
+	adminJSON(w, http.StatusOK, list)
+}
+
+func adminAdd(s adminScope, w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Addr   string            `json:"addr"`
+		Pool   string            `json:"pool"`
+		Weight int               `json:"weight"`
+		Labels map[string]string `json:"labels"`
+		//Standby keeps the backend in reserve
+		Standby bool `json:"standby"`
+		//MaxConnections caps the backend's open connections
+		MaxConnections int `json:"max_connections"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Pool == "" {
+		req.Pool = DefaultPool
+	}
+	if req.Weight < 0 {
+		adminError(w, http.StatusBadRequest, errors.New("weight must not be negative"))
+		return
+	}
+	if req.MaxConnections < 0 {
+		adminError(w, http.StatusBadRequest, errors.New("max_connections must not be negative"))
+		return
+	}
+
+	p := s.pool(req.Pool)
+	if p == nil {
+		adminError(w, http.StatusNotFound, fmt.Errorf("unknown pool %s", req.Pool))
+		return
+	}
+	if p.Backend(req.Addr) != nil {
+		adminError(w, http.StatusConflict, fmt.Errorf("backend %s already in pool %s", req.Addr, p.name))
+		return
+	}
+	add := p.AddBackend
+	if req.Standby {
+		add = p.AddStandby
+	}
+	b, err := add(req.Addr)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Weight > 0 {
+		b.SetWeight(req.Weight)
+	}
+	if req.MaxConnections > 0 {
+		b.SetMaxConnections(req.MaxConnections)
+	}
+	if req.Labels != nil {
+		b.SetLabels(req.Labels)
+	}
+	adminJSON(w, http.StatusCreated, newAdminBackend(p.name, b))
+}
+
+func adminRemove(s adminScope, w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("pool")
+	if name == "" {
+		name = DefaultPool
+	}
+	p := s.pool(name)
+	if p == nil {
+		adminError(w, http.StatusNotFound, fmt.Errorf("unknown pool %s", name))
+		return
+	}
+	addr := r.PathValue("addr")
+	b := p.Backend(addr)
+	if b == nil {
+		adminError(w, http.StatusNotFound, fmt.Errorf("backend %s not in pool %s", addr, p.name))
+		return
+	}
+
+	go p.RetireBackend(context.Background(), addr)
+	adminJSON(w, http.StatusAccepted, newAdminBackend(p.name, b))
+}
+
+// adminTargets are the backends at the request's addr within its pools.
+func adminTargets(s adminScope, w http.ResponseWriter, r *http.Request) (string, []*Backend, []string, bool) {
+	pools, err := s.pools(r.URL.Query().Get("pool"))
+	if err != nil {
+		adminError(w, http.StatusNotFound, err)
+		return "", nil, nil, false
+	}
+	addr := r.PathValue("addr")
+	backends, names := backendsAt(pools, addr)
+	if len(backends) == 0 {
+		adminError(w, http.StatusNotFound, fmt.Errorf("unknown backend %s", addr))
+		return "", nil, nil, false
+	}
+	return addr, backends, names, true
+}
+
+func adminDrain(s adminScope, w http.ResponseWriter, r *http.Request) {
+	addr, backends, pools, ok := adminTargets(s, w, r)
+	if !ok {
+		return
+	}
+	//marked here so the response already shows the drain
+	for _, b := range backends {
+		b.SetDraining(true)
+	}
+	go s.lb.drainBackends(context.Background(), addr, backends, pools)
+	adminJSON(w, http.StatusAccepted, adminBackends(backends, pools))
+}
+
+func adminResume(s adminScope, w http.ResponseWriter, r *http.Request) {
+	addr, backends, pools, ok := adminTargets(s, w, r)
+	if !ok {
+		return
+	}
+	s.lb.resumeBackends(addr, backends, pools)
+	adminJSON(w, http.StatusOK, adminBackends(backends, pools))
+}
+
+func adminAdmit(on bool) func(adminScope, http.ResponseWriter, *http.Request) {
+	return func(s adminScope, w http.ResponseWriter, r *http.Request) {
+		addr, backends, pools, ok := adminTargets(s, w, r)
+		if !ok {
+			return
+		}
+		if err := s.lb.admitStandby(addr, backends, pools, on); err != nil {
+			adminError(w, http.StatusConflict, err)
+			return
+		}
+		adminJSON(w, http.StatusOK, adminBackends(backends, pools))
+	}
+}
+
+func adminReplace(s adminScope, w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		//Addr is the new address
+		Addr string `json:"addr"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	name := r.URL.Query().Get("pool")
+	if name == "" {
+		name = DefaultPool
+	}
+	p := s.pool(name)
+	if p == nil {
+		adminError(w, http.StatusNotFound, fmt.Errorf("unknown pool %s", name))
+		return
+	}
+	addr := r.PathValue("addr")
+	if p.Backend(addr) == nil {
+		adminError(w, http.StatusNotFound, fmt.Errorf("backend %s not in pool %s", addr, p.name))
+		return
+	}
+	if p.Backend(req.Addr) != nil {
+		adminError(w, http.StatusConflict, fmt.Errorf("backend %s already in pool %s", req.Addr, p.name))
+		return
+	}
+	b, err := p.ReplaceBackend(addr, req.Addr)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	adminJSON(w, http.StatusAccepted, newAdminBackend(p.name, b))
+}
+
+func adminDebug(s adminScope, w http.ResponseWriter, r *http.Request) {
+	if s.tenant != nil {
+		adminError(w, http.StatusForbidden, errors.New("debugging needs the operator token"))
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		s.lb.SetDebug(true)
+	case http.MethodDelete:
+		s.lb.SetDebug(false)
+	}
+	adminJSON(w, http.StatusOK, map[string]any{"debug": s.lb.Debugging(), "header": s.lb.debugHeaderName()})
+}
+
+func adminConfigs(s adminScope, w http.ResponseWriter, r *http.Request) {
+	if s.tenant != nil {
+		adminError(w, http.StatusForbidden, errors.New("config versions need the operator token"))
+		return
+	}
+	versions, err := s.lb.ConfigVersions()
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	type adminConfigVersion struct {
+		Version int    `json:"version"`
+		Applied string `json:"applied"`
+		Size    int    `json:"size"`
+	}
+	list := []adminConfigVersion{}
+	for _, v := range versions {
+		list = append(list, adminConfigVersion{
+			Version: v.Version,
+			Applied: v.Applied.UTC().Format(time.RFC3339),
+			Size:    len(v.Source),
+		})
+	}
+	adminJSON(w, http.StatusOK, list)
+}
+
+func adminConfig(s adminScope, w http.ResponseWriter, r *http.Request) {
+	if s.tenant != nil {
+		adminError(w, http.StatusForbidden, errors.New("config versions need the operator token"))
+		return
+	}
+	versions, err := s.lb.ConfigVersions()
+	if err != nil {
+		adminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	for _, v := range versions {
+		if strconv.Itoa(v.Version) == r.PathValue("version") {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write(v.Source)
+			return
+		}
+	}
+	adminError(w, http.StatusNotFound, fmt.Errorf("no config version %s", r.PathValue("version")))
+}
+
+// adminClientPin is a pin as the admin API shows it.
+type adminClientPin struct {
+	Pool    string `json:"pool"`
+	Client  string `json:"client"`
+	Backend string `json:"backend"`
+	Expires string `json:"expires"`
+}
+
+func newAdminClientPin(pin ClientPin) adminClientPin {
+	return adminClientPin{
+		Pool:    pin.Pool,
+		Client:  pin.Clients.String(),
+		Backend: pin.Backend,
+		Expires: pin.Expires.UTC().Format(time.RFC3339),
+	}
+}
+
+func adminClientPins(s adminScope, w http.ResponseWriter, r *http.Request) {
+	pools, err := s.pools(r.URL.Query().Get("pool"))
+	if err != nil {
+		adminError(w, http.StatusNotFound, err)
+		return
+	}
+	list := []adminClientPin{}
+	for _, p := range pools {
+		for _, pin := range p.ClientPins() {
+			list = append(list, newAdminClientPin(pin))
+		}
+	}
+	adminJSON(w, http.StatusOK, list)
+}
+
+func adminPinClients(s adminScope, w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		//Client is an IP or a CIDR
+		Client  string `json:"client"`
+		Backend string `json:"backend"`
+		Pool    string `json:"pool"`
+		//TTL is a duration such as "30m", DefaultPinTTL if empty
+		TTL string `json:"ttl"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Pool == "" {
+		req.Pool = DefaultPool
+	}
+	prefix, err := acl.ParsePrefix(req.Client)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			adminError(w, http.StatusBadRequest, fmt.Errorf("invalid ttl %q", req.TTL))
+			return
+		}
+	}
+
+	p := s.pool(req.Pool)
+	if p == nil {
+		adminError(w, http.StatusNotFound, fmt.Errorf("unknown pool %s", req.Pool))
+		return
+	}
+	pin, err := p.PinClients(prefix, req.Backend, ttl)
+	if err != nil {
+		adminError(w, http.StatusNotFound, err)
+		return
+	}
+	adminJSON(w, http.StatusOK, newAdminClientPin(pin))
+}
+
+func adminUnpinClients(s adminScope, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix, err := acl.ParsePrefix(query.Get("client"))
+	if err != nil {
+		adminError(w, http.StatusBadRequest, err)
+		return
+	}
+	name := query.Get("pool")
+	if name == "" {
+		name = DefaultPool
+	}
+	p := s.pool(name)
+	if p == nil {
+		adminError(w, http.StatusNotFound, fmt.Errorf("unknown pool %s", name))
+		return
+	}
+	if !p.UnpinClients(prefix) {
+		adminError(w, http.StatusNotFound, fmt.Errorf("clients %s not pinned in pool %s", prefix.Masked(), p.name))
+		return
+	}
+	adminJSON(w, http.StatusOK, map[string]string{"pool": p.name, "client": prefix.Masked().String()})
+}
+
+// registrant checks that s may register addr: tenants may not, and the
+// register token only from addr's own host.
+func (s adminScope) registrant(w http.ResponseWriter, r *http.Request) (string, bool) {
+	addr := r.PathValue("addr")
+	if s.tenant != nil {
+		adminError(w, http.StatusForbidden, errors.New("tenants can't register backends"))
+		return "", false
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		adminError(w, http.StatusBadRequest, fmt.Errorf("invalid backend address %q: %w", addr, err))
+		return "", false
+	}
+	if s.registrar {
+		from, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if host != from {
+			adminError(w, http.StatusForbidden, fmt.Errorf("%s may only register its own address", from))
+			return "", false
+		}
+	}
+	return addr, true
+}
+
+func adminRegister(s adminScope, w http.ResponseWriter, r *http.Request) {
+	addr, ok := s.registrant(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Weight int               `json:"weight"`
+		Labels map[string]string `json:"labels"`
+		//MaxConnections caps the backend's open connections
+		MaxConnections int `json:"max_connections"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+			adminError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if req.Weight < 0 {
+		adminError(w, http.StatusBadRequest, errors.New("weight must not be negative"))
+		return
+	}
+	if req.MaxConnections < 0 {
+		adminError(w, http.StatusBadRequest, errors.New("max_connections must not be negative"))
+		return
+	}
+
+	reg, b, err := s.lb.Register(r.URL.Query().Get("pool"), addr)
+	if err != nil {
+		status := http.StatusForbidden
+		if errors.Is(err, errNoRegistration) {
+			status = http.StatusNotFound
+		}
+		adminError(w, status, err)
+		return
+	}
+	if req.Weight > 0 {
+		b.SetWeight(req.Weight)
+	}
+	if req.MaxConnections > 0 {
+		b.SetMaxConnections(req.MaxConnections)
+	}
+	if req.Labels != nil {
+		b.SetLabels(req.Labels)
+	}
+	status := http.StatusOK
+	if reg.New {
+		status = http.StatusCreated
+	}
+	adminJSON(w, status, map[string]string{"pool": reg.Pool, "addr": reg.Addr, "ttl": reg.TTL.String()})
+}
+
+func adminDeregister(s adminScope, w http.ResponseWriter, r *http.Request) {
+	addr, ok := s.registrant(w, r)
+	if !ok {
+		return
+	}
+	pool := r.URL.Query().Get("pool")
+	if err := s.lb.Deregister(pool, addr); err != nil {
+		adminError(w, http.StatusNotFound, err)
+		return
+	}
+	if pool == "" {
+		pool = DefaultPool
+	}
+	adminJSON(w, http.StatusAccepted, map[string]string{"pool": pool, "addr": addr})
+}
+
+func adminBackends(backends []*Backend, pools []string) []adminBackend {
+	list := make([]adminBackend, len(backends))
+	for i, b := range backends {
+		list[i] = newAdminBackend(pools[i], b)
+	}
+	return list
+}
+
+func adminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, status int, err error) {
+	adminJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,18 @@
+//go:build nohttp
+
+package balancer
+
+import "errors"
+
+// AdminConfig is only available with net/http; ListenAdmin refuses it in
+// nohttp builds.
+type AdminConfig struct {
+	Address       string
+	Token         []byte
+	TenantTokens  map[string][]byte
+	RegisterToken []byte
+}
+
+func (lb *LoadBalancer) ListenAdmin(cfg AdminConfig) error {
+	return errors.New("the admin API is not built in (nohttp build tag)")
+}
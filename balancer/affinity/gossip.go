@@ -0,0 +1,212 @@
+package affinity
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/logging"
+)
+
+const (
+	maxDatagram = 1400
+	//every instance resends its whole table this often, so a restarted
+	//peer catches up and lost datagrams do not matter for long
+	syncInterval = 30 * time.Second
+)
+
+// Gossip replicates affinity tables between instances over UDP. Changes
+// are pushed to every peer as they happen and full tables are resent
+// periodically. Datagrams are authenticated with an HMAC of the shared
+// secret; unsigned ones are dropped.
+type Gossip struct {
+	conn   *net.UDPConn
+	peers  []*net.UDPAddr
+	secret []byte
+	clock  clock.Clock
+	//log is logging.Default unless SetLogger changed it
+	log *slog.Logger
+
+	mu     sync.RWMutex
+	tables map[string]*Table
+
+	//closed ends the resends
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type message struct {
+	Table   string         `json:"t"`
+	Entries []messageEntry `json:"e"`
+}
+
+type messageEntry struct {
+	Key     string `json:"k"`
+	Backend string `json:"b"`
+	//Expires is in Unix milliseconds
+	Expires int64 `json:"x"`
+}
+
+func NewGossip(listen string, peers []string, secret []byte, c clock.Clock) (*Gossip, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("gossip: a shared secret is required")
+	}
+
+	laddr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Gossip{conn: conn, secret: secret, clock: c, log: logging.Default(), tables: make(map[string]*Table), closed: make(chan struct{})}
+	for _, peer := range peers {
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("gossip peer %s: %w", peer, err)
+		}
+		g.peers = append(g.peers, addr)
+	}
+	return g, nil
+}
+
+// SetLogger sends what the gossip logs to l; call it before Run.
+func (g *Gossip) SetLogger(l *slog.Logger) {
+	g.log = l
+}
+
+// Attach replicates t under name, which must be the same on every instance.
+func (g *Gossip) Attach(name string, t *Table) {
+	g.mu.Lock()
+	g.tables[name] = t
+	g.mu.Unlock()
+
+	t.OnSet(func(e Entry) {
+		g.send(name, []Entry{e})
+	})
+}
+
+// Run receives updates from peers and periodically resends every table.
+func (g *Gossip) Run() {
+	go g.resend()
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		msg, ok := g.open(buf[:n])
+		if !ok {
+			g.log.Warn("Dropped unauthenticated affinity update", "peer", from.String())
+			continue
+		}
+
+		g.mu.RLock()
+		t := g.tables[msg.Table]
+		g.mu.RUnlock()
+		if t == nil {
+			continue
+		}
+
+		for _, e := range msg.Entries {
+			t.Apply(Entry{Key: e.Key, Backend: e.Backend, Expires: time.UnixMilli(e.Expires)})
+		}
+	}
+}
+
+// Close stops Run and the resends.
+func (g *Gossip) Close() error {
+	g.closeOnce.Do(func() { close(g.closed) })
+	return g.conn.Close()
+}
+
+func (g *Gossip) resend() {
+	ticker := g.clock.NewTicker(syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.closed:
+			return
+		case <-ticker.C():
+		}
+
+		g.mu.RLock()
+		tables := make(map[string]*Table, len(g.tables))
+		for name, t := range g.tables {
+			tables[name] = t
+		}
+		g.mu.RUnlock()
+
+		for name, t := range tables {
+			g.send(name, t.Entries())
+		}
+	}
+}
+
+// send splits entries into datagrams that stay below the usual MTU.
+func (g *Gossip) send(table string, entries []Entry) {
+	msg := message{Table: table}
+	size := 0
+
+	flush := func() {
+		if len(msg.Entries) == 0 {
+			return
+		}
+		packet := g.seal(msg)
+		for _, peer := range g.peers {
+			g.conn.WriteToUDP(packet, peer)
+		}
+		msg.Entries = msg.Entries[:0]
+		size = 0
+	}
+
+	for _, e := range entries {
+		me := messageEntry{Key: e.Key, Backend: e.Backend, Expires: e.Expires.UnixMilli()}
+		//rough encoded size of one entry
+		entrySize := len(me.Key) + len(me.Backend) + 40
+		if size+entrySize > maxDatagram-len(table)-sha256.Size-32 {
+			flush()
+		}
+		msg.Entries = append(msg.Entries, me)
+		size += entrySize
+	}
+	flush()
+}
+
+func (g *Gossip) seal(msg message) []byte {
+	payload, _ := json.Marshal(msg)
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write(payload)
+	return mac.Sum(payload)
+}
+
+func (g *Gossip) open(packet []byte) (message, bool) {
+	var msg message
+	if len(packet) < sha256.Size {
+		return msg, false
+	}
+
+	payload, sum := packet[:len(packet)-sha256.Size], packet[len(packet)-sha256.Size:]
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return msg, false
+	}
+	return msg, json.Unmarshal(payload, &msg) == nil
+}
@@ -0,0 +1,157 @@
+package affinity
+
+import (
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/clock"
+)
+
+// Entry pins a client key to a backend address until Expires.
+type Entry struct {
+	Key     string
+	Backend string
+	Expires time.Time
+}
+
+// Table remembers which backend each client was sent to. Entries slide:
+// every use pushes the expiry out again by the TTL.
+type Table struct {
+	ttl   time.Duration
+	clock clock.Clock
+
+	mu        sync.Mutex
+	entries   map[string]Entry
+	lastSweep time.Time
+	hooks     []func(Entry)
+}
+
+func NewTable(ttl time.Duration, c clock.Clock) *Table {
+	return &Table{ttl: ttl, clock: c, entries: make(map[string]Entry), lastSweep: c.Now()}
+}
+
+func (t *Table) TTL() time.Duration { return t.ttl }
+
+// OnSet registers fn to run for every local change, e.g. to replicate it.
+// Entries applied with Apply do not trigger it.
+func (t *Table) OnSet(fn func(Entry)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.hooks = append(t.hooks, fn)
+}
+
+// Lookup returns the backend key is pinned to.
+func (t *Table) Lookup(key string) (string, bool) {
+	now := t.clock.Now()
+
+	t.mu.Lock()
+	e, ok := t.entries[key]
+	if !ok || now.After(e.Expires) {
+		t.mu.Unlock()
+		return "", false
+	}
+
+	//refresh at most every half TTL so replication stays cheap
+	var refreshed *Entry
+	if e.Expires.Sub(now) < t.ttl/2 {
+		e.Expires = now.Add(t.ttl)
+		t.entries[key] = e
+		refreshed = &e
+	}
+	hooks := t.hooks
+	t.mu.Unlock()
+
+	if refreshed != nil {
+		for _, fn := range hooks {
+			fn(*refreshed)
+		}
+	}
+	return e.Backend, true
+}
+
+// Set pins key to backend.
+func (t *Table) Set(key, backend string) {
+	now := t.clock.Now()
+	e := Entry{Key: key, Backend: backend, Expires: now.Add(t.ttl)}
+
+	t.mu.Lock()
+	t.sweep(now)
+	t.entries[key] = e
+	hooks := t.hooks
+	t.mu.Unlock()
+
+	for _, fn := range hooks {
+		fn(e)
+	}
+}
+
+// Apply merges an entry learned from elsewhere. The newer pin wins.
+func (t *Table) Apply(e Entry) {
+	now := t.clock.Now()
+	if now.After(e.Expires) {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sweep(now)
+	if current, ok := t.entries[e.Key]; ok && current.Expires.After(e.Expires) {
+		return
+	}
+	t.entries[e.Key] = e
+}
+
+// Move repins the keys pinned to from onto to, keeping their expiry, and
+// returns how many moved.
+func (t *Table) Move(from, to string) int {
+	now := t.clock.Now()
+
+	t.mu.Lock()
+	var moved []Entry
+	for key, e := range t.entries {
+		if e.Backend == from && now.Before(e.Expires) {
+			e.Backend = to
+			t.entries[key] = e
+			moved = append(moved, e)
+		}
+	}
+	hooks := t.hooks
+	t.mu.Unlock()
+
+	for _, e := range moved {
+		for _, fn := range hooks {
+			fn(e)
+		}
+	}
+	return len(moved)
+}
+
+// Entries returns the live entries.
+func (t *Table) Entries() []Entry {
+	now := t.clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries := make([]Entry, 0, len(t.entries))
+	for _, e := range t.entries {
+		if now.Before(e.Expires) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func (t *Table) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < time.Minute {
+		return
+	}
+	t.lastSweep = now
+
+	for key, e := range t.entries {
+		if now.After(e.Expires) {
+			delete(t.entries, key)
+		}
+	}
+}
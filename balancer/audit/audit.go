@@ -0,0 +1,122 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/clock"
+)
+
+// event kinds
+const (
+	KindACL       = "acl"
+	KindGeoIP     = "geoip"
+	KindRateLimit = "rate_limit"
+	KindAuth      = "auth"
+	KindProtocol  = "protocol"
+	//KindShed is a connection refused to shed load
+	KindShed = "shed"
+	//KindFilter is a connection refused by a listener's accept filter
+	KindFilter = "filter"
+	//KindBudget is a connection refused for its share of the connection
+	//budget
+	KindBudget = "budget"
+	//KindLimit is a connection closed at accept once the balancer's
+	//connection limit stayed reached for its wait
+	KindLimit = "limit"
+	//KindSampled summarises events dropped by sampling
+	KindSampled = "sampled"
+)
+
+// Event is one rejected or limited connection.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	Listener string    `json:"listener,omitempty"`
+	Client   string    `json:"client,omitempty"`
+	Rule     string    `json:"rule,omitempty"`
+	//Suppressed is set on KindSampled events
+	Suppressed uint64 `json:"suppressed,omitempty"`
+}
+
+// Sampling keeps the audit stream bounded under attack: the first Burst
+// events of each second are written, after that only one in Rate.
+type Sampling struct {
+	Burst int
+	Rate  int
+}
+
+// Logger writes audit events as JSON lines to a dedicated stream.
+type Logger struct {
+	clock    clock.Clock
+	sampling Sampling
+
+	mu         sync.Mutex
+	enc        *json.Encoder
+	window     time.Time
+	inWindow   int
+	suppressed uint64
+	written    uint64
+	totalDrops uint64
+}
+
+func New(w io.Writer, c clock.Clock, sampling Sampling) *Logger {
+	if sampling.Burst <= 0 {
+		sampling.Burst = 100
+	}
+	if sampling.Rate <= 0 {
+		sampling.Rate = 100
+	}
+	return &Logger{clock: c, sampling: sampling, enc: json.NewEncoder(w)}
+}
+
+// Record writes e unless sampling drops it. Events are never silently lost:
+// the number dropped in a second is written as a KindSampled event when the
+// next second starts.
+func (l *Logger) Record(e Event) {
+	if l == nil {
+		return
+	}
+
+	now := l.clock.Now()
+	if e.Time.IsZero() {
+		e.Time = now
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if window := now.Truncate(time.Second); !window.Equal(l.window) {
+		l.flushSuppressed(now)
+		l.window = window
+		l.inWindow = 0
+	}
+
+	l.inWindow++
+	over := l.inWindow - l.sampling.Burst
+	if over > 0 && over%l.sampling.Rate != 0 {
+		l.suppressed++
+		l.totalDrops++
+		return
+	}
+
+	l.written++
+	l.enc.Encode(e)
+}
+
+func (l *Logger) flushSuppressed(now time.Time) {
+	if l.suppressed == 0 {
+		return
+	}
+	l.enc.Encode(Event{Time: now, Kind: KindSampled, Suppressed: l.suppressed})
+	l.suppressed = 0
+}
+
+// Counts returns how many events were written and how many sampled away.
+func (l *Logger) Counts() (written, suppressed uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.written, l.totalDrops
+}
@@ -0,0 +1,298 @@
+package backend
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// Backend is a single upstream server and the state shared between the
+// strategy, health and proxy packages.
+type Backend struct {
+	Addr string
+
+	Counters
+	//Requests are only counted in HTTP mode
+	Requests Requests
+	//Probes time the health checks
+	Probes Probes
+
+	healthy atomic.Bool
+	//draining backends take no new connections
+	draining atomic.Bool
+	//standby backends are kept in reserve: health checked, but given no
+	//new connections unless admitted
+	standby  atomic.Bool
+	admitted atomic.Bool
+	//probed and reported are the Views under Healthy, from active checks
+	//and from the discovery source
+	probed   atomic.Int32
+	reported atomic.Int32
+
+	//weight is set by the operator, 0 meaning 1
+	weight atomic.Int64
+	//factor is the learned multiplier as float64 bits, 0 meaning 1
+	factor atomic.Uint64
+	pinned atomic.Bool
+
+	labels atomic.Pointer[map[string]string]
+
+	//latency is the moving average as float64 nanoseconds, 0 until sampled
+	latency atomic.Uint64
+
+	//ramp is the slow-start multiplier as float64 bits, 0 meaning 1;
+	//rampFrom is where it restarts whenever the backend turns healthy
+	ramp     atomic.Uint64
+	rampFrom atomic.Uint64
+
+	//maxConns caps the connections holding one of the slots, 0 for no
+	//limit
+	maxConns atomic.Int64
+	slots    atomic.Int64
+}
+
+// New returns a backend that starts out healthy, so traffic flows before the
+// first health check has run.
+func New(addr string) *Backend {
+	b := &Backend{Addr: addr}
+	b.healthy.Store(true)
+	return b
+}
+
+func (b *Backend) Healthy() bool {
+	return b.healthy.Load()
+}
+
+// SetHealthy records the health status and reports whether it changed.
+// A backend that turns healthy under slow start restarts its ramp.
+func (b *Backend) SetHealthy(status bool) bool {
+	changed := b.healthy.Swap(status) != status
+	if changed && status {
+		if from := b.rampFrom.Load(); from != 0 {
+			b.ramp.Store(from)
+		}
+	}
+	return changed
+}
+
+// Draining reports whether the backend is kept out of selection while its
+// connections finish.
+func (b *Backend) Draining() bool {
+	return b.draining.Load()
+}
+
+// SetDraining starts or ends draining and reports whether that changed.
+func (b *Backend) SetDraining(on bool) bool {
+	return b.draining.Swap(on) != on
+}
+
+// Standby reports whether the backend is kept in reserve, admitted or not.
+func (b *Backend) Standby() bool {
+	return b.standby.Load()
+}
+
+// SetStandby makes the backend a standby or a regular member and reports
+// whether that changed. Either way it starts out not admitted.
+func (b *Backend) SetStandby(on bool) bool {
+	changed := b.standby.Swap(on) != on
+	if changed {
+		b.admitted.Store(false)
+	}
+	return changed
+}
+
+// Admitted reports whether a standby backend was let into rotation.
+func (b *Backend) Admitted() bool {
+	return b.admitted.Load()
+}
+
+// SetAdmitted lets a standby backend take new connections, or returns it
+// to reserve, and reports whether that changed.
+func (b *Backend) SetAdmitted(on bool) bool {
+	return b.admitted.Swap(on) != on
+}
+
+// Reserved reports whether the backend is a standby that is not admitted,
+// so it takes no new connections.
+func (b *Backend) Reserved() bool {
+	return b.standby.Load() && !b.admitted.Load()
+}
+
+// View is what one source of health information says about a backend.
+type View int32
+
+const (
+	//Unknown until the source has said anything
+	Unknown View = iota
+	Up
+	Down
+)
+
+func (v View) String() string {
+	switch v {
+	case Up:
+		return "up"
+	case Down:
+		return "down"
+	}
+	return "unknown"
+}
+
+func ViewOf(ok bool) View {
+	if ok {
+		return Up
+	}
+	return Down
+}
+
+// Probed is the result of the last active check.
+func (b *Backend) Probed() View {
+	return View(b.probed.Load())
+}
+
+func (b *Backend) SetProbed(v View) {
+	b.probed.Store(int32(v))
+}
+
+// Reported is the health the discovery source last reported.
+func (b *Backend) Reported() View {
+	return View(b.reported.Load())
+}
+
+func (b *Backend) SetReported(v View) {
+	b.reported.Store(int32(v))
+}
+
+// Weight is the operator's weight, at least 1.
+func (b *Backend) Weight() int {
+	return int(max(b.weight.Load(), 1))
+}
+
+func (b *Backend) SetWeight(w int) {
+	b.weight.Store(int64(w))
+}
+
+// Factor is the multiplier learned from the backend's latency and errors,
+// 1 until something learns it.
+func (b *Backend) Factor() float64 {
+	bits := b.factor.Load()
+	if bits == 0 {
+		return 1
+	}
+	return math.Float64frombits(bits)
+}
+
+func (b *Backend) SetFactor(f float64) {
+	b.factor.Store(math.Float64bits(f))
+}
+
+// Pinned reports whether the operator fixed the weight, so that nothing
+// adjusts the factor.
+func (b *Backend) Pinned() bool {
+	return b.pinned.Load()
+}
+
+// Pin sets the weight and holds it there, dropping any learned factor.
+func (b *Backend) Pin(w int) {
+	b.pinned.Store(true)
+	b.SetWeight(w)
+	b.SetFactor(1)
+}
+
+// Unpin lets the factor be learned again, starting over from 1.
+func (b *Backend) Unpin() {
+	b.pinned.Store(false)
+}
+
+// Ramp is the share of its weight a backend in slow start gets, 1 once it
+// is over.
+func (b *Backend) Ramp() float64 {
+	bits := b.ramp.Load()
+	if bits == 0 {
+		return 1
+	}
+	return math.Float64frombits(bits)
+}
+
+// SetRamp sets the share, 1 ending the slow start.
+func (b *Backend) SetRamp(f float64) {
+	if f >= 1 {
+		b.ramp.Store(0)
+		return
+	}
+	b.ramp.Store(math.Float64bits(f))
+}
+
+// SetSlowStart makes SetHealthy restart the ramp at from whenever the
+// backend turns healthy; 0 turns that off.
+func (b *Backend) SetSlowStart(from float64) {
+	if from <= 0 || from >= 1 {
+		b.rampFrom.Store(0)
+		return
+	}
+	b.rampFrom.Store(math.Float64bits(from))
+}
+
+// EffectiveWeight is the weight strategies balance by.
+func (b *Backend) EffectiveWeight() float64 {
+	return float64(b.Weight()) * b.Factor() * b.Ramp()
+}
+
+// MaxConnections is the most connections the backend takes at once, 0 for
+// no limit.
+func (b *Backend) MaxConnections() int {
+	return int(b.maxConns.Load())
+}
+
+// SetMaxConnections sets the limit; connections over a lowered one stay
+// until they end.
+func (b *Backend) SetMaxConnections(n int) {
+	b.maxConns.Store(int64(max(n, 0)))
+}
+
+// Full reports whether the backend is at MaxConnections.
+func (b *Backend) Full() bool {
+	limit := b.maxConns.Load()
+	return limit > 0 && b.slots.Load() >= limit
+}
+
+// Acquire takes a slot for a connection to the backend, false when it is
+// full. Release gives it back.
+func (b *Backend) Acquire() bool {
+	if b.slots.Add(1) > b.maxConns.Load() && b.maxConns.Load() > 0 {
+		b.slots.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (b *Backend) Release() {
+	b.slots.Add(-1)
+}
+
+// Labels are the operator's metadata about the backend, e.g. its version.
+// The map must not be modified.
+func (b *Backend) Labels() map[string]string {
+	if l := b.labels.Load(); l != nil {
+		return *l
+	}
+	return nil
+}
+
+func (b *Backend) SetLabels(labels map[string]string) {
+	b.labels.Store(&labels)
+}
+
+// HasLabels reports whether the backend carries every one of want.
+func (b *Backend) HasLabels(want map[string]string) bool {
+	labels := b.Labels()
+	for k, v := range want {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Backend) String() string {
+	return b.Addr
+}
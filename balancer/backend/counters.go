@@ -0,0 +1,73 @@
+package backend
+
+import "sync/atomic"
+
+// Counters tracks traffic through a backend. All methods are safe for
+// concurrent use.
+type Counters struct {
+	connections atomic.Uint64
+	active      atomic.Int64
+	dialing     atomic.Int64
+	failed      atomic.Uint64
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+}
+
+// Snapshot is a point-in-time copy of Counters.
+type Snapshot struct {
+	Connections uint64
+	Active      int64
+	Failed      uint64
+	BytesIn     uint64
+	BytesOut    uint64
+}
+
+func (c *Counters) ConnStarted() {
+	c.connections.Add(1)
+	c.active.Add(1)
+}
+
+func (c *Counters) ConnFinished() {
+	c.active.Add(-1)
+}
+
+// DialStarted and DialFinished bracket a connect to the backend, which
+// counts towards Load before the connection is established.
+func (c *Counters) DialStarted() {
+	c.dialing.Add(1)
+}
+
+func (c *Counters) DialFinished() {
+	c.dialing.Add(-1)
+}
+
+func (c *Counters) ConnFailed() {
+	c.failed.Add(1)
+}
+
+func (c *Counters) AddBytesIn(n int) {
+	c.bytesIn.Add(uint64(n))
+}
+
+func (c *Counters) AddBytesOut(n int) {
+	c.bytesOut.Add(uint64(n))
+}
+
+func (c *Counters) Active() int64 {
+	return c.active.Load()
+}
+
+// Load is the active connections plus those being dialed.
+func (c *Counters) Load() int64 {
+	return c.active.Load() + c.dialing.Load()
+}
+
+func (c *Counters) Snapshot() Snapshot {
+	return Snapshot{
+		Connections: c.connections.Load(),
+		Active:      c.active.Load(),
+		Failed:      c.failed.Load(),
+		BytesIn:     c.bytesIn.Load(),
+		BytesOut:    c.bytesOut.Load(),
+	}
+}
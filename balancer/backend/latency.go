@@ -0,0 +1,37 @@
+package backend
+
+import (
+	"math"
+	"time"
+)
+
+// latencyWeight is the share of a new sample in the latency average, so
+// that about the last ten connections count.
+const latencyWeight = 0.2
+
+// ObserveLatency adds one connection's latency, from the start of the
+// connect to the backend's first byte, to the moving average.
+func (b *Backend) ObserveLatency(d time.Duration) {
+	sample := float64(d)
+	for {
+		old := b.latency.Load()
+		next := sample
+		if old != 0 {
+			avg := math.Float64frombits(old)
+			next = avg + latencyWeight*(sample-avg)
+		}
+		if b.latency.CompareAndSwap(old, math.Float64bits(max(next, 1))) {
+			return
+		}
+	}
+}
+
+// Latency is the moving average of ObserveLatency, 0 before the first
+// sample.
+func (b *Backend) Latency() time.Duration {
+	bits := b.latency.Load()
+	if bits == 0 {
+		return 0
+	}
+	return time.Duration(math.Float64frombits(bits))
+}
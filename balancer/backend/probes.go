@@ -0,0 +1,47 @@
+package backend
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Probes counts the health checks of a backend and how long they took.
+// All methods are safe for concurrent use.
+type Probes struct {
+	probes   atomic.Uint64
+	failed   atomic.Uint64
+	duration [len(LatencyBuckets) + 1]atomic.Uint64
+	sum      atomic.Int64
+}
+
+// ProbeSnapshot is a point-in-time copy of Probes.
+type ProbeSnapshot struct {
+	Probes uint64
+	Failed uint64
+	//Duration counts the probes by how long they took, per LatencyBuckets
+	//and the last for slower ones
+	Duration    [len(LatencyBuckets) + 1]uint64
+	DurationSum time.Duration
+}
+
+// Observe counts a probe that took d, failed when err is not nil.
+func (p *Probes) Observe(d time.Duration, err error) {
+	p.probes.Add(1)
+	if err != nil {
+		p.failed.Add(1)
+	}
+	p.duration[latencyBucket(d)].Add(1)
+	p.sum.Add(int64(d))
+}
+
+func (p *Probes) Snapshot() ProbeSnapshot {
+	s := ProbeSnapshot{
+		Probes:      p.probes.Load(),
+		Failed:      p.failed.Load(),
+		DurationSum: time.Duration(p.sum.Load()),
+	}
+	for i := range p.duration {
+		s.Duration[i] = p.duration[i].Load()
+	}
+	return s
+}
@@ -0,0 +1,105 @@
+package backend
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds RequestSnapshot.Latency counts by.
+var LatencyBuckets = [...]time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Requests counts the HTTP requests proxied in HTTP mode, several of which
+// can share a connection. All methods are safe for concurrent use.
+type Requests struct {
+	requests   atomic.Uint64
+	classes    [6]atomic.Uint64
+	local      atomic.Uint64
+	failed     atomic.Uint64
+	latency    [len(LatencyBuckets) + 1]atomic.Uint64
+	latencySum atomic.Int64
+}
+
+// RequestSnapshot is a point-in-time copy of Requests.
+type RequestSnapshot struct {
+	Requests uint64
+	//Classes count the backend responses by status class, Classes[5] the
+	//5xx
+	Classes [6]uint64
+	//Local requests were answered by the balancer itself, such as a 429
+	Local uint64
+	//Failed requests got no response from the backend
+	Failed uint64
+	//Latency counts the backend responses by the time from sending the
+	//request to the response head, per LatencyBuckets and the last for
+	//slower ones
+	Latency    [len(LatencyBuckets) + 1]uint64
+	LatencySum time.Duration
+}
+
+// Responded counts a request the backend answered with status.
+func (r *Requests) Responded(status int, latency time.Duration) {
+	r.requests.Add(1)
+	r.classes[min(max(status/100, 0), 5)].Add(1)
+	r.latency[latencyBucket(latency)].Add(1)
+	r.latencySum.Add(int64(latency))
+}
+
+// latencyBucket is the index of the first of LatencyBuckets d fits in,
+// len(LatencyBuckets) for slower ones.
+func latencyBucket(d time.Duration) int {
+	for i, bound := range LatencyBuckets {
+		if d <= bound {
+			return i
+		}
+	}
+	return len(LatencyBuckets)
+}
+
+// Answered counts a request the balancer answered without the backend.
+func (r *Requests) Answered() {
+	r.requests.Add(1)
+	r.local.Add(1)
+}
+
+// Failed counts a request the backend never answered.
+func (r *Requests) Failed() {
+	r.requests.Add(1)
+	r.failed.Add(1)
+}
+
+func (r *Requests) Snapshot() RequestSnapshot {
+	s := RequestSnapshot{
+		Requests:   r.requests.Load(),
+		Local:      r.local.Load(),
+		Failed:     r.failed.Load(),
+		LatencySum: time.Duration(r.latencySum.Load()),
+	}
+	for i := range r.classes {
+		s.Classes[i] = r.classes[i].Load()
+	}
+	for i := range r.latency {
+		s.Latency[i] = r.latency[i].Load()
+	}
+	return s
+}
+
+// Responses is the number of backend responses, those Latency counts.
+func (s RequestSnapshot) Responses() uint64 {
+	var n uint64
+	for _, c := range s.Classes {
+		n += c
+	}
+	return n
+}
@@ -2,130 +2,415 @@ package balancer
 
 import (
 	"fmt"
-	"net"
+	"log/slog"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"loadbalancer/balancer/audit"
+	"loadbalancer/balancer/backend"
+	"loadbalancer/balancer/breaker"
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/discovery"
+	"loadbalancer/balancer/health"
+	"loadbalancer/balancer/logging"
+	"loadbalancer/balancer/peer"
+	"loadbalancer/balancer/ratelimit"
+	"loadbalancer/balancer/replay"
+	"loadbalancer/balancer/resolve"
+	"loadbalancer/balancer/strategy"
+	"loadbalancer/balancer/weights"
 )
 
 type LoadBalancer struct {
-	servers 		[]string
-	currentIndex 	int
-	mu 				sync.Mutex
+	mu          sync.RWMutex
+	pools       map[string]*Pool
+	defaultPool *Pool
+	tenants     map[string]*Tenant
+	tags        map[string]*tag
+	frontends   []*frontend
+	started     bool
 
-	healthy			map[string]bool
-	healthyMu		sync.RWMutex
-}
+	source  discovery.Source
+	loadErr error
 
-func NewLoadBalancer(servers []string) *LoadBalancer{
+	healthPolicy health.Policy
+	selector     SelectFunc
+	audit        *audit.Logger
+	posture      posture
+	certs        certMonitor
+	//cas counts the CAs that verified client and backend certificates
+	cas caCounter
+	//failures records failed connections for loadbalancer replay
+	failures *replay.Recorder
 
-	healthy := make(map[string]bool)
+	//strategy is the default pool's, from WithStrategy
+	strategy Strategy
+	//initialWeights are those of WithWeightedBackends, by address
+	initialWeights map[string]int
 
-	for _, server := range servers {
-		healthy[server] = true
-	}
+	timeoutPolicy Timeouts
+	//dialRetries are the other backends tried after a failed dial
+	dialRetries int
 
-	return &LoadBalancer{
-		servers: 		servers,
-		currentIndex: 	0,
-		healthy: 		healthy,
-	}
+	//learning is set by WithWeightLearning, learner is built from it once
+	//the clock is known
+	learning *weights.Policy
+	learner  *weights.Learner
+	//breaking is set by WithCircuitBreaker, breakers built from it likewise
+	breaking *breaker.Policy
+	breakers *breaker.Breakers
+	//slowStart is set by WithSlowStart
+	slowStart *slowStart
+	//budget is set by WithConnectionBudget
+	budget *budget
+
+	//resolving is set by WithDNSTracking, resolver tracks hostname
+	//backends with it
+	resolving resolve.Policy
+	resolver  *resolve.Tracker
+
+	//dnsCache resolves backend host names for dialing and the DNS
+	//frontend, with the policy of WithDNSCache
+	caching  resolve.CachePolicy
+	dnsCache *resolve.Cache
+	//dialed rotates dials over a host name's addresses
+	dialed atomic.Uint64
+
+	//rebalancer is nil unless WithRebalancing is given
+	rebalancer *rebalancer
+
+	//standby is nil unless WithStandby is given
+	standby *standby
+
+	//registry is nil unless WithRegistration is given
+	registry *registry
+
+	//shedder is nil unless WithLoadShedding is given
+	shedder *shedder
+
+	//fleet is nil unless WithFleetStats is given
+	fleet *fleetStats
+	//cluster is nil unless WithCluster is given
+	cluster *peer.Node
+
+	drainPolicy DrainPolicy
+	drain       drainState
+	open        openConns
+	//stop is closed by Shutdown to end the background loops
+	stop     chan struct{}
+	stopOnce sync.Once
+	//servers are the HTTP servers Shutdown stops last
+	serversMu sync.Mutex
+	servers   []server
+
+	//ipv6Prefix groups IPv6 clients for hashing and affinity
+	ipv6Prefix int
+
+	//copyBuffer is the per-direction buffer of ModeTCP connections, 0 for io.Copy's
+	copyBuffer int
+
+	//debugHeader is set by WithDebugHeader, debug by SetDebug
+	debugHeader string
+	debug       atomic.Bool
+
+	stateStore    StateStore
+	stateInterval time.Duration
+	restoreOnce   sync.Once
+	reportFile    string
+	//startedAt is when the first listener started, for the uptime
+	startedAt time.Time
+	//configsMu orders the read and write of RecordConfig
+	configsMu sync.Mutex
+
+	clock clock.Clock
+	//log is set by WithLogger
+	log *slog.Logger
+
+	counters backend.Counters
+	rejected atomic.Uint64
+	panics   atomic.Uint64
+	//fdPressure counts accepts failed for lack of file descriptors
+	fdPressure atomic.Uint64
+	//retried counts dials retried with another backend
+	retried atomic.Uint64
+	//errorResponses count the error responses written by reason code, in
+	//*atomic.Uint64
+	errorResponses sync.Map
+	//connLimit pauses accepts while the balancer is full
+	connLimit *connLimit
 }
 
-func (lb *LoadBalancer) isHealthy(server string) bool{
-	lb.healthyMu.RLock()
-	defer lb.healthyMu.RUnlock()
-	return lb.healthy[server]
+// New creates a LoadBalancer. Backends come from WithBackends or
+// WithDiscovery; without either the default pool starts empty.
+func New(opts ...Option) (*LoadBalancer, error) {
+	lb := newLoadBalancer(opts)
+	if lb.loadErr != nil {
+		return nil, lb.loadErr
+	}
+	return lb, nil
 }
 
-func (lb *LoadBalancer) setHealthy(server string, status bool){
-	lb.healthyMu.Lock()
-	defer lb.healthyMu.Unlock()
-	lb.healthy[server] = status
+// NewLoadBalancer creates a LoadBalancer for a fixed list of servers.
+//
+// Deprecated: Use New with WithBackends, which reports construction errors.
+func NewLoadBalancer(servers []string, opts ...Option) *LoadBalancer {
+	return newLoadBalancer(append([]Option{WithBackends(servers...)}, opts...))
 }
 
-func (lb *LoadBalancer) checkHealth(server string){
-	//try to connect with the server
-	conn, err := net.DialTimeout("tcp", server,2*time.Second)
+func newLoadBalancer(opts []Option) *LoadBalancer {
+	lb := &LoadBalancer{
+		pools:         make(map[string]*Pool),
+		tenants:       make(map[string]*Tenant),
+		tags:          make(map[string]*tag),
+		source:        discovery.Static(nil),
+		healthPolicy:  health.DefaultPolicy(),
+		timeoutPolicy: DefaultTimeouts(),
+		dialRetries:   DefaultDialRetries,
+		ipv6Prefix:    ratelimit.DefaultIPv6Prefix,
+		resolving:     resolve.DefaultPolicy(),
+		clock:         clock.Real,
+		log:           logging.Default(),
+	}
+	lb.posture.policy = DefaultUnderAttackPolicy()
+	lb.drain.done = make(chan struct{})
+	lb.stop = make(chan struct{})
+	lb.certs.warning = DefaultCertificateWarning
 
-	if err != nil {
-		//failed to connect - server is unhealthy
-		if lb.isHealthy(server) {
-			//log unhealthy only if it's status changed
-			fmt.Printf("Server %s marked as UNHEALTHY: %v\n", server, err)
+	for _, opt := range opts {
+		opt(lb)
+	}
+	lb.posture.clock = lb.clock
+	if lb.learning != nil {
+		lb.learner = weights.New(lb.clock, *lb.learning)
+		lb.learner.SetLogger(lb.log)
+	}
+	lb.newBreakers()
+	lb.resolver = resolve.New(lb.clock, lb.resolving)
+	lb.resolver.SetLogger(lb.log)
+	lb.dnsCache = resolve.NewCache(lb.clock, lb.caching)
+	lb.dnsCache.SetLogger(lb.log)
+
+	var addrs []string
+	addrs, lb.loadErr = lb.discover()
+	if err := lb.fleet.build(lb.clock, lb.log); err != nil && lb.loadErr == nil {
+		lb.loadErr = err
+	}
+
+	lb.defaultPool = newPool(lb, DefaultPool, addrs)
+	for _, b := range lb.defaultPool.backends {
+		if w, ok := lb.initialWeights[b.Addr]; ok {
+			b.SetWeight(w)
 		}
-		lb.setHealthy(server, false)
-		return
 	}
+	switch {
+	case lb.strategy != nil:
+		lb.defaultPool.strategy = lb.strategy
+	case lb.initialWeights != nil:
+		lb.defaultPool.strategy = strategy.NewWeightedRoundRobin()
+	}
+	lb.pools[DefaultPool] = lb.defaultPool
 
-	//Successfully connected now close the connection
-	conn.Close()
+	return lb
+}
 
-	if !lb.isHealthy(server) {
-		//log only when status changed
-		fmt.Printf("Server %s marked as HEALTHY\n", server)
+// discover fetches the initial backend list from the discovery source
+func (lb *LoadBalancer) discover() ([]string, error) {
+	addrs, err := lb.source.Backends()
+	if err != nil {
+		return nil, fmt.Errorf("discovering backends: %w", err)
 	}
+	return addrs, nil
+}
 
-	lb.setHealthy(server, true)
+// Pool returns the pool with the given name, or nil if there is none.
+func (lb *LoadBalancer) Pool(name string) *Pool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.pools[name]
 }
 
-func (lb *LoadBalancer) startHealthChecker() {
-	ticker := time.NewTicker(10 * time.Second)
+// DefaultPool returns the pool built from the initial backends.
+func (lb *LoadBalancer) DefaultPool() *Pool {
+	return lb.defaultPool
+}
 
-	fmt.Println("Health checker started (checking every second)")
+// Cluster returns the peer node given with WithCluster, or nil.
+func (lb *LoadBalancer) Cluster() *peer.Node {
+	return lb.cluster
+}
 
-	for range ticker.C {
-		fmt.Println("Running health checks...")
+// Pools returns every pool sorted by name.
+func (lb *LoadBalancer) Pools() []*Pool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
 
-		for _, server := range lb.servers {
-			lb.checkHealth(server)
-		}
+	pools := make([]*Pool, 0, len(lb.pools))
+	for _, p := range lb.pools {
+		pools = append(pools, p)
 	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].name < pools[j].name })
+	return pools
 }
 
-func (lb *LoadBalancer) getNextServer() string {
+// AddPool creates a new named pool. If the balancer is already running the
+// pool's health checker starts right away.
+func (lb *LoadBalancer) AddPool(name string, servers []string) (*Pool, error) {
+	return lb.addPool(name, servers, nil)
+}
+
+func (lb *LoadBalancer) addPool(name string, servers []string, tenant *Tenant) (*Pool, error) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 
-	// startIndex := lb.currentIndex
-	attempts := 0
-
-	for attempts < len(lb.servers){
-		server := lb.servers[lb.currentIndex]
-		lb.currentIndex = (lb.currentIndex + 1) % len(lb.servers)
+	if _, ok := lb.pools[name]; ok {
+		return nil, fmt.Errorf("pool %s already exists", name)
+	}
 
-		if lb.isHealthy(server) {
-			return server
+	p := newPool(lb, name, nil)
+	p.tenant = tenant
+	for _, addr := range servers {
+		if _, err := p.AddBackend(addr); err != nil {
+			return nil, err
 		}
-		
-		attempts++
 	}
-	
-	return ""
+
+	lb.pools[name] = p
+	if lb.started {
+		p.start()
+	}
+	return p, nil
 }
 
-func (lb *LoadBalancer) Start(address string) error {
-	listener, err := net.Listen("tcp", address)
+// AddBackend adds addr to the default pool while the balancer runs, see
+// Pool.AddBackend. It is safe to call from any goroutine.
+func (lb *LoadBalancer) AddBackend(addr string) (*Backend, error) {
+	return lb.defaultPool.AddBackend(addr)
+}
 
-	if err != nil {
-		return err
+// RemoveBackend takes addr out of the default pool. Connections in flight
+// to it finish normally; use the pool's RetireBackend to wait for them.
+func (lb *LoadBalancer) RemoveBackend(addr string) error {
+	return lb.defaultPool.RemoveBackend(addr)
+}
+
+func (lb *LoadBalancer) findBackend(addr string) *Backend {
+	for _, p := range lb.Pools() {
+		if b := p.Backend(addr); b != nil {
+			return b
+		}
 	}
+	return nil
+}
 
-	defer listener.Close()
+// SetBackendHealth records health state reported by an external source such
+// as an orchestrator. It is meant to be used together with
+// WithExternalHealth, otherwise the built-in checker overwrites it on the
+// next round. It takes the place of the active checks, so the pool's gate
+// still combines it with what discovery reports.
+func (lb *LoadBalancer) SetBackendHealth(addr string, healthy bool) error {
+	found := false
+	for _, p := range lb.Pools() {
+		b := p.Backend(addr)
+		if b == nil {
+			continue
+		}
+		found = true
 
-	fmt.Printf("Load Balancer Listening on %s\n", address)
-	fmt.Printf("Forwarding to backends: %v\n", lb.servers)
+		b.SetProbed(backend.ViewOf(healthy))
+		if p.HealthPolicy().Gate.Apply(b) {
+			if healthy {
+				lb.log.Info("Server marked as HEALTHY (external)", "backend", addr, "pool", p.name)
+			} else {
+				lb.log.Warn("Server marked as UNHEALTHY (external)", "backend", addr, "pool", p.name)
+			}
+		}
+	}
 
-	//start health checker in background
-	go lb.startHealthChecker()
+	if !found {
+		return fmt.Errorf("unknown backend %s", addr)
+	}
+	return nil
+}
 
-	for {
-		conn, err := listener.Accept()
+func (lb *LoadBalancer) startPools() {
+	//restore before the first health round so it confirms the saved state
+	if lb.stateStore != nil {
+		lb.restoreOnce.Do(func() {
+			if err := lb.loadSnapshot(lb.stateStore); err != nil {
+				lb.log.Warn("Ignoring saved state", "store", fmt.Sprint(lb.stateStore), "error", err)
+			}
+		})
+	}
 
-		if err != nil {
-			fmt.Println("Error accepting connection:", err)
-			continue
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if !lb.started {
+		lb.startedAt = lb.clock.Now()
+		lb.goSafe("certificate monitor", lb.watchCertificates)
+		if lb.stateStore != nil {
+			lb.goSafe("state snapshots", lb.saveState)
+		}
+		if lb.shedder != nil {
+			lb.goSafe("load shedder", func() {
+				lb.shedder.run(lb.clock, lb.stop, lb.log)
+			})
+		}
+		if lb.learner != nil {
+			lb.goSafe("weight learner", func() {
+				lb.learner.Run(lb.allBackends)
+			})
+		}
+		if lb.rebalancer != nil {
+			lb.goSafe("rebalancer", lb.runRebalancer)
+		}
+		if lb.standby != nil {
+			lb.goSafe("standby", lb.runStandby)
+		}
+		if lb.slowStart != nil {
+			lb.goSafe("slow start", lb.runSlowStart)
+		}
+		if lb.registry != nil {
+			lb.goSafe("registry", lb.runRegistry)
+		}
+		if lb.fleet != nil {
+			lb.goSafe("fleet stats", lb.runFleet)
 		}
+		if hs, ok := lb.source.(discovery.HealthSource); ok {
+			lb.goSafe("discovery health", func() {
+				lb.watchDiscoveryHealth(hs)
+			})
+		}
+		if gs, ok := lb.source.(discovery.GoingAwaySource); ok {
+			lb.goSafe("discovery going away", func() {
+				lb.watchGoingAway(gs)
+			})
+		}
+		lb.goSafe("dns tracker", func() {
+			lb.resolver.Run(lb.allBackends)
+		})
+	}
+	lb.started = true
+	for _, p := range lb.pools {
+		p.start()
+	}
+}
 
-		go handleConnection(conn, lb)
+// allBackends returns the members of every pool.
+func (lb *LoadBalancer) allBackends() []*Backend {
+	var all []*Backend
+	for _, p := range lb.Pools() {
+		all = append(all, p.Backends()...)
 	}
-}
\ No newline at end of file
+	return all
+}
+
+// Start listens on address with a plain TCP frontend routed to the default
+// pool.
+//
+// Deprecated: Use Listen, which also takes protocol adapters and a pool.
+func (lb *LoadBalancer) Start(address string) error {
+	return lb.Listen(ListenerConfig{Address: address})
+}
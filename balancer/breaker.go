@@ -0,0 +1,38 @@
+package balancer
+
+import (
+	"errors"
+
+	"loadbalancer/balancer/breaker"
+)
+
+// WithCircuitBreaker keeps a circuit per backend: it opens after a run of
+// failed requests or a high error rate, routes around the backend for the
+// cooldown, then half-opens and lets a few trial requests through before
+// traffic is fully restored. Requests are connections, and in ModeHTTP the
+// requests on them, which fail with a 5xx or no response.
+func WithCircuitBreaker(policy breaker.Policy) Option {
+	return func(lb *LoadBalancer) {
+		lb.breaking = &policy
+	}
+}
+
+var (
+	errServerError = errors.New("server error")
+	errNoResponse  = errors.New("no response")
+)
+
+// newBreakers builds the circuits of WithCircuitBreaker, if any.
+func (lb *LoadBalancer) newBreakers() {
+	if lb.breaking == nil {
+		return
+	}
+	lb.breakers = breaker.New(lb.clock, *lb.breaking)
+	lb.breakers.OnChange(func(b *Backend, s breaker.State, reason string) {
+		if s == breaker.Open {
+			lb.log.Warn("Circuit opened", "backend", b.Addr, "reason", reason)
+			return
+		}
+		lb.log.Info("Circuit "+s.String(), "backend", b.Addr, "reason", reason)
+	})
+}
@@ -0,0 +1,318 @@
+package breaker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/backend"
+	"loadbalancer/balancer/clock"
+)
+
+const (
+	DefaultMinRequests = 20
+	DefaultWindow      = 10 * time.Second
+	DefaultCooldown    = 30 * time.Second
+	DefaultTrials      = 3
+)
+
+// Policy says when a backend's circuit opens and how it closes again.
+type Policy struct {
+	//Failures opens the circuit after that many failures in a row, 0 for
+	//no limit
+	Failures int
+	//ErrorRate opens it once that share of a window's requests failed,
+	//from 0 to 1, 0 for no limit
+	ErrorRate float64
+	//MinRequests a window needs before its error rate counts
+	MinRequests int
+	//Window is how long the error rate is measured over
+	Window time.Duration
+	//Cooldown is how long an open circuit routes around the backend
+	//before half-opening
+	Cooldown time.Duration
+	//Trials are the requests let through while half-open, which must all
+	//succeed for the circuit to close
+	Trials int
+}
+
+func DefaultPolicy() Policy {
+	return Policy{
+		MinRequests: DefaultMinRequests,
+		Window:      DefaultWindow,
+		Cooldown:    DefaultCooldown,
+		Trials:      DefaultTrials,
+	}
+}
+
+func (p Policy) withDefaults() Policy {
+	def := DefaultPolicy()
+	if p.MinRequests <= 0 {
+		p.MinRequests = def.MinRequests
+	}
+	if p.Window <= 0 {
+		p.Window = def.Window
+	}
+	if p.Cooldown <= 0 {
+		p.Cooldown = def.Cooldown
+	}
+	if p.Trials <= 0 {
+		p.Trials = def.Trials
+	}
+	return p
+}
+
+// State is where a backend's circuit is.
+type State int
+
+const (
+	//Closed circuits let traffic through
+	Closed State = iota
+	//Open circuits route around the backend until the cooldown ends
+	Open
+	//HalfOpen circuits let the trial requests through
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// Breakers keeps a circuit per backend. All methods are safe for concurrent
+// use, and do nothing, or let everything through, on a nil Breakers.
+type Breakers struct {
+	clock  clock.Clock
+	policy Policy
+
+	mu       sync.Mutex
+	circuits map[*backend.Backend]*circuit
+	onChange func(b *backend.Backend, s State, reason string)
+	//changes wait for onChange until mu is released
+	changes []change
+}
+
+type circuit struct {
+	state State
+	//since is when the circuit opened, or when the window started while
+	//closed
+	since time.Time
+	//failures in a row, and the requests and failures of the window
+	streak   int
+	requests int
+	failed   int
+	//trials in flight and passed while half-open
+	trials int
+	passed int
+	//gen changes with the state, so trials of an earlier half-open end
+	//without effect
+	gen int
+}
+
+func New(c clock.Clock, policy Policy) *Breakers {
+	return &Breakers{
+		clock:    c,
+		policy:   policy.withDefaults(),
+		circuits: make(map[*backend.Backend]*circuit),
+	}
+}
+
+func (bs *Breakers) Policy() Policy {
+	return bs.policy
+}
+
+// OnChange registers fn to be called whenever a circuit changes state.
+func (bs *Breakers) OnChange(fn func(b *backend.Backend, s State, reason string)) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.onChange = fn
+}
+
+// State is where b's circuit is now.
+func (bs *Breakers) State(b *backend.Backend) State {
+	if bs == nil {
+		return Closed
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if c := bs.circuits[b]; c != nil {
+		return c.state
+	}
+	return Closed
+}
+
+// Allow reports whether b may take a new connection: its circuit is closed,
+// or half-open with room for another trial. An open circuit whose cooldown
+// ended half-opens here.
+func (bs *Breakers) Allow(b *backend.Backend) bool {
+	if bs == nil {
+		return true
+	}
+	bs.mu.Lock()
+	c := bs.circuits[b]
+	if c == nil || c.state == Closed {
+		bs.mu.Unlock()
+		return true
+	}
+	if c.state == Open && bs.clock.Since(c.since) >= bs.policy.Cooldown {
+		bs.set(b, c, HalfOpen, fmt.Sprintf("cooldown of %s over", bs.policy.Cooldown))
+	}
+	ok := c.state == HalfOpen && c.trials+c.passed < bs.policy.Trials
+	bs.mu.Unlock()
+	bs.notify()
+	return ok
+}
+
+// Begin is called when a connection is routed to b, and the function it
+// returns when that connection ends. While half-open the connection is a
+// trial, which holds one of the Trials until it ends.
+func (bs *Breakers) Begin(b *backend.Backend) (end func()) {
+	if bs == nil {
+		return func() {}
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	c := bs.circuits[b]
+	if c == nil || c.state != HalfOpen {
+		return func() {}
+	}
+	c.trials++
+	gen := c.gen
+	return func() {
+		bs.mu.Lock()
+		defer bs.mu.Unlock()
+		if c.gen == gen {
+			c.trials--
+		}
+	}
+}
+
+// Record counts the outcome of one request to b, failed when err is not
+// nil, and opens or closes its circuit as the policy says.
+func (bs *Breakers) Record(b *backend.Backend, err error) {
+	if bs == nil {
+		return
+	}
+	bs.mu.Lock()
+	bs.record(b, err)
+	bs.mu.Unlock()
+	bs.notify()
+}
+
+func (bs *Breakers) record(b *backend.Backend, err error) {
+	c := bs.circuits[b]
+	if c == nil {
+		c = &circuit{since: bs.clock.Now()}
+		bs.circuits[b] = c
+	}
+
+	switch c.state {
+	case Open:
+		//from connections routed before it opened
+		return
+	case HalfOpen:
+		if err != nil {
+			bs.set(b, c, Open, fmt.Sprintf("trial failed: %v", err))
+			return
+		}
+		c.passed++
+		if c.passed >= bs.policy.Trials {
+			bs.set(b, c, Closed, fmt.Sprintf("%d trial(s) passed", c.passed))
+		}
+		return
+	}
+
+	if bs.clock.Since(c.since) >= bs.policy.Window {
+		c.since = bs.clock.Now()
+		c.requests, c.failed = 0, 0
+	}
+	c.requests++
+	if err == nil {
+		c.streak = 0
+		return
+	}
+	c.streak++
+	c.failed++
+
+	p := bs.policy
+	switch {
+	case p.Failures > 0 && c.streak >= p.Failures:
+		bs.set(b, c, Open, fmt.Sprintf("%d failures in a row, last: %v", c.streak, err))
+	case p.ErrorRate > 0 && c.requests >= p.MinRequests && float64(c.failed) >= p.ErrorRate*float64(c.requests):
+		bs.set(b, c, Open, fmt.Sprintf("%d of %d requests failed in %s", c.failed, c.requests, p.Window))
+	}
+}
+
+// change is a state change waiting to be passed to onChange.
+type change struct {
+	b      *backend.Backend
+	state  State
+	reason string
+}
+
+// set moves c to s afresh; the caller holds bs.mu.
+func (bs *Breakers) set(b *backend.Backend, c *circuit, s State, reason string) {
+	*c = circuit{state: s, since: bs.clock.Now(), gen: c.gen + 1}
+	bs.changes = append(bs.changes, change{b: b, state: s, reason: reason})
+}
+
+// notify passes the pending changes to onChange outside bs.mu, so it may
+// call back into bs.
+func (bs *Breakers) notify() {
+	bs.mu.Lock()
+	changes, fn := bs.changes, bs.onChange
+	bs.changes = nil
+	bs.mu.Unlock()
+	if fn == nil {
+		return
+	}
+	for _, ch := range changes {
+		fn(ch.b, ch.state, ch.reason)
+	}
+}
+
+// Opened is when b's circuit opened, zero unless it is open.
+func (bs *Breakers) Opened(b *backend.Backend) time.Time {
+	if bs == nil {
+		return time.Time{}
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if c := bs.circuits[b]; c != nil && c.state == Open {
+		return c.since
+	}
+	return time.Time{}
+}
+
+// Reopen opens b's circuit as of since, so its cooldown runs from then, to
+// carry an open circuit across a restart.
+func (bs *Breakers) Reopen(b *backend.Backend, since time.Time, reason string) {
+	if bs == nil {
+		return
+	}
+	bs.mu.Lock()
+	c := bs.circuits[b]
+	if c == nil {
+		c = &circuit{}
+		bs.circuits[b] = c
+	}
+	bs.set(b, c, Open, reason)
+	c.since = since
+	bs.mu.Unlock()
+	bs.notify()
+}
+
+// Forget drops b's circuit once it left its pool.
+func (bs *Breakers) Forget(b *backend.Backend) {
+	if bs == nil {
+		return
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	delete(bs.circuits, b)
+}
@@ -0,0 +1,161 @@
+package balancer
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// WithConnectionBudget caps the connections open through the balancer's
+// listeners at max. Listeners and routes with a BudgetShare are guaranteed
+// that share of it: while the budget is not used up anyone may take a
+// connection, but under pressure a connection is only let in within its
+// own share or from what no share holds back, so bulk traffic can't crowd
+// out the critical paths.
+func WithConnectionBudget(max int) Option {
+	return func(lb *LoadBalancer) {
+		if max > 0 {
+			lb.budget = &budget{max: int64(max)}
+		}
+	}
+}
+
+type budget struct {
+	max int64
+
+	mu sync.Mutex
+	//open are the connections holding a slot, idle the slots the shares
+	//hold back for connections of their own
+	open int64
+	idle int64
+	//shared is the sum of the shares given out
+	shared  float64
+	classes []*budgetClass
+}
+
+// budgetClass is a listener, or a route of one, and its share.
+type budgetClass struct {
+	name  string
+	share float64
+	//reserved is the share in connections, used those open now; both
+	//under budget.mu
+	reserved int64
+	used     int64
+	refused  atomic.Uint64
+}
+
+// BudgetStats is one listener or route under WithConnectionBudget.
+type BudgetStats struct {
+	Name string
+	//Share is the guaranteed fraction of the budget, Reserved that in
+	//connections
+	Share    float64
+	Reserved int64
+	Open     int64
+	Refused  uint64
+}
+
+// class adds a listener or route with share; nil-safe for balancers
+// without a budget.
+func (b *budget) class(name string, share float64) (*budgetClass, error) {
+	if b == nil {
+		return nil, nil
+	}
+	if share < 0 || share > 1 {
+		return nil, fmt.Errorf("budget share of %s must be between 0 and 1", name)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.shared+share > 1 {
+		return nil, fmt.Errorf("budget share of %s: shares add up to more than the budget", name)
+	}
+	c := &budgetClass{name: name, share: share, reserved: int64(share * float64(b.max))}
+	b.shared += share
+	b.idle += c.reserved
+	b.classes = append(b.classes, c)
+	return c, nil
+}
+
+// take gives c a slot: within its share, or from those no share holds
+// back.
+func (b *budget) take(c *budgetClass) bool {
+	if b == nil || c == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.used < c.reserved {
+		b.idle--
+	} else if b.open+b.idle >= b.max {
+		c.refused.Add(1)
+		return false
+	}
+	c.used++
+	b.open++
+	return true
+}
+
+func (b *budget) release(c *budgetClass) {
+	if b == nil || c == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c.used--
+	b.open--
+	if c.used < c.reserved {
+		b.idle++
+	}
+}
+
+// stats reports every listener and route, nil without a budget.
+func (b *budget) stats() []BudgetStats {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := make([]BudgetStats, 0, len(b.classes))
+	for _, c := range b.classes {
+		stats = append(stats, BudgetStats{
+			Name:     c.name,
+			Share:    c.share,
+			Reserved: c.reserved,
+			Open:     c.used,
+			Refused:  c.refused.Load(),
+		})
+	}
+	return stats
+}
+
+// budgetClasses adds the listener and those of its routes with a share.
+func (lb *LoadBalancer) budgetClasses(fe *frontend) error {
+	var err error
+	if fe.budget, err = lb.budget.class("listener "+fe.addr.String(), fe.cfg.BudgetShare); err != nil {
+		return err
+	}
+	fe.routeBudgets = make([]*budgetClass, len(fe.cfg.Routes))
+	for i, r := range fe.cfg.Routes {
+		if r.BudgetShare == 0 {
+			continue
+		}
+		name := fmt.Sprintf("route %d to %s on listener %s", i, r.Pool, fe.addr)
+		if fe.routeBudgets[i], err = lb.budget.class(name, r.BudgetShare); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// budgetFor is the class a connection is charged to: its route's if that
+// has a share, the listener's otherwise.
+func (fe *frontend) budgetFor(route int) *budgetClass {
+	if route >= 0 && route < len(fe.routeBudgets) && fe.routeBudgets[route] != nil {
+		return fe.routeBudgets[route]
+	}
+	return fe.budget
+}
@@ -0,0 +1,221 @@
+package capture
+
+import (
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/logging"
+)
+
+// Config says which connections are captured and how much of them.
+type Config struct {
+	//Sample is the fraction of connections captured, from 0 to 1
+	Sample float64
+	//MaxConnBytes stops capturing a connection after this much payload,
+	//default 1MB
+	MaxConnBytes int
+	//MaxBytes stops the whole capture once this much has been written to
+	//the sink, default 100MB
+	MaxBytes int64
+	//Redact may rewrite captured data before it is written; data is a copy.
+	//toBackend tells the direction.
+	Redact func(toBackend bool, data []byte) []byte
+}
+
+func (c Config) withDefaults() Config {
+	if c.MaxConnBytes <= 0 {
+		c.MaxConnBytes = 1 << 20
+	}
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = 100 << 20
+	}
+	return c
+}
+
+// Capturer tees a sample of connections into a pcap stream, with synthetic
+// TCP/IP headers so tools such as Wireshark can follow each connection.
+type Capturer struct {
+	cfg  Config
+	sink io.Writer
+	//log is logging.Default unless SetLogger changed it
+	log *slog.Logger
+
+	//mu serialises writes and guards the sequence numbers of every tap
+	mu      sync.Mutex
+	written int64
+	header  bool
+	full    bool
+}
+
+// New captures into sink, e.g. a file from os.Create or a socket from Dial.
+func New(cfg Config, sink io.Writer) *Capturer {
+	return &Capturer{cfg: cfg.withDefaults(), sink: sink, log: logging.Default()}
+}
+
+// SetLogger sends what the capturer logs to l; call it before the first
+// Tap.
+func (c *Capturer) SetLogger(l *slog.Logger) {
+	c.log = l
+}
+
+// Tap returns conn with its traffic captured, or conn itself when it is not
+// sampled. client and backend are the addresses recorded for both ends.
+func (c *Capturer) Tap(conn net.Conn, client, backend net.Addr) net.Conn {
+	if c == nil || rand.Float64() >= c.cfg.Sample {
+		return conn
+	}
+
+	c.mu.Lock()
+	full := c.full
+	c.mu.Unlock()
+	if full {
+		return conn
+	}
+
+	t := &tapConn{
+		Conn:    conn,
+		c:       c,
+		client:  addrPort(client),
+		backend: addrPort(backend),
+		//arbitrary but distinct initial sequence numbers
+		clientSeq:  rand.Uint32(),
+		backendSeq: rand.Uint32(),
+	}
+	t.handshake()
+	return t
+}
+
+// write sends the records of segs to the sink unless the capture is full.
+func (c *Capturer) write(segs ...segment) {
+	if c.full {
+		return
+	}
+
+	var buf []byte
+	//a Socket sends the file header itself on every new connection
+	if _, ok := c.sink.(*Socket); !ok && !c.header {
+		buf = pcapHeader()
+	}
+	now := time.Now()
+	for _, s := range segs {
+		buf = appendRecord(buf, now, s)
+	}
+
+	if c.written+int64(len(buf)) > c.cfg.MaxBytes {
+		c.full = true
+		c.log.Info("Capture stopped, size limit reached", "bytes", c.cfg.MaxBytes)
+		return
+	}
+
+	if _, err := c.sink.Write(buf); err != nil {
+		return
+	}
+	c.written += int64(len(buf))
+	c.header = true
+}
+
+// addrPort unmaps IPv4 clients of a dual-stack listener, so that IPv4
+// connections are recorded as IPv4 packets.
+func addrPort(addr net.Addr) netip.AddrPort {
+	ap, _ := netip.ParseAddrPort(addr.String())
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		ap = tcp.AddrPort()
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// tapConn records what is written to and read from a backend connection
+// as client --> backend and backend --> client segments.
+type tapConn struct {
+	net.Conn
+	c *Capturer
+
+	client, backend       netip.AddrPort
+	clientSeq, backendSeq uint32
+	captured              int
+	truncated             bool
+	closeOnce             sync.Once
+}
+
+func (t *tapConn) handshake() {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+
+	t.c.write(
+		segment{src: t.client, dst: t.backend, seq: t.clientSeq, flags: tcpSYN},
+		segment{src: t.backend, dst: t.client, seq: t.backendSeq, ack: t.clientSeq + 1, flags: tcpSYN | tcpACK},
+		segment{src: t.client, dst: t.backend, seq: t.clientSeq + 1, ack: t.backendSeq + 1, flags: tcpACK},
+	)
+	t.clientSeq++
+	t.backendSeq++
+}
+
+func (t *tapConn) Write(p []byte) (int, error) {
+	n, err := t.Conn.Write(p)
+	t.record(true, p[:n])
+	return n, err
+}
+
+func (t *tapConn) Read(p []byte) (int, error) {
+	n, err := t.Conn.Read(p)
+	t.record(false, p[:n])
+	return n, err
+}
+
+func (t *tapConn) record(toBackend bool, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+
+	if t.truncated {
+		return
+	}
+	if t.captured+len(p) > t.c.cfg.MaxConnBytes {
+		p = p[:t.c.cfg.MaxConnBytes-t.captured]
+		t.truncated = true
+	}
+	t.captured += len(p)
+
+	data := append([]byte(nil), p...)
+	if t.c.cfg.Redact != nil {
+		data = t.c.cfg.Redact(toBackend, data)
+	}
+
+	for len(data) > 0 {
+		chunk := data[:min(len(data), maxSegment)]
+		data = data[len(chunk):]
+
+		if toBackend {
+			t.c.write(segment{src: t.client, dst: t.backend, seq: t.clientSeq, ack: t.backendSeq, flags: tcpPSH | tcpACK, payload: chunk})
+			t.clientSeq += uint32(len(chunk))
+		} else {
+			t.c.write(segment{src: t.backend, dst: t.client, seq: t.backendSeq, ack: t.clientSeq, flags: tcpPSH | tcpACK, payload: chunk})
+			t.backendSeq += uint32(len(chunk))
+		}
+	}
+}
+
+func (t *tapConn) Close() error {
+	t.closeOnce.Do(func() {
+		t.c.mu.Lock()
+		defer t.c.mu.Unlock()
+
+		t.c.write(
+			segment{src: t.client, dst: t.backend, seq: t.clientSeq, ack: t.backendSeq, flags: tcpFIN | tcpACK},
+			segment{src: t.backend, dst: t.client, seq: t.backendSeq, ack: t.clientSeq + 1, flags: tcpFIN | tcpACK},
+		)
+	})
+	return t.Conn.Close()
+}
+
+func (t *tapConn) Unwrap() net.Conn {
+	return t.Conn
+}
@@ -0,0 +1,37 @@
+package capture
+
+import "bytes"
+
+// RedactHeaders masks the values of the named HTTP headers, e.g.
+// Authorization and Cookie, keeping their length so the capture still lines
+// up. Headers split across two reads are not recognised.
+func RedactHeaders(names ...string) func(toBackend bool, data []byte) []byte {
+	prefixes := make([][]byte, len(names))
+	for i, name := range names {
+		prefixes[i] = []byte(name + ":")
+	}
+
+	return func(toBackend bool, data []byte) []byte {
+		for line := data; len(line) > 0; {
+			end := bytes.IndexByte(line, '\n')
+			if end < 0 {
+				end = len(line)
+			} else {
+				end++
+			}
+
+			for _, prefix := range prefixes {
+				if len(line) >= len(prefix) && bytes.EqualFold(line[:len(prefix)], prefix) {
+					value := bytes.TrimRight(line[len(prefix):end], "\r\n")
+					for i := range value {
+						if value[i] != ' ' {
+							value[i] = '*'
+						}
+					}
+				}
+			}
+			line = line[end:]
+		}
+		return data
+	}
+}
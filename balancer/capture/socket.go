@@ -0,0 +1,69 @@
+package capture
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const redialInterval = 5 * time.Second
+
+// Socket is a sink streaming the capture to a listener, e.g.
+// "nc -l 9999 | wireshark -k -i -". It connects on first use and after a
+// failure at most every five seconds; records are dropped while it is down.
+type Socket struct {
+	network, addr string
+
+	mu       sync.Mutex
+	conn     net.Conn
+	lastDial time.Time
+}
+
+// Dial returns a sink for a TCP address or, with network "unix", a socket
+// path.
+func Dial(network, addr string) *Socket {
+	return &Socket{network: network, addr: addr}
+}
+
+func (s *Socket) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if time.Since(s.lastDial) < redialInterval {
+			return 0, net.ErrClosed
+		}
+		s.lastDial = time.Now()
+
+		conn, err := net.DialTimeout(s.network, s.addr, time.Second)
+		if err != nil {
+			return 0, err
+		}
+		//every connection is a capture file of its own
+		if _, err := conn.Write(pcapHeader()); err != nil {
+			conn.Close()
+			return 0, err
+		}
+		s.conn = conn
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	n, err := s.conn.Write(p)
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return n, err
+}
+
+func (s *Socket) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,79 @@
+package balancer
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//DefaultCertificateWarning is how long before expiry certificates are flagged
+	DefaultCertificateWarning = 30 * 24 * time.Hour
+	certificateCheckInterval  = 6 * time.Hour
+)
+
+type CertificateStats struct {
+	//Name says where the certificate is used, e.g. "listener :8443"
+	Name     string
+	Subject  string
+	NotAfter time.Time
+	DaysLeft int
+	//Expiring is set within the warning window and after expiry
+	Expiring bool
+}
+
+// WithCertificateWarning sets how long before expiry a certificate is
+// reported as expiring.
+func WithCertificateWarning(d time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		lb.certs.warning = d
+	}
+}
+
+// CAStats counts the connections a CA verified the peer certificate of.
+type CAStats struct {
+	//Name says where, e.g. "listener :8443" for client certificates or
+	//"pool default" for backends
+	Name     string
+	CA       string
+	Verified uint64
+}
+
+// caCounter counts verified connections by place and CA.
+type caCounter struct {
+	counts sync.Map //caKey -> *atomic.Uint64
+}
+
+type caKey struct {
+	name, ca string
+}
+
+// add counts a connection verified by ca, unless ca is empty.
+func (c *caCounter) add(name, ca string) {
+	if ca == "" {
+		return
+	}
+	key := caKey{name, ca}
+	n, ok := c.counts.Load(key)
+	if !ok {
+		n, _ = c.counts.LoadOrStore(key, new(atomic.Uint64))
+	}
+	n.(*atomic.Uint64).Add(1)
+}
+
+func (c *caCounter) stats() []CAStats {
+	var stats []CAStats
+	c.counts.Range(func(k, v any) bool {
+		key := k.(caKey)
+		stats = append(stats, CAStats{Name: key.name, CA: key.ca, Verified: v.(*atomic.Uint64).Load()})
+		return true
+	})
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Name != stats[j].Name {
+			return stats[i].Name < stats[j].Name
+		}
+		return stats[i].CA < stats[j].CA
+	})
+	return stats
+}
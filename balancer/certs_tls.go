@@ -0,0 +1,149 @@
+//go:build !notls
+
+package balancer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sort"
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/listener"
+)
+
+// certMonitor remembers certificates presented by backends; the ones the
+// balancer serves itself are read from the listener and pool TLS configs.
+type certMonitor struct {
+	warning time.Duration
+
+	mu       sync.Mutex
+	observed map[string]*x509.Certificate
+}
+
+func (m *certMonitor) observe(name string, cert *x509.Certificate) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.observed == nil {
+		m.observed = make(map[string]*x509.Certificate)
+	}
+	m.observed[name] = cert
+}
+
+// certificateStats lists every known certificate, soonest expiry first.
+func (lb *LoadBalancer) certificateStats() []CertificateStats {
+	leaves := make(map[string]*x509.Certificate)
+
+	for _, fe := range lb.frontendList() {
+		for _, a := range fe.chain {
+			var cfg *tls.Config
+			switch a := a.(type) {
+			case listener.TLS:
+				cfg = a.Config
+			case *listener.TLS:
+				cfg = a.Config
+			}
+			if cert := serverCertificate(cfg); cert != nil {
+				leaves["listener "+fe.addr.String()] = cert
+			}
+		}
+	}
+
+	for _, p := range lb.Pools() {
+		if cert := clientCertificate(p.TLS()); cert != nil {
+			leaves["pool "+p.name+" client"] = cert
+		}
+	}
+
+	lb.certs.mu.Lock()
+	for name, cert := range lb.certs.observed {
+		leaves[name] = cert
+	}
+	lb.certs.mu.Unlock()
+
+	now := lb.clock.Now()
+	stats := make([]CertificateStats, 0, len(leaves))
+	for name, cert := range leaves {
+		left := cert.NotAfter.Sub(now)
+		stats = append(stats, CertificateStats{
+			Name:     name,
+			Subject:  cert.Subject.String(),
+			NotAfter: cert.NotAfter,
+			DaysLeft: int(left.Hours() / 24),
+			Expiring: left < lb.certs.warning,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].NotAfter.Before(stats[j].NotAfter) })
+	return stats
+}
+
+// watchCertificates logs a warning for every expiring certificate, at start
+// and then a few times a day, until Shutdown.
+func (lb *LoadBalancer) watchCertificates() {
+	ticker := lb.clock.NewTicker(certificateCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, c := range lb.certificateStats() {
+			if !c.Expiring {
+				continue
+			}
+			if c.DaysLeft < 0 {
+				lb.log.Warn("Certificate expired", "certificate", c.Name, "subject", c.Subject, "not_after", c.NotAfter.Format(time.DateOnly))
+			} else {
+				lb.log.Warn("Certificate expires soon", "certificate", c.Name, "subject", c.Subject, "days_left", c.DaysLeft)
+			}
+		}
+		select {
+		case <-lb.stop:
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+func serverCertificate(cfg *tls.Config) *x509.Certificate {
+	if cfg == nil {
+		return nil
+	}
+	if cfg.GetCertificate != nil {
+		cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{})
+		if err == nil {
+			return leaf(cert)
+		}
+	}
+	if len(cfg.Certificates) > 0 {
+		return leaf(&cfg.Certificates[0])
+	}
+	return nil
+}
+
+func clientCertificate(cfg *tls.Config) *x509.Certificate {
+	if cfg == nil {
+		return nil
+	}
+	if cfg.GetClientCertificate != nil {
+		cert, err := cfg.GetClientCertificate(&tls.CertificateRequestInfo{})
+		if err == nil {
+			return leaf(cert)
+		}
+	}
+	if len(cfg.Certificates) > 0 {
+		return leaf(&cfg.Certificates[0])
+	}
+	return nil
+}
+
+func leaf(cert *tls.Certificate) *x509.Certificate {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil
+	}
+	if cert.Leaf != nil {
+		return cert.Leaf
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return parsed
+}
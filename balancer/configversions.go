@@ -0,0 +1,70 @@
+package balancer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MaxConfigVersions is how many configs RecordConfig keeps.
+const MaxConfigVersions = 20
+
+// ConfigVersion is a config the balancer ran with, as written, so that an
+// earlier one can be found again after a bad change.
+type ConfigVersion struct {
+	Version int
+	Applied time.Time
+	Source  []byte
+}
+
+// RecordConfig keeps source in the state store as the next version, unless
+// it is the same as the latest, and drops versions past MaxConfigVersions.
+func (lb *LoadBalancer) RecordConfig(source []byte) (ConfigVersion, error) {
+	lb.configsMu.Lock()
+	defer lb.configsMu.Unlock()
+
+	versions, err := lb.ConfigVersions()
+	if err != nil {
+		return ConfigVersion{}, err
+	}
+	if n := len(versions); n > 0 && bytes.Equal(versions[n-1].Source, source) {
+		return versions[n-1], nil
+	}
+
+	v := ConfigVersion{Version: 1, Applied: lb.clock.Now(), Source: source}
+	if n := len(versions); n > 0 {
+		v.Version = versions[n-1].Version + 1
+	}
+	versions = append(versions, v)
+	if len(versions) > MaxConfigVersions {
+		versions = versions[len(versions)-MaxConfigVersions:]
+	}
+
+	data, err := json.Marshal(versions)
+	if err != nil {
+		return ConfigVersion{}, err
+	}
+	if err := lb.stateStore.Save(configsKey, data); err != nil {
+		return ConfigVersion{}, err
+	}
+	lb.log.Info("Config version recorded", "version", v.Version)
+	return v, nil
+}
+
+// ConfigVersions are the configs RecordConfig kept, oldest first.
+func (lb *LoadBalancer) ConfigVersions() ([]ConfigVersion, error) {
+	if lb.stateStore == nil {
+		return nil, errors.New("no state store to keep config versions in")
+	}
+	data, err := lb.stateStore.Load(configsKey)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var versions []ConfigVersion
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, fmt.Errorf("config versions in %v: %w", lb.stateStore, err)
+	}
+	return versions, nil
+}
@@ -0,0 +1,132 @@
+package balancer
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"loadbalancer/balancer/audit"
+)
+
+// ConnectionLimit caps the connections all listeners hold at once, from
+// accept until the connection ends, so a traffic spike can't spawn
+// goroutines without bound.
+type ConnectionLimit struct {
+	//Max connections at once
+	Max int
+	//Wait is how long a full balancer stops accepting, leaving clients in
+	//the listen backlog, before it takes them and closes them at once until
+	//a connection ends, so they fail fast; 0 waits as long as it takes
+	Wait time.Duration
+}
+
+// WithConnectionLimit pauses every accept loop while limit.Max connections
+// are open. The kernel's listen backlog then holds new clients until one
+// ends, or until limit.Wait when set.
+func WithConnectionLimit(limit ConnectionLimit) Option {
+	return func(lb *LoadBalancer) {
+		if limit.Max > 0 {
+			lb.connLimit = &connLimit{policy: limit, slots: make(chan struct{}, limit.Max)}
+		}
+	}
+}
+
+type connLimit struct {
+	policy ConnectionLimit
+	//slots holds a value per open connection
+	slots chan struct{}
+
+	//full is set once an accept waited, overflowing once the wait timed out
+	full        atomic.Bool
+	overflowing atomic.Bool
+	paused      atomic.Uint64
+	refused     atomic.Uint64
+}
+
+// ConnectionLimitStats is the state of WithConnectionLimit.
+type ConnectionLimitStats struct {
+	Max  int
+	Open int
+	//Paused counts the times accepts stopped for the limit, Refused the
+	//connections closed after its Wait
+	Paused  uint64
+	Refused uint64
+}
+
+// acquire takes a slot for a connection just accepted, waiting while there
+// is none, which holds up its accept loop. It reports false, holding no
+// slot, once Wait is over and while no slot freed since; the caller then
+// refuses the connection. Nil-safe for balancers without a limit.
+func (l *connLimit) acquire(lb *LoadBalancer) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		l.resume(lb.log)
+		return true
+	default:
+	}
+	if l.overflowing.Load() {
+		return false
+	}
+
+	if !l.full.Swap(true) {
+		l.paused.Add(1)
+		lb.log.Warn("Connection limit reached, pausing accepts", "max", l.policy.Max)
+	}
+	if l.policy.Wait <= 0 {
+		l.slots <- struct{}{}
+		l.resume(lb.log)
+		return true
+	}
+
+	timer := lb.clock.NewTimer(l.policy.Wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		l.resume(lb.log)
+		return true
+	case <-timer.C():
+		if !l.overflowing.Swap(true) {
+			lb.log.Warn("Connection limit still reached, refusing new connections", "wait", l.policy.Wait)
+		}
+		return false
+	}
+}
+
+// resume logs the end of a pause once a slot was taken.
+func (l *connLimit) resume(log *slog.Logger) {
+	l.overflowing.Store(false)
+	if l.full.Swap(false) {
+		log.Info("Connection limit eased, accepting again")
+	}
+}
+
+func (l *connLimit) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// refuseOverLimit closes a connection accepted over the limit.
+func (lb *LoadBalancer) refuseOverLimit(fe *frontend, conn net.Conn) {
+	lb.connLimit.refused.Add(1)
+	lb.reject(fe, conn.RemoteAddr(), audit.KindLimit, fmt.Sprintf("%d connection(s) open", lb.connLimit.policy.Max))
+	conn.Close()
+}
+
+func (l *connLimit) stats() *ConnectionLimitStats {
+	if l == nil {
+		return nil
+	}
+	return &ConnectionLimitStats{
+		Max:     l.policy.Max,
+		Open:    len(l.slots),
+		Paused:  l.paused.Load(),
+		Refused: l.refused.Load(),
+	}
+}
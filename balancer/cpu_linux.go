@@ -0,0 +1,26 @@
+//go:build linux
+
+package balancer
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// pinThread restricts the calling OS thread to one processor. The caller
+// must have locked its goroutine to the thread.
+func pinThread(cpu int) error {
+	var mask [1024 / 64]uint64
+	if cpu < 0 || cpu >= len(mask)*64 {
+		return fmt.Errorf("cpu %d out of range", cpu)
+	}
+	mask[cpu/64] |= 1 << (cpu % 64)
+
+	//pid 0 is the calling thread
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package balancer
+
+import "errors"
+
+func pinThread(cpu int) error {
+	return errors.New("processor affinity is only supported on Linux")
+}
@@ -0,0 +1,62 @@
+package balancer
+
+import (
+	"net"
+)
+
+// DefaultDebugHeader carries the backend of each response while debugging.
+const DefaultDebugHeader = "X-Backend"
+
+// WithDebugHeader names the response header that shows, in ModeHTTP, the
+// backend and pool of each response while debugging is on; "" for
+// DefaultDebugHeader. Debugging starts off, see SetDebug.
+func WithDebugHeader(name string) Option {
+	return func(lb *LoadBalancer) {
+		if name == "" {
+			name = DefaultDebugHeader
+		}
+		lb.debugHeader = name
+	}
+}
+
+// SetDebug turns debugging on or off and reports whether that changed.
+// While it is on every connection logs the pool and backend it was routed
+// to, and in ModeHTTP the responses carry them in the debug header, so
+// developers can verify routing end to end. Turn it off again once done,
+// it tells clients about the backends.
+func (lb *LoadBalancer) SetDebug(on bool) bool {
+	if lb.debug.Swap(on) == on {
+		return false
+	}
+	if on {
+		lb.log.Info("Debugging on", "header", lb.debugHeaderName())
+	} else {
+		lb.log.Info("Debugging off")
+	}
+	return true
+}
+
+// Debugging reports whether SetDebug turned debugging on.
+func (lb *LoadBalancer) Debugging() bool {
+	return lb.debug.Load()
+}
+
+func (lb *LoadBalancer) debugHeaderName() string {
+	if lb.debugHeader == "" {
+		return DefaultDebugHeader
+	}
+	return lb.debugHeader
+}
+
+// debugValue is what the debug header says about b.
+func debugValue(pool *Pool, b *Backend) string {
+	return b.Addr + "; pool=" + pool.name
+}
+
+// debugRoute logs where a connection went while debugging.
+func (lb *LoadBalancer) debugRoute(fe *frontend, pool *Pool, client net.Conn, b *Backend) {
+	if !lb.Debugging() {
+		return
+	}
+	lb.log.Info("Debug: routed", "client", client.RemoteAddr().String(), "listener", fe.addr, "to", debugValue(pool, b))
+}
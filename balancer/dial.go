@@ -0,0 +1,65 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"loadbalancer/balancer/resolve"
+)
+
+// dialBackend connects to a backend of pool, re-encrypting with the pool's
+// TLS config if it has one. The timeout covers both.
+func (lb *LoadBalancer) dialBackend(pool *Pool, b *Backend, timeout time.Duration) (net.Conn, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := lb.dial(&dialer, b.Addr)
+	if err != nil {
+		return nil, err
+	}
+	lb.resolver.Dialed(b.Addr, conn.RemoteAddr())
+	return lb.backendTLS(pool, b, conn, deadline)
+}
+
+// dial connects to addr, resolving a host name through the DNS cache. The
+// addresses are tried in turn from one that moves on with every dial, so
+// connections spread over them as they would with a rotating nameserver.
+func (lb *LoadBalancer) dial(dialer *net.Dialer, addr string) (net.Conn, error) {
+	host, ok := resolve.HostName(addr)
+	if !ok {
+		return dialer.Dial("tcp", addr)
+	}
+	_, port, _ := net.SplitHostPort(addr)
+
+	ctx := context.Background()
+	if !dialer.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, dialer.Deadline)
+		defer cancel()
+	}
+	ips, err := lb.dnsCache.LookupNetIP(ctx, host)
+	if err == nil && len(ips) == 0 {
+		err = errors.New("no addresses")
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: err.Error(), Name: host}}
+	}
+
+	first := int(lb.dialed.Add(1) % uint64(len(ips)))
+	for i := range ips {
+		ip := ips[(first+i)%len(ips)]
+		conn, derr := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if derr == nil {
+			return conn, nil
+		}
+		if err == nil {
+			err = derr
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,31 @@
+package discovery
+
+// Source provides the list of backend addresses the balancer should use.
+type Source interface {
+	Backends() ([]string, error)
+}
+
+// Static is a fixed list of backend addresses.
+type Static []string
+
+func (s Static) Backends() ([]string, error) {
+	return append([]string(nil), s...), nil
+}
+
+// HealthSource is a Source that also knows which backends are usable, such
+// as Consul with its checks or Kubernetes with endpoint readiness. Health
+// returns the state of the backends it knows by address; the rest are left
+// as unknown.
+type HealthSource interface {
+	Source
+	Health() (map[string]bool, error)
+}
+
+// GoingAwaySource is a Source that can flag backends about to shut down,
+// such as a registry entry marked for deregistration. GoingAway returns
+// their addresses; they are drained before they stop, and resumed once the
+// flag is gone.
+type GoingAwaySource interface {
+	Source
+	GoingAway() ([]string, error)
+}
@@ -0,0 +1,63 @@
+package balancer
+
+import (
+	"loadbalancer/balancer/backend"
+	"loadbalancer/balancer/discovery"
+	"loadbalancer/balancer/health"
+)
+
+// watchDiscoveryHealth polls what the discovery source reports about
+// backend health once per health check interval until Shutdown.
+func (lb *LoadBalancer) watchDiscoveryHealth(source discovery.HealthSource) {
+	interval := lb.healthPolicy.Interval
+	if interval <= 0 {
+		interval = health.DefaultInterval
+	}
+	ticker := lb.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		//paused under load, keeping the last reports
+		if !lb.shedder.paused("discovery") {
+			reports, err := source.Health()
+			switch {
+			case err != nil && !failing:
+				lb.log.Warn("Discovery health failed, keeping the last reports", "error", err)
+			case err == nil:
+				lb.applyDiscoveryHealth(reports)
+			}
+			failing = err != nil
+		}
+
+		select {
+		case <-lb.stop:
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// applyDiscoveryHealth records the reports and re-gates every backend, as
+// a backend the source stopped mentioning goes back to unknown.
+func (lb *LoadBalancer) applyDiscoveryHealth(reports map[string]bool) {
+	for _, p := range lb.Pools() {
+		gate := p.HealthPolicy().Gate
+		for _, b := range p.Backends() {
+			view := backend.Unknown
+			if ok, known := reports[b.Addr]; known {
+				view = backend.ViewOf(ok)
+			}
+			b.SetReported(view)
+
+			if gate == health.GateLocal || !gate.Apply(b) {
+				continue
+			}
+			if b.Healthy() {
+				lb.log.Info("Server marked as HEALTHY (discovery)", "backend", b.Addr, "pool", p.name)
+			} else {
+				lb.log.Warn("Server marked as UNHEALTHY (discovery)", "backend", b.Addr, "pool", p.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"loadbalancer/balancer/dnslb"
+)
+
+// DNSConfig describes a DNS frontend, for clients that balance themselves
+// and only need the healthy backends of a service.
+type DNSConfig struct {
+	//Address is the UDP address to answer on, e.g. ":53"
+	Address string
+	//Services maps a DNS name to the pool it resolves to
+	Services map[string]string
+	//TTL of the answers, default 5s; keep it low so failures are noticed
+	TTL time.Duration
+	//MaxAnswers caps the addresses in one answer, default 8
+	MaxAnswers int
+}
+
+// ListenDNS answers A and AAAA queries for the configured names with the
+// addresses of the pools' healthy backends until the socket fails. Backend
+// ports are not part of the answer, so clients must know the service port.
+func (lb *LoadBalancer) ListenDNS(cfg DNSConfig) error {
+	services := make(map[string]string, len(cfg.Services))
+	for name, pool := range cfg.Services {
+		if lb.Pool(pool) == nil {
+			return fmt.Errorf("dns %s: unknown pool %s", name, pool)
+		}
+		services[strings.ToLower(strings.TrimSuffix(name, "."))] = pool
+	}
+
+	pc, err := net.ListenPacket("udp", cfg.Address)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	server := &dnslb.Server{
+		TTL:        cfg.TTL,
+		MaxAnswers: cfg.MaxAnswers,
+		Lookup: func(name string) ([]dnslb.Record, bool) {
+			pool, ok := services[name]
+			if !ok {
+				return nil, false
+			}
+			if p := lb.Pool(pool); p != nil {
+				return lb.backendRecords(p.healthyBackends()), true
+			}
+			return nil, true
+		},
+	}
+
+	lb.log.Info("DNS answering", "address", pc.LocalAddr().String(), "services", len(services))
+
+	//the answers come from the same health checks as proxied traffic
+	lb.startPools()
+
+	return server.Serve(pc)
+}
+
+// backendRecords returns the distinct addresses of backends, weighted by
+// their effective weight; backends sharing an address add up. Host names
+// are resolved through the DNS cache.
+func (lb *LoadBalancer) backendRecords(backends []*Backend) []dnslb.Record {
+	seen := make(map[netip.Addr]int)
+	var records []dnslb.Record
+	add := func(ip netip.Addr, weight float64) {
+		ip = ip.Unmap()
+		if i, ok := seen[ip]; ok {
+			records[i].Weight += weight
+			return
+		}
+		seen[ip] = len(records)
+		records = append(records, dnslb.Record{Addr: ip, Weight: weight})
+	}
+
+	for _, b := range backends {
+		host, _, err := net.SplitHostPort(b.Addr)
+		if err != nil {
+			continue
+		}
+
+		weight := b.EffectiveWeight()
+		if ip, err := netip.ParseAddr(host); err == nil {
+			add(ip, weight)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resolved, err := lb.dnsCache.LookupNetIP(ctx, host)
+		cancel()
+		if err != nil {
+			lb.log.Warn("DNS answer skips backend", "backend", b.Addr, "error", err)
+			continue
+		}
+		for _, ip := range resolved {
+			add(ip, weight)
+		}
+	}
+	return records
+}
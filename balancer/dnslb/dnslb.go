@@ -0,0 +1,249 @@
+package dnslb
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	typeA    = 1
+	typeAAAA = 28
+	classIN  = 1
+
+	rcodeFormErr  = 1
+	rcodeServFail = 2
+	rcodeRefused  = 5
+
+	//maxUDP is the answer size every resolver accepts without EDNS
+	maxUDP = 512
+)
+
+// Record is an address a name resolves to. Weight is its share of the
+// answers that list it first, relative to the name's other records.
+type Record struct {
+	Addr   netip.Addr
+	Weight float64
+}
+
+// Lookup returns the records of a name right now. Names are lower case
+// without the trailing dot; ok is false for names the server does not
+// answer for.
+type Lookup func(name string) (records []Record, ok bool)
+
+// Server is a minimal authoritative DNS server for A and AAAA queries over
+// UDP. Successive answers start at a different address, picked by weight
+// the way strategy.WeightedRoundRobin picks backends, so clients that take
+// the first one are spread in proportion. Records without any weight are
+// taken in turn.
+type Server struct {
+	Lookup Lookup
+	//TTL of the records, default 5s
+	TTL time.Duration
+	//MaxAnswers caps the records per answer, default 8
+	MaxAnswers int
+
+	mu sync.Mutex
+	//current are the running scores of the smooth algorithm per question
+	current map[question]map[netip.Addr]float64
+}
+
+type question struct {
+	name  string
+	qtype uint16
+}
+
+var errMalformed = errors.New("malformed query")
+
+// Serve answers queries on pc until it fails.
+func (s *Server) Serve(pc net.PacketConn) error {
+	buf := make([]byte, maxUDP)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			continue
+		}
+
+		if resp := s.Answer(buf[:n]); resp != nil {
+			pc.WriteTo(resp, addr)
+		}
+	}
+}
+
+// Answer builds the response to one query message, or returns nil when the
+// message is not worth answering.
+func (s *Server) Answer(query []byte) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+
+	flags := binary.BigEndian.Uint16(query[2:])
+	//responses and anything but standard queries are dropped
+	if flags&0x8000 != 0 || flags&0x7800 != 0 {
+		return nil
+	}
+
+	name, qtype, qclass, end, err := parseQuestion(query)
+	if err != nil {
+		return header(query, 0, rcodeFormErr, false)
+	}
+
+	resp := header(query, 1, 0, true)
+	resp = append(resp, query[12:end]...)
+
+	records, ok := s.Lookup(name)
+	switch {
+	case !ok:
+		//not our zone, so not authoritative either
+		resp[2] &^= 0x04
+		return setRcode(resp, rcodeRefused)
+	case len(records) == 0:
+		//nothing healthy: clients should retry rather than cache an empty answer
+		return setRcode(resp, rcodeServFail)
+	case qclass != classIN || (qtype != typeA && qtype != typeAAAA):
+		return resp
+	}
+
+	var matching []Record
+	for _, r := range records {
+		if r.Addr.Is4() == (qtype == typeA) {
+			matching = append(matching, r)
+		}
+	}
+	if len(matching) == 0 {
+		return resp
+	}
+
+	ttl := uint32(5)
+	if s.TTL > 0 {
+		ttl = uint32(max(s.TTL/time.Second, 1))
+	}
+	limit := s.MaxAnswers
+	if limit <= 0 {
+		limit = 8
+	}
+
+	start := s.first(question{name, qtype}, matching)
+	count := 0
+	for i := range min(limit, len(matching)) {
+		ip := matching[(start+i)%len(matching)].Addr.AsSlice()
+		if len(resp)+12+len(ip) > maxUDP {
+			break
+		}
+
+		//0xc00c points back at the name in the question
+		resp = binary.BigEndian.AppendUint16(resp, 0xc00c)
+		resp = binary.BigEndian.AppendUint16(resp, qtype)
+		resp = binary.BigEndian.AppendUint16(resp, classIN)
+		resp = binary.BigEndian.AppendUint32(resp, ttl)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(ip)))
+		resp = append(resp, ip...)
+		count++
+	}
+	binary.BigEndian.PutUint16(resp[6:], uint16(count))
+	return resp
+}
+
+// first returns the index of the record to list first. The others follow
+// in order.
+func (s *Server) first(q question, records []Record) int {
+	weight := func(r Record) float64 { return max(r.Weight, 0) }
+	if !slices.ContainsFunc(records, func(r Record) bool { return r.Weight > 0 }) {
+		weight = func(Record) float64 { return 1 }
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current == nil {
+		s.current = make(map[question]map[netip.Addr]float64)
+	}
+	//forget addresses that left the answer, so one coming back starts over
+	scores := s.current[q]
+	if scores == nil || len(scores) > len(records) {
+		kept := make(map[netip.Addr]float64, len(records))
+		for _, r := range records {
+			if v, ok := scores[r.Addr]; ok {
+				kept[r.Addr] = v
+			}
+		}
+		scores = kept
+		s.current[q] = scores
+	}
+
+	best := 0
+	var total float64
+	for i, r := range records {
+		w := weight(r)
+		total += w
+		scores[r.Addr] += w
+		if scores[r.Addr] > scores[records[best].Addr] {
+			best = i
+		}
+	}
+	scores[records[best].Addr] -= total
+	return best
+}
+
+// parseQuestion reads the single question of a query and returns the offset
+// just past it.
+func parseQuestion(msg []byte) (name string, qtype, qclass uint16, end int, err error) {
+	if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return "", 0, 0, 0, errMalformed
+	}
+
+	var labels []string
+	off := 12
+	for {
+		if off >= len(msg) {
+			return "", 0, 0, 0, errMalformed
+		}
+		n := int(msg[off])
+		off++
+		if n == 0 {
+			break
+		}
+		//compression pointers are not expected in a question
+		if n > 63 || off+n > len(msg) {
+			return "", 0, 0, 0, errMalformed
+		}
+		labels = append(labels, strings.ToLower(string(msg[off:off+n])))
+		off += n
+	}
+
+	if off+4 > len(msg) {
+		return "", 0, 0, 0, errMalformed
+	}
+	qtype = binary.BigEndian.Uint16(msg[off:])
+	qclass = binary.BigEndian.Uint16(msg[off+2:])
+	return strings.Join(labels, "."), qtype, qclass, off + 4, nil
+}
+
+// header starts a response to query with the given question count and
+// response code. Recursion is never available.
+func header(query []byte, questions uint16, rcode uint16, authoritative bool) []byte {
+	flags := uint16(0x8000) | binary.BigEndian.Uint16(query[2:])&0x0100 | rcode
+	if authoritative {
+		flags |= 0x0400
+	}
+
+	h := make([]byte, 12, maxUDP)
+	copy(h, query[:2])
+	binary.BigEndian.PutUint16(h[2:], flags)
+	binary.BigEndian.PutUint16(h[4:], questions)
+	return h
+}
+
+func setRcode(resp []byte, rcode uint16) []byte {
+	flags := binary.BigEndian.Uint16(resp[2:])&^0x000f | rcode
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	return resp
+}
@@ -0,0 +1,195 @@
+package dnslb
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// query builds a standard query with recursion desired.
+func query(name string, qtype uint16) []byte {
+	msg := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for label := range strings.SplitSeq(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, classIN)
+}
+
+type response struct {
+	flags uint16
+	addrs []netip.Addr
+	ttls  []uint32
+}
+
+func parse(t *testing.T, q, resp []byte) response {
+	t.Helper()
+	if len(resp) < len(q) || string(resp[:2]) != string(q[:2]) || string(resp[12:len(q)]) != string(q[12:]) {
+		t.Fatalf("response %x does not echo query %x", resp, q)
+	}
+	r := response{flags: binary.BigEndian.Uint16(resp[2:])}
+	rest := resp[len(q):]
+	for range binary.BigEndian.Uint16(resp[6:]) {
+		size := int(binary.BigEndian.Uint16(rest[10:]))
+		addr, _ := netip.AddrFromSlice(rest[12 : 12+size])
+		r.addrs = append(r.addrs, addr)
+		r.ttls = append(r.ttls, binary.BigEndian.Uint32(rest[6:]))
+		rest = rest[12+size:]
+	}
+	if len(rest) != 0 {
+		t.Fatalf("%d bytes after the answers", len(rest))
+	}
+	return r
+}
+
+func records(weight float64, addrs ...string) []Record {
+	var rs []Record
+	for _, a := range addrs {
+		rs = append(rs, Record{Addr: netip.MustParseAddr(a), Weight: weight})
+	}
+	return rs
+}
+
+func TestAnswerMalformed(t *testing.T) {
+	s := &Server{Lookup: func(string) ([]Record, bool) { return records(1, "10.0.0.1"), true }}
+	good := query("web.svc", typeA)
+	set := func(off int, b ...byte) []byte {
+		q := append([]byte(nil), good...)
+		copy(q[off:], b)
+		return q
+	}
+
+	for _, tt := range []struct {
+		name  string
+		query []byte
+		//rcode is -1 when the query is dropped
+		rcode int
+	}{
+		{"empty", nil, -1},
+		{"short header", good[:11], -1},
+		{"response", set(2, 0x81), -1},
+		{"not a standard query", set(2, 0x11), -1},
+		{"no question", set(4, 0, 0), rcodeFormErr},
+		{"two questions", set(4, 0, 2), rcodeFormErr},
+		{"header only", good[:12], rcodeFormErr},
+		{"truncated name", good[:15], rcodeFormErr},
+		{"no root label", good[:20], rcodeFormErr},
+		{"truncated type", good[:len(good)-3], rcodeFormErr},
+		{"compression pointer", set(12, 0xc0, 0x0c), rcodeFormErr},
+		{"label too long", set(12, 64), rcodeFormErr},
+		{"good", good, 0},
+	} {
+		resp := s.Answer(tt.query)
+		switch {
+		case tt.rcode < 0 && resp != nil:
+			t.Errorf("%s: answered %x", tt.name, resp)
+		case tt.rcode >= 0 && len(resp) < 12:
+			t.Errorf("%s: got %x, want rcode %d", tt.name, resp, tt.rcode)
+		case tt.rcode >= 0 && int(resp[3]&0x0f) != tt.rcode:
+			t.Errorf("%s: rcode %d, want %d", tt.name, resp[3]&0x0f, tt.rcode)
+		}
+	}
+}
+
+func TestAnswer(t *testing.T) {
+	zone := map[string][]Record{
+		"web.svc":  append(records(1, "10.0.0.1", "10.0.0.2"), records(1, "2001:db8::1")...),
+		"v4.svc":   records(1, "10.0.0.1"),
+		"down.svc": nil,
+		"many.svc": records(1, "2001:db8::1", "2001:db8::2", "2001:db8::3", "2001:db8::4", "2001:db8::5",
+			"2001:db8::6", "2001:db8::7", "2001:db8::8", "2001:db8::9", "2001:db8::a", "2001:db8::b",
+			"2001:db8::c", "2001:db8::d", "2001:db8::e", "2001:db8::f", "2001:db8::10", "2001:db8::11",
+			"2001:db8::12", "2001:db8::13", "2001:db8::14", "2001:db8::15", "2001:db8::16", "2001:db8::17",
+			"2001:db8::18", "2001:db8::19", "2001:db8::1a", "2001:db8::1b", "2001:db8::1c",
+			"2001:db8::1d", "2001:db8::1e", "2001:db8::1f", "2001:db8::20"),
+	}
+	s := &Server{
+		TTL:        30 * time.Second,
+		MaxAnswers: 100,
+		Lookup: func(name string) ([]Record, bool) {
+			rs, ok := zone[name]
+			return rs, ok
+		},
+	}
+
+	for _, tt := range []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		rcode   uint16
+		auth    bool
+		answers int
+	}{
+		{"A", "web.svc", typeA, 0, true, 2},
+		{"AAAA", "web.svc", typeAAAA, 0, true, 1},
+		{"case insensitive", "WEB.Svc", typeA, 0, true, 2},
+		{"no AAAA", "v4.svc", typeAAAA, 0, true, 0},
+		{"other type", "web.svc", 15, 0, true, 0},
+		{"nothing healthy", "down.svc", typeA, rcodeServFail, true, 0},
+		{"not our zone", "example.com", typeA, rcodeRefused, false, 0},
+		//17 AAAA records of 28 bytes fit after the 26 of header and question
+		{"size capped", "many.svc", typeAAAA, 0, true, 17},
+	} {
+		q := query(tt.qname, tt.qtype)
+		r := parse(t, q, s.Answer(q))
+		if r.flags&0x8000 == 0 || r.flags&0x0100 == 0 || r.flags&0x0080 != 0 {
+			t.Errorf("%s: flags %#04x want QR and RD, no RA", tt.name, r.flags)
+		}
+		if rcode := r.flags & 0x0f; rcode != tt.rcode || (r.flags&0x0400 != 0) != tt.auth {
+			t.Errorf("%s: rcode %d, authoritative %v", tt.name, rcode, r.flags&0x0400 != 0)
+		}
+		if len(r.addrs) != tt.answers {
+			t.Errorf("%s: %d answers, want %d", tt.name, len(r.addrs), tt.answers)
+		}
+		for i, addr := range r.addrs {
+			if addr.Is4() != (tt.qtype == typeA) || r.ttls[i] != 30 {
+				t.Errorf("%s: answer %v with TTL %d", tt.name, addr, r.ttls[i])
+			}
+		}
+	}
+
+	s.MaxAnswers = 0
+	q := query("many.svc", typeAAAA)
+	if r := parse(t, q, s.Answer(q)); len(r.addrs) != 8 || r.ttls[0] != 30 {
+		t.Errorf("defaults: %d answers", len(r.addrs))
+	}
+}
+
+func TestAnswerWeights(t *testing.T) {
+	rs := []Record{
+		{Addr: netip.MustParseAddr("10.0.0.1"), Weight: 3},
+		{Addr: netip.MustParseAddr("10.0.0.2"), Weight: 1},
+		{Addr: netip.MustParseAddr("10.0.0.3"), Weight: 0},
+	}
+	s := &Server{Lookup: func(string) ([]Record, bool) { return rs, true }}
+	firsts := func(n int) map[string]int {
+		counts := make(map[string]int)
+		q := query("web.svc", typeA)
+		for range n {
+			r := parse(t, q, s.Answer(q))
+			if len(r.addrs) != len(rs) {
+				t.Fatalf("%d answers, want %d", len(r.addrs), len(rs))
+			}
+			counts[r.addrs[0].String()]++
+		}
+		return counts
+	}
+
+	got := firsts(400)
+	if got["10.0.0.1"] != 300 || got["10.0.0.2"] != 100 || got["10.0.0.3"] != 0 {
+		t.Errorf("weights 3, 1, 0: first records %v", got)
+	}
+
+	//without any weight the records take turns
+	for i := range rs {
+		rs[i].Weight = 0
+	}
+	rs = rs[:2]
+	if got := firsts(100); got["10.0.0.1"] != 50 || got["10.0.0.2"] != 50 {
+		t.Errorf("no weights: first records %v", got)
+	}
+}
@@ -0,0 +1,261 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// drain events
+const (
+	DrainStarted   = "drain_started"
+	DrainCompleted = "drain_completed"
+)
+
+// drainPoll is how often a drain checks for open connections.
+const drainPoll = 100 * time.Millisecond
+
+var errAlreadyDraining = errors.New("balancer is already draining")
+
+// DrainEvent tells a hook that a drain started or completed, so a deploy
+// pipeline can restart a backend or an instance once it is actually idle.
+type DrainEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	//Backend and Pools are empty when the whole balancer drains
+	Backend string   `json:"backend,omitempty"`
+	Pools   []string `json:"pools,omitempty"`
+	//Active are the connections still open
+	Active int64 `json:"active"`
+	//Timeout is set on completion when the deadline passed with Active
+	//connections left
+	Timeout bool `json:"timeout,omitempty"`
+}
+
+type DrainHook func(DrainEvent)
+
+// DrainPolicy configures what happens around drains.
+type DrainPolicy struct {
+	//Hooks run in order on every event, e.g. to call a webhook. A drain
+	//waits for them, so they should be quick.
+	Hooks []DrainHook
+	//Timeout bounds drains whose context has no deadline, such as one
+	//started by signal; 0 waits for every connection
+	Timeout time.Duration
+}
+
+func WithDrainPolicy(policy DrainPolicy) Option {
+	return func(lb *LoadBalancer) {
+		lb.drainPolicy = policy
+	}
+}
+
+// drainState is the drain of the whole balancer.
+type drainState struct {
+	mu      sync.Mutex
+	started bool
+	//open are the connections there were when it started
+	open int64
+	//done is closed once the drain completed or gave up
+	done chan struct{}
+}
+
+func (lb *LoadBalancer) drainEvent(e DrainEvent) {
+	e.Time = lb.clock.Now()
+	for _, hook := range lb.drainPolicy.Hooks {
+		lb.safeCall("drain hook", func() error {
+			hook(e)
+			return nil
+		})
+	}
+}
+
+func (lb *LoadBalancer) drainContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); !ok && lb.drainPolicy.Timeout > 0 {
+		return context.WithTimeout(ctx, lb.drainPolicy.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// waitIdle polls active until it is 0 or ctx ends, and returns what is
+// left.
+func (lb *LoadBalancer) waitIdle(ctx context.Context, active func() int64) (int64, error) {
+	ticker := lb.clock.NewTicker(drainPoll)
+	defer ticker.Stop()
+
+	for {
+		n := active()
+		if n <= 0 {
+			return 0, nil
+		}
+		select {
+		case <-ctx.Done():
+			return n, ctx.Err()
+		case <-ticker.C():
+		}
+	}
+}
+
+// DrainBackend stops sending new connections to the backend at addr, in
+// every pool that has it, and waits until its open connections are done,
+// ctx ends or it is resumed. The backend keeps draining afterwards until
+// ResumeBackend.
+func (lb *LoadBalancer) DrainBackend(ctx context.Context, addr string) error {
+	backends, pools := backendsAt(lb.Pools(), addr)
+	if len(backends) == 0 {
+		return fmt.Errorf("unknown backend %s", addr)
+	}
+	return lb.drainBackends(ctx, addr, backends, pools)
+}
+
+// backendsAt returns the backends at addr and their pools' names.
+func backendsAt(pools []*Pool, addr string) ([]*Backend, []string) {
+	var backends []*Backend
+	var names []string
+	for _, p := range pools {
+		if b := p.Backend(addr); b != nil {
+			backends = append(backends, b)
+			names = append(names, p.name)
+		}
+	}
+	return backends, names
+}
+
+// RetireBackend drains the backend at addr and then removes it from the
+// pool, however the drain ended. It is how a reload takes backends out.
+// Resuming the backend meanwhile keeps it in the pool.
+func (p *Pool) RetireBackend(ctx context.Context, addr string) error {
+	b := p.Backend(addr)
+	if b == nil {
+		return fmt.Errorf("backend %s not in pool %s", addr, p.name)
+	}
+	err := p.lb.drainBackends(ctx, addr, []*Backend{b}, []string{p.name})
+	if !b.Draining() {
+		return nil
+	}
+	if rerr := p.RemoveBackend(addr); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (lb *LoadBalancer) drainBackends(ctx context.Context, addr string, backends []*Backend, pools []string) error {
+	//resumed backends no longer hold the drain up
+	active := func() int64 {
+		var n int64
+		for _, b := range backends {
+			if b.Draining() {
+				n += b.Load()
+			}
+		}
+		return n
+	}
+
+	for _, b := range backends {
+		b.SetDraining(true)
+	}
+	lb.log.Info("Draining backend", "backend", addr, "connections", active())
+	lb.drainEvent(DrainEvent{Event: DrainStarted, Backend: addr, Pools: pools, Active: active()})
+
+	ctx, cancel := lb.drainContext(ctx)
+	defer cancel()
+	left, err := lb.waitIdle(ctx, active)
+
+	if err != nil {
+		lb.log.Warn("Backend still has connections at the drain deadline", "backend", addr, "connections", left)
+	} else {
+		lb.log.Info("Backend drained", "backend", addr)
+	}
+	lb.drainEvent(DrainEvent{Event: DrainCompleted, Backend: addr, Pools: pools, Active: left, Timeout: err != nil})
+	return err
+}
+
+// ResumeBackend lets the backend at addr take new connections again.
+func (lb *LoadBalancer) ResumeBackend(addr string) error {
+	backends, pools := backendsAt(lb.Pools(), addr)
+	if len(backends) == 0 {
+		return fmt.Errorf("unknown backend %s", addr)
+	}
+	lb.resumeBackends(addr, backends, pools)
+	return nil
+}
+
+func (lb *LoadBalancer) resumeBackends(addr string, backends []*Backend, pools []string) {
+	for i, b := range backends {
+		if b.SetDraining(false) {
+			lb.log.Info("Backend no longer draining", "backend", addr, "pool", pools[i])
+		}
+	}
+}
+
+// Drain closes every listener, so that new clients go to another instance,
+// and waits until the connections in flight are done or ctx ends.
+// Listen and Serve return once it finished. A balancer drains only once.
+func (lb *LoadBalancer) Drain(ctx context.Context) error {
+	if err := lb.startDrain(); err != nil {
+		return err
+	}
+	defer close(lb.drain.done)
+	return lb.drainAll(ctx)
+}
+
+func (lb *LoadBalancer) startDrain() error {
+	d := &lb.drain
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.started {
+		return errAlreadyDraining
+	}
+	d.started = true
+	return nil
+}
+
+// drainAll is Drain without ending it, which is up to the caller.
+func (lb *LoadBalancer) drainAll(ctx context.Context) error {
+
+	for _, fe := range lb.frontendList() {
+		for _, ln := range fe.lns {
+			ln.Close()
+		}
+	}
+
+	active := func() int64 { return lb.counters.Snapshot().Active }
+	open := active()
+	lb.drain.mu.Lock()
+	lb.drain.open = open
+	lb.drain.mu.Unlock()
+	lb.log.Info("Draining, no longer accepting", "connections", open)
+	lb.drainEvent(DrainEvent{Event: DrainStarted, Active: open})
+
+	ctx, cancel := lb.drainContext(ctx)
+	defer cancel()
+	left, err := lb.waitIdle(ctx, active)
+
+	if err != nil {
+		lb.log.Warn("Connections still open at the drain deadline", "connections", left)
+	} else {
+		lb.log.Info("Drained")
+	}
+	lb.drainEvent(DrainEvent{Event: DrainCompleted, Active: left, Timeout: err != nil})
+	return err
+}
+
+// draining reports whether Drain has started.
+func (lb *LoadBalancer) draining() bool {
+	lb.drain.mu.Lock()
+	defer lb.drain.mu.Unlock()
+	return lb.drain.started
+}
+
+// drained is how an accept loop ends once Drain closed its listener: it
+// waits for the drain so that Listen returns when the connections are done.
+func (lb *LoadBalancer) drained(err error) bool {
+	if !errors.Is(err, net.ErrClosed) || !lb.draining() {
+		return false
+	}
+	<-lb.drain.done
+	return true
+}
@@ -0,0 +1,48 @@
+//go:build !nohttp
+
+package balancer
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"loadbalancer/balancer/edgeauth"
+	"loadbalancer/balancer/proxy"
+)
+
+// HeaderAuthUser carries the user or API key name authenticated at the edge.
+const HeaderAuthUser = "X-Auth-User"
+
+// authorizeEdge applies the route's basic-auth or API-key rule. It returns
+// a 401 response when the request is refused and nil otherwise.
+func authorizeEdge(p *edgeauth.Policy, req *http.Request, client string, log *slog.Logger) *http.Response {
+	if p == nil {
+		return nil
+	}
+
+	req.Header.Del(HeaderAuthUser)
+
+	rule := p.Match(req)
+	if rule == nil {
+		return nil
+	}
+
+	name, ok := p.Authenticate(rule, req)
+	if !ok {
+		log.Info("Rejected request, missing or invalid credentials", "client", client, "method", req.Method, "path", req.URL.Path)
+
+		resp := proxy.TextResponse(req, http.StatusUnauthorized, "Unauthorized\n")
+		if rule.Basic {
+			realm := rule.Realm
+			if realm == "" {
+				realm = "restricted"
+			}
+			resp.Header.Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+		}
+		return resp
+	}
+
+	req.Header.Set(HeaderAuthUser, name)
+	return nil
+}
@@ -0,0 +1,148 @@
+package edgeauth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"loadbalancer/balancer/secrets"
+)
+
+// Credentials is a parsed credentials file. Each non-empty line is
+//
+//	user <name> <password>
+//	key  <name> <api-key>
+//
+// where the secret is either plain text or "sha256:" followed by the hex
+// digest, so files can be committed without the secrets themselves.
+type Credentials struct {
+	users map[string][]byte
+	//keys maps the digest of an API key to its name
+	keys map[string]string
+}
+
+func ParseCredentials(data []byte) (*Credentials, error) {
+	c := &Credentials{users: make(map[string][]byte), keys: make(map[string]string)}
+
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: want <user|key> <name> <secret>", n)
+		}
+		digest, err := parseSecret(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		switch fields[0] {
+		case "user":
+			c.users[fields[1]] = digest
+		case "key":
+			c.keys[string(digest)] = fields[1]
+		default:
+			return nil, fmt.Errorf("line %d: unknown kind %q", n, fields[0])
+		}
+	}
+	return c, sc.Err()
+}
+
+func parseSecret(s string) ([]byte, error) {
+	if hexDigest, ok := strings.CutPrefix(s, "sha256:"); ok {
+		digest, err := hex.DecodeString(hexDigest)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("invalid sha256 digest")
+		}
+		return digest, nil
+	}
+	sum := sha256.Sum256([]byte(s))
+	return sum[:], nil
+}
+
+// CheckUser reports whether password is correct for user.
+func (c *Credentials) CheckUser(user, password string) bool {
+	want, ok := c.users[user]
+	sum := sha256.Sum256([]byte(password))
+	//compare even for unknown users so timing does not reveal them
+	if !ok {
+		want = make([]byte, sha256.Size)
+	}
+	return subtle.ConstantTimeCompare(want, sum[:]) == 1 && ok
+}
+
+// CheckKey returns the name of the API key, if it is known.
+func (c *Credentials) CheckKey(key string) (string, bool) {
+	sum := sha256.Sum256([]byte(key))
+	name, ok := c.keys[string(sum[:])]
+	return name, ok
+}
+
+// Store holds the current credentials of a file and swaps them when the
+// secret behind it changes. A file that fails to parse keeps the previous
+// credentials in place.
+type Store struct {
+	current atomic.Pointer[Credentials]
+}
+
+func NewStore(file *secrets.Secret) (*Store, error) {
+	creds, err := ParseCredentials(file.Value())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	s := &Store{}
+	s.current.Store(creds)
+
+	file.OnChange(func(v []byte) {
+		creds, err := ParseCredentials(v)
+		if err != nil {
+			file.Logger().Warn("Credentials reload failed, keeping previous", "error", err)
+			return
+		}
+		s.current.Store(creds)
+	})
+	return s, nil
+}
+
+func (s *Store) Credentials() *Credentials {
+	return s.current.Load()
+}
+
+// Rule protects requests matching Host and PathPrefix. At least one of
+// Basic and APIKey should be set; either credential is accepted then.
+type Rule struct {
+	//Host matches the request host without port; empty matches any host
+	Host string
+	//PathPrefix matches whole segments of the cleaned path: "/admin"
+	//covers "/admin/x" and "/x/../admin" but not "/administrator"
+	PathPrefix string
+
+	Basic bool
+	//Realm is shown in the browser's login prompt
+	Realm string
+
+	APIKey bool
+	//Header carries the API key, default X-Api-Key
+	Header string
+
+	//Users restricts the rule to some names from the file; empty allows all
+	Users []string
+}
+
+// Policy is an ordered list of rules sharing one credentials store. The
+// rule with the longest matching PathPrefix applies; requests that match
+// no rule are let through.
+type Policy struct {
+	Store *Store
+	Rules []Rule
+}
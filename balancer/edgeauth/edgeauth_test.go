@@ -0,0 +1,76 @@
+package edgeauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func digest(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestParseCredentialsErrors(t *testing.T) {
+	for _, tt := range []struct{ file, want string }{
+		{"user alice", "line 1: want <user|key> <name> <secret>"},
+		{"user alice secret extra", "line 1: want"},
+		{"# comment\n\nuser alice a b", "line 3: want"},
+		{"admin alice secret", `line 1: unknown kind "admin"`},
+		{"user alice sha256:zz", "line 1: invalid sha256 digest"},
+		{"user alice sha256:abcd", "line 1: invalid sha256 digest"},
+		{"user alice sha256:", "line 1: invalid sha256 digest"},
+		{"key ci " + digest("k") + "00", "line 1: invalid sha256 digest"},
+	} {
+		_, err := ParseCredentials([]byte(tt.file))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.file, err, tt.want)
+		}
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	c, err := ParseCredentials([]byte(strings.Join([]string{
+		"# operators",
+		"user alice wonderland",
+		"  user bob " + digest("builder") + "  ",
+		"key ci ci-key-1",
+		"key deploy " + digest("deploy-key"),
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		user, password string
+		want           bool
+	}{
+		{"alice", "wonderland", true},
+		{"alice", "Wonderland", false},
+		{"alice", "", false},
+		{"bob", "builder", true},
+		//a digest is not the password
+		{"bob", digest("builder"), false},
+		{"mallory", "wonderland", false},
+		{"", "", false},
+		//keys are not users
+		{"ci", "ci-key-1", false},
+	} {
+		if got := c.CheckUser(tt.user, tt.password); got != tt.want {
+			t.Errorf("CheckUser(%q, %q) = %v", tt.user, tt.password, got)
+		}
+	}
+
+	for key, want := range map[string]string{
+		"ci-key-1":           "ci",
+		"deploy-key":         "deploy",
+		digest("deploy-key"): "",
+		"wonderland":         "",
+		"":                   "",
+	} {
+		if name, ok := c.CheckKey(key); name != want || ok != (want != "") {
+			t.Errorf("CheckKey(%q) = %q, %v, want %q", key, name, ok, want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+//go:build !nohttp
+
+package edgeauth
+
+import (
+	"net"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+)
+
+func (r *Rule) matches(req *http.Request) bool {
+	if r.Host != "" {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !strings.EqualFold(host, r.Host) {
+			return false
+		}
+	}
+	return underPrefix(req.URL.Path, r.PathPrefix)
+}
+
+// underPrefix reports whether the cleaned p is prefix or below it, so that
+// "/x/../admin" and "//admin" fall under "/admin" but "/administrator"
+// does not.
+func underPrefix(p, prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+	p, prefix = path.Clean("/"+p), path.Clean("/"+prefix)
+	rest, ok := strings.CutPrefix(p, prefix)
+	return ok && (rest == "" || rest[0] == '/' || prefix == "/")
+}
+
+func (r *Rule) keyHeader() string {
+	if r.Header == "" {
+		return "X-Api-Key"
+	}
+	return r.Header
+}
+
+// Match returns the rule for req, or nil.
+func (p *Policy) Match(req *http.Request) *Rule {
+	var best *Rule
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.matches(req) && (best == nil || len(r.PathPrefix) > len(best.PathPrefix)) {
+			best = r
+		}
+	}
+	return best
+}
+
+// Authenticate checks the credentials on req against rule and returns the
+// authenticated name. The credential is removed from the request so it is
+// not forwarded to the backend.
+func (p *Policy) Authenticate(rule *Rule, req *http.Request) (string, bool) {
+	creds := p.Store.Credentials()
+
+	name, ok := "", false
+	if rule.APIKey {
+		if key := req.Header.Get(rule.keyHeader()); key != "" {
+			name, ok = creds.CheckKey(key)
+		}
+	}
+	if !ok && rule.Basic {
+		if user, password, found := req.BasicAuth(); found && creds.CheckUser(user, password) {
+			name, ok = user, true
+		}
+	}
+
+	if !ok || (len(rule.Users) > 0 && !slices.Contains(rule.Users, name)) {
+		return "", false
+	}
+
+	if rule.APIKey {
+		req.Header.Del(rule.keyHeader())
+	}
+	if rule.Basic {
+		req.Header.Del("Authorization")
+	}
+	return name, true
+}
@@ -0,0 +1,115 @@
+//go:build !nohttp
+
+package edgeauth
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRuleMatches(t *testing.T) {
+	for _, tt := range []struct {
+		host, prefix string
+		url          string
+		want         bool
+	}{
+		{"", "/admin", "/admin", true},
+		{"", "/admin", "/admin/", true},
+		{"", "/admin", "/admin/users", true},
+		{"", "/admin", "/administrator", false},
+		{"", "/admin", "/x/../admin", true},
+		{"", "/admin", "//admin", true},
+		{"", "/admin", "/./admin/x", true},
+		{"", "/admin", "/admin/../public", false},
+		{"", "/admin", "/%61dmin", true},
+		{"", "/admin", "/public", false},
+		{"", "/admin/", "/admin", true},
+		{"", "/admin/", "/adminx", false},
+		{"", "/", "/anything", true},
+		{"", "", "/anything", true},
+		{"api.example.com", "", "http://api.example.com:8080/x", true},
+		{"api.example.com", "", "http://API.example.com/x", true},
+		{"api.example.com", "", "http://www.example.com/x", false},
+		{"api.example.com", "/admin", "http://api.example.com/administrator", false},
+	} {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		r := Rule{Host: tt.host, PathPrefix: tt.prefix}
+		if got := r.matches(req); got != tt.want {
+			t.Errorf("host %q prefix %q, %s: %v, want %v", tt.host, tt.prefix, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyMatchLongest(t *testing.T) {
+	p := &Policy{Rules: []Rule{{PathPrefix: "/"}, {PathPrefix: "/api/admin"}, {PathPrefix: "/api"}}}
+	for url, want := range map[string]string{
+		"/":                "/",
+		"/api":             "/api",
+		"/api/users":       "/api",
+		"/api/admin/x":     "/api/admin",
+		"/api/administer":  "/api",
+		"/api/x/../admin/": "/api/admin",
+	} {
+		if got := p.Match(httptest.NewRequest("GET", url, nil)); got == nil || got.PathPrefix != want {
+			t.Errorf("%s: matched %v, want %s", url, got, want)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	creds, err := ParseCredentials([]byte("user alice wonderland\nuser bob builder\nkey ci ci-key-1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &Store{}
+	store.current.Store(creds)
+	p := &Policy{Store: store}
+
+	basic := Rule{Basic: true}
+	key := Rule{APIKey: true}
+	either := Rule{Basic: true, APIKey: true, Header: "X-Token"}
+	onlyBob := Rule{Basic: true, Users: []string{"bob"}}
+
+	for _, tt := range []struct {
+		name      string
+		rule      Rule
+		user      string
+		password  string
+		header    string
+		key       string
+		want      string
+		forwarded bool
+	}{
+		{"basic", basic, "alice", "wonderland", "", "", "alice", false},
+		{"basic wrong password", basic, "alice", "builder", "", "", "", true},
+		{"basic unknown user", basic, "mallory", "wonderland", "", "", "", true},
+		{"basic without credentials", basic, "", "", "", "", "", false},
+		{"key on a basic rule", basic, "", "", "X-Api-Key", "ci-key-1", "", true},
+		{"key", key, "", "", "X-Api-Key", "ci-key-1", "ci", false},
+		{"wrong key", key, "", "", "X-Api-Key", "nope", "", true},
+		{"key in another header", key, "", "", "X-Token", "ci-key-1", "", true},
+		{"basic on a key rule", key, "alice", "wonderland", "", "", "", true},
+		{"either by key", either, "", "", "X-Token", "ci-key-1", "ci", false},
+		{"either falls back to basic", either, "alice", "wonderland", "X-Token", "nope", "alice", false},
+		{"user allowed", onlyBob, "bob", "builder", "", "", "bob", false},
+		{"user not allowed", onlyBob, "alice", "wonderland", "", "", "", true},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.password)
+		}
+		if tt.header != "" {
+			req.Header.Set(tt.header, tt.key)
+		}
+
+		name, ok := p.Authenticate(&tt.rule, req)
+		if name != tt.want || ok != (tt.want != "") {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, name, ok, tt.want)
+		}
+		//credentials are stripped once accepted, left alone when refused
+		forwarded := req.Header.Get("Authorization") != "" || (tt.header != "" && req.Header.Get(tt.header) != "")
+		if forwarded != tt.forwarded {
+			t.Errorf("%s: credentials forwarded %v, want %v", tt.name, forwarded, tt.forwarded)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package election
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/logging"
+)
+
+// Backend is a leader election mechanism shared by the instances of a
+// pair.
+type Backend interface {
+	//Acquire takes or renews leadership for ttl and reports whether id holds it
+	Acquire(id string, ttl time.Duration) (bool, error)
+	//Release gives leadership up early so the standby takes over at once
+	Release(id string) error
+}
+
+// Election keeps campaigning through a Backend and tracks whether this
+// instance is the leader.
+type Election struct {
+	backend  Backend
+	id       string
+	ttl      time.Duration
+	interval time.Duration
+	clock    clock.Clock
+	//log is logging.Default unless SetLogger changed it
+	log *slog.Logger
+
+	mu       sync.Mutex
+	leader   bool
+	renewed  time.Time
+	changed  chan struct{}
+	hooks    []func(leader bool)
+	resigned bool
+	//stop is closed by Resign to end Run
+	stop chan struct{}
+}
+
+// New creates an election for instance id. Leadership is renewed every
+// third of ttl, so a standby takes over at most ttl plus that interval
+// after the leader dies.
+func New(backend Backend, id string, ttl time.Duration, c clock.Clock) *Election {
+	if id == "" {
+		id, _ = os.Hostname()
+	}
+	if ttl <= 0 {
+		ttl = 10 * time.Second
+	}
+	return &Election{
+		backend:  backend,
+		id:       id,
+		ttl:      ttl,
+		interval: ttl / 3,
+		clock:    c,
+		log:      logging.Default(),
+		changed:  make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+}
+
+func (e *Election) ID() string { return e.id }
+
+// SetLogger sends what the election and its listeners log to l; call it
+// before Run and Listen.
+func (e *Election) SetLogger(l *slog.Logger) {
+	e.log = l
+}
+
+// OnChange registers fn to run on every transition, e.g. to move a VIP.
+func (e *Election) OnChange(fn func(leader bool)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.hooks = append(e.hooks, fn)
+}
+
+// Leader reports whether this instance currently leads.
+func (e *Election) Leader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// Wait returns the current state and a channel that is closed on the next
+// transition.
+func (e *Election) Wait() (bool, <-chan struct{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader, e.changed
+}
+
+// Run campaigns until Resign is called.
+func (e *Election) Run() {
+	for {
+		ok, err := e.backend.Acquire(e.id, e.ttl)
+		now := e.clock.Now()
+
+		e.mu.Lock()
+		if e.resigned {
+			e.mu.Unlock()
+			//Resign came in while the lease was being taken
+			if ok {
+				e.backend.Release(e.id)
+			}
+			return
+		}
+		switch {
+		case err != nil:
+			e.log.Warn("Leader election failed", "error", err)
+			//the lease could not be renewed; step down before it can lapse
+			//and be taken by the standby
+			if e.leader && now.Sub(e.renewed) >= e.ttl-e.interval {
+				e.setLocked(false)
+			}
+		case ok:
+			e.renewed = now
+			e.setLocked(true)
+		default:
+			e.setLocked(false)
+		}
+		e.mu.Unlock()
+
+		select {
+		case <-e.stop:
+			return
+		case <-e.clock.After(e.interval):
+		}
+	}
+}
+
+// Resign stops campaigning and releases leadership if held.
+func (e *Election) Resign() error {
+	e.mu.Lock()
+	if !e.resigned {
+		e.resigned = true
+		close(e.stop)
+	}
+	wasLeader := e.leader
+	e.setLocked(false)
+	e.mu.Unlock()
+
+	if !wasLeader {
+		return nil
+	}
+	return e.backend.Release(e.id)
+}
+
+func (e *Election) setLocked(leader bool) {
+	if e.leader == leader {
+		return
+	}
+	e.leader = leader
+
+	if leader {
+		e.log.Info("Leader election: now the LEADER", "id", e.id)
+	} else {
+		e.log.Info("Leader election: now PASSIVE", "id", e.id)
+	}
+
+	close(e.changed)
+	e.changed = make(chan struct{})
+
+	for _, fn := range e.hooks {
+		go fn(leader)
+	}
+}
+
+// Exec returns a hook running onElected or onDemoted as commands, the way
+// keepalived notify scripts are used to move addresses around. Commands
+// that fail are logged to log, logging.Default if nil.
+func Exec(onElected, onDemoted []string, log *slog.Logger) func(leader bool) {
+	if log == nil {
+		log = logging.Default()
+	}
+	return func(leader bool) {
+		argv := onDemoted
+		if leader {
+			argv = onElected
+		}
+		if len(argv) == 0 {
+			return
+		}
+
+		out, err := exec.Command(argv[0], argv[1:]...).CombinedOutput()
+		if err != nil {
+			log.Warn("Leader election hook failed", "hook", strings.Join(argv, " "), "error", err, "output", string(out))
+		}
+	}
+}
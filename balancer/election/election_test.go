@@ -0,0 +1,139 @@
+package election
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"loadbalancer/balancer/clock"
+)
+
+// memory is a Backend that grants the lease to whoever asks first.
+type memory struct {
+	mu       sync.Mutex
+	holder   string
+	acquired atomic.Int32
+}
+
+func (m *memory) Acquire(id string, ttl time.Duration) (bool, error) {
+	m.acquired.Add(1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.holder == "" {
+		m.holder = id
+	}
+	return m.holder == id, nil
+}
+
+func (m *memory) Release(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.holder == id {
+		m.holder = ""
+	}
+	return nil
+}
+
+func TestResignStopsRun(t *testing.T) {
+	f := clock.NewFake(time.Unix(0, 0))
+	b := &memory{}
+	e := New(b, "a", 3*time.Second, f)
+
+	done := make(chan struct{})
+	go func() {
+		e.Run()
+		close(done)
+	}()
+	for !e.Leader() || f.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := e.Resign(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run still campaigning after Resign")
+	}
+
+	n := b.acquired.Load()
+	f.Advance(time.Minute)
+	if e.Leader() || b.holder != "" || b.acquired.Load() != n {
+		t.Errorf("after Resign: leader %v, holder %q, %d acquires more", e.Leader(), b.holder, b.acquired.Load()-n)
+	}
+}
+
+func TestLeaseFile(t *testing.T) {
+	f := clock.NewFake(time.Unix(1000, 0))
+	path := filepath.Join(t.TempDir(), "lease")
+	a := &LeaseFile{Path: path, Clock: f}
+	b := &LeaseFile{Path: path, Clock: f}
+
+	for i, step := range []struct {
+		lf      *LeaseFile
+		id      string
+		advance time.Duration
+		want    bool
+	}{
+		{a, "a", 0, true},
+		{b, "b", 0, false},
+		{a, "a", 5 * time.Second, true}, //renewed
+		{b, "b", 9 * time.Second, false},
+		{b, "b", 2 * time.Second, true}, //lapsed
+		{a, "a", 0, false},
+	} {
+		f.Advance(step.advance)
+		got, err := step.lf.Acquire(step.id, 10*time.Second)
+		if err != nil || got != step.want {
+			t.Errorf("step %d: %s got %v, %v, want %v", i, step.id, got, err, step.want)
+		}
+	}
+
+	if err := a.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := a.Acquire("a", 10*time.Second); ok {
+		t.Error("a released b's lease")
+	}
+	if err := b.Release("b"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := a.Acquire("a", 10*time.Second); !ok {
+		t.Error("released lease not taken")
+	}
+}
+
+func TestLeaseFileRace(t *testing.T) {
+	f := clock.NewFake(time.Unix(1000, 0))
+	path := filepath.Join(t.TempDir(), "lease")
+
+	for round := range 20 {
+		//every round starts from a lapsed lease
+		f.Advance(time.Minute)
+
+		var winners atomic.Int32
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for i := range 8 {
+			lf := &LeaseFile{Path: path, Clock: f}
+			id := fmt.Sprintf("node%d", i)
+			wg.Go(func() {
+				<-start
+				if ok, err := lf.Acquire(id, 10*time.Second); err != nil {
+					t.Error(err)
+				} else if ok {
+					winners.Add(1)
+				}
+			})
+		}
+		close(start)
+		wg.Wait()
+		if n := winners.Load(); n > 1 {
+			t.Errorf("round %d: %d instances lead", round, n)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+//go:build !nohttp
+
+package election
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Etcd elects through a key attached to an etcd lease, using the v3 JSON
+// gateway so no client library is needed. The key is created only if it
+// does not exist, and disappears with the lease when the leader stops
+// renewing it.
+type Etcd struct {
+	//Endpoints are tried in order, e.g. "http://etcd-1:2379"
+	Endpoints []string
+	Key       string
+	HTTP      *http.Client
+
+	mu    sync.Mutex
+	lease string
+}
+
+func (e *Etcd) Acquire(id string, ttl time.Duration) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.lease != "" {
+		var resp struct {
+			Result struct {
+				TTL string `json:"TTL"`
+			} `json:"result"`
+		}
+		if err := e.call("/v3/lease/keepalive", map[string]string{"ID": e.lease}, &resp); err != nil {
+			return false, err
+		}
+		if left, _ := strconv.Atoi(resp.Result.TTL); left > 0 {
+			return true, nil
+		}
+		//the lease expired, and the key with it
+		e.lease = ""
+	}
+
+	var grant struct {
+		ID string `json:"ID"`
+	}
+	seconds := max(1, int(ttl.Seconds()))
+	if err := e.call("/v3/lease/grant", map[string]int{"TTL": seconds}, &grant); err != nil {
+		return false, err
+	}
+
+	key := base64.StdEncoding.EncodeToString([]byte(e.Key))
+	txn := map[string]any{
+		"compare": []map[string]string{{
+			"key": key, "target": "CREATE", "result": "EQUAL", "create_revision": "0",
+		}},
+		"success": []map[string]any{{
+			"request_put": map[string]string{
+				"key":   key,
+				"value": base64.StdEncoding.EncodeToString([]byte(id)),
+				"lease": grant.ID,
+			},
+		}},
+	}
+	var result struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := e.call("/v3/kv/txn", txn, &result); err != nil {
+		return false, err
+	}
+
+	if !result.Succeeded {
+		e.call("/v3/lease/revoke", map[string]string{"ID": grant.ID}, nil)
+		return false, nil
+	}
+	e.lease = grant.ID
+	return true, nil
+}
+
+func (e *Etcd) Release(string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.lease == "" {
+		return nil
+	}
+	err := e.call("/v3/lease/revoke", map[string]string{"ID": e.lease}, nil)
+	e.lease = ""
+	return err
+}
+
+func (e *Etcd) call(path string, body, out any) error {
+	if len(e.Endpoints) == 0 {
+		return errors.New("etcd: no endpoints")
+	}
+
+	client := e.HTTP
+	if client == nil {
+		client = &http.Client{Timeout: 2 * time.Second}
+	}
+	payload, _ := json.Marshal(body)
+
+	var lastErr error
+	for _, endpoint := range e.Endpoints {
+		resp, err := client.Post(endpoint+path, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("etcd %s: %s: %s", path, resp.Status, bytes.TrimSpace(data))
+			continue
+		}
+
+		if out == nil {
+			return nil
+		}
+		return json.Unmarshal(data, out)
+	}
+	return lastErr
+}
@@ -0,0 +1,143 @@
+package election
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"loadbalancer/balancer/clock"
+)
+
+// LeaseFile elects through a file on storage both instances see, such as
+// an NFS mount. The holder rewrites it before the lease expires; a standby
+// takes it over once it has lapsed. Writers take turns through a lock file
+// created exclusively next to it, and write only if the lease is still the
+// one they read, by its token; writes are atomic renames. Clocks must be
+// roughly in sync. Use Etcd when that is not good enough.
+type LeaseFile struct {
+	Path  string
+	Clock clock.Clock
+}
+
+type lease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+	//Token is new with every write
+	Token string `json:"token"`
+}
+
+func (f *LeaseFile) read() (lease, error) {
+	var l lease
+	data, err := os.ReadFile(f.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return l, err
+	}
+	if err := json.Unmarshal(data, &l); err != nil {
+		//a torn or foreign file counts as no lease
+		return lease{}, nil
+	}
+	return l, nil
+}
+
+func (f *LeaseFile) Acquire(id string, ttl time.Duration) (bool, error) {
+	current, err := f.read()
+	if err != nil {
+		return false, err
+	}
+
+	now := f.Clock.Now()
+	if current.Holder != id && now.Before(current.Expires) {
+		return false, nil
+	}
+
+	unlock, err := f.lock(ttl)
+	if errors.Is(err, fs.ErrExist) {
+		//the other instance is writing; it wins this round
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	//a write since the read above was the other instance's
+	if again, err := f.read(); err != nil || again.Token != current.Token {
+		return false, err
+	}
+
+	data, _ := json.Marshal(lease{Holder: id, Expires: now.Add(ttl), Token: newToken()})
+	tmp := filepath.Join(filepath.Dir(f.Path), "."+filepath.Base(f.Path)+"."+sanitize(id))
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, f.Path); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, nil
+}
+
+func (f *LeaseFile) Release(id string) error {
+	unlock, err := f.lock(0)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := f.read()
+	if err != nil || current.Holder != id {
+		return err
+	}
+	return os.Remove(f.Path)
+}
+
+// lock creates the lock file, or reports fs.ErrExist while another writer
+// holds it. A lock older than stale, left by a writer that died holding
+// it, is taken over; zero never does.
+func (f *LeaseFile) lock(stale time.Duration) (func(), error) {
+	path := f.Path + ".lock"
+	create := func() error {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			file.Close()
+		}
+		return err
+	}
+
+	err := create()
+	if errors.Is(err, fs.ErrExist) && stale > 0 {
+		//file times come from the storage, so this is wall-clock time
+		if info, serr := os.Stat(path); serr == nil && time.Since(info.ModTime()) > stale {
+			os.Remove(path)
+			err = create()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return func() { os.Remove(path) }, nil
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func sanitize(id string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, id)
+}
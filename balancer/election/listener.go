@@ -0,0 +1,139 @@
+package election
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Listener binds address only while the election is won and closes the
+// socket when leadership is lost, so a passive instance neither accepts nor
+// advertises. Connections accepted as leader are left to finish.
+type Listener struct {
+	network, address string
+	log              *slog.Logger
+
+	mu     sync.Mutex
+	ln     net.Listener
+	bound  chan struct{}
+	closed bool
+}
+
+// Listen returns a Listener following e. It can be passed to
+// LoadBalancer.Serve.
+func Listen(e *Election, network, address string) *Listener {
+	l := &Listener{network: network, address: address, log: e.log, bound: make(chan struct{})}
+	go l.follow(e)
+	return l
+}
+
+func (l *Listener) follow(e *Election) {
+	for !l.isClosed() {
+		leader, changed := e.Wait()
+		if l.sync(leader) {
+			<-changed
+			continue
+		}
+
+		//bind failed as leader; retry until it works or the state moves on
+		select {
+		case <-changed:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (l *Listener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// sync binds or unbinds to match leader and reports whether it succeeded.
+func (l *Listener) sync(leader bool) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return true
+	}
+
+	switch {
+	case leader && l.ln == nil:
+		ln, err := net.Listen(l.network, l.address)
+		if err != nil {
+			l.log.Warn("Leader election: binding failed", "address", l.address, "error", err)
+			return false
+		}
+		l.ln = ln
+		close(l.bound)
+
+	case !leader && l.ln != nil:
+		l.ln.Close()
+		l.ln = nil
+		l.bound = make(chan struct{})
+	}
+	return true
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		l.mu.Lock()
+		ln, bound, closed := l.ln, l.bound, l.closed
+		l.mu.Unlock()
+
+		if closed {
+			return nil, net.ErrClosed
+		}
+		if ln == nil {
+			<-bound
+			continue
+		}
+
+		conn, err := ln.Accept()
+		if err == nil {
+			return conn, nil
+		}
+
+		//closed under us by a demotion: wait to be elected again
+		l.mu.Lock()
+		demoted := l.ln != ln
+		l.mu.Unlock()
+		if !demoted {
+			return nil, err
+		}
+	}
+}
+
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+
+	if l.ln != nil {
+		l.ln.Close()
+		l.ln = nil
+	} else {
+		close(l.bound)
+	}
+	return nil
+}
+
+// Addr returns the bound address, or the configured one while passive.
+func (l *Listener) Addr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.ln != nil {
+		return l.ln.Addr()
+	}
+	if addr, err := net.ResolveTCPAddr(l.network, l.address); err == nil {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
@@ -0,0 +1,33 @@
+package election
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// StateFile follows an election run by someone else, typically keepalived
+// with VRRP. Its notify script writes the state it enters into Path:
+//
+//	notify "/bin/sh -c 'echo $3 > /run/lb/vrrp-state'"
+//
+// This instance leads while the file says MASTER.
+type StateFile struct {
+	Path string
+}
+
+func (s StateFile) Acquire(string, time.Duration) (bool, error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(data)) == "MASTER", nil
+}
+
+// Release does nothing; keepalived decides when to fail over.
+func (s StateFile) Release(string) error { return nil }
@@ -0,0 +1,77 @@
+package balancer
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"loadbalancer/balancer/audit"
+)
+
+// DefaultFilterBudget is how long an accept filter may take by default.
+const DefaultFilterBudget = 10 * time.Millisecond
+
+// AcceptFilter runs right after accept on the raw connection, before any
+// adapter, handshake or backend work, and refuses the connection by
+// returning an error. It may look at the socket, e.g. through SyscallConn
+// for an eBPF map lookup, but must not read or write, as the bytes would
+// be lost to the rest of the chain.
+type AcceptFilter func(conn net.Conn) error
+
+type filterResult struct {
+	err      error
+	panicked bool
+}
+
+// filterConn runs the listener's accept filter within its budget. A filter
+// that overruns or panics lets the connection in only when the listener
+// fails open; the accept loop never waits longer than the budget.
+func (lb *LoadBalancer) filterConn(fe *frontend, conn net.Conn) bool {
+	filter := fe.cfg.AcceptFilter
+	if filter == nil {
+		return true
+	}
+
+	budget := fe.cfg.FilterBudget
+	if budget <= 0 {
+		budget = DefaultFilterBudget
+	}
+
+	done := make(chan filterResult, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				lb.logPanic("accept filter", r)
+				done <- filterResult{panicked: true}
+			}
+		}()
+		done <- filterResult{err: filter(conn)}
+	}()
+
+	timer := lb.clock.NewTimer(budget)
+	defer timer.Stop()
+
+	var reason string
+	select {
+	case r := <-done:
+		if !r.panicked {
+			if r.err != nil {
+				fe.filtered.Add(1)
+				lb.reject(fe, conn.RemoteAddr(), audit.KindFilter, r.err.Error())
+				return false
+			}
+			return true
+		}
+		reason = "accept filter panicked"
+	case <-timer.C():
+		fe.filterTimeouts.Add(1)
+		reason = fmt.Sprintf("accept filter over its %s budget", budget)
+	}
+
+	if fe.cfg.FilterFailOpen {
+		return true
+	}
+	fe.filtered.Add(1)
+	lb.reject(fe, conn.RemoteAddr(), audit.KindFilter, reason)
+	return false
+}
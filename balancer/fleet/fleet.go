@@ -0,0 +1,325 @@
+package fleet
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/logging"
+)
+
+const (
+	DefaultInterval = 10 * time.Second
+	//DefaultExpiry drops instances that missed three pushes
+	DefaultExpiry = 3 * DefaultInterval
+
+	//maxSummary bounds one line of the protocol
+	maxSummary = 4 << 20
+)
+
+// Summary is what one instance reports about itself.
+type Summary struct {
+	Instance string    `json:"instance"`
+	Sent     time.Time `json:"sent"`
+	Accepted uint64    `json:"accepted"`
+	Active   int64     `json:"active"`
+	Failed   uint64    `json:"failed"`
+	BytesIn  uint64    `json:"bytes_in"`
+	BytesOut uint64    `json:"bytes_out"`
+	Backends []Backend `json:"backends"`
+}
+
+// Backend is one backend as an instance sees it.
+type Backend struct {
+	Pool        string `json:"pool"`
+	Addr        string `json:"addr"`
+	Healthy     bool   `json:"healthy"`
+	Active      int64  `json:"active"`
+	Connections uint64 `json:"connections"`
+	Failed      uint64 `json:"failed"`
+}
+
+// View is the fleet as the aggregator last heard from it.
+type View struct {
+	Instances []Instance
+	//Backends add up what every instance reported, by pool and address
+	Backends []BackendTotal
+
+	Accepted uint64
+	Active   int64
+	Failed   uint64
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+type Instance struct {
+	Name     string
+	Received time.Time
+	//Local is the aggregating instance itself
+	Local bool
+	Summary
+}
+
+type BackendTotal struct {
+	Pool        string
+	Addr        string
+	Active      int64
+	Connections uint64
+	Failed      uint64
+	//Reporting instances know the backend, HealthyOn of them see it healthy
+	Reporting int
+	HealthyOn int
+}
+
+// Aggregator keeps the latest summary of every instance, its own included.
+// Instances that stop reporting drop out after the expiry. Summaries served
+// from peers carry an HMAC of the shared secret; unsigned ones are dropped.
+// Without a secret summaries only come from AddLocal and Add.
+type Aggregator struct {
+	clock  clock.Clock
+	expiry time.Duration
+	secret []byte
+	//log is logging.Default unless SetLogger changed it
+	log *slog.Logger
+
+	mu        sync.Mutex
+	instances map[string]Instance
+}
+
+func NewAggregator(c clock.Clock, expiry time.Duration, secret []byte) (*Aggregator, error) {
+	if expiry <= 0 {
+		expiry = DefaultExpiry
+	}
+	return &Aggregator{
+		clock:     c,
+		expiry:    expiry,
+		secret:    secret,
+		log:       logging.Default(),
+		instances: make(map[string]Instance),
+	}, nil
+}
+
+// SetLogger sends what the aggregator logs to l; call it before Serve.
+func (a *Aggregator) SetLogger(l *slog.Logger) {
+	a.log = l
+}
+
+// AddLocal records the aggregating instance's own summary.
+func (a *Aggregator) AddLocal(s Summary) {
+	a.put(s, true)
+}
+
+// Add records a peer's summary that arrived authenticated some other way,
+// such as over the peer protocol.
+func (a *Aggregator) Add(s Summary) {
+	a.put(s, false)
+}
+
+func (a *Aggregator) put(s Summary, local bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.instances[s.Instance] = Instance{Name: s.Instance, Received: a.clock.Now(), Local: local, Summary: s}
+}
+
+// Serve reads summaries from peers on ln, one signed JSON object per line.
+// A peer may keep its connection open and push on it again. It returns
+// when ln is closed.
+func (a *Aggregator) Serve(ln net.Listener) error {
+	if len(a.secret) == 0 {
+		return errors.New("fleet: a shared secret is required")
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go a.serveConn(conn)
+	}
+}
+
+func (a *Aggregator) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, maxSummary)
+	warned := false
+	for {
+		//an idle peer is given up on once it missed its pushes
+		conn.SetReadDeadline(time.Now().Add(a.expiry))
+		if !scanner.Scan() {
+			return
+		}
+		s, err := open(a.secret, scanner.Bytes())
+		if err != nil {
+			//a misconfigured peer keeps pushing, so it is reported once per
+			//connection
+			if !warned {
+				a.log.Warn("Dropping fleet summaries", "peer", conn.RemoteAddr().String(), "error", err)
+				warned = true
+			}
+			continue
+		}
+		a.put(s, false)
+	}
+}
+
+// seal signs the summary as one line: the hex HMAC, a space and the JSON.
+func seal(secret []byte, s Summary) ([]byte, error) {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+
+	line := hex.AppendEncode(nil, mac.Sum(nil))
+	line = append(line, ' ')
+	line = append(line, payload...)
+	return append(line, '\n'), nil
+}
+
+func open(secret []byte, line []byte) (Summary, error) {
+	var s Summary
+	sum, payload, ok := bytes.Cut(line, []byte(" "))
+	if !ok {
+		return s, errors.New("malformed line")
+	}
+	want, err := hex.DecodeString(string(sum))
+	if err != nil {
+		return s, errors.New("malformed line")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	if !hmac.Equal(want, mac.Sum(nil)) {
+		return s, errors.New("bad signature")
+	}
+	if err := json.Unmarshal(payload, &s); err != nil {
+		return s, err
+	}
+	if s.Instance == "" {
+		return s, errors.New("summary without instance name")
+	}
+	return s, nil
+}
+
+// View returns the instances heard from within the expiry and their totals.
+func (a *Aggregator) View() View {
+	now := a.clock.Now()
+
+	a.mu.Lock()
+	var view View
+	for name, in := range a.instances {
+		if now.Sub(in.Received) > a.expiry {
+			delete(a.instances, name)
+			continue
+		}
+		view.Instances = append(view.Instances, in)
+	}
+	a.mu.Unlock()
+
+	slices.SortFunc(view.Instances, func(x, y Instance) int { return strings.Compare(x.Name, y.Name) })
+
+	type key struct{ pool, addr string }
+	totals := make(map[key]*BackendTotal)
+	var order []key
+	for _, in := range view.Instances {
+		view.Accepted += in.Accepted
+		view.Active += in.Active
+		view.Failed += in.Failed
+		view.BytesIn += in.BytesIn
+		view.BytesOut += in.BytesOut
+
+		for _, b := range in.Backends {
+			k := key{b.Pool, b.Addr}
+			t := totals[k]
+			if t == nil {
+				t = &BackendTotal{Pool: b.Pool, Addr: b.Addr}
+				totals[k] = t
+				order = append(order, k)
+			}
+			t.Active += b.Active
+			t.Connections += b.Connections
+			t.Failed += b.Failed
+			t.Reporting++
+			if b.Healthy {
+				t.HealthyOn++
+			}
+		}
+	}
+
+	slices.SortFunc(order, func(x, y key) int {
+		if c := strings.Compare(x.pool, y.pool); c != 0 {
+			return c
+		}
+		return strings.Compare(x.addr, y.addr)
+	})
+	for _, k := range order {
+		view.Backends = append(view.Backends, *totals[k])
+	}
+	return view
+}
+
+// Pusher sends summaries to one peer over a connection it keeps open, and
+// redials after an error.
+type Pusher struct {
+	Addr    string
+	Secret  []byte
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (p *Pusher) Push(s Summary) error {
+	line, err := seal(p.Secret, s)
+	if err != nil {
+		return err
+	}
+
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		conn, err := net.DialTimeout("tcp", p.Addr, timeout)
+		if err != nil {
+			return err
+		}
+		p.conn = conn
+	}
+
+	p.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := p.conn.Write(line); err != nil {
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (p *Pusher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
@@ -0,0 +1,197 @@
+package balancer
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/fleet"
+	"loadbalancer/balancer/peer"
+)
+
+// FleetPolicy shares stats between balancer instances. Every instance
+// pushes a summary of its counters to Peers each Interval; instances with
+// Listen set collect the summaries and serve the whole fleet's view from
+// FleetStats. One listening instance gives a designated aggregator, all of
+// them listening and naming each other lets every one show the fleet.
+// With Cluster the summaries go over the peer protocol instead, and every
+// instance shows the fleet.
+type FleetPolicy struct {
+	//Instance names this instance in the view, default the host name
+	Instance string
+	//Listen is the TCP address summaries are received on
+	Listen string
+	Peers  []string
+	//Interval between pushes, default 10s
+	Interval time.Duration
+	//Expiry drops instances not heard from for this long, default 30s
+	Expiry time.Duration
+	//Secret signs the summaries; every instance needs the same
+	Secret []byte
+	//Cluster replaces Listen, Peers and Secret
+	Cluster *peer.Node
+}
+
+// kindFleet are summaries sent over the peer protocol
+const kindFleet = "fleet"
+
+func WithFleetStats(policy FleetPolicy) Option {
+	return func(lb *LoadBalancer) {
+		switch {
+		case policy.Instance != "":
+		case policy.Cluster != nil:
+			policy.Instance = policy.Cluster.ID()
+		default:
+			policy.Instance, _ = os.Hostname()
+		}
+		if policy.Interval <= 0 {
+			policy.Interval = fleet.DefaultInterval
+		}
+		if policy.Expiry <= 0 {
+			policy.Expiry = max(fleet.DefaultExpiry, 3*policy.Interval)
+		}
+		lb.fleet = &fleetStats{policy: policy}
+	}
+}
+
+type fleetStats struct {
+	policy     FleetPolicy
+	aggregator *fleet.Aggregator
+	pushers    []*fleet.Pusher
+}
+
+// build sets up the aggregator and pushers once the clock and logger are
+// known. It does nothing when fleet stats are off.
+func (f *fleetStats) build(c clock.Clock, log *slog.Logger) error {
+	if f == nil {
+		return nil
+	}
+	if node := f.policy.Cluster; node != nil {
+		f.aggregator, _ = fleet.NewAggregator(c, f.policy.Expiry, nil)
+		node.Handle(kindFleet, func(from string, body json.RawMessage) {
+			var s fleet.Summary
+			if json.Unmarshal(body, &s) != nil {
+				return
+			}
+			//the sender is known from the handshake
+			s.Instance = from
+			f.aggregator.Add(s)
+		})
+		return nil
+	}
+	if len(f.policy.Secret) == 0 {
+		return errors.New("fleet stats: a shared secret is required")
+	}
+	if f.policy.Listen != "" {
+		agg, err := fleet.NewAggregator(c, f.policy.Expiry, f.policy.Secret)
+		if err != nil {
+			return err
+		}
+		agg.SetLogger(log)
+		f.aggregator = agg
+	}
+	for _, peer := range f.policy.Peers {
+		f.pushers = append(f.pushers, &fleet.Pusher{Addr: peer, Secret: f.policy.Secret})
+	}
+	return nil
+}
+
+// runFleet receives and pushes summaries until Shutdown.
+func (lb *LoadBalancer) runFleet() {
+	f := lb.fleet
+	policy := f.policy
+
+	if policy.Listen != "" && policy.Cluster == nil {
+		ln, err := net.Listen("tcp", policy.Listen)
+		if err != nil {
+			lb.log.Warn("Fleet stats not collected, only pushing", "error", err)
+		} else {
+			lb.log.Info("Collecting fleet stats", "address", ln.Addr().String())
+			defer ln.Close()
+			lb.goSafe("fleet aggregator", func() {
+				if err := f.aggregator.Serve(ln); err != nil && !errors.Is(err, net.ErrClosed) {
+					lb.log.Warn("Fleet aggregator stopped", "error", err)
+				}
+			})
+		}
+	}
+
+	failing := make([]bool, len(f.pushers))
+	clusterFailing := false
+	push := func() {
+		s := lb.fleetSummary()
+		if f.aggregator != nil {
+			f.aggregator.AddLocal(s)
+		}
+		if node := policy.Cluster; node != nil {
+			err := node.Broadcast(kindFleet, s)
+			if err != nil && !clusterFailing {
+				lb.log.Warn("Sending fleet stats failed", "error", err)
+			}
+			clusterFailing = err != nil
+		}
+		for i, p := range f.pushers {
+			err := p.Push(s)
+			//log on changes only, a peer being down is reported once
+			if err != nil && !failing[i] {
+				lb.log.Warn("Pushing fleet stats failed", "peer", p.Addr, "error", err)
+			}
+			if err == nil && failing[i] {
+				lb.log.Info("Pushing fleet stats again", "peer", p.Addr)
+			}
+			failing[i] = err != nil
+		}
+	}
+
+	ticker := lb.clock.NewTicker(policy.Interval)
+	defer ticker.Stop()
+
+	push()
+	for {
+		select {
+		case <-lb.stop:
+			return
+		case <-ticker.C():
+			if !lb.shedder.paused("fleet") {
+				push()
+			}
+		}
+	}
+}
+
+func (lb *LoadBalancer) fleetSummary() fleet.Summary {
+	stats := lb.Stats()
+	s := fleet.Summary{
+		Instance: lb.fleet.policy.Instance,
+		Sent:     lb.clock.Now(),
+		Accepted: stats.Accepted,
+		Active:   stats.Active,
+		Failed:   stats.Failed,
+		BytesIn:  stats.BytesIn,
+		BytesOut: stats.BytesOut,
+	}
+	for _, b := range stats.Backends {
+		s.Backends = append(s.Backends, fleet.Backend{
+			Pool:        b.Pool,
+			Addr:        b.Addr,
+			Healthy:     b.Healthy,
+			Active:      b.Active,
+			Connections: b.Connections,
+			Failed:      b.Failed,
+		})
+	}
+	return s
+}
+
+// FleetStats returns the fleet-wide view collected by this instance. It
+// reports false unless WithFleetStats is given with Listen or Cluster set.
+func (lb *LoadBalancer) FleetStats() (fleet.View, bool) {
+	if lb.fleet == nil || lb.fleet.aggregator == nil {
+		return fleet.View{}, false
+	}
+	return lb.fleet.aggregator.View(), true
+}
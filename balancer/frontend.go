@@ -0,0 +1,558 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"loadbalancer/balancer/acl"
+	"loadbalancer/balancer/audit"
+	"loadbalancer/balancer/capture"
+	"loadbalancer/balancer/edgeauth"
+	"loadbalancer/balancer/geoip"
+	"loadbalancer/balancer/listener"
+	"loadbalancer/balancer/ratelimit"
+	"loadbalancer/balancer/sockopt"
+	"loadbalancer/balancer/tarpit"
+)
+
+// Mode selects how a listener proxies traffic.
+type Mode string
+
+const (
+	//ModeTCP copies bytes without looking at them
+	ModeTCP Mode = "tcp"
+	//ModeHTTP parses HTTP/1.x requests so headers can be added and checked
+	ModeHTTP Mode = "http"
+)
+
+// ListenerConfig describes one frontend: where to listen, which protocol
+// adapters to layer on accepted connections and which pool to route to.
+type ListenerConfig struct {
+	Address string
+	//Addresses are more addresses served by the same listener, e.g. an
+	//IPv6 one next to an IPv4 Address
+	Addresses []string
+	//Network is "tcp" (default), "tcp4" or "tcp6". With "tcp" a wildcard
+	//address such as ":8090" or "[::]:8090" is one dual-stack socket;
+	//"tcp6" accepts IPv6 only, so an IPv4 socket can share the port
+	Network string
+	//Pool defaults to DefaultPool
+	Pool string
+	//Tenant restricts the listener to that tenant's pools, which Pool and
+	//GeoIP routes then name without the tenant prefix, and charges its
+	//connections to the tenant's quota
+	Tenant string
+	//Mode defaults to ModeTCP
+	Mode     Mode
+	Adapters []listener.Adapter
+	//ACL is checked against the peer address right after accept
+	ACL *acl.ACL
+	//AcceptFilter is a custom check after the ACL and rate limits, run
+	//from the accept loop within FilterBudget (DefaultFilterBudget); a
+	//filter that overruns or panics refuses the connection unless
+	//FilterFailOpen is set
+	AcceptFilter   AcceptFilter
+	FilterBudget   time.Duration
+	FilterFailOpen bool
+	//Routes pick the pool by protocol, server name or ALPN, checked in
+	//order before GeoIP routes
+	Routes []Route
+	//GeoIP blocks clients by country/ASN and may route them to another pool
+	GeoIP *geoip.Policy
+	//Regions replace Pool with the fastest healthy of several regional
+	//pools, for connections no route sent elsewhere
+	Regions *RegionFailover
+	//BudgetShare guarantees the listener that share of
+	//WithConnectionBudget, from 0 to 1, for connections no route with a
+	//share of its own took
+	BudgetShare float64
+	//RateLimit limits new connections per client IP
+	RateLimit *ratelimit.Limiter
+	//HostLimit limits connections per SNI name and, in ModeHTTP, requests per Host
+	HostLimit *ratelimit.HostLimiter
+	//Tarpit holds clients refused by ACL, GeoIP or rate limits open instead
+	//of closing them
+	Tarpit *tarpit.Tarpit
+	//Auth enforces basic-auth or API keys per route in ModeHTTP
+	Auth *edgeauth.Policy
+	//JWT authenticates requests in ModeHTTP
+	JWT *JWTPolicy
+	//Timeouts override those of the pool for connections on this listener
+	Timeouts Timeouts
+	//Capture records a sample of the traffic to the backends for debugging
+	Capture *capture.Capturer
+	//Tags are given to every connection on the listener; tenant listeners
+	//add "tenant:<name>". Tagger may add more per connection.
+	Tags   []string
+	Tagger TagFunc
+
+	//Acceptors is the number of goroutines calling Accept, default 1
+	Acceptors int
+	//CPUs pins the accept goroutines to these processors, round-robin; a
+	//hint only honoured on Linux. Connection handlers are not pinned.
+	CPUs []int
+	//ReusePort gives each acceptor its own SO_REUSEPORT socket where the
+	//platform spreads connections between them (Linux, FreeBSD); elsewhere
+	//the acceptors share one socket
+	ReusePort bool
+	//Transparent accepts connections redirected by TPROXY (Linux)
+	Transparent bool
+}
+
+// frontend is a running listener and its counters.
+type frontend struct {
+	cfg    ListenerConfig
+	addr   net.Addr
+	lns    []net.Listener
+	pool   *Pool
+	tenant *Tenant
+	chain  listener.Chain
+	//staticTags are the listener's and tenant's tags, sorted
+	staticTags []string
+	//regions override pool with RegionFailover
+	regions *regions
+	//budget and routeBudgets are the classes of WithConnectionBudget, a
+	//route without a share of its own having none
+	budget       *budgetClass
+	routeBudgets []*budgetClass
+
+	accepted  atomic.Uint64
+	rejected  atomic.Uint64
+	tarpitted atomic.Uint64
+
+	//filtered counts connections refused by the accept filter
+	filtered       atomic.Uint64
+	filterTimeouts atomic.Uint64
+
+	acceptErrors atomic.Uint64
+	//fdPressure is set while accepts fail for lack of file descriptors
+	fdPressure atomic.Bool
+
+	//acl starts out as cfg.ACL, see SetACL
+	acl atomic.Pointer[acl.ACL]
+}
+
+// Listen serves one frontend until its listener fails. Several frontends
+// can run on the same LoadBalancer. Sockets for its addresses inherited
+// from the parent process are used instead of binding new ones.
+func (lb *LoadBalancer) Listen(cfg ListenerConfig) error {
+	network := cfg.Network
+	switch network {
+	case "":
+		network = "tcp"
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return fmt.Errorf("listener %s: unknown network %q", cfg.Address, cfg.Network)
+	}
+
+	opts := sockopt.Options{ReusePort: cfg.ReusePort, Transparent: cfg.Transparent}
+	sockets := 1
+	if cfg.ReusePort {
+		if sockopt.CanReusePort() {
+			sockets = max(cfg.Acceptors, 1)
+		} else {
+			lb.log.Warn("SO_REUSEPORT is not available here, acceptors share one socket", "listener", cfg.Address)
+			opts.ReusePort = false
+		}
+	}
+
+	var lns []net.Listener
+	for _, address := range append([]string{cfg.Address}, cfg.Addresses...) {
+		if ln := sockopt.Inherited(address); ln != nil {
+			lb.log.Info("Using inherited socket", "listener", ln.Addr().String())
+			lns = append(lns, ln)
+			continue
+		}
+		for range sockets {
+			ln, err := sockopt.Listen(network, address, opts)
+			if err != nil {
+				for _, ln := range lns {
+					ln.Close()
+				}
+				return err
+			}
+			lns = append(lns, ln)
+			//the rest join the port picked for the first, should it be ":0"
+			address = ln.Addr().String()
+		}
+	}
+	return lb.serve(lns, cfg)
+}
+
+// ListenContext is Listen until ctx ends, which shuts the whole balancer
+// down at once: the listeners close, open connections are cut and the
+// health checks and other background work stop. Use Shutdown instead to
+// let connections finish.
+func (lb *LoadBalancer) ListenContext(ctx context.Context, cfg ListenerConfig) error {
+	stop := context.AfterFunc(ctx, func() {
+		now, cancel := context.WithCancel(context.Background())
+		cancel()
+		lb.Shutdown(now)
+	})
+	defer stop()
+	return lb.Listen(cfg)
+}
+
+// Serve is like Listen but accepts on an existing listener. cfg.Address is
+// ignored.
+func (lb *LoadBalancer) Serve(ln net.Listener, cfg ListenerConfig) error {
+	return lb.serve([]net.Listener{ln}, cfg)
+}
+
+// serve runs the acceptors of one frontend, spread over lns.
+func (lb *LoadBalancer) serve(lns []net.Listener, cfg ListenerConfig) error {
+	for _, ln := range lns {
+		defer ln.Close()
+	}
+	ln := lns[0]
+
+	//only reachable through the deprecated NewLoadBalancer
+	if lb.loadErr != nil {
+		return lb.loadErr
+	}
+
+	poolName := cfg.Pool
+	if poolName == "" {
+		poolName = DefaultPool
+	}
+
+	var tenant *Tenant
+	if cfg.Tenant != "" {
+		if tenant = lb.Tenant(cfg.Tenant); tenant == nil {
+			return fmt.Errorf("listener %s: unknown tenant %s", ln.Addr(), cfg.Tenant)
+		}
+	}
+
+	pool := lb.lookupPool(tenant, poolName)
+	if pool == nil {
+		return fmt.Errorf("listener %s: unknown pool %s", ln.Addr(), poolName)
+	}
+
+	if err := checkHTTP(cfg); err != nil {
+		return fmt.Errorf("listener %s: %w", ln.Addr(), err)
+	}
+
+	if err := lb.checkRoutes(cfg, tenant); err != nil {
+		return fmt.Errorf("listener %s: %w", ln.Addr(), err)
+	}
+
+	regions, err := lb.newRegions(cfg.Regions, tenant)
+	if err != nil {
+		return fmt.Errorf("listener %s: %w", ln.Addr(), err)
+	}
+
+	if lb.draining() {
+		return fmt.Errorf("listener %s: balancer is draining", ln.Addr())
+	}
+
+	fe := &frontend{
+		cfg:    cfg,
+		addr:   ln.Addr(),
+		lns:    lns,
+		pool:   pool,
+		tenant: tenant,
+		chain:  listener.Chain(cfg.Adapters),
+
+		staticTags: listenerTags(cfg, tenant),
+		regions:    regions,
+	}
+	fe.acl.Store(cfg.ACL)
+	if err := lb.budgetClasses(fe); err != nil {
+		return fmt.Errorf("listener %s: %w", ln.Addr(), err)
+	}
+	lb.addFrontend(fe)
+
+	for _, ln := range lns {
+		lb.log.Info("Load Balancer Listening", "address", ln.Addr().String())
+	}
+	lb.log.Info("Forwarding to backends", "pool", pool.name, "backends", fmt.Sprint(pool.Backends()))
+
+	//start health checkers in background
+	lb.startPools()
+	if regions != nil {
+		lb.goSafe("region probes for "+fe.addr.String(), func() {
+			lb.runRegions(fe)
+		})
+	}
+
+	acceptors := max(cfg.Acceptors, len(lns))
+	if acceptors == 1 && len(cfg.CPUs) == 0 {
+		return lb.acceptLoop(ln, fe)
+	}
+
+	//the first loop to stop closes the listeners for the others
+	errc := make(chan error, acceptors)
+	for i := range acceptors {
+		go func() {
+			if len(cfg.CPUs) > 0 {
+				//never unlocked: the pinned thread exits with the goroutine
+				runtime.LockOSThread()
+				cpu := cfg.CPUs[i%len(cfg.CPUs)]
+				if err := pinThread(cpu); err != nil {
+					lb.log.Warn("Accept loop not pinned to cpu", "listener", fe.addr, "cpu", cpu, "error", err)
+				}
+			}
+			errc <- lb.acceptLoop(lns[i%len(lns)], fe)
+		}()
+	}
+	return <-errc
+}
+
+// acceptLoop accepts connections until the listener fails or the balancer
+// drained. Several loops may share one listener. Temporary errors such as
+// running out of file descriptors are retried with backoff.
+func (lb *LoadBalancer) acceptLoop(ln net.Listener, fe *frontend) error {
+	var backoff acceptBackoff
+	for {
+		conn, err := ln.Accept()
+
+		if err != nil {
+			if lb.drained(err) {
+				return nil
+			}
+			delay, ok := lb.acceptFailed(fe, &backoff, err)
+			if !ok {
+				return err
+			}
+			lb.clock.Sleep(delay)
+			continue
+		}
+		lb.accepted(fe, &backoff)
+
+		if !lb.admit(fe, conn) {
+			lb.refuse(fe, conn)
+			continue
+		}
+		//a full balancer stops accepting here, see WithConnectionLimit
+		if !lb.connLimit.acquire(lb) {
+			fe.tenant.release()
+			lb.refuseOverLimit(fe, conn)
+			continue
+		}
+
+		accepted := lb.clock.Now()
+		lb.goSafe("connection handler", func() {
+			defer lb.connLimit.release()
+			defer fe.tenant.release()
+			lb.shedder.observeAccept(lb.clock.Since(accepted))
+
+			capped, release := lb.posture.handshakeDeadline(conn)
+			adapted, err := fe.chain.Adapt(capped)
+			release()
+			if err != nil {
+				lb.rejectAdapter(fe, conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			if id := listener.ClientIdentity(adapted); id != nil {
+				lb.cas.add("listener "+fe.addr.String(), id.CA)
+			}
+
+			//adapters such as PROXY protocol may reveal the real client
+			if adapted.RemoteAddr().String() != conn.RemoteAddr().String() && !lb.checkClient(fe, adapted.RemoteAddr()) {
+				adapted.Close()
+				return
+			}
+
+			//counted by the real client, after adapters such as PROXY protocol
+			client := clientIP(adapted.RemoteAddr())
+			if allowed, reason := fe.cfg.RateLimit.Acquire(client); !allowed {
+				lb.reject(fe, adapted.RemoteAddr(), audit.KindRateLimit, reason)
+				adapted.Close()
+				return
+			}
+			defer fe.cfg.RateLimit.Release(client)
+
+			if !lb.checkHost(fe, adapted) {
+				adapted.Close()
+				return
+			}
+
+			tags, ok := lb.tagConn(fe, adapted)
+			if !ok {
+				adapted.Close()
+				return
+			}
+			defer tags.release()
+
+			pool, route := lb.poolFor(fe, adapted)
+			class := fe.budgetFor(route)
+			if !lb.budget.take(class) {
+				lb.reject(fe, adapted.RemoteAddr(), audit.KindBudget, "connection budget of "+class.name+" used up")
+				adapted.Close()
+				return
+			}
+			defer lb.budget.release(class)
+
+			handleConnection(adapted, lb, fe, pool, tags)
+		})
+	}
+}
+
+// admit runs the cheap accept-time checks on the accept goroutine, before
+// any per-connection work is started.
+func (lb *LoadBalancer) admit(fe *frontend, conn net.Conn) bool {
+	fe.accepted.Add(1)
+	if !lb.checkClient(fe, conn.RemoteAddr()) {
+		return false
+	}
+
+	if allowed, reason := fe.cfg.RateLimit.Allow(clientIP(conn.RemoteAddr())); !allowed {
+		lb.reject(fe, conn.RemoteAddr(), audit.KindRateLimit, reason)
+		return false
+	}
+
+	if allowed, reason := lb.posture.admit(fe, clientIP(conn.RemoteAddr())); !allowed {
+		lb.reject(fe, conn.RemoteAddr(), audit.KindRateLimit, reason)
+		return false
+	}
+
+	if fe.cfg.Tagger == nil && !lb.admitLoad(fe, conn.RemoteAddr(), fe.staticTags) {
+		return false
+	}
+
+	if !lb.filterConn(fe, conn) {
+		return false
+	}
+
+	//last, as it takes a quota slot that the connection handler gives back
+	if allowed, reason := fe.tenant.admit(); !allowed {
+		lb.reject(fe, conn.RemoteAddr(), audit.KindRateLimit, reason)
+		return false
+	}
+
+	return true
+}
+
+// refuse disposes of a connection admit turned down: into the listener's
+// tarpit if it has one and there is room, otherwise it is closed. Nothing
+// is held while shedding load, as holding connections is load too.
+func (lb *LoadBalancer) refuse(fe *frontend, conn net.Conn) {
+	if fe.cfg.Tarpit != nil && !lb.shedder.active() && fe.cfg.Tarpit.Hold(conn) {
+		fe.tarpitted.Add(1)
+		return
+	}
+	conn.Close()
+}
+
+// checkClient applies the listener's ACL and GeoIP rules to a client address.
+func (lb *LoadBalancer) checkClient(fe *frontend, addr net.Addr) bool {
+	ip := clientIP(addr)
+
+	if allowed, rule := fe.acl.Load().Check(ip); !allowed {
+		lb.reject(fe, addr, audit.KindACL, rule)
+		return false
+	}
+
+	if allowed, rule := fe.cfg.GeoIP.Check(ip); !allowed {
+		lb.reject(fe, addr, audit.KindGeoIP, rule)
+		return false
+	}
+
+	return true
+}
+
+// SetACL replaces the ACL of the listeners configured with address, as
+// their Address or one of their Addresses, for the connections they accept
+// from now on; nil lets every client in.
+func (lb *LoadBalancer) SetACL(address string, rules *acl.ACL) error {
+	found := false
+	for _, fe := range lb.frontendList() {
+		if fe.cfg.Address == address || slices.Contains(fe.cfg.Addresses, address) {
+			fe.acl.Store(rules)
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("unknown listener %s", address)
+	}
+	lb.log.Info("ACL of listener updated", "listener", address)
+	return nil
+}
+
+// reject counts a refused connection and records it in the audit stream,
+// or on stdout when no audit log is configured.
+func (lb *LoadBalancer) reject(fe *frontend, addr net.Addr, kind, reason string) {
+	fe.rejected.Add(1)
+	lb.rejected.Add(1)
+	if fe.tenant != nil {
+		fe.tenant.rejected.Add(1)
+	}
+
+	if lb.audit == nil {
+		lb.log.Info("Rejected connection", "client", addr.String(), "listener", fe.addr, "reason", reason)
+		return
+	}
+
+	lb.audit.Record(audit.Event{
+		Kind:     kind,
+		Listener: fe.addr.String(),
+		Client:   addr.String(),
+		Rule:     reason,
+	})
+}
+
+// rejectAdapter classifies a failure inside the adapter chain; TLS failures
+// are authentication failures when client certificates are required.
+func (lb *LoadBalancer) rejectAdapter(fe *frontend, addr net.Addr, err error) {
+	kind := audit.KindProtocol
+
+	var adaptErr *listener.Error
+	if errors.As(err, &adaptErr) && isTLSAdapter(adaptErr.Adapter) {
+		kind = audit.KindAuth
+	}
+
+	lb.reject(fe, addr, kind, err.Error())
+}
+
+// poolFor picks the pool for a connection, honouring the listener's
+// routes, then GeoIP routes and then the region failover. It also returns
+// the index of the route taken, -1 for none.
+func (lb *LoadBalancer) poolFor(fe *frontend, conn net.Conn) (*Pool, int) {
+	if p, i := lb.route(fe, conn); p != nil {
+		return p, i
+	}
+
+	fallback := fe.pool
+	if p := fe.regions.pool(); p != nil {
+		fallback = p
+	}
+
+	name := fe.cfg.GeoIP.Route(clientIP(conn.RemoteAddr()))
+	if name == "" {
+		return fallback, -1
+	}
+
+	if p := lb.lookupPool(fe.tenant, name); p != nil {
+		return p, -1
+	}
+
+	lb.log.Warn("GeoIP route to unknown pool", "pool", name, "using", fallback.name)
+	return fallback, -1
+}
+
+// lookupPool finds a pool by name, among the tenant's pools if there is one.
+func (lb *LoadBalancer) lookupPool(tenant *Tenant, name string) *Pool {
+	if tenant != nil {
+		return tenant.Pool(name)
+	}
+	return lb.Pool(name)
+}
+
+func (lb *LoadBalancer) addFrontend(fe *frontend) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.frontends = append(lb.frontends, fe)
+}
+
+func (lb *LoadBalancer) frontendList() []*frontend {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return append([]*frontend(nil), lb.frontends...)
+}
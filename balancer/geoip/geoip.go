@@ -0,0 +1,145 @@
+package geoip
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"loadbalancer/balancer/acl"
+)
+
+// Record is what a GeoIP database knows about a network.
+type Record struct {
+	Country string //ISO 3166-1 alpha-2, upper case
+	ASN     uint32
+	Org     string
+}
+
+// Database looks up client addresses. Implementations backed by other
+// formats (e.g. an MMDB reader) can be plugged in through this interface.
+type Database interface {
+	Lookup(addr netip.Addr) (Record, bool)
+}
+
+// Table is an in-memory database doing longest-prefix matches.
+type Table struct {
+	byBits map[int]map[netip.Prefix]Record
+	bits   []int //prefix lengths present, longest first
+	size   int
+}
+
+func (t *Table) Lookup(addr netip.Addr) (Record, bool) {
+	addr = addr.Unmap()
+	for _, bits := range t.bits {
+		if bits > addr.BitLen() {
+			continue
+		}
+		p, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if r, ok := t.byBits[bits][p]; ok {
+			return r, true
+		}
+	}
+	return Record{}, false
+}
+
+// Len returns the number of networks in the table.
+func (t *Table) Len() int {
+	return t.size
+}
+
+func (t *Table) add(p netip.Prefix, r Record) {
+	if t.byBits == nil {
+		t.byBits = make(map[int]map[netip.Prefix]Record)
+	}
+	m, ok := t.byBits[p.Bits()]
+	if !ok {
+		m = make(map[netip.Prefix]Record)
+		t.byBits[p.Bits()] = m
+		t.bits = append(t.bits, p.Bits())
+		sort.Sort(sort.Reverse(sort.IntSlice(t.bits)))
+	}
+	if _, dup := m[p]; !dup {
+		t.size++
+	}
+	m[p] = r
+}
+
+// ParseCSV reads a network-keyed CSV in the spirit of the GeoLite2 CSV
+// exports, one network per line:
+//
+//	network,country,asn,org
+//	81.2.69.0/24,GB,20712,Andrews & Arnold
+//
+// The asn and org columns are optional, lines starting with # and a header
+// line starting with "network" are skipped.
+func ParseCSV(r io.Reader) (*Table, error) {
+	t := &Table{}
+	sc := bufio.NewScanner(r)
+
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "network") {
+			continue
+		}
+
+		fields := strings.SplitN(text, ",", 4)
+		p, err := acl.ParsePrefix(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		var rec Record
+		if len(fields) > 1 {
+			rec.Country = strings.ToUpper(strings.TrimSpace(fields[1]))
+		}
+		if len(fields) > 2 && strings.TrimSpace(fields[2]) != "" {
+			asn, err := parseASN(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			rec.ASN = asn
+		}
+		if len(fields) > 3 {
+			rec.Org = strings.Trim(strings.TrimSpace(fields[3]), `"`)
+		}
+
+		t.add(p, rec)
+	}
+
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// LoadFile parses a CSV database from disk.
+func LoadFile(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	t, err := ParseCSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+func parseASN(s string) (uint32, error) {
+	s = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "AS")
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ASN %q", s)
+	}
+	return uint32(n), nil
+}
@@ -0,0 +1,75 @@
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Policy blocks or routes connections by country and ASN.
+type Policy struct {
+	DB Database
+
+	//AllowCountries, when set, rejects every other country including unknown addresses
+	AllowCountries []string
+	DenyCountries  []string
+	DenyASNs       []uint32
+
+	//Routes maps a country code to the pool its clients are sent to
+	Routes map[string]string
+}
+
+// Check reports whether addr may connect and the rule that decided it.
+func (p *Policy) Check(addr netip.Addr) (bool, string) {
+	if p == nil || p.DB == nil {
+		return true, ""
+	}
+
+	rec, found := p.DB.Lookup(addr)
+
+	if found && slices.Contains(p.DenyASNs, rec.ASN) {
+		return false, fmt.Sprintf("geoip deny AS%d", rec.ASN)
+	}
+	if found && containsFold(p.DenyCountries, rec.Country) {
+		return false, "geoip deny country " + rec.Country
+	}
+
+	if len(p.AllowCountries) > 0 {
+		if !found || !containsFold(p.AllowCountries, rec.Country) {
+			country := rec.Country
+			if !found {
+				country = "unknown"
+			}
+			return false, "geoip country " + country + " not allowed"
+		}
+	}
+
+	return true, ""
+}
+
+// Route returns the pool for addr, or "" to use the listener's pool.
+func (p *Policy) Route(addr netip.Addr) string {
+	if p == nil || p.DB == nil || len(p.Routes) == 0 {
+		return ""
+	}
+
+	rec, found := p.DB.Lookup(addr)
+	if !found {
+		return ""
+	}
+
+	if pool, ok := p.Routes[rec.Country]; ok {
+		return pool
+	}
+	return p.Routes[strings.ToLower(rec.Country)]
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package geoip
+
+import (
+	"log/slog"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/logging"
+)
+
+// Reloader is a Database backed by a file that is re-read whenever its
+// modification time changes. Lookups never block on a reload.
+type Reloader struct {
+	path  string
+	clock clock.Clock
+	//log is logging.Default unless SetLogger changed it
+	log *slog.Logger
+
+	current atomic.Pointer[Table]
+	modTime time.Time
+}
+
+// NewReloader loads path once and fails if that does not work; later reload
+// errors are logged and the previous table is kept.
+func NewReloader(path string, c clock.Clock) (*Reloader, error) {
+	r := &Reloader{path: path, clock: c, log: logging.Default()}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) Lookup(addr netip.Addr) (Record, bool) {
+	return r.current.Load().Lookup(addr)
+}
+
+// Len returns the number of networks in the current table.
+func (r *Reloader) Len() int {
+	return r.current.Load().Len()
+}
+
+// SetLogger sends what Watch logs to l; call it before Watch.
+func (r *Reloader) SetLogger(l *slog.Logger) {
+	r.log = l
+}
+
+// Watch polls the file every interval and reloads it when it changed,
+// until stop is closed; run it on its own goroutine.
+func (r *Reloader) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := r.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+		}
+
+		info, err := os.Stat(r.path)
+		if err != nil {
+			r.log.Warn("GeoIP database unavailable", "path", r.path, "error", err)
+			continue
+		}
+		if info.ModTime().Equal(r.modTime) {
+			continue
+		}
+
+		if err := r.reload(); err != nil {
+			r.log.Warn("GeoIP reload failed, keeping previous database", "error", err)
+			continue
+		}
+		r.log.Info("GeoIP database loaded", "path", r.path, "networks", r.Len())
+	}
+}
+
+func (r *Reloader) reload() error {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return err
+	}
+
+	t, err := LoadFile(r.path)
+	if err != nil {
+		return err
+	}
+
+	r.current.Store(t)
+	r.modTime = info.ModTime()
+	return nil
+}
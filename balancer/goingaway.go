@@ -0,0 +1,98 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+
+	"loadbalancer/balancer/discovery"
+	"loadbalancer/balancer/health"
+)
+
+// signals a backend can announce its shutdown with
+const (
+	awayHealth    = "health check"
+	awayDiscovery = "discovery"
+)
+
+// goingAway drains b once signal says it is about to shut down, so that it
+// stops getting new connections before it stops answering, and resumes it
+// once the same signal no longer says so. Backends draining for another
+// reason are left alone.
+func (p *Pool) goingAway(b *Backend, signal string, away bool) {
+	p.mu.Lock()
+	flagged, ok := p.away[b.Addr]
+	switch {
+	case away && !ok && !b.Draining():
+		if p.away == nil {
+			p.away = make(map[string]string)
+		}
+		p.away[b.Addr] = signal
+	case !away && ok && flagged == signal:
+		delete(p.away, b.Addr)
+	default:
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+
+	if !away {
+		if b.SetDraining(false) {
+			p.lb.log.Info("Backend is back", "backend", b.Addr, "pool", p.name, "signal", signal)
+		}
+		return
+	}
+
+	p.lb.log.Info("Backend is going away", "backend", b.Addr, "pool", p.name, "signal", signal)
+	b.SetDraining(true)
+	p.lb.goSafe("going away drain", func() {
+		p.lb.drainBackends(context.Background(), b.Addr, []*Backend{b}, []string{p.name})
+	})
+}
+
+// observeProbe feeds the pool's health check results to goingAway. Only a
+// passing check ends the drain, a failing one may be the shutdown itself.
+func (p *Pool) observeProbe(b *Backend, err error) {
+	switch {
+	case errors.Is(err, health.ErrGoingAway):
+		p.goingAway(b, awayHealth, true)
+	case err == nil:
+		p.goingAway(b, awayHealth, false)
+	}
+}
+
+// watchGoingAway polls the discovery source for backends flagged as going
+// away once per health check interval until Shutdown.
+func (lb *LoadBalancer) watchGoingAway(source discovery.GoingAwaySource) {
+	interval := lb.healthPolicy.Interval
+	if interval <= 0 {
+		interval = health.DefaultInterval
+	}
+	ticker := lb.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		addrs, err := source.GoingAway()
+		switch {
+		case err != nil && !failing:
+			lb.log.Warn("Discovery going away failed, keeping the last flags", "error", err)
+		case err == nil:
+			away := make(map[string]bool, len(addrs))
+			for _, addr := range addrs {
+				away[addr] = true
+			}
+			for _, p := range lb.Pools() {
+				for _, b := range p.Backends() {
+					p.goingAway(b, awayDiscovery, away[b.Addr])
+				}
+			}
+		}
+		failing = err != nil
+
+		select {
+		case <-lb.stop:
+			return
+		case <-ticker.C():
+		}
+	}
+}
@@ -1,47 +1,246 @@
 package balancer
 
 import (
-	"fmt"
-	"io"
+	"errors"
+	"log/slog"
 	"net"
+	"sync/atomic"
+	"time"
+
+	"loadbalancer/balancer/listener"
+	"loadbalancer/balancer/proxy"
+	"loadbalancer/balancer/replay"
+)
+
+var (
+	errNoBackend    = errors.New("no running server")
+	errAtCapacity   = errors.New("every backend is at capacity")
+	errPoolDraining = errors.New("every backend is draining")
 )
 
-func handleConnection(clientConn net.Conn, lb *LoadBalancer){
+func handleConnection(clientConn net.Conn, lb *LoadBalancer, fe *frontend, pool *Pool, tags connTags) {
 	defer clientConn.Close()
+	lb.open.add(clientConn)
+	defer lb.open.remove(clientConn)
+
+	lb.counters.ConnStarted()
+	defer lb.counters.ConnFinished()
+	fe.tenant.connStarted()
+	defer fe.tenant.connFinished()
+	tags.connStarted()
+	defer tags.connFinished()
+
+	accepted := lb.clock.Now()
+	log := lb.connLogger(clientConn, pool, tags)
 
-	//get the next server using round robin
-	backend := lb.getNextServer()
+	//get the next server from the strategy
+	backend := pool.take(clientConn, nil)
 
-	if backend == "" {
-		fmt.Println("No running server found!!")
-		send502Response(clientConn)
+	if backend == nil {
+		err, reason := errNoBackend, proxy.ReasonNoHealthyBackend
+		switch {
+		case pool.atCapacity():
+			log.Warn("Every backend of the pool is at its connection limit")
+			err, reason = errAtCapacity, proxy.ReasonOverCapacity
+		case pool.drainingOut():
+			log.Info("Every backend of the pool is draining")
+			err, reason = errPoolDraining, proxy.ReasonPoolDraining
+		default:
+			log.Warn("No running server found")
+		}
+		lb.recordFailure(clientConn, fe, pool, nil, tags, replay.StageSelect, err, accepted, 0)
+		lb.counters.ConnFailed()
+		fe.tenant.connFailed()
+		tags.connFailed()
+		lb.writeError(clientConn, reason)
 		return
 	}
-	
-	fmt.Printf("Forwarding connection to %s\n", backend)
 
-	backendConn, err := net.Dial("tcp", backend)
-	if err != nil {
-		fmt.Printf("Failed to connect to backend %s: %v\n", backend, err)
-		send502Response(clientConn)
-		return
+	if identity := listener.ClientIdentity(clientConn); identity != nil {
+		log = log.With("identity", identity.Subject)
+	}
+	log.Info("Forwarding connection", "backend", backend.Addr)
+
+	timeouts := lb.timeouts(fe, pool)
+	var start time.Time
+	var backendConn net.Conn
+	var tried []*Backend
+	var endTrial func()
+	for {
+		lb.debugRoute(fe, pool, clientConn, backend)
+		endTrial = lb.breakers.Begin(backend)
+		start = lb.clock.Now()
+
+		var err error
+		backend.DialStarted()
+		backendConn, err = lb.dialBackend(pool, backend, timeouts.Dial)
+		backend.DialFinished()
+		lb.learner.Observe(backend, lb.clock.Since(start), err)
+		if err == nil {
+			break
+		}
+
+		log.Warn("Failed to connect to backend", "backend", backend.Addr, "duration", lb.clock.Since(start), "error", err)
+		pool.checker.Traffic(backend, err)
+		lb.breakers.Record(backend, err)
+		endTrial()
+		backend.Release()
+		backend.ConnFailed()
+
+		//nothing was sent yet, so another backend can take the client
+		tried = append(tried, backend)
+		var next *Backend
+		if len(tried) <= lb.dialRetries {
+			next = pool.take(clientConn, tried)
+		}
+		if next == nil {
+			lb.recordFailure(clientConn, fe, pool, backend, tags, replay.StageDial, err, accepted, timeouts.Dial)
+			lb.counters.ConnFailed()
+			fe.tenant.connFailed()
+			tags.connFailed()
+			reason := proxy.ReasonDialFailed
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				reason = proxy.ReasonDialTimeout
+			}
+			lb.writeError(clientConn, reason)
+			return
+		}
+		log.Info("Retrying connection", "backend", next.Addr, "attempt", len(tried)+1, "attempts", lb.dialRetries+1)
+		lb.retried.Add(1)
+		backend = next
 	}
 
+	defer backend.Release()
 	defer backendConn.Close()
+	defer endTrial()
+	lb.open.dialed(clientConn, backendConn)
+	pool.checker.Traffic(backend, nil)
+	//in ModeHTTP the requests count instead
+	if fe.cfg.Mode != ModeHTTP {
+		lb.breakers.Record(backend, nil)
+	}
+
+	backend.ConnStarted()
+	defer backend.ConnFinished()
+	log = log.With("backend", backend.Addr)
+	defer func() {
+		log.Debug("Connection closed", "duration", lb.clock.Since(accepted))
+	}()
+
+	lc := lb.rebalancer.track(backend, clientConn, backendConn, fe.cfg.Mode == ModeHTTP, lb.clock.Now())
+	defer lb.rebalancer.untrack(lc)
+
+	meter := connMeter{lb: lb, backend: backend, tenant: fe.tenant, tags: tags, first: &firstByte{start: start}}
+
+	//only the backend owes a first byte
+	clientTimeouts := timeouts
+	clientTimeouts.FirstByte = 0
+	elapsed := lb.clock.Since(start)
+	clientConn = tags.throttle(limitConn(clientConn, clientTimeouts, elapsed, fe.cfg.Mode))
+	backendConn = limitConn(backendConn, timeouts, elapsed, fe.cfg.Mode)
+	limited, _ := backendConn.(*proxy.IdleConn)
+
+	//the backend side shows what the backend got, after TLS termination and
+	//HTTP rewriting
+	if fe.cfg.Capture != nil {
+		backendConn = fe.cfg.Capture.Tap(backendConn, clientConn.RemoteAddr(), backendConn.RemoteAddr())
+		defer backendConn.Close()
+	}
+
+	if fe.cfg.Mode == ModeHTTP {
+		//a connection closed at the end of its rebalancing grace is no error
+		if err := lb.serveHTTP(fe, pool, backend, clientConn, backendConn, meter, timeouts.HeaderRead, lc); err != nil && !lc.leaving() {
+			log.Warn("HTTP proxy error", "duration", lb.clock.Since(accepted), "error", err)
+			var backendErr *proxy.BackendError
+			if errors.As(err, &backendErr) {
+				pool.checker.Traffic(backend, err)
+			}
+			lb.recordFailure(clientConn, fe, pool, backend, tags, replay.StageProxy, err, accepted, timeouts.Dial)
+		}
+		return
+	}
+
+	err := proxy.PipeBuffer(clientConn, backendConn, meter, lb.copyBuffer)
+	if limited != nil && limited.FirstByteTimedOut() {
+		err = errFirstByte
+	}
+	if err != nil && !lc.leaving() {
+		if err == errFirstByte {
+			log.Warn("Backend sent nothing in time", "timeout", timeouts.FirstByte)
+		} else {
+			log.Warn("Backend connection failed", "duration", lb.clock.Since(accepted), "error", err)
+		}
+		pool.checker.Traffic(backend, err)
+		lb.breakers.Record(backend, err)
+		lb.recordFailure(clientConn, fe, pool, backend, tags, replay.StageProxy, err, accepted, timeouts.Dial)
+	}
+}
 
-	//copy data bidirectionally
-	//Go routing - client --> Backend
-	go io.Copy(backendConn, clientConn)
+// connLogger is the logger of a connection to pool, with its client and
+// tags as fields.
+func (lb *LoadBalancer) connLogger(conn net.Conn, pool *Pool, tags connTags) *slog.Logger {
+	log := lb.log.With("client", conn.RemoteAddr().String(), "pool", pool.name)
+	if len(tags) > 0 {
+		log = log.With("tags", tags.names())
+	}
+	return log
+}
+
+// writeError answers a client the balancer found no backend for, and
+// counts the reason for Stats.
+func (lb *LoadBalancer) writeError(conn net.Conn, reason string) {
+	n, _ := lb.errorResponses.LoadOrStore(reason, new(atomic.Uint64))
+	n.(*atomic.Uint64).Add(1)
+	if errorStatus(reason) == 503 {
+		proxy.WriteServiceUnavailable(conn, reason)
+	} else {
+		proxy.WriteBadGateway(conn, reason)
+	}
+}
 
-	//backend --> client
-	io.Copy(clientConn, backendConn)
+// errorStatus is the status writeError answers reason with: 503 while the
+// backends are there but can't take more, 502 otherwise.
+func errorStatus(reason string) int {
+	switch reason {
+	case proxy.ReasonOverCapacity, proxy.ReasonPoolDraining:
+		return 503
+	}
+	return 502
 }
 
-func send502Response(conn net.Conn){
-	response := "HTTP/1.1 502 Bad Gateway\r\n"
-	response += "Content-Type: text/plain\r\n"
-	response += "Content-Length: 21\r\n"
-	response += "\r\n"
-	response += "Backend Unavailable\n"
-	conn.Write([]byte(response))
-}
\ No newline at end of file
+// recordFailure gives the metadata of a failed connection to the failure
+// recorder, if any. b is nil when no backend was found.
+func (lb *LoadBalancer) recordFailure(conn net.Conn, fe *frontend, pool *Pool, b *Backend, tags connTags, stage string, err error, accepted time.Time, dialTimeout time.Duration) {
+	if lb.failures == nil {
+		return
+	}
+
+	rec := replay.Record{
+		Listener:      fe.addr.String(),
+		Mode:          string(fe.cfg.Mode),
+		Pool:          pool.name,
+		Client:        conn.RemoteAddr().String(),
+		ServerName:    tlsServerName(conn),
+		Stage:         stage,
+		Error:         err.Error(),
+		ElapsedMS:     float64(lb.clock.Since(accepted)) / float64(time.Millisecond),
+		DialTimeoutMS: float64(dialTimeout) / float64(time.Millisecond),
+	}
+	if rec.Mode == "" {
+		rec.Mode = string(ModeTCP)
+	}
+	if b != nil {
+		rec.Backend = b.Addr
+	}
+	for _, t := range tags {
+		rec.Tags = append(rec.Tags, t.name)
+	}
+	for _, pb := range pool.Backends() {
+		rec.Backends++
+		if pb.Healthy() {
+			rec.Healthy++
+		}
+	}
+	lb.failures.Record(rec)
+}
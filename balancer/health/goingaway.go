@@ -0,0 +1,46 @@
+package health
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrGoingAway is returned, possibly wrapped, by a probe whose backend
+// announced that it is shutting down. The backend is drained instead of
+// marked unhealthy, and resumed once a probe succeeds again.
+var ErrGoingAway = errors.New("backend is going away")
+
+// GoingAway describes the status endpoint a backend uses to announce a
+// shutdown, e.g. GET /status answering 503 or a body containing
+// "draining" once it received SIGTERM.
+type GoingAway struct {
+	Path string
+	//Status marks the backend as going away, 0 to go by Body alone
+	Status int
+	//Body marks it when the response contains it, "" to go by Status alone
+	Body string
+}
+
+// Probe asks the endpoint first and returns ErrGoingAway when it says the
+// backend is going away. Otherwise, including when the endpoint can't be
+// reached, the result is that of next.
+func (g GoingAway) Probe(next Probe) Probe {
+	return func(addr string, timeout time.Duration) error {
+		start := time.Now()
+		status, body, err := get(addr, g.Path, timeout)
+		if err == nil && g.matches(status, body) {
+			return fmt.Errorf("%w: %s answered %d", ErrGoingAway, g.Path, status)
+		}
+		return next(addr, max(timeout-time.Since(start), time.Millisecond))
+	}
+}
+
+func (g GoingAway) matches(status int, body string) bool {
+	if g.Status == 0 && g.Body == "" {
+		return false
+	}
+	return (g.Status == 0 || status == g.Status) &&
+		(g.Body == "" || strings.Contains(body, g.Body))
+}
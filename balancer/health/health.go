@@ -0,0 +1,486 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/backend"
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/logging"
+)
+
+const (
+	DefaultInterval = 10 * time.Second
+	DefaultTimeout  = 2 * time.Second
+)
+
+// Probe checks a single backend and returns nil when it is able to serve.
+type Probe func(addr string, timeout time.Duration) error
+
+// Check is a probe that sees the whole backend, for app-specific checks
+// such as a Redis PING. ctx ends after the policy's Timeout.
+type Check func(ctx context.Context, b *backend.Backend) error
+
+// TCPProbe considers a backend healthy when a TCP connection can be opened.
+func TCPProbe(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Type names a built-in probe.
+type Type string
+
+const (
+	//TypeTCP opens a connection, the default
+	TypeTCP Type = "tcp"
+	//TypeTLS completes a TLS handshake as well, without verifying the
+	//certificate, for backends whose TLS stack can fail on its own
+	TypeTLS Type = "tls"
+	//TypeHTTP sends GET / and wants a 2xx or 3xx; use HTTP for another
+	//path or status
+	TypeHTTP Type = "http"
+)
+
+func (t Type) Valid() bool {
+	switch t {
+	case "", TypeTCP, TypeTLS, TypeHTTP:
+		return true
+	}
+	return false
+}
+
+// Probe returns the built-in probe of t, TCPProbe for unknown types.
+func (t Type) Probe() Probe {
+	switch t {
+	case TypeTLS:
+		return TLSProbe
+	case TypeHTTP:
+		return HTTP{}.Probe
+	}
+	return TCPProbe
+}
+
+// Policy controls how a set of backends is health checked.
+type Policy struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	//Probe checks each backend, default the probe of Type
+	Probe Probe
+	Type  Type
+	//Check replaces Probe when set
+	Check Check
+
+	//External disables active probing; health is pushed from outside
+	External bool
+	//Gate combines the checks with the health the discovery source reports
+	Gate Gate
+	//MinHealthy backends are kept in rotation however their checks fail,
+	//so that a broken check can't take the whole set out; 0 for no floor
+	MinHealthy int
+	//Rise checks in a row have to pass to mark a backend up, and Fall to
+	//fail to mark it down, default 1; a backend's first check counts at once
+	Rise int
+	Fall int
+	//Passive marks a backend down at once when that many connections to
+	//it failed in a row, 0 to go by the checks alone; the checks bring it
+	//back
+	Passive int
+}
+
+// Gate decides a backend's health from the active checks and the discovery
+// source. A view that is still Unknown never counts against a backend.
+type Gate string
+
+const (
+	//GateLocal goes by the checks alone and ignores the discovery source
+	GateLocal Gate = ""
+	//GateAnd needs both to agree the backend is up
+	GateAnd Gate = "and"
+	//GateOr takes the backend while either says it is up
+	GateOr Gate = "or"
+	//GatePreferLocal goes by the checks once they ran, by the discovery
+	//source before that and while checks are external and silent
+	GatePreferLocal Gate = "prefer_local"
+)
+
+func (g Gate) Valid() bool {
+	switch g {
+	case GateLocal, GateAnd, GateOr, GatePreferLocal:
+		return true
+	}
+	return false
+}
+
+// Healthy combines the backend's views.
+func (g Gate) Healthy(b *backend.Backend) bool {
+	probed, reported := b.Probed(), b.Reported()
+	switch g {
+	case GateAnd:
+		return probed != backend.Down && reported != backend.Down
+	case GateOr:
+		return probed == backend.Up || reported == backend.Up ||
+			probed != backend.Down && reported != backend.Down
+	case GatePreferLocal:
+		if probed != backend.Unknown {
+			return probed == backend.Up
+		}
+		return reported != backend.Down
+	}
+	return probed != backend.Down
+}
+
+// Apply sets the backend's health from its views and reports whether it
+// changed.
+func (g Gate) Apply(b *backend.Backend) bool {
+	return b.SetHealthy(g.Healthy(b))
+}
+
+func DefaultPolicy() Policy {
+	return Policy{
+		Interval: DefaultInterval,
+		Timeout:  DefaultTimeout,
+		Probe:    TCPProbe,
+	}
+}
+
+func (p Policy) withDefaults() Policy {
+	def := DefaultPolicy()
+	if p.Interval <= 0 {
+		p.Interval = def.Interval
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = def.Timeout
+	}
+	if p.Probe == nil {
+		p.Probe = p.Type.Probe()
+	}
+	p.Rise = max(p.Rise, 1)
+	p.Fall = max(p.Fall, 1)
+	return p
+}
+
+func (p Policy) probe(b *backend.Backend) error {
+	if p.Check == nil {
+		return p.Probe(b.Addr, p.Timeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+	return p.Check(ctx, b)
+}
+
+// Checker periodically probes a set of backends and updates their health.
+// Its policy can be changed while it runs.
+type Checker struct {
+	clock clock.Clock
+	//log is logging.Default unless SetLogger changed it
+	log *slog.Logger
+
+	mu      sync.Mutex
+	policy  Policy
+	changed chan struct{}
+	//observe sees every probe result
+	observe func(b *backend.Backend, err error)
+	//held are the backends kept healthy by MinHealthy, by address
+	held map[string]bool
+	//streaks count the checks in a row that passed, or failed when
+	//negative, by address
+	streaks map[string]int
+	//failures count the connections in a row that failed, by address
+	failures map[string]int
+	//targets are those of Run, for MinHealthy between rounds
+	targets func() []*backend.Backend
+	//throttle says how many rounds to merge into one, see Throttle
+	throttle func() int
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewChecker(c clock.Clock, policy Policy) *Checker {
+	return &Checker{
+		clock:    c,
+		log:      logging.Default(),
+		policy:   policy.withDefaults(),
+		changed:  make(chan struct{}, 1),
+		held:     make(map[string]bool),
+		streaks:  make(map[string]int),
+		failures: make(map[string]int),
+		stop:     make(chan struct{}),
+	}
+}
+
+func (c *Checker) Policy() Policy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.policy
+}
+
+// SetPolicy replaces the policy; a running checker picks it up immediately.
+func (c *Checker) SetPolicy(policy Policy) {
+	c.mu.Lock()
+	c.policy = policy.withDefaults()
+	c.mu.Unlock()
+
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// SetLogger sends what the checker logs to l; call it before Run.
+func (c *Checker) SetLogger(l *slog.Logger) {
+	c.log = l
+}
+
+// OnResult registers fn to see the result of every probe, such as
+// ErrGoingAway, before it is applied.
+func (c *Checker) OnResult(fn func(b *backend.Backend, err error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.observe = fn
+}
+
+// Throttle registers fn, which Run asks before every round: while it
+// returns n > 1 only every nth round runs, to spare an overloaded host.
+func (c *Checker) Throttle(fn func() int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.throttle = fn
+}
+
+// slowdown is the current factor of Throttle, 1 without one.
+func (c *Checker) slowdown() int {
+	c.mu.Lock()
+	fn := c.throttle
+	c.mu.Unlock()
+	if fn == nil {
+		return 1
+	}
+	return max(1, fn())
+}
+
+// Check probes one backend and logs only when its status changes.
+func (c *Checker) Check(b *backend.Backend) {
+	c.check(b, nil)
+}
+
+// check is Check within set, the backends MinHealthy counts.
+func (c *Checker) check(b *backend.Backend, set []*backend.Backend) {
+	policy := c.Policy()
+	start := c.clock.Now()
+	err := policy.probe(b)
+	b.Probes.Observe(c.clock.Since(start), err)
+
+	c.mu.Lock()
+	observe := c.observe
+	c.mu.Unlock()
+	if observe != nil {
+		observe(b, err)
+	}
+	//a backend going away still serves what it has; it is drained instead
+	if errors.Is(err, ErrGoingAway) {
+		err = nil
+	}
+	if !c.count(b, err == nil, policy) {
+		return
+	}
+	if c.hold(b, set, policy.MinHealthy, err) {
+		return
+	}
+
+	b.SetProbed(backend.ViewOf(err == nil))
+	if !policy.Gate.Apply(b) {
+		return
+	}
+
+	switch healthy := b.Healthy(); {
+	case !healthy && err != nil:
+		c.log.Warn("Server marked as UNHEALTHY", "backend", b.Addr, "error", err)
+	case !healthy:
+		c.log.Warn("Server marked as UNHEALTHY (discovery)", "backend", b.Addr)
+	case err != nil:
+		c.log.Info("Server marked as HEALTHY (discovery, check failing)", "backend", b.Addr, "error", err)
+	default:
+		c.log.Info("Server marked as HEALTHY", "backend", b.Addr)
+	}
+}
+
+// count adds a check to b's streak and reports whether the streak is long
+// enough to change the backend's probed view, or confirms it.
+func (c *Checker) count(b *backend.Backend, up bool, policy Policy) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.streaks[b.Addr]
+	switch {
+	case up && s < 0, !up && s > 0:
+		s = 0
+	}
+	if up {
+		s++
+	} else {
+		s--
+	}
+	c.streaks[b.Addr] = s
+
+	switch b.Probed() {
+	case backend.Up:
+		return up || -s >= policy.Fall
+	case backend.Down:
+		return !up || s >= policy.Rise
+	}
+	return true
+}
+
+// Traffic feeds the outcome of a real connection to b into its health:
+// after Passive failures in a row it is marked down without waiting for
+// the next check.
+func (c *Checker) Traffic(b *backend.Backend, err error) {
+	policy := c.Policy()
+	if policy.Passive <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	if err == nil {
+		delete(c.failures, b.Addr)
+		c.mu.Unlock()
+		return
+	}
+	c.failures[b.Addr]++
+	failed := c.failures[b.Addr]
+	targets := c.targets
+	c.mu.Unlock()
+
+	if failed < policy.Passive || b.Probed() == backend.Down {
+		return
+	}
+	var set []*backend.Backend
+	if targets != nil {
+		set = targets()
+	}
+	if c.hold(b, set, policy.MinHealthy, err) {
+		return
+	}
+
+	c.mu.Lock()
+	delete(c.failures, b.Addr)
+	//the checks start counting towards Rise from here
+	c.streaks[b.Addr] = 0
+	c.mu.Unlock()
+
+	b.SetProbed(backend.Down)
+	if policy.Gate.Apply(b) && !b.Healthy() {
+		c.log.Warn("Server marked as UNHEALTHY, connections in a row failed", "backend", b.Addr, "failed", failed, "error", err)
+	}
+}
+
+// forget drops what is kept about backends no longer in set.
+func (c *Checker) forget(set []*backend.Backend) {
+	keep := make(map[string]bool, len(set))
+	for _, b := range set {
+		keep[b.Addr] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, m := range []map[string]int{c.streaks, c.failures} {
+		for addr := range m {
+			if !keep[addr] {
+				delete(m, addr)
+			}
+		}
+	}
+	for addr := range c.held {
+		if !keep[addr] {
+			delete(c.held, addr)
+		}
+	}
+}
+
+// hold reports whether b stays healthy despite failing, because marking it
+// down would leave fewer than minHealthy healthy backends in set.
+func (c *Checker) hold(b *backend.Backend, set []*backend.Backend, minHealthy int, err error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil || minHealthy <= 0 || !b.Healthy() {
+		delete(c.held, b.Addr)
+		return false
+	}
+	healthy := 0
+	for _, other := range set {
+		if other.Healthy() {
+			healthy++
+		}
+	}
+	if healthy > minHealthy {
+		delete(c.held, b.Addr)
+		return false
+	}
+
+	if !c.held[b.Addr] {
+		c.held[b.Addr] = true
+		c.log.Warn("Server failing checks but kept HEALTHY", "backend", b.Addr, "error", err, "min_healthy", minHealthy)
+	}
+	return true
+}
+
+// Stop ends Run after the round in progress, if any.
+func (c *Checker) Stop() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// Run checks every backend returned by targets once per interval until
+// Stop.
+func (c *Checker) Run(targets func() []*backend.Backend) {
+	c.mu.Lock()
+	c.targets = targets
+	c.mu.Unlock()
+
+	policy := c.Policy()
+	ticker := c.clock.NewTicker(policy.Interval)
+	defer ticker.Stop()
+
+	c.log.Info("Health checker started", "interval", policy.Interval)
+
+	//skipped counts the rounds left out by Throttle since the last one
+	skipped := 0
+	for {
+		select {
+		case <-c.stop:
+			return
+
+		case <-c.changed:
+			next := c.Policy()
+			if next.Interval != policy.Interval {
+				ticker.Reset(next.Interval)
+				c.log.Info("Health check interval changed", "interval", next.Interval)
+			}
+			policy = next
+
+		case <-ticker.C():
+			if policy.External {
+				continue
+			}
+			if skipped++; skipped < c.slowdown() {
+				continue
+			}
+			skipped = 0
+
+			c.log.Info("Running health checks...")
+
+			set := targets()
+			for _, b := range set {
+				c.check(b, set)
+			}
+			c.forget(set)
+		}
+	}
+}
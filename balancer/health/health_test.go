@@ -0,0 +1,65 @@
+package health
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"loadbalancer/balancer/backend"
+	"loadbalancer/balancer/clock"
+)
+
+func TestRiseFall(t *testing.T) {
+	f := clock.NewFake(time.Unix(0, 0))
+	results := make(chan error)
+	c := NewChecker(f, Policy{
+		Interval: time.Second,
+		Rise:     2,
+		Fall:     3,
+		Probe:    func(string, time.Duration) error { return <-results },
+	})
+	c.SetLogger(slog.New(slog.DiscardHandler))
+
+	b := backend.New("10.0.0.1:80")
+	rounds := make(chan struct{})
+	go c.Run(func() []*backend.Backend {
+		rounds <- struct{}{}
+		return []*backend.Backend{b}
+	})
+	defer close(results)
+	defer c.Stop()
+
+	for f.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	//tick starts the next round, which Run only gets to once the last is applied
+	tick := func() {
+		f.Advance(time.Second)
+		<-rounds
+	}
+
+	down := errors.New("connection refused")
+	tick()
+	for i, step := range []struct {
+		err     error
+		healthy bool
+	}{
+		{nil, true},
+		{down, true},
+		{nil, true}, //a pass resets the streak
+		{down, true},
+		{down, true},
+		{down, false},
+		{nil, false},
+		{down, false},
+		{nil, false},
+		{nil, true},
+	} {
+		results <- step.err
+		tick()
+		if got := b.Healthy(); got != step.healthy {
+			t.Errorf("check %d (%v): healthy %v, want %v", i, step.err, got, step.healthy)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package health
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTP checks that a backend serves requests, not only that it accepts
+// connections.
+type HTTP struct {
+	//Path is requested with GET, default "/"
+	Path string
+	//Status is the one status that counts as healthy, 0 for any 2xx or 3xx
+	Status int
+}
+
+// Probe returns the check of h.
+func (h HTTP) Probe(addr string, timeout time.Duration) error {
+	path := h.Path
+	if path == "" {
+		path = "/"
+	}
+	status, _, err := get(addr, path, timeout)
+	if err != nil {
+		return err
+	}
+	if h.Status != 0 && status != h.Status {
+		return fmt.Errorf("GET %s answered %d, want %d", path, status, h.Status)
+	}
+	if h.Status == 0 && (status < 200 || status > 399) {
+		return fmt.Errorf("GET %s answered %d", path, status)
+	}
+	return nil
+}
+
+// get is a minimal HTTP/1.0 GET, so checks don't depend on net/http. It
+// returns the status and the first 4KB of the body.
+func get(addr, path string, timeout time.Duration) (int, string, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return 0, "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := fmt.Fprintf(conn, "GET %s HTTP/1.0\r\nHost: %s\r\nUser-Agent: loadbalancer-health\r\n\r\n", path, addr); err != nil {
+		return 0, "", err
+	}
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return 0, "", fmt.Errorf("malformed status line %q", strings.TrimSpace(line))
+	}
+	status, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, "", fmt.Errorf("malformed status %q", fields[1])
+	}
+
+	//skip the headers
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return 0, "", err
+		}
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+	}
+	body, _ := io.ReadAll(io.LimitReader(r, 4<<10))
+	return status, string(body), nil
+}
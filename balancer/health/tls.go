@@ -0,0 +1,28 @@
+//go:build !notls
+
+package health
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// TLSProbe considers a backend healthy when a TLS handshake with it
+// completes. The certificate isn't verified; that is the business of the
+// connections themselves.
+func TLSProbe(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	host, _, _ := net.SplitHostPort(addr)
+	tc := tls.Client(conn, &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: true,
+	})
+	return tc.Handshake()
+}
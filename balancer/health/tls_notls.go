@@ -0,0 +1,13 @@
+//go:build notls
+
+package health
+
+import (
+	"errors"
+	"time"
+)
+
+// TLSProbe fails every check; this build has no TLS.
+func TLSProbe(addr string, timeout time.Duration) error {
+	return errors.New("tls checks not built in (notls build tag)")
+}
@@ -0,0 +1,54 @@
+package balancer
+
+import (
+	"net"
+	"strings"
+
+	"loadbalancer/balancer/audit"
+	"loadbalancer/balancer/listener"
+)
+
+// requestedHost is the hostname the client asked for: the SNI of a
+// passthrough or terminated TLS connection, else the Host of the request
+// peeked by the HTTP adapter, else what Sniff found. Empty when none of
+// them ran.
+func requestedHost(conn net.Conn) string {
+	if name := tlsServerName(conn); name != "" {
+		return name
+	}
+	if name := httpHost(conn); name != "" {
+		return name
+	}
+	if c, ok := listener.Find[*listener.SniffConn](conn); ok {
+		return c.ServerName
+	}
+	return ""
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.Trim(host, "[]")
+}
+
+// checkHost applies the listener's per-host connection limit.
+func (lb *LoadBalancer) checkHost(fe *frontend, conn net.Conn) bool {
+	if fe.cfg.HostLimit == nil {
+		return true
+	}
+
+	host := requestedHost(conn)
+	if !fe.cfg.HostLimit.AllowConn(host) {
+		lb.reject(fe, conn.RemoteAddr(), audit.KindRateLimit, "connection rate limit for host "+hostLabel(host))
+		return false
+	}
+	return true
+}
+
+func hostLabel(host string) string {
+	if host == "" {
+		return "(none)"
+	}
+	return host
+}
@@ -0,0 +1,157 @@
+//go:build !nohttp
+
+package balancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"loadbalancer/balancer/audit"
+	"loadbalancer/balancer/listener"
+	"loadbalancer/balancer/proxy"
+)
+
+// client certificate details forwarded to backends in HTTP mode
+const (
+	HeaderClientCertSubject     = "X-Client-Cert-Subject"
+	HeaderClientCertFingerprint = "X-Client-Cert-Fingerprint"
+	HeaderClientCertURI         = "X-Client-Cert-Uri"
+)
+
+// serveHTTP proxies a ModeHTTP connection to b of pool through the
+// listener's hooks.
+func (lb *LoadBalancer) serveHTTP(fe *frontend, pool *Pool, b *Backend, clientConn, backendConn net.Conn, meter proxy.Meter, headerTimeout time.Duration, lc *liveConn) error {
+	opts := lb.httpOptions(fe, clientConn, lc)
+	response := opts.Response
+	opts.Response = func(req *http.Request, resp *http.Response) {
+		response(req, resp)
+		if lb.Debugging() {
+			resp.Header.Set(lb.debugHeaderName(), debugValue(pool, b))
+		}
+	}
+	opts.Observe = func(x proxy.Exchange) {
+		switch {
+		case x.Local:
+			pool.requests.Answered()
+			b.Requests.Answered()
+		case x.Response == nil:
+			pool.requests.Failed()
+			b.Requests.Failed()
+			lb.breakers.Record(b, errNoResponse)
+		default:
+			pool.requests.Responded(x.Response.StatusCode, x.Latency)
+			b.Requests.Responded(x.Response.StatusCode, x.Latency)
+			if x.Response.StatusCode >= 500 {
+				lb.breakers.Record(b, fmt.Errorf("%w: %s", errServerError, x.Response.Status))
+			} else {
+				lb.breakers.Record(b, nil)
+			}
+		}
+	}
+	opts.HeaderTimeout = headerTimeout
+	return proxy.ServeHTTP(clientConn, backendConn, meter, opts)
+}
+
+// checkHTTP reports listener settings this build cannot serve.
+func checkHTTP(cfg ListenerConfig) error {
+	return nil
+}
+
+// httpHost is the Host of the first request, peeked by the HTTP adapter.
+func httpHost(conn net.Conn) string {
+	if c, ok := listener.Find[*listener.HTTPConn](conn); ok {
+		return stripPort(c.Request.Host)
+	}
+	return ""
+}
+
+// httpHeader is a header of the first request, peeked by the HTTP adapter.
+func httpHeader(conn net.Conn, name string) string {
+	if c, ok := listener.Find[*listener.HTTPConn](conn); ok {
+		return c.Request.Header.Get(name)
+	}
+	return ""
+}
+
+// limitRequest answers 429 when the Host of an HTTP request is over its
+// request rate.
+func (lb *LoadBalancer) limitRequest(fe *frontend, req *http.Request, client string) *http.Response {
+	host := stripPort(req.Host)
+	if fe.cfg.HostLimit.AllowRequest(host) {
+		return nil
+	}
+
+	lb.audit.Record(audit.Event{
+		Kind:     audit.KindRateLimit,
+		Listener: fe.addr.String(),
+		Client:   client,
+		Rule:     "request rate limit for host " + hostLabel(host),
+	})
+
+	resp := proxy.TextResponse(req, http.StatusTooManyRequests, "Too Many Requests\n")
+	resp.Header.Set("Retry-After", "1")
+	return resp
+}
+
+// httpOptions builds the per-connection hooks for HTTP mode.
+func (lb *LoadBalancer) httpOptions(fe *frontend, clientConn net.Conn, lc *liveConn) proxy.HTTPOptions {
+	identity := listener.ClientIdentity(clientConn)
+	isTLS := isTLSConn(clientConn)
+	clientHost := clientIP(clientConn.RemoteAddr()).String()
+
+	return proxy.HTTPOptions{
+		Request: func(req *http.Request) *http.Response {
+			setForwardedHeaders(req, clientHost, isTLS)
+			setClientCertHeaders(req, identity)
+			if resp := lb.limitRequest(fe, req, clientHost); resp != nil {
+				return resp
+			}
+			if resp := authorizeEdge(fe.cfg.Auth, req, clientHost, lb.log); resp != nil {
+				return resp
+			}
+			return fe.cfg.JWT.authorize(req, clientHost, lb.log)
+		},
+		Response: func(req *http.Request, resp *http.Response) {
+			//the client reconnects for its next request, to a backend
+			//with room
+			if lc.leaving() {
+				resp.Close = true
+				resp.Header.Set("Connection", "close")
+			}
+		},
+	}
+}
+
+func setForwardedHeaders(req *http.Request, clientHost string, isTLS bool) {
+	if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+		clientHost = prior + ", " + clientHost
+	}
+	req.Header.Set("X-Forwarded-For", clientHost)
+
+	proto := "http"
+	if isTLS {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+}
+
+// setClientCertHeaders always strips client-supplied certificate headers so
+// backends can trust them.
+func setClientCertHeaders(req *http.Request, identity *listener.Identity) {
+	req.Header.Del(HeaderClientCertSubject)
+	req.Header.Del(HeaderClientCertFingerprint)
+	req.Header.Del(HeaderClientCertURI)
+
+	if identity == nil {
+		return
+	}
+
+	req.Header.Set(HeaderClientCertSubject, identity.Subject)
+	req.Header.Set(HeaderClientCertFingerprint, identity.Fingerprint)
+	if len(identity.URIs) > 0 {
+		req.Header.Set(HeaderClientCertURI, strings.Join(identity.URIs, ","))
+	}
+}
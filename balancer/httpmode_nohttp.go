@@ -0,0 +1,32 @@
+//go:build nohttp
+
+package balancer
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"loadbalancer/balancer/proxy"
+)
+
+// JWTPolicy is only available with HTTP mode; in nohttp builds listeners
+// that set one are refused.
+type JWTPolicy struct{}
+
+var errNoHTTP = errors.New("HTTP mode, auth and JWT are not built in (nohttp build tag)")
+
+func (lb *LoadBalancer) serveHTTP(fe *frontend, pool *Pool, b *Backend, clientConn, backendConn net.Conn, meter proxy.Meter, headerTimeout time.Duration, lc *liveConn) error {
+	return errNoHTTP
+}
+
+func checkHTTP(cfg ListenerConfig) error {
+	if cfg.Mode == ModeHTTP || cfg.Auth != nil || cfg.JWT != nil {
+		return errNoHTTP
+	}
+	return nil
+}
+
+func httpHost(conn net.Conn) string { return "" }
+
+func httpHeader(conn net.Conn, name string) string { return "" }
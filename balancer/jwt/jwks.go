@@ -0,0 +1,238 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/clock"
+)
+
+// KeySet fetches a JWKS document and caches its keys. Unknown key IDs
+// and an expired cache trigger a refresh, at most once per MinRefresh, so
+// key rotation on the issuer side is picked up without hammering it. One
+// fetch runs at a time and, while the issuer is unreachable, the keys
+// already known keep serving.
+type KeySet struct {
+	URL string
+	//TTL is used when the response has no Cache-Control max-age, default 1h
+	TTL        time.Duration
+	MinRefresh time.Duration
+	HTTP       *http.Client
+	Clock      clock.Clock
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	expires time.Time
+	//lastFetch is when the last fetch ended, or the running one began
+	lastFetch time.Time
+	//fetching is closed when the running fetch ends, nil without one
+	fetching chan struct{}
+	//err is the last fetch's
+	err error
+}
+
+func NewKeySet(url string, c clock.Clock) *KeySet {
+	return &KeySet{
+		URL:        url,
+		TTL:        time.Hour,
+		MinRefresh: 30 * time.Second,
+		HTTP:       &http.Client{Timeout: 10 * time.Second},
+		Clock:      c,
+	}
+}
+
+// Key returns the public key for kid, fetching the set when the cache is
+// cold, expired or does not know kid yet. An expired key is returned at
+// once while the set is refetched in the background.
+func (ks *KeySet) Key(kid string) (crypto.PublicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	key, known := ks.keys[kid]
+	if known && !ks.Clock.Now().After(ks.expires) {
+		return key, nil
+	}
+
+	done := ks.refresh()
+	if known {
+		return key, nil
+	}
+	if done != nil {
+		ks.mu.Unlock()
+		<-done
+		ks.mu.Lock()
+		if key, known = ks.keys[kid]; known {
+			return key, nil
+		}
+	}
+
+	if ks.keys == nil && ks.err != nil {
+		return nil, ks.err
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// refresh starts a fetch of the set, unless one is running or the last
+// ended less than MinRefresh ago, and returns the channel closed when the
+// running fetch ends, nil without one. ks.mu must be held.
+func (ks *KeySet) refresh() <-chan struct{} {
+	if ks.fetching != nil {
+		return ks.fetching
+	}
+	now := ks.Clock.Now()
+	if now.Sub(ks.lastFetch) < ks.MinRefresh {
+		return nil
+	}
+	ks.lastFetch = now
+
+	done := make(chan struct{})
+	ks.fetching = done
+	go func() {
+		keys, ttl, err := ks.fetch()
+
+		ks.mu.Lock()
+		defer ks.mu.Unlock()
+		//a failed fetch puts off the next one by MinRefresh too
+		now := ks.Clock.Now()
+		ks.lastFetch = now
+		ks.err = err
+		if err == nil {
+			ks.keys = keys
+			ks.expires = now.Add(ttl)
+		}
+		ks.fetching = nil
+		close(done)
+	}()
+	return done
+}
+
+// fetch downloads the set and returns its signing keys and how long to
+// cache them.
+func (ks *KeySet) fetch() (map[string]crypto.PublicKey, time.Duration, error) {
+	resp, err := ks.HTTP.Get(ks.URL)
+	if err != nil {
+		return nil, 0, fmt.Errorf("fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("fetching JWKS: %s", resp.Status)
+	}
+
+	var doc struct {
+		Keys []jsonKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, 0, fmt.Errorf("decoding JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(doc.Keys))
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			//skip key types we do not understand rather than failing the set
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return nil, 0, errors.New("JWKS has no usable signing keys")
+	}
+	return keys, maxAge(resp.Header.Get("Cache-Control"), ks.TTL), nil
+}
+
+func maxAge(cacheControl string, fallback time.Duration) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if strings.EqualFold(name, "max-age") {
+			if secs, err := strconv.Atoi(value); err == nil && secs > 0 {
+				return time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return fallback
+}
+
+type jsonKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
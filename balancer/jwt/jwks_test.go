@@ -0,0 +1,122 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"loadbalancer/balancer/clock"
+)
+
+// issuer serves a JWKS with one Ed25519 key under kid, or fails while down.
+type issuer struct {
+	fetches atomic.Int32
+	down    atomic.Bool
+	//wait holds every request until it is closed
+	wait chan struct{}
+}
+
+func newIssuer(t *testing.T, kid string, pub ed25519.PublicKey) (*issuer, *httptest.Server) {
+	is := &issuer{wait: make(chan struct{})}
+	close(is.wait)
+	doc := fmt.Sprintf(`{"keys":[{"kty":"OKP","crv":"Ed25519","kid":%q,"x":%q}]}`, kid, base64.RawURLEncoding.EncodeToString(pub))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		is.fetches.Add(1)
+		<-is.wait
+		if is.down.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, doc)
+	}))
+	t.Cleanup(srv.Close)
+	return is, srv
+}
+
+func TestKeySetStale(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	is, srv := newIssuer(t, "a", pub)
+	f := clock.NewFake(time.Unix(1000, 0))
+	ks := NewKeySet(srv.URL, f)
+
+	if _, err := ks.Key("a"); err != nil {
+		t.Fatal(err)
+	}
+	is.down.Store(true)
+	f.Advance(2 * time.Minute)
+
+	//the expired key keeps serving while the refetch fails behind it
+	for range 10 {
+		if _, err := ks.Key("a"); err != nil {
+			t.Fatalf("stale key: %v", err)
+		}
+	}
+	//an unknown kid waits for the refetch in flight, if any, and starts none
+	if _, err := ks.Key("b"); err == nil {
+		t.Error("unknown kid: no error")
+	}
+	if n := is.fetches.Load(); n != 2 {
+		t.Errorf("%d fetches within MinRefresh, want 2", n)
+	}
+
+	f.Advance(ks.MinRefresh)
+	is.down.Store(false)
+	ks.Key("b")
+	if n := is.fetches.Load(); n != 3 {
+		t.Errorf("%d fetches after MinRefresh, want 3", n)
+	}
+}
+
+func TestKeySetSingleFetch(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	is, srv := newIssuer(t, "a", pub)
+	is.wait = make(chan struct{})
+	ks := NewKeySet(srv.URL, clock.NewFake(time.Unix(1000, 0)))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for range 20 {
+		wg.Go(func() {
+			_, err := ks.Key("a")
+			errs <- err
+		})
+	}
+	for is.fetches.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(is.wait)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := is.fetches.Load(); n != 1 {
+		t.Errorf("%d fetches for a cold cache, want 1", n)
+	}
+}
+
+func TestKeySetColdFailure(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	is, srv := newIssuer(t, "a", pub)
+	is.down.Store(true)
+	ks := NewKeySet(srv.URL, clock.NewFake(time.Unix(1000, 0)))
+
+	for range 3 {
+		if _, err := ks.Key("a"); err == nil {
+			t.Fatal("issuer down: no error")
+		}
+	}
+	if n := is.fetches.Load(); n != 1 {
+		t.Errorf("%d fetches, want 1", n)
+	}
+}
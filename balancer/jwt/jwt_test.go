@@ -0,0 +1,190 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"loadbalancer/balancer/clock"
+)
+
+// signers holds one key per algorithm family, under its kid.
+type signers struct {
+	ed  ed25519.PrivateKey
+	ec  *ecdsa.PrivateKey
+	rsa *rsa.PrivateKey
+}
+
+func newSigners(t *testing.T) *signers {
+	_, ed, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &signers{ed: ed, ec: ec, rsa: rk}
+}
+
+// sign builds a token with the key of alg's family; kid defaults to that
+// family's.
+func (s *signers) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	if kid == "" {
+		kid = alg[:2]
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch alg {
+	case "EdDSA":
+		sig = ed25519.Sign(s.ed, []byte(signed))
+	case "ES256":
+		var r, ss *big.Int
+		r, ss, err = ecdsa.Sign(rand.Reader, s.ec, digest[:])
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+		}
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, s.rsa, crypto.SHA256, digest[:])
+	case "PS256":
+		sig, err = rsa.SignPSS(rand.Reader, s.rsa, crypto.SHA256, digest[:], nil)
+	default:
+		//unsupported algorithms get a signature of garbage
+		sig = []byte("sig")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// keySet is a KeySet that already knows the signers' keys and never fetches.
+func (s *signers) keySet(c clock.Clock) *KeySet {
+	return &KeySet{
+		MinRefresh: time.Hour,
+		Clock:      c,
+		keys: map[string]crypto.PublicKey{
+			"Ed": s.ed.Public(),
+			"ES": &s.ec.PublicKey,
+			"RS": &s.rsa.PublicKey,
+			"PS": &s.rsa.PublicKey,
+		},
+		expires:   c.Now().Add(time.Hour),
+		lastFetch: c.Now(),
+	}
+}
+
+func TestVerify(t *testing.T) {
+	s := newSigners(t)
+	f := clock.NewFake(time.Unix(1_000_000, 0))
+	now := float64(f.Now().Unix())
+	v := &Verifier{
+		Keys:     s.keySet(f),
+		Issuer:   "https://issuer.example",
+		Audience: "lb",
+		Leeway:   30 * time.Second,
+		Clock:    f,
+	}
+	valid := func() map[string]any {
+		return map[string]any{"iss": "https://issuer.example", "aud": "lb", "exp": now + 60, "sub": "alice"}
+	}
+	with := func(k string, val any) map[string]any {
+		c := valid()
+		if val == nil {
+			delete(c, k)
+		} else {
+			c[k] = val
+		}
+		return c
+	}
+	good := s.sign(t, "EdDSA", "", valid())
+	parts := strings.Split(good, ".")
+
+	for _, tt := range []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"EdDSA", good, ""},
+		{"ES256", s.sign(t, "ES256", "", valid()), ""},
+		{"RS256", s.sign(t, "RS256", "", valid()), ""},
+		{"PS256", s.sign(t, "PS256", "", valid()), ""},
+
+		{"empty", "", "malformed"},
+		{"two segments", parts[0] + "." + parts[1], "malformed"},
+		{"four segments", good + ".x", "malformed"},
+		{"header not base64", "!!." + parts[1] + "." + parts[2], "malformed"},
+		{"header not JSON", b64([]byte("{")) + "." + parts[1] + "." + parts[2], "malformed"},
+		{"signature not base64", parts[0] + "." + parts[1] + ".!!", "malformed"},
+
+		{"tampered payload", parts[0] + "." + b64([]byte(`{"sub":"root"}`)) + "." + parts[2], "invalid signature"},
+		{"alg none", s.sign(t, "none", "Ed", valid()), "unsupported algorithm"},
+		{"alg HS256", s.sign(t, "HS256", "Ed", valid()), "unsupported algorithm"},
+		{"RSA alg on an Ed25519 key", s.sign(t, "RS256", "Ed", valid()), "invalid signature"},
+		{"short ECDSA signature", parts[0] + "." + parts[1] + "." + b64([]byte("short")), "invalid signature"},
+		{"unknown kid", s.sign(t, "EdDSA", "other", valid()), "unknown key id"},
+
+		{"expired", s.sign(t, "EdDSA", "", with("exp", now-31)), "expired"},
+		{"expired within leeway", s.sign(t, "EdDSA", "", with("exp", now-29)), ""},
+		{"not valid yet", s.sign(t, "EdDSA", "", with("nbf", now+31)), "not valid yet"},
+		{"nbf within leeway", s.sign(t, "EdDSA", "", with("nbf", now+29)), ""},
+		{"no exp", s.sign(t, "EdDSA", "", with("exp", nil)), ""},
+
+		{"wrong issuer", s.sign(t, "EdDSA", "", with("iss", "https://evil.example")), "unexpected issuer"},
+		{"no issuer", s.sign(t, "EdDSA", "", with("iss", nil)), "unexpected issuer"},
+		{"wrong audience", s.sign(t, "EdDSA", "", with("aud", "other")), "unexpected audience"},
+		{"audience list", s.sign(t, "EdDSA", "", with("aud", []string{"other", "lb"})), ""},
+		{"audience list without us", s.sign(t, "EdDSA", "", with("aud", []string{"other"})), "unexpected audience"},
+		{"no audience", s.sign(t, "EdDSA", "", with("aud", nil)), "missing audience"},
+		{"numeric audience", s.sign(t, "EdDSA", "", with("aud", 1)), "missing audience"},
+	} {
+		claims, err := v.Verify(tt.token)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.want == "" && claims.String("sub") != "alice":
+			t.Errorf("%s: sub %q", tt.name, claims.String("sub"))
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestVerifyAlgorithms(t *testing.T) {
+	s := newSigners(t)
+	f := clock.NewFake(time.Unix(1_000_000, 0))
+	v := &Verifier{Keys: s.keySet(f), Algorithms: []string{"EdDSA", "PS256"}, Clock: f}
+
+	for alg, allowed := range map[string]bool{"EdDSA": true, "PS256": true, "ES256": false, "RS256": false} {
+		_, err := v.Verify(s.sign(t, alg, "", map[string]any{}))
+		if allowed && err != nil {
+			t.Errorf("%s: %v", alg, err)
+		}
+		if !allowed && (err == nil || !strings.Contains(err.Error(), "not allowed")) {
+			t.Errorf("%s: got %v, want not allowed", alg, err)
+		}
+	}
+}
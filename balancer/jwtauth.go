@@ -0,0 +1,76 @@
+//go:build !nohttp
+
+package balancer
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"loadbalancer/balancer/jwt"
+	"loadbalancer/balancer/proxy"
+)
+
+// JWTPolicy validates bearer tokens on every request of an HTTP mode
+// listener. Invalid tokens are answered with 401 at the edge.
+type JWTPolicy struct {
+	Verifier *jwt.Verifier
+	//Optional lets requests without an Authorization header through;
+	//a token that is present must still be valid
+	Optional bool
+	//ClaimHeaders maps claim names to request headers set for the backend,
+	//e.g. "sub" -> "X-User". Client-supplied values are always stripped.
+	ClaimHeaders map[string]string
+}
+
+// authorize returns a 401 response for requests that fail the policy and
+// nil otherwise. A nil policy allows everything.
+func (p *JWTPolicy) authorize(req *http.Request, client string, log *slog.Logger) *http.Response {
+	if p == nil {
+		return nil
+	}
+
+	for _, header := range p.ClaimHeaders {
+		req.Header.Del(header)
+	}
+
+	token, found := bearerToken(req)
+	if !found {
+		if p.Optional {
+			return nil
+		}
+		return unauthorized(req, "")
+	}
+
+	claims, err := p.Verifier.Verify(token)
+	if err != nil {
+		log.Info("Rejected JWT", "client", client, "error", err)
+		return unauthorized(req, "invalid_token")
+	}
+
+	for claim, header := range p.ClaimHeaders {
+		if value := claims.String(claim); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	return nil
+}
+
+func bearerToken(req *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+func unauthorized(req *http.Request, code string) *http.Response {
+	resp := proxy.TextResponse(req, http.StatusUnauthorized, "Unauthorized\n")
+	challenge := "Bearer"
+	if code != "" {
+		challenge += fmt.Sprintf(` error="%s"`, code)
+	}
+	resp.Header.Set("WWW-Authenticate", challenge)
+	return resp
+}
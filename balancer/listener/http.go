@@ -0,0 +1,67 @@
+//go:build !nohttp
+
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const maxHeaderBytes = 64 << 10
+
+// HTTP reads the head of the first HTTP/1.x request on the connection so
+// that routing, logging and auth can use it. The bytes are replayed to the
+// backend unchanged.
+type HTTP struct {
+	//Timeout bounds how long the client may take to send the request head, default 10s
+	Timeout time.Duration
+}
+
+func (HTTP) Name() string { return "http" }
+
+func (h HTTP) Adapt(conn net.Conn) (net.Conn, error) {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReaderSize(conn, maxHeaderBytes)
+
+	//peek until the blank line ending the head is buffered
+	var head []byte
+	for {
+		buf, _ := br.Peek(br.Buffered())
+		if i := bytes.Index(buf, []byte("\r\n\r\n")); i >= 0 {
+			head = buf[:i+4]
+			break
+		}
+		if br.Buffered() == br.Size() {
+			return nil, errors.New("request head too large")
+		}
+		//block until at least one more byte arrives
+		if _, err := br.Peek(br.Buffered() + 1); err != nil {
+			return nil, fmt.Errorf("reading request head: %w", err)
+		}
+	}
+
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		return nil, fmt.Errorf("parsing request: %w", err)
+	}
+
+	return &HTTPConn{bufferedConn: bufferedConn{Conn: conn, r: br}, Request: req}, nil
+}
+
+// HTTPConn carries the head of the first request read by the HTTP adapter.
+// The request body is not available; it is still in the connection.
+type HTTPConn struct {
+	bufferedConn
+	Request *http.Request
+}
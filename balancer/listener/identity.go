@@ -0,0 +1,37 @@
+package listener
+
+import (
+	"net"
+	"time"
+)
+
+// Identity describes a verified client certificate.
+type Identity struct {
+	Subject  string
+	Common   string
+	DNSNames []string
+	URIs     []string
+	Serial   string
+	//Fingerprint is the hex SHA-256 of the DER certificate
+	Fingerprint string
+	NotAfter    time.Time
+	//CA is the subject of the CA the certificate was verified against,
+	//empty when it was not verified
+	CA string
+}
+
+// identified is implemented by connections that verified a client
+// certificate, such as TLSConn.
+type identified interface {
+	net.Conn
+	ClientIdentity() *Identity
+}
+
+// ClientIdentity finds the client certificate identity anywhere in the
+// adapter chain of conn.
+func ClientIdentity(conn net.Conn) *Identity {
+	if c, ok := Find[identified](conn); ok {
+		return c.ClientIdentity()
+	}
+	return nil
+}
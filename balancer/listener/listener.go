@@ -0,0 +1,88 @@
+package listener
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+)
+
+// Adapter is one layer of a listener-side protocol stack. Adapters run in
+// order on every accepted connection and may wrap it (TLS), consume a
+// preamble (PROXY protocol), inspect it (HTTP) or reject it by returning an
+// error.
+type Adapter interface {
+	Name() string
+	Adapt(conn net.Conn) (net.Conn, error)
+}
+
+// Chain applies a list of adapters in order.
+type Chain []Adapter
+
+func (c Chain) Adapt(conn net.Conn) (net.Conn, error) {
+	for _, a := range c {
+		next, err := a.Adapt(conn)
+		if err != nil {
+			return nil, &Error{Adapter: a.Name(), Err: err}
+		}
+		conn = next
+	}
+	return conn, nil
+}
+
+// Error is returned by Chain when an adapter rejects a connection.
+type Error struct {
+	Adapter string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s adapter: %v", e.Adapter, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Wrapper is implemented by connections that wrap another one, so metadata
+// added by earlier layers stays reachable.
+type Wrapper interface {
+	Unwrap() net.Conn
+}
+
+// Find walks the wrapper chain of conn and returns the first layer of type T.
+func Find[T net.Conn](conn net.Conn) (T, bool) {
+	for conn != nil {
+		if t, ok := conn.(T); ok {
+			return t, true
+		}
+		w, ok := conn.(Wrapper)
+		if !ok {
+			break
+		}
+		conn = w.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
+// TCP is the raw passthrough adapter.
+type TCP struct{}
+
+func (TCP) Name() string { return "tcp" }
+
+func (TCP) Adapt(conn net.Conn) (net.Conn, error) { return conn, nil }
+
+// bufferedConn replays bytes an adapter read ahead before handing the
+// connection on.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) Unwrap() net.Conn {
+	return c.Conn
+}
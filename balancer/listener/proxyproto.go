@@ -0,0 +1,167 @@
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocol reads a PROXY protocol v1 or v2 header sent by an upstream
+// load balancer and reports the original client address as RemoteAddr.
+type ProxyProtocol struct {
+	//Timeout bounds how long to wait for the header, default 5s
+	Timeout time.Duration
+	//Optional allows clients that do not send a header at all
+	Optional bool
+}
+
+func (ProxyProtocol) Name() string { return "proxy-protocol" }
+
+func (p ProxyProtocol) Adapt(conn net.Conn) (net.Conn, error) {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReader(conn)
+	out := &ProxyConn{bufferedConn: bufferedConn{Conn: conn, r: br}}
+
+	head, err := br.Peek(len(proxyV2Signature))
+	if err != nil && !(p.Optional && len(head) > 0) {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	switch {
+	case bytes.Equal(head, proxyV2Signature):
+		err = out.readV2(br)
+	case bytes.HasPrefix(head, []byte("PROXY ")):
+		err = out.readV1(br)
+	case p.Optional:
+		return out, nil
+	default:
+		return nil, errors.New("missing PROXY protocol header")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ProxyConn carries the addresses announced in the PROXY header.
+type ProxyConn struct {
+	bufferedConn
+	source net.Addr
+	dest   net.Addr
+}
+
+func (c *ProxyConn) RemoteAddr() net.Addr {
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *ProxyConn) LocalAddr() net.Addr {
+	if c.dest != nil {
+		return c.dest
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ProxiedBy returns the address of the proxy that sent the header.
+func (c *ProxyConn) ProxiedBy() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+func (c *ProxyConn) readV1(br *bufio.Reader) error {
+	//v1 headers are at most 107 bytes including CRLF
+	line, err := br.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("malformed PROXY v1 header")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("malformed PROXY v1 header %q", line)
+	}
+
+	src, err := parseAddr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseAddr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+
+	c.source, c.dest = src, dst
+	return nil
+}
+
+func parseAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, fmt.Errorf("invalid address %q in PROXY header", ip)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return nil, fmt.Errorf("invalid port %q in PROXY header", port)
+	}
+	return &net.TCPAddr{IP: addr, Port: p}, nil
+}
+
+func (c *ProxyConn) readV2(br *bufio.Reader) error {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return fmt.Errorf("reading PROXY v2 header: %w", err)
+	}
+
+	if hdr[12]>>4 != 2 {
+		return fmt.Errorf("unsupported PROXY protocol version %d", hdr[12]>>4)
+	}
+	command := hdr[12] & 0x0f
+	family := hdr[13]
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return fmt.Errorf("reading PROXY v2 addresses: %w", err)
+	}
+
+	//LOCAL command: health check from the proxy itself, keep real addresses
+	if command == 0 {
+		return nil
+	}
+
+	switch family >> 4 {
+	case 1: //AF_INET
+		if len(payload) < 12 {
+			return errors.New("short PROXY v2 IPv4 block")
+		}
+		c.source = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		c.dest = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case 2: //AF_INET6
+		if len(payload) < 36 {
+			return errors.New("short PROXY v2 IPv6 block")
+		}
+		c.source = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		c.dest = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+//go:build !notls
+
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// SNI reads the TLS ClientHello to learn the requested server name without
+// terminating TLS, for passthrough listeners. The bytes are replayed to the
+// backend unchanged.
+type SNI struct {
+	//Timeout bounds how long the client may take to send the ClientHello, default 10s
+	Timeout time.Duration
+}
+
+func (SNI) Name() string { return "sni" }
+
+var errHelloRead = errors.New("client hello read")
+
+func (s SNI) Adapt(conn net.Conn) (net.Conn, error) {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	//let crypto/tls parse the hello from a copy of what we read, then stop
+	var seen bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(helloConn{r: io.TeeReader(conn, &seen)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	if hello == nil {
+		return nil, fmt.Errorf("reading client hello: %w", err)
+	}
+
+	replay := bufio.NewReader(io.MultiReader(&seen, conn))
+	return &SNIConn{bufferedConn: bufferedConn{Conn: conn, r: replay}, ServerName: hello.ServerName}, nil
+}
+
+// SNIConn carries the server name from the ClientHello; empty when the
+// client sent none.
+type SNIConn struct {
+	bufferedConn
+	ServerName string
+}
+
+// helloConn feeds the handshake from r and swallows what it writes back.
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error)       { return c.r.Read(p) }
+func (c helloConn) Write(p []byte) (int, error)      { return len(p), nil }
+func (c helloConn) Close() error                     { return nil }
+func (c helloConn) LocalAddr() net.Addr              { return nil }
+func (c helloConn) RemoteAddr() net.Addr             { return nil }
+func (c helloConn) SetDeadline(time.Time) error      { return nil }
+func (c helloConn) SetReadDeadline(time.Time) error  { return nil }
+func (c helloConn) SetWriteDeadline(time.Time) error { return nil }
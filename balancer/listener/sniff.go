@@ -0,0 +1,292 @@
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Protocols told apart by Sniff.
+const (
+	ProtocolTLS  = "tls"
+	ProtocolHTTP = "http"
+	ProtocolSSH  = "ssh"
+	//ProtocolOther is anything else, including clients that wait for the
+	//server to speak first
+	ProtocolOther = "other"
+)
+
+const (
+	//a TLS record header and the largest record
+	maxSniffTLS = 5 + 16<<10
+	//enough for the request line and the usual headers
+	maxSniffHTTP = 8 << 10
+)
+
+var httpMethods = []string{"GET ", "POST ", "PUT ", "HEAD ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE ", "PRI "}
+
+// Sniff looks at the first bytes of a connection to tell its protocol and,
+// for TLS and HTTP, the server name asked for. Unlike SNI and HTTP it never
+// fails on an unexpected protocol, so one listener can take several and
+// route each to its own pool. Everything read is replayed to the backend.
+type Sniff struct {
+	//Wait bounds how long the client may take to send enough to decide,
+	//default 1s; a client still silent after it is ProtocolOther
+	Wait time.Duration
+}
+
+func (Sniff) Name() string { return "sniff" }
+
+func (s Sniff) Adapt(conn net.Conn) (net.Conn, error) {
+	wait := s.Wait
+	if wait <= 0 {
+		wait = time.Second
+	}
+	conn.SetReadDeadline(time.Now().Add(wait))
+	defer conn.SetReadDeadline(time.Time{})
+
+	sn := &sniffer{conn: conn}
+	if err := sn.fill(1); err != nil && len(sn.buf) == 0 && !isTimeout(err) {
+		return nil, err
+	}
+
+	sc := &SniffConn{Protocol: ProtocolOther}
+	switch {
+	case len(sn.buf) == 0:
+	case sn.buf[0] == 0x16:
+		sc.Protocol = ProtocolTLS
+		sc.ServerName, sc.ALPN = sn.clientHello()
+	case sn.prefixOf(httpMethods):
+		sc.Protocol = ProtocolHTTP
+		sc.ServerName = sn.httpHost()
+	case sn.prefixOf([]string{"SSH-"}):
+		sc.Protocol = ProtocolSSH
+	}
+
+	//a bufio.Reader over the replay rather than over conn, as the sniffing
+	//reads may have ended in a deadline error it would hand out later
+	replay := bufio.NewReader(io.MultiReader(bytes.NewReader(sn.buf), conn))
+	sc.bufferedConn = bufferedConn{Conn: conn, r: replay}
+	return sc, nil
+}
+
+// SniffConn carries what Sniff found out. ServerName is the SNI of a TLS
+// ClientHello or the Host of an HTTP request, without the port.
+type SniffConn struct {
+	bufferedConn
+	Protocol   string
+	ServerName string
+	//ALPN are the protocols a TLS client offered
+	ALPN []string
+}
+
+// sniffer reads ahead on conn, keeping everything it read.
+type sniffer struct {
+	conn net.Conn
+	buf  []byte
+}
+
+// fill reads until at least n bytes are buffered or the read fails.
+func (s *sniffer) fill(n int) error {
+	for len(s.buf) < n {
+		if cap(s.buf) < n {
+			grown := make([]byte, len(s.buf), max(n, 512))
+			copy(grown, s.buf)
+			s.buf = grown
+		}
+		m, err := s.conn.Read(s.buf[len(s.buf):cap(s.buf)])
+		s.buf = s.buf[:len(s.buf)+m]
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prefixOf reports whether the data starts with one of prefixes, reading
+// more when it is too short to tell.
+func (s *sniffer) prefixOf(prefixes []string) bool {
+	for _, p := range prefixes {
+		if len(s.buf) < len(p) && strings.HasPrefix(p, string(s.buf)) {
+			s.fill(len(p))
+		}
+		if bytes.HasPrefix(s.buf, []byte(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpHost reads the request head and returns its Host, empty when the
+// head doesn't arrive in time or has none.
+func (s *sniffer) httpHost() string {
+	for !bytes.Contains(s.buf, []byte("\r\n\r\n")) {
+		if len(s.buf) >= maxSniffHTTP || s.fill(len(s.buf)+1) != nil {
+			return ""
+		}
+	}
+
+	head := string(s.buf[:bytes.Index(s.buf, []byte("\r\n\r\n"))])
+	for _, line := range strings.Split(head, "\r\n")[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "host") {
+			return stripHostPort(strings.ToLower(strings.TrimSpace(value)))
+		}
+	}
+	return ""
+}
+
+func stripHostPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.Trim(host, "[]")
+}
+
+// clientHello reads the first TLS record and picks out the server name
+// and ALPN extensions. A hello that doesn't fit in one record, which
+// clients don't send in practice, yields neither.
+func (s *sniffer) clientHello() (string, []string) {
+	if s.fill(5) != nil {
+		return "", nil
+	}
+	n := 5 + int(binary.BigEndian.Uint16(s.buf[3:5]))
+	if n > maxSniffTLS || s.fill(n) != nil {
+		return "", nil
+	}
+
+	name, alpn, err := parseClientHello(s.buf[5:n])
+	if err != nil {
+		return "", nil
+	}
+	return name, alpn
+}
+
+var errShortHello = errors.New("truncated client hello")
+
+// parseClientHello walks a handshake message holding a ClientHello.
+func parseClientHello(msg []byte) (string, []string, error) {
+	r := helloReader(msg)
+	//handshake type 1 and a 24-bit length
+	if t, ok := r.u8(); !ok || t != 1 {
+		return "", nil, errors.New("not a client hello")
+	}
+	if !r.skip(3 + 2 + 32) {
+		return "", nil, errShortHello
+	}
+	//session id, cipher suites and compression methods
+	if _, ok := r.vec8(); !ok {
+		return "", nil, errShortHello
+	}
+	if _, ok := r.vec16(); !ok {
+		return "", nil, errShortHello
+	}
+	if _, ok := r.vec8(); !ok {
+		return "", nil, errShortHello
+	}
+
+	exts, ok := r.vec16()
+	if !ok {
+		//no extensions at all
+		return "", nil, nil
+	}
+
+	var name string
+	var alpn []string
+	for len(exts) > 0 {
+		t, ok1 := exts.u16()
+		body, ok2 := exts.vec16()
+		if !ok1 || !ok2 {
+			return "", nil, errShortHello
+		}
+
+		switch t {
+		case 0: //server_name
+			list, _ := body.vec16()
+			for len(list) > 0 {
+				kind, _ := list.u8()
+				host, ok := list.vec16()
+				if !ok {
+					break
+				}
+				if kind == 0 {
+					name = strings.ToLower(string(host))
+				}
+			}
+		case 16: //application_layer_protocol_negotiation
+			list, _ := body.vec16()
+			for len(list) > 0 {
+				proto, ok := list.vec8()
+				if !ok {
+					break
+				}
+				alpn = append(alpn, string(proto))
+			}
+		}
+	}
+	return name, alpn, nil
+}
+
+// helloReader consumes a byte slice from the front.
+type helloReader []byte
+
+func (r *helloReader) u8() (byte, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *helloReader) u16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *helloReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *helloReader) bytes(n int) (helloReader, bool) {
+	if len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+func (r *helloReader) vec8() (helloReader, bool) {
+	n, ok := r.u8()
+	if !ok {
+		return nil, false
+	}
+	return r.bytes(int(n))
+}
+
+func (r *helloReader) vec16() (helloReader, bool) {
+	n, ok := r.u16()
+	if !ok {
+		return nil, false
+	}
+	return r.bytes(int(n))
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,119 @@
+//go:build !notls
+
+package listener
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net"
+	"time"
+)
+
+// TLS terminates TLS on accepted connections.
+type TLS struct {
+	Config *tls.Config
+	//HandshakeTimeout bounds the handshake, default 10s
+	HandshakeTimeout time.Duration
+
+	//ClientCAs, when set, makes a client certificate signed by one of them mandatory
+	ClientCAs *x509.CertPool
+	//ClientCAPool is like ClientCAs but asked on every handshake, for CA
+	//bundles that are reloaded
+	ClientCAPool func() *x509.CertPool
+}
+
+func (TLS) Name() string { return "tls" }
+
+func (t TLS) Adapt(conn net.Conn) (net.Conn, error) {
+	if t.Config == nil {
+		return nil, errors.New("no TLS config")
+	}
+
+	timeout := t.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	cfg := t.Config
+	cas := t.ClientCAs
+	if t.ClientCAPool != nil {
+		cas = t.ClientCAPool()
+	}
+	if cas != nil {
+		cfg = cfg.Clone()
+		cfg.ClientCAs = cas
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	tlsConn := tls.Server(conn, cfg)
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	out := &TLSConn{Conn: tlsConn, raw: conn}
+	state := tlsConn.ConnectionState()
+	if certs := state.PeerCertificates; len(certs) > 0 {
+		out.identity = newIdentity(certs[0])
+		out.identity.CA = VerifiedBy(state)
+	}
+	return out, nil
+}
+
+// TLSConn is a terminated TLS connection.
+type TLSConn struct {
+	*tls.Conn
+	raw      net.Conn
+	identity *Identity
+}
+
+func (c *TLSConn) Unwrap() net.Conn {
+	return c.raw
+}
+
+// RemoteAddr keeps addresses rewritten by earlier layers such as PROXY
+// protocol.
+func (c *TLSConn) RemoteAddr() net.Addr {
+	return c.raw.RemoteAddr()
+}
+
+func (c *TLSConn) LocalAddr() net.Addr {
+	return c.raw.LocalAddr()
+}
+
+// ClientIdentity returns the verified client certificate identity, or nil
+// when the client did not present one.
+func (c *TLSConn) ClientIdentity() *Identity {
+	return c.identity
+}
+
+// VerifiedBy returns the subject of the root CA the peer was verified
+// against, or "" if it was not verified.
+func VerifiedBy(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	chain := state.VerifiedChains[0]
+	return chain[len(chain)-1].Subject.String()
+}
+
+func newIdentity(cert *x509.Certificate) *Identity {
+	sum := sha256.Sum256(cert.Raw)
+
+	id := &Identity{
+		Subject:     cert.Subject.String(),
+		Common:      cert.Subject.CommonName,
+		DNSNames:    cert.DNSNames,
+		Serial:      cert.SerialNumber.String(),
+		Fingerprint: hex.EncodeToString(sum[:]),
+		NotAfter:    cert.NotAfter,
+	}
+	for _, u := range cert.URIs {
+		id.URIs = append(id.URIs, u.String())
+	}
+	return id
+}
@@ -0,0 +1,33 @@
+package balancer
+
+import (
+	"io"
+	"log/slog"
+
+	"loadbalancer/balancer/logging"
+)
+
+// WithLogger sends everything the balancer logs to logger, e.g.
+// slog.New(slog.NewJSONHandler(os.Stderr, nil)), with fields such as
+// backend, client, pool and duration. Without it the balancer logs to
+// logging.Default, plain lines on stdout. Parts built apart from the
+// balancer, such as secrets or a GeoIP database, log to logging.Default,
+// see logging.SetDefault.
+func WithLogger(logger *slog.Logger) Option {
+	return func(lb *LoadBalancer) {
+		if logger != nil {
+			lb.log = logger
+		}
+	}
+}
+
+// Logger is where the balancer logs, for hooks of one's own to log alike.
+func (lb *LoadBalancer) Logger() *slog.Logger {
+	return lb.log
+}
+
+// PlainLogHandler is logging.PlainHandler, the default line format, for a
+// writer and level of one's own.
+func PlainLogHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	return logging.PlainHandler(w, level)
+}
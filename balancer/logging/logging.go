@@ -0,0 +1,136 @@
+// Package logging is the log output shared by the balancer and its
+// subpackages: a plain line format and the process-wide default logger
+// for the parts built apart from a balancer, such as secrets, GeoIP
+// databases and leader elections, until SetLogger gives them another.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PlainHandler writes the message, ERROR:, WARNING: or DEBUG: first as
+// the level says, then the fields as key=value, one line per record.
+// Records below level are dropped.
+func PlainHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	if level == nil {
+		level = slog.LevelInfo
+	}
+	return &plainHandler{w: w, mu: new(sync.Mutex), level: level}
+}
+
+var defaultLogger atomic.Pointer[slog.Logger]
+
+func init() {
+	defaultLogger.Store(slog.New(PlainHandler(os.Stdout, slog.LevelInfo)))
+}
+
+// Default is the logger of the parts without one of their own, plain lines
+// on stdout at slog.LevelInfo unless SetDefault changed it.
+func Default() *slog.Logger {
+	return defaultLogger.Load()
+}
+
+// SetDefault replaces the Default logger; nil is ignored.
+func SetDefault(l *slog.Logger) {
+	if l != nil {
+		defaultLogger.Store(l)
+	}
+}
+
+type plainHandler struct {
+	w     io.Writer
+	mu    *sync.Mutex
+	level slog.Leveler
+	//attrs are those of With, already formatted, under group
+	attrs []byte
+	group string
+}
+
+func (h *plainHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *plainHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf []byte
+	switch {
+	case r.Level >= slog.LevelError:
+		buf = append(buf, "ERROR: "...)
+	case r.Level >= slog.LevelWarn:
+		buf = append(buf, "WARNING: "...)
+	case r.Level < slog.LevelInfo:
+		buf = append(buf, "DEBUG: "...)
+	}
+	buf = append(buf, r.Message...)
+	buf = append(buf, h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		buf = appendLogAttr(buf, h.group, a)
+		return true
+	})
+	buf = append(buf, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf)
+	return err
+}
+
+func (h *plainHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append([]byte(nil), h.attrs...)
+	for _, a := range attrs {
+		h2.attrs = appendLogAttr(h2.attrs, h.group, a)
+	}
+	return &h2
+}
+
+func (h *plainHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group = h.group + name + "."
+	return &h2
+}
+
+// appendLogAttr appends " key=value", groups flattened to group.key.
+func appendLogAttr(buf []byte, group string, a slog.Attr) []byte {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return buf
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			group += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			buf = appendLogAttr(buf, group, ga)
+		}
+		return buf
+	}
+
+	buf = append(buf, ' ')
+	buf = append(buf, group...)
+	buf = append(buf, a.Key...)
+	buf = append(buf, '=')
+	var s string
+	switch a.Value.Kind() {
+	case slog.KindDuration:
+		s = a.Value.Duration().Round(time.Microsecond).String()
+	case slog.KindTime:
+		s = a.Value.Time().Format(time.RFC3339)
+	default:
+		s = a.Value.String()
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\n") {
+		return strconv.AppendQuote(buf, s)
+	}
+	return append(buf, s...)
+}
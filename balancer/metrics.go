@@ -0,0 +1,203 @@
+//go:build !nohttp
+
+package balancer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"loadbalancer/balancer/backend"
+)
+
+// ListenMetrics serves Stats in the Prometheus text format on /metrics at
+// address until its listener fails or Shutdown. Anyone who can reach it can read it,
+// so bind it to a private address.
+func (lb *LoadBalancer) ListenMetrics(address string) error {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", lb.MetricsHandler())
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	if !lb.addServer(srv) {
+		ln.Close()
+		return nil
+	}
+	lb.log.Info("Metrics listening", "address", ln.Addr().String())
+
+	if err := srv.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// MetricsHandler writes Stats in the Prometheus text format, to mount on a
+// server of one's own.
+func (lb *LoadBalancer) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m := metricsWriter{w: bufio.NewWriter(w)}
+		writeMetrics(&m, lb.Stats())
+		m.w.Flush()
+	})
+}
+
+func writeMetrics(m *metricsWriter, s Stats) {
+	m.counter("lb_connections_total", "Client connections handed to a backend or failed.", float64(s.Accepted))
+	m.gauge("lb_active_connections", "Connections open through the balancer.", float64(s.Active))
+	m.counter("lb_failed_connections_total", "Connections that found no backend or failed to reach one.", float64(s.Failed))
+	m.counter("lb_bytes_in_total", "Bytes from clients to backends.", float64(s.BytesIn))
+	m.counter("lb_bytes_out_total", "Bytes from backends to clients.", float64(s.BytesOut))
+	m.counter("lb_rejected_connections_total", "Connections refused before reaching a backend.", float64(s.Rejected))
+	m.counter("lb_retried_dials_total", "Failed dials retried with another backend.", float64(s.Retried))
+	m.counter("lb_panics_total", "Panics recovered in connection handlers and background tasks.", float64(s.Panics))
+
+	m.help("lb_error_responses_total", "counter", "Error responses the balancer answered itself, by reason code.")
+	reasons := make([]string, 0, len(s.ErrorResponses))
+	for reason := range s.ErrorResponses {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		status := strconv.Itoa(errorStatus(reason))
+		m.sample("lb_error_responses_total", float64(s.ErrorResponses[reason]), "reason", reason, "status", status)
+	}
+
+	m.help("lb_listener_accepted_total", "counter", "Connections accepted, by listener.")
+	for _, l := range s.Listeners {
+		m.sample("lb_listener_accepted_total", float64(l.Accepted), "listener", l.Address)
+	}
+	m.help("lb_listener_rejected_total", "counter", "Connections refused before reaching a backend, by listener.")
+	for _, l := range s.Listeners {
+		m.sample("lb_listener_rejected_total", float64(l.Rejected), "listener", l.Address)
+	}
+
+	backendMetric := func(name, kind, help string, value func(BackendStats) float64) {
+		m.help(name, kind, help)
+		for _, b := range s.Backends {
+			m.sample(name, value(b), "pool", b.Pool, "backend", b.Addr)
+		}
+	}
+	backendMetric("lb_backend_up", "gauge", "Whether the backend is healthy.", func(b BackendStats) float64 { return boolMetric(b.Healthy) })
+	backendMetric("lb_backend_draining", "gauge", "Whether the backend is draining.", func(b BackendStats) float64 { return boolMetric(b.Draining) })
+	backendMetric("lb_backend_connections_total", "counter", "Connections proxied to the backend.", func(b BackendStats) float64 { return float64(b.Connections) })
+	backendMetric("lb_backend_active_connections", "gauge", "Connections open to the backend.", func(b BackendStats) float64 { return float64(b.Active) })
+	backendMetric("lb_backend_dial_errors_total", "counter", "Failed connects to the backend.", func(b BackendStats) float64 { return float64(b.Failed) })
+	backendMetric("lb_backend_bytes_in_total", "counter", "Bytes from clients to the backend.", func(b BackendStats) float64 { return float64(b.BytesIn) })
+	backendMetric("lb_backend_bytes_out_total", "counter", "Bytes from the backend to clients.", func(b BackendStats) float64 { return float64(b.BytesOut) })
+	backendMetric("lb_backend_health_checks_failed_total", "counter", "Health checks of the backend that failed.", func(b BackendStats) float64 { return float64(b.Probes.Failed) })
+
+	m.help("lb_backend_health_check_duration_seconds", "histogram", "How long the health checks of the backend took.")
+	for _, b := range s.Backends {
+		m.histogram("lb_backend_health_check_duration_seconds", b.Probes.Duration[:], b.Probes.DurationSum, "pool", b.Pool, "backend", b.Addr)
+	}
+
+	if len(s.Requests) > 0 {
+		m.help("lb_http_requests_total", "counter", "HTTP mode requests by pool and backend status class, local for those the balancer answered and failed for those never answered.")
+		for _, r := range s.Requests {
+			for class, n := range r.Classes {
+				if class > 0 {
+					m.sample("lb_http_requests_total", float64(n), "pool", r.Pool, "class", strconv.Itoa(class)+"xx")
+				}
+			}
+			m.sample("lb_http_requests_total", float64(r.Local), "pool", r.Pool, "class", "local")
+			m.sample("lb_http_requests_total", float64(r.Failed), "pool", r.Pool, "class", "failed")
+		}
+		m.help("lb_http_response_duration_seconds", "histogram", "Time from sending an HTTP request to the backend's response head.")
+		for _, r := range s.Requests {
+			m.histogram("lb_http_response_duration_seconds", r.Latency[:], r.LatencySum, "pool", r.Pool)
+		}
+	}
+
+	m.gauge("lb_shedding_level", "Priority classes being shed, 0 when none.", float64(s.Shedding.Level))
+	m.counter("lb_shed_connections_total", "Connections refused while shedding load.", float64(s.Shedding.Shed))
+
+	if l := s.ConnectionLimit; l != nil {
+		m.gauge("lb_connection_limit", "Connections allowed open at once.", float64(l.Max))
+		m.gauge("lb_connection_limit_open", "Connections holding a slot of the connection limit.", float64(l.Open))
+		m.counter("lb_connection_limit_refused_total", "Connections closed for the connection limit after its wait.", float64(l.Refused))
+	}
+	if len(s.Budget) > 0 {
+		m.help("lb_budget_open_connections", "gauge", "Connections open on the connection budget, by listener or route.")
+		for _, b := range s.Budget {
+			m.sample("lb_budget_open_connections", float64(b.Open), "class", b.Name)
+		}
+		m.help("lb_budget_refused_total", "counter", "Connections refused for the connection budget, by listener or route.")
+		for _, b := range s.Budget {
+			m.sample("lb_budget_refused_total", float64(b.Refused), "class", b.Name)
+		}
+	}
+}
+
+// metricsWriter writes the Prometheus text format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (m *metricsWriter) help(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (m *metricsWriter) counter(name, help string, value float64) {
+	m.help(name, "counter", help)
+	m.sample(name, value)
+}
+
+func (m *metricsWriter) gauge(name, help string, value float64) {
+	m.help(name, "gauge", help)
+	m.sample(name, value)
+}
+
+// sample writes one line; labels are name, value pairs.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	m.w.WriteString(name)
+	if len(labels) > 0 {
+		m.w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				m.w.WriteByte(',')
+			}
+			fmt.Fprintf(m.w, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		m.w.WriteByte('}')
+	}
+	m.w.WriteByte(' ')
+	m.w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	m.w.WriteByte('\n')
+}
+
+// histogram writes counts per backend.LatencyBuckets, the last one for
+// slower observations, as cumulative buckets with their sum and count.
+func (m *metricsWriter) histogram(name string, counts []uint64, sum time.Duration, labels ...string) {
+	var total uint64
+	for i, n := range counts {
+		total += n
+		le := "+Inf"
+		if i < len(backend.LatencyBuckets) {
+			le = strconv.FormatFloat(backend.LatencyBuckets[i].Seconds(), 'g', -1, 64)
+		}
+		m.sample(name+"_bucket", float64(total), append(labels, "le", le)...)
+	}
+	m.sample(name+"_sum", sum.Seconds(), labels...)
+	m.sample(name+"_count", float64(total), labels...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
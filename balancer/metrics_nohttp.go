@@ -0,0 +1,10 @@
+//go:build nohttp
+
+package balancer
+
+import "errors"
+
+// ListenMetrics needs net/http; it refuses to serve in nohttp builds.
+func (lb *LoadBalancer) ListenMetrics(address string) error {
+	return errors.New("the metrics endpoint is not built in (nohttp build tag)")
+}
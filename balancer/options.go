@@ -0,0 +1,205 @@
+package balancer
+
+import (
+	"context"
+
+	"loadbalancer/balancer/audit"
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/discovery"
+	"loadbalancer/balancer/health"
+	"loadbalancer/balancer/peer"
+	"loadbalancer/balancer/replay"
+	"loadbalancer/balancer/resolve"
+	"loadbalancer/balancer/weights"
+)
+
+// Option customises a LoadBalancer at construction time.
+type Option func(*LoadBalancer)
+
+// WithClock replaces the wall clock used for health-check scheduling and
+// timeouts, mainly so tests can drive time by hand.
+func WithClock(c clock.Clock) Option {
+	return func(lb *LoadBalancer) {
+		lb.clock = c
+	}
+}
+
+// WithBackends sets a fixed list of backend addresses for the default pool.
+func WithBackends(addrs ...string) Option {
+	return WithDiscovery(discovery.Static(addrs))
+}
+
+// WeightedBackend is a backend address with the weight it starts with.
+type WeightedBackend struct {
+	Addr string
+	//Weight is relative to the others, at least 1
+	Weight int
+}
+
+// WithWeightedBackends is WithBackends with weights. Unless WithStrategy
+// says otherwise, the default pool then balances by smooth weighted round
+// robin, so a backend of weight 5 gets five connections for every one of a
+// backend of weight 1.
+func WithWeightedBackends(backends ...WeightedBackend) Option {
+	return func(lb *LoadBalancer) {
+		addrs := make([]string, 0, len(backends))
+		lb.initialWeights = make(map[string]int, len(backends))
+		for _, b := range backends {
+			addrs = append(addrs, b.Addr)
+			lb.initialWeights[b.Addr] = b.Weight
+		}
+		lb.source = discovery.Static(addrs)
+	}
+}
+
+// WithDiscovery sets the source of the default pool's backends, consulted
+// when the balancer is created.
+func WithDiscovery(source discovery.Source) Option {
+	return func(lb *LoadBalancer) {
+		lb.source = source
+	}
+}
+
+// WithExternalHealth disables the built-in health checker for every pool.
+// Health state is then only changed through SetBackendHealth.
+func WithExternalHealth() Option {
+	return func(lb *LoadBalancer) {
+		lb.healthPolicy.External = true
+	}
+}
+
+// WithHealthGate sets how every pool combines its checks with the health
+// reported by a discovery.HealthSource.
+func WithHealthGate(gate health.Gate) Option {
+	return func(lb *LoadBalancer) {
+		lb.healthPolicy.Gate = gate
+	}
+}
+
+// HealthChecker is an app-specific health check, such as a Redis PING or a
+// database SELECT 1, in place of the built-in probe. Check returns nil when
+// b can serve; ctx ends after the health timeout.
+type HealthChecker interface {
+	Check(ctx context.Context, b *Backend) error
+}
+
+// WithHealthChecker checks the backends of every pool with hc. A panic in
+// it counts as a failed check.
+func WithHealthChecker(hc HealthChecker) Option {
+	return func(lb *LoadBalancer) {
+		lb.healthPolicy.Check = lb.healthCheck(hc)
+	}
+}
+
+// healthCheck adapts hc to the health package, nil for the built-in probe.
+func (lb *LoadBalancer) healthCheck(hc HealthChecker) health.Check {
+	if hc == nil {
+		return nil
+	}
+	return func(ctx context.Context, b *Backend) error {
+		return lb.safeCall("health checker", func() error {
+			return hc.Check(ctx, b)
+		})
+	}
+}
+
+// WithHealthPolicy sets the health policy new pools start with.
+func WithHealthPolicy(policy health.Policy) Option {
+	return func(lb *LoadBalancer) {
+		lb.healthPolicy = policy
+	}
+}
+
+// WithAuditLog sends every rejected or limited connection to a dedicated
+// audit stream instead of the regular log.
+func WithAuditLog(l *audit.Logger) Option {
+	return func(lb *LoadBalancer) {
+		lb.audit = l
+	}
+}
+
+// WithFailureRecording records the metadata of every failed connection to
+// rec, for "loadbalancer replay" against a staging listener.
+func WithFailureRecording(rec *replay.Recorder) Option {
+	return func(lb *LoadBalancer) {
+		lb.failures = rec
+	}
+}
+
+// WithTimeouts sets the balancer-wide timeouts that pools and listeners
+// inherit. Unset fields keep DefaultTimeouts.
+func WithTimeouts(t Timeouts) Option {
+	return func(lb *LoadBalancer) {
+		lb.timeoutPolicy = t.inherit(DefaultTimeouts())
+	}
+}
+
+// WithWeightLearning scales every backend's weight by a factor learned from
+// its connect latency and failures. Only weight-aware strategies such as
+// BoundedHash balance by weight; pinned backends keep their weight.
+func WithWeightLearning(policy weights.Policy) Option {
+	return func(lb *LoadBalancer) {
+		lb.learning = &policy
+	}
+}
+
+// WithStrategy replaces round robin in the default pool. Other pools take
+// theirs from Pool.SetStrategy, as a strategy may keep state about the
+// backends it was last given.
+func WithStrategy(s Strategy) Option {
+	return func(lb *LoadBalancer) {
+		lb.strategy = s
+	}
+}
+
+// WithDNSTracking paces the re-resolution of backends addressed by host
+// name, whose answers show up in BackendStats.DNS.
+func WithDNSTracking(policy resolve.Policy) Option {
+	return func(lb *LoadBalancer) {
+		lb.resolving = policy
+	}
+}
+
+// WithDNSCache tunes the cache backend host names are resolved through
+// when dialing.
+func WithDNSCache(policy resolve.CachePolicy) Option {
+	return func(lb *LoadBalancer) {
+		lb.caching = policy
+	}
+}
+
+// WithDialRetries tries up to n other backends of the pool when a dial
+// fails, before the client gets a 502; DefaultDialRetries by default and 0
+// to give up at once. Nothing has been sent to a backend at that point, so
+// any connection can be retried. Each try has the full dial timeout.
+func WithDialRetries(n int) Option {
+	return func(lb *LoadBalancer) {
+		lb.dialRetries = n
+	}
+}
+
+// WithIPv6Prefix sets the IPv6 network length treated as one client by
+// hashing strategies and sticky sessions, default 64. Rate limiters take
+// theirs from ratelimit.Config.
+func WithIPv6Prefix(bits int) Option {
+	return func(lb *LoadBalancer) {
+		lb.ipv6Prefix = bits
+	}
+}
+
+// WithCopyBuffer sets the buffer size, per direction, used to copy ModeTCP
+// connections. The default is io.Copy's 32KB; with 100k+ mostly idle
+// connections a 4KB buffer needs an eighth of the copy memory.
+func WithCopyBuffer(size int) Option {
+	return func(lb *LoadBalancer) {
+		lb.copyBuffer = size
+	}
+}
+
+// WithCluster makes node, already running, the balancer's connection to the
+// other instances. Shutdown closes it.
+func WithCluster(node *peer.Node) Option {
+	return func(lb *LoadBalancer) {
+		lb.cluster = node
+	}
+}
@@ -0,0 +1,60 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Discovery finds the addresses of the other instances. Returning this
+// instance's own address too is fine, the handshake finds out.
+type Discovery interface {
+	Peers() ([]string, error)
+}
+
+// Static is a fixed list of peer addresses.
+type Static []string
+
+func (s Static) Peers() ([]string, error) {
+	return append([]string(nil), s...), nil
+}
+
+// DNS looks the peers up by name on every refresh: an SRV name such as
+// "_lb-peer._tcp.example.org", or host:port for every A and AAAA record of
+// host, such as a headless Kubernetes service.
+type DNS string
+
+func (d DNS) Peers() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	name := string(d)
+	if strings.HasPrefix(name, "_") {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		addrs := make([]string, 0, len(records))
+		for _, r := range records {
+			addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))))
+		}
+		return addrs, nil
+	}
+
+	host, port, err := net.SplitHostPort(name)
+	if err != nil {
+		return nil, fmt.Errorf("peer dns %q: %w", name, err)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs, nil
+}
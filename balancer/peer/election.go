@@ -0,0 +1,35 @@
+package peer
+
+import "time"
+
+// Election is a leader election backend over the peer protocol, for
+// election.New: of the eligible instances heard from within the TTL, the
+// one with the lowest ID leads. It needs no shared storage, but each
+// instance decides on what it hears, so during a network partition each
+// side elects its own leader. A restarted instance with a lower ID takes
+// leadership back once it has heard from its peers.
+type Election struct {
+	Node *Node
+}
+
+// Acquire reports whether id leads. A node claims nothing until it had
+// time to hear from its peers.
+func (e Election) Acquire(id string, ttl time.Duration) (bool, error) {
+	n := e.Node
+	if !n.Eligible() || n.cfg.Clock.Since(n.started) < 2*n.cfg.Interval {
+		return false, nil
+	}
+	for _, p := range n.heard(max(ttl, 3*n.cfg.Interval)) {
+		if p.Eligible && p.ID < id {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Release makes this instance ineligible and tells its peers at once, so
+// the next in line takes over without waiting for the TTL.
+func (e Election) Release(id string) error {
+	e.Node.SetEligible(false)
+	return nil
+}
@@ -0,0 +1,669 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/logging"
+)
+
+const (
+	DefaultInterval = 2 * time.Second
+
+	version = 2
+	//maxMessage bounds one line of the protocol
+	maxMessage       = 4 << 20
+	handshakeTimeout = 5 * time.Second
+	//a failed accept is retried after acceptBackoffMin, doubling up to
+	//acceptBackoffMax, like the balancer's listeners
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+	//kindHello is the heartbeat every node sends each interval
+	kindHello = "hello"
+)
+
+// Config describes this instance's end of the peer protocol.
+//
+// Every connection starts with a handshake proving both ends know Token
+// without sending it: each side sends a random nonce and answers the
+// other's with an HMAC over both nonces, its role and its ID. After that
+// the dialing side sends one JSON message per line, each behind an HMAC
+// over its sequence number under a key derived from both nonces: a message
+// altered, replayed or reordered on the wire drops the connection. Messages
+// are not encrypted; Upgrade them to TLS for that. Every node dials all of
+// its peers, so messages flow both ways over two connections.
+type Config struct {
+	//ID names this instance to its peers, default the host name; it must
+	//be unique within the cluster
+	ID string
+	//Listen is the TCP address peers connect to, "" to only send
+	Listen string
+	//Discovery finds the peers' addresses, refreshed every interval
+	Discovery Discovery
+	//Token is shared by every instance of the cluster
+	Token []byte
+	//Upgrade wraps every connection before the handshake, e.g. in mutual
+	//TLS; server is set for accepted connections
+	Upgrade func(conn net.Conn, server bool) (net.Conn, error)
+	//Interval between heartbeats, default 2s; a peer not heard from for
+	//three of them is gone
+	Interval time.Duration
+	Clock    clock.Clock
+}
+
+// Handler gets the messages of one kind. from is the sender's
+// authenticated ID.
+type Handler func(from string, body json.RawMessage)
+
+// Peer is another instance as this one last heard from it.
+type Peer struct {
+	ID   string
+	Addr string
+	Seen time.Time
+	//Eligible peers may lead an Election
+	Eligible bool
+}
+
+// Node is this instance's member of the cluster.
+type Node struct {
+	cfg     Config
+	ln      net.Listener
+	started time.Time
+	//log is logging.Default unless SetLogger changed it
+	log *slog.Logger
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+	links    map[string]*link
+	//self are discovered addresses that turned out to be this node
+	self map[string]bool
+	//refused are the hosts whose failed handshake was logged, until one succeeds
+	refused  map[string]bool
+	peers    map[string]Peer
+	eligible bool
+	closed   bool
+	done     chan struct{}
+}
+
+type message struct {
+	Kind string          `json:"kind"`
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+type hello struct {
+	Eligible bool `json:"eligible"`
+}
+
+// New starts listening, if the config says so, but exchanges nothing until
+// Run.
+func New(cfg Config) (*Node, error) {
+	if len(cfg.Token) == 0 {
+		return nil, errors.New("peer: a shared token is required")
+	}
+	if cfg.ID == "" {
+		cfg.ID, _ = os.Hostname()
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real
+	}
+	if cfg.Discovery == nil {
+		cfg.Discovery = Static(nil)
+	}
+
+	n := &Node{
+		cfg:      cfg,
+		started:  cfg.Clock.Now(),
+		log:      logging.Default(),
+		handlers: make(map[string]Handler),
+		links:    make(map[string]*link),
+		self:     make(map[string]bool),
+		refused:  make(map[string]bool),
+		peers:    make(map[string]Peer),
+		eligible: true,
+		done:     make(chan struct{}),
+	}
+	if cfg.Listen != "" {
+		ln, err := net.Listen("tcp", cfg.Listen)
+		if err != nil {
+			return nil, err
+		}
+		n.ln = ln
+	}
+	return n, nil
+}
+
+func (n *Node) ID() string { return n.cfg.ID }
+
+// SetLogger sends what the node logs to l; call it before Run.
+func (n *Node) SetLogger(l *slog.Logger) {
+	n.log = l
+}
+
+// Addr is the address peers connect to, nil when the node only sends.
+func (n *Node) Addr() net.Addr {
+	if n.ln == nil {
+		return nil
+	}
+	return n.ln.Addr()
+}
+
+// Done is closed once the node is closed.
+func (n *Node) Done() <-chan struct{} { return n.done }
+
+// Handle registers h for messages of kind, replacing any earlier one.
+func (n *Node) Handle(kind string, h Handler) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.handlers[kind] = h
+}
+
+// Peers returns the peers heard from within three intervals, by ID.
+func (n *Node) Peers() []Peer {
+	return n.heard(3 * n.cfg.Interval)
+}
+
+func (n *Node) heard(within time.Duration) []Peer {
+	now := n.cfg.Clock.Now()
+
+	n.mu.Lock()
+	var peers []Peer
+	for _, p := range n.peers {
+		if now.Sub(p.Seen) <= within {
+			peers = append(peers, p)
+		}
+	}
+	n.mu.Unlock()
+
+	slices.SortFunc(peers, func(a, b Peer) int { return strings.Compare(a.ID, b.ID) })
+	return peers
+}
+
+// SetEligible tells the peers whether this instance may lead. It goes out
+// with the next heartbeat, which is sent right away.
+func (n *Node) SetEligible(on bool) {
+	n.mu.Lock()
+	n.eligible = on
+	n.mu.Unlock()
+	n.sendHello()
+}
+
+func (n *Node) Eligible() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.eligible
+}
+
+// Run accepts peers and sends heartbeats until Close.
+func (n *Node) Run() {
+	if n.ln != nil {
+		n.log.Info("Peer protocol listening", "address", n.ln.Addr().String(), "id", n.cfg.ID)
+		go n.serve()
+	}
+
+	ticker := n.cfg.Clock.NewTicker(n.cfg.Interval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		err := n.discover()
+		switch {
+		case err != nil && !failing:
+			n.log.Warn("Peer discovery failed, keeping the last peers", "error", err)
+		case err == nil && failing:
+			n.log.Info("Peer discovery working again")
+		}
+		failing = err != nil
+		n.sendHello()
+
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// Close stops listening and drops the connections to peers.
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	close(n.done)
+	links := n.links
+	n.links = make(map[string]*link)
+	n.mu.Unlock()
+
+	for _, l := range links {
+		l.close()
+	}
+	if n.ln != nil {
+		return n.ln.Close()
+	}
+	return nil
+}
+
+// discover syncs the links with the addresses discovery returns.
+func (n *Node) discover() error {
+	addrs, err := n.cfg.Discovery.Peers()
+	if err != nil {
+		return err
+	}
+
+	want := make(map[string]bool, len(addrs))
+	n.mu.Lock()
+	for _, addr := range addrs {
+		want[addr] = true
+		if n.links[addr] == nil && !n.self[addr] {
+			n.links[addr] = &link{node: n, addr: addr}
+		}
+	}
+	var gone []*link
+	for addr, l := range n.links {
+		if !want[addr] {
+			delete(n.links, addr)
+			gone = append(gone, l)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, l := range gone {
+		l.close()
+	}
+	return nil
+}
+
+func (n *Node) sendHello() {
+	n.Broadcast(kindHello, hello{Eligible: n.Eligible()})
+}
+
+// Broadcast sends a message of kind to every peer. A peer that can't be
+// reached is dialed again an interval later; its errors are returned.
+func (n *Node) Broadcast(kind string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(message{Kind: kind, Body: body})
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	links := make([]*link, 0, len(n.links))
+	for _, l := range n.links {
+		links = append(links, l)
+	}
+	n.mu.Unlock()
+
+	var errs []error
+	for _, l := range links {
+		if err := l.send(line); err != nil {
+			errs = append(errs, fmt.Errorf("peer %s: %w", l.addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isSelf drops a discovered address that reached this very node.
+func (n *Node) isSelf(addr string) {
+	n.mu.Lock()
+	n.self[addr] = true
+	l := n.links[addr]
+	delete(n.links, addr)
+	n.mu.Unlock()
+	if l != nil {
+		l.close()
+	}
+}
+
+func (n *Node) serve() {
+	var delay time.Duration
+	for {
+		conn, err := n.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if delay == 0 {
+				delay = acceptBackoffMin
+				n.log.Warn("Error accepting peer connection, backing off", "address", n.ln.Addr().String(), "error", err)
+			} else {
+				delay = min(2*delay, acceptBackoffMax)
+			}
+			n.cfg.Clock.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go n.serveConn(conn)
+	}
+}
+
+func (n *Node) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if n.cfg.Upgrade != nil {
+		upgraded, err := n.cfg.Upgrade(conn, true)
+		if err != nil {
+			n.log.Warn("Peer connection failed", "peer", conn.RemoteAddr().String(), "error", err)
+			return
+		}
+		conn = upgraded
+		defer conn.Close()
+	}
+
+	r := bufio.NewReader(conn)
+	from, key, err := n.accept(conn, r)
+	if err != nil {
+		if !errors.Is(err, errSelf) && n.refuse(conn.RemoteAddr(), true) {
+			n.log.Warn("Refused peer", "peer", conn.RemoteAddr().String(), "error", err)
+		}
+		return
+	}
+	n.refuse(conn.RemoteAddr(), false)
+	conn.SetDeadline(time.Time{})
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxMessage)
+	for seq := uint64(0); ; seq++ {
+		//a peer sends at least a heartbeat per interval
+		conn.SetReadDeadline(time.Now().Add(3 * n.cfg.Interval))
+		if !scanner.Scan() {
+			return
+		}
+		line, ok := open(key, seq, scanner.Bytes())
+		if !ok {
+			n.log.Warn("Dropping peer connection, message failed authentication", "peer", from, "address", conn.RemoteAddr().String())
+			return
+		}
+		var msg message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			continue
+		}
+		n.receive(from, conn.RemoteAddr().String(), msg)
+	}
+}
+
+// refuse records whether the last handshake from addr's host failed and
+// reports whether that is news.
+func (n *Node) refuse(addr net.Addr, refused bool) bool {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.refused[host] == refused {
+		return false
+	}
+	if refused {
+		n.refused[host] = true
+	} else {
+		delete(n.refused, host)
+	}
+	return true
+}
+
+func (n *Node) receive(from, addr string, msg message) {
+	n.mu.Lock()
+	p := n.peers[from]
+	p.ID, p.Addr, p.Seen = from, addr, n.cfg.Clock.Now()
+	if msg.Kind == kindHello {
+		var h hello
+		if json.Unmarshal(msg.Body, &h) == nil {
+			p.Eligible = h.Eligible
+		}
+	}
+	n.peers[from] = p
+	h := n.handlers[msg.Kind]
+	n.mu.Unlock()
+
+	if h != nil && msg.Kind != kindHello {
+		h(from, msg.Body)
+	}
+}
+
+// link is the connection to one peer, dialed on demand.
+type link struct {
+	node *Node
+	addr string
+
+	mu   sync.Mutex
+	conn net.Conn
+	//key authenticates the messages on conn, seq numbers them
+	key []byte
+	seq uint64
+	//retry is when a peer that could not be dialed is tried again, so
+	//messages to it fail fast meanwhile
+	retry time.Time
+	err   error
+}
+
+func (l *link) send(line []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conn == nil {
+		now := l.node.cfg.Clock.Now()
+		if now.Before(l.retry) {
+			return l.err
+		}
+		conn, key, err := l.node.dial(l.addr)
+		if errors.Is(err, errSelf) {
+			go l.node.isSelf(l.addr)
+			return nil
+		}
+		if err != nil {
+			l.retry, l.err = now.Add(l.node.cfg.Interval), err
+			return err
+		}
+		l.conn, l.key, l.seq = conn, key, 0
+	}
+
+	l.conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	if _, err := l.conn.Write(seal(l.key, l.seq, line)); err != nil {
+		l.conn.Close()
+		l.conn = nil
+		return err
+	}
+	l.seq++
+	return nil
+}
+
+func (l *link) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn != nil {
+		l.conn.Close()
+		l.conn = nil
+	}
+}
+
+func (n *Node) dial(addr string) (net.Conn, []byte, error) {
+	conn, err := net.DialTimeout("tcp", addr, handshakeTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if n.cfg.Upgrade != nil {
+		upgraded, err := n.cfg.Upgrade(conn, false)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = upgraded
+	}
+	key, err := n.connect(conn, bufio.NewReader(conn))
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, key, nil
+}
+
+// the handshake, one JSON object per line each way
+type greeting struct {
+	Version int    `json:"v"`
+	ID      string `json:"id"`
+	Nonce   string `json:"nonce,omitempty"`
+	Proof   string `json:"proof,omitempty"`
+}
+
+var errSelf = errors.New("connected to itself")
+
+// connect is the dialing side of the handshake and returns the key of the
+// messages sent after it.
+func (n *Node) connect(conn net.Conn, r *bufio.Reader) ([]byte, error) {
+	nonce := newNonce()
+	if err := writeGreeting(conn, greeting{Version: version, ID: n.cfg.ID, Nonce: nonce}); err != nil {
+		return nil, err
+	}
+
+	reply, err := readGreeting(r)
+	if err != nil {
+		return nil, err
+	}
+	if reply.ID == n.cfg.ID {
+		return nil, errSelf
+	}
+	if reply.Version != version {
+		return nil, fmt.Errorf("unsupported version %d", reply.Version)
+	}
+	if !hmac.Equal([]byte(reply.Proof), []byte(n.proof("server", nonce, reply.Nonce, reply.ID))) {
+		return nil, errors.New("peer does not know the token")
+	}
+
+	if err := writeGreeting(conn, greeting{Version: version, ID: n.cfg.ID, Proof: n.proof("client", reply.Nonce, nonce, n.cfg.ID)}); err != nil {
+		return nil, err
+	}
+	return n.sessionKey(nonce, reply.Nonce), nil
+}
+
+// accept is the accepting side of the handshake and returns the peer's ID
+// and the key of the messages it sends.
+func (n *Node) accept(conn net.Conn, r *bufio.Reader) (string, []byte, error) {
+	hi, err := readGreeting(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if hi.Version != version {
+		return "", nil, fmt.Errorf("unsupported version %d", hi.Version)
+	}
+	if hi.ID == "" || hi.Nonce == "" {
+		return "", nil, errors.New("malformed greeting")
+	}
+
+	nonce := newNonce()
+	if err := writeGreeting(conn, greeting{Version: version, ID: n.cfg.ID, Nonce: nonce, Proof: n.proof("server", hi.Nonce, nonce, n.cfg.ID)}); err != nil {
+		return "", nil, err
+	}
+	if hi.ID == n.cfg.ID {
+		return "", nil, errSelf
+	}
+
+	answer, err := readGreeting(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if !hmac.Equal([]byte(answer.Proof), []byte(n.proof("client", nonce, hi.Nonce, hi.ID))) {
+		return "", nil, errors.New("bad token")
+	}
+	return hi.ID, n.sessionKey(hi.Nonce, nonce), nil
+}
+
+// proof binds the token to both nonces, the role and the ID claimed.
+func (n *Node) proof(role, theirs, ours, id string) string {
+	mac := hmac.New(sha256.New, n.cfg.Token)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", role, theirs, ours, id)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sessionKey is the key of the messages on one connection, from the
+// dialing side's nonce and the accepting side's.
+func (n *Node) sessionKey(client, server string) []byte {
+	mac := hmac.New(sha256.New, n.cfg.Token)
+	fmt.Fprintf(mac, "session\n%s\n%s", client, server)
+	return mac.Sum(nil)
+}
+
+// seal frames the message numbered seq as its hex HMAC, a space, the
+// message and a newline.
+func seal(key []byte, seq uint64, msg []byte) []byte {
+	sum := frameMAC(key, seq, msg)
+	line := make([]byte, 0, hex.EncodedLen(len(sum))+len(msg)+2)
+	line = hex.AppendEncode(line, sum)
+	line = append(line, ' ')
+	line = append(line, msg...)
+	return append(line, '\n')
+}
+
+// open returns the message in a line sealed as number seq, or false when
+// its HMAC does not match.
+func open(key []byte, seq uint64, line []byte) ([]byte, bool) {
+	tag, msg, ok := bytes.Cut(line, []byte(" "))
+	if !ok {
+		return nil, false
+	}
+	sum, err := hex.DecodeString(string(tag))
+	if err != nil || !hmac.Equal(sum, frameMAC(key, seq, msg)) {
+		return nil, false
+	}
+	return msg, true
+}
+
+func frameMAC(key []byte, seq uint64, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(binary.BigEndian.AppendUint64(nil, seq))
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeGreeting(conn net.Conn, g greeting) error {
+	line, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(line, '\n'))
+	return err
+}
+
+func readGreeting(r *bufio.Reader) (greeting, error) {
+	var g greeting
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return g, err
+	}
+	if err := json.Unmarshal(line, &g); err != nil {
+		return g, errors.New("malformed greeting")
+	}
+	return g, nil
+}
@@ -0,0 +1,192 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newNode(t *testing.T, id, token, listen string) *Node {
+	n, err := New(Config{ID: id, Token: []byte(token), Listen: listen})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.SetLogger(slog.New(slog.DiscardHandler))
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+// handshake runs client's side against server's over a pipe.
+func handshake(client, server *Node) (from string, clientKey, serverKey []byte, cerr, serr error) {
+	c, s := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		from, serverKey, serr = server.accept(s, bufio.NewReader(s))
+		s.Close()
+	}()
+	clientKey, cerr = client.connect(c, bufio.NewReader(c))
+	c.Close()
+	<-done
+	return
+}
+
+func TestHandshake(t *testing.T) {
+	a := newNode(t, "a", "secret", "")
+	for _, tt := range []struct {
+		name       string
+		client     *Node
+		cerr, serr string
+	}{
+		{"same token", newNode(t, "b", "secret", ""), "", ""},
+		{"other token", newNode(t, "b", "guess", ""), "does not know the token", "EOF"},
+		{"token prefix", newNode(t, "b", "secre", ""), "does not know the token", "EOF"},
+		{"itself", newNode(t, "a", "secret", ""), errSelf.Error(), errSelf.Error()},
+	} {
+		from, ck, sk, cerr, serr := handshake(tt.client, a)
+		if !matches(cerr, tt.cerr) || !matches(serr, tt.serr) {
+			t.Errorf("%s: client %v, server %v, want %q and %q", tt.name, cerr, serr, tt.cerr, tt.serr)
+			continue
+		}
+		if tt.cerr == "" && (from != "b" || len(ck) == 0 || !bytes.Equal(ck, sk)) {
+			t.Errorf("%s: from %q, keys %x and %x", tt.name, from, ck, sk)
+		}
+	}
+
+	//every connection gets its own key
+	b := newNode(t, "b", "secret", "")
+	_, k1, _, _, _ := handshake(b, a)
+	_, k2, _, _, _ := handshake(b, a)
+	if bytes.Equal(k1, k2) {
+		t.Error("two connections share a key")
+	}
+}
+
+func matches(err error, want string) bool {
+	if want == "" {
+		return err == nil
+	}
+	return err != nil && strings.Contains(err.Error(), want)
+}
+
+func TestAcceptGreetings(t *testing.T) {
+	a := newNode(t, "a", "secret", "")
+	for _, tt := range []struct{ greetings, want string }{
+		{"", "EOF"},
+		{"not json\n", "malformed greeting"},
+		{`{"v":1,"id":"b","nonce":"n"}` + "\n", "unsupported version 1"},
+		{`{"v":2,"nonce":"n"}` + "\n", "malformed greeting"},
+		{`{"v":2,"id":"b"}` + "\n", "malformed greeting"},
+		{`{"v":2,"id":"b","nonce":"n"}`, "EOF"},
+		{`{"v":2,"id":"b","nonce":"n"}` + "\n", "EOF"},
+		{`{"v":2,"id":"b","nonce":"n"}` + "\n" + `{"v":2,"id":"b"}` + "\n", "bad token"},
+		{`{"v":2,"id":"b","nonce":"n"}` + "\n" + `{"v":2,"id":"b","proof":"00"}` + "\n", "bad token"},
+	} {
+		c, s := net.Pipe()
+		go io.Copy(io.Discard, c)
+		_, _, err := a.accept(s, bufio.NewReader(strings.NewReader(tt.greetings)))
+		c.Close()
+		if !matches(err, tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.greetings, err, tt.want)
+		}
+	}
+}
+
+func TestMessages(t *testing.T) {
+	a := newNode(t, "a", "secret", "127.0.0.1:0")
+	got := make(chan string, 10)
+	a.Handle("note", func(from string, body json.RawMessage) { got <- from + " " + string(body) })
+	go a.serve()
+
+	b := newNode(t, "b", "secret", "")
+	b.cfg.Discovery = Static{a.Addr().String()}
+	if err := b.discover(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast("note", "one"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Broadcast("note", "two"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`b "one"`, `b "two"`} {
+		if s := receive(t, got); s != want {
+			t.Errorf("got %s, want %s", s, want)
+		}
+	}
+
+	//a line replayed on the same connection drops it
+	conn, key, err := b.dial(a.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	line := seal(key, 0, []byte(`{"kind":"note","body":"three"}`))
+	conn.Write(line)
+	if s := receive(t, got); s != `b "three"` {
+		t.Errorf("got %s", s)
+	}
+	conn.Write(line)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("replayed message: read %v, want EOF", err)
+	}
+	select {
+	case s := <-got:
+		t.Errorf("replayed message delivered: %s", s)
+	default:
+	}
+}
+
+func receive(t *testing.T, got <-chan string) string {
+	select {
+	case s := <-got:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message")
+		return ""
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	key := []byte("session key")
+	msg := []byte(`{"kind":"hello","body":{"eligible":true}}`)
+	line := seal(key, 7, msg)
+	if !bytes.HasSuffix(line, []byte("\n")) {
+		t.Fatalf("%q: no newline", line)
+	}
+	line = line[:len(line)-1]
+
+	if got, ok := open(key, 7, line); !ok || !bytes.Equal(got, msg) {
+		t.Fatalf("open: %q, %v", got, ok)
+	}
+
+	tampered := bytes.Replace(line, []byte("true"), []byte("fals"), 1)
+	for name, tt := range map[string]struct {
+		key  []byte
+		seq  uint64
+		line []byte
+	}{
+		"replayed":     {key, 8, line},
+		"reordered":    {key, 6, line},
+		"other key":    {[]byte("other key"), 7, line},
+		"tampered":     {key, 7, tampered},
+		"no MAC":       {key, 7, msg},
+		"MAC not hex":  {key, 7, append([]byte("zz "), msg...)},
+		"empty MAC":    {key, 7, append([]byte(" "), msg...)},
+		"MAC only":     {key, 7, line[:64]},
+		"empty":        {key, 7, nil},
+		"truncated":    {key, 7, line[:len(line)-1]},
+		"extra prefix": {key, 7, append([]byte("00"), line...)},
+	} {
+		if got, ok := open(tt.key, tt.seq, tt.line); ok {
+			t.Errorf("%s: accepted %q", name, got)
+		}
+	}
+}
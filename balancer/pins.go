@@ -0,0 +1,104 @@
+package balancer
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// DefaultPinTTL is how long a pin lasts when PinClients is given none.
+const DefaultPinTTL = 15 * time.Minute
+
+// ClientPin sends the clients of a network to one backend of a pool,
+// overriding the strategy, subsets and sticky sessions, so that a customer
+// issue can be reproduced against a known instance. A pinned backend that
+// can't take the connection, e.g. unhealthy or draining, is passed over as
+// if there were no pin.
+type ClientPin struct {
+	Pool    string
+	Clients netip.Prefix
+	Backend string
+	Expires time.Time
+}
+
+// PinClients pins the clients in prefix, a single IP or a network, to the
+// backend at addr for ttl, DefaultPinTTL if 0. Pinning the same prefix
+// again replaces the pin. Where pins overlap the narrowest wins.
+func (p *Pool) PinClients(prefix netip.Prefix, addr string, ttl time.Duration) (ClientPin, error) {
+	if ttl <= 0 {
+		ttl = DefaultPinTTL
+	}
+	if p.Backend(addr) == nil {
+		return ClientPin{}, fmt.Errorf("backend %s not in pool %s", addr, p.name)
+	}
+	pin := ClientPin{Pool: p.name, Clients: prefix.Masked(), Backend: addr, Expires: p.lb.clock.Now().Add(ttl)}
+
+	p.mu.Lock()
+	p.pins = slices.DeleteFunc(p.pins, func(old ClientPin) bool { return old.Clients == pin.Clients })
+	p.pins = append(p.pins, pin)
+	p.mu.Unlock()
+
+	p.lb.log.Info("Clients pinned", "clients", pin.Clients.String(), "backend", addr, "pool", p.name, "ttl", ttl)
+	return pin, nil
+}
+
+// UnpinClients drops the pin of prefix and reports whether there was one.
+func (p *Pool) UnpinClients(prefix netip.Prefix) bool {
+	prefix = prefix.Masked()
+	p.mu.Lock()
+	n := len(p.pins)
+	p.pins = slices.DeleteFunc(p.pins, func(pin ClientPin) bool { return pin.Clients == prefix })
+	found := len(p.pins) < n
+	p.mu.Unlock()
+
+	if found {
+		p.lb.log.Info("Clients unpinned", "clients", prefix.String(), "pool", p.name)
+	}
+	return found
+}
+
+// ClientPins are the pins that haven't expired.
+func (p *Pool) ClientPins() []ClientPin {
+	now := p.lb.clock.Now()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	pins := make([]ClientPin, 0, len(p.pins))
+	for _, pin := range p.pins {
+		if now.Before(pin.Expires) {
+			pins = append(pins, pin)
+		}
+	}
+	return pins
+}
+
+// pinnedBackend is the address client is pinned to, "" without a pin.
+// Expired pins are dropped on the way.
+func (p *Pool) pinnedBackend(client net.Conn) string {
+	p.mu.RLock()
+	empty := len(p.pins) == 0
+	p.mu.RUnlock()
+	if empty {
+		return ""
+	}
+
+	ip := clientIP(client.RemoteAddr())
+	now := p.lb.clock.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best ClientPin
+	p.pins = slices.DeleteFunc(p.pins, func(pin ClientPin) bool {
+		if !now.Before(pin.Expires) {
+			p.lb.log.Info("Pin expired", "clients", pin.Clients.String(), "backend", pin.Backend, "pool", p.name)
+			return true
+		}
+		if pin.Clients.Contains(ip) && (best.Backend == "" || pin.Clients.Bits() > best.Clients.Bits()) {
+			best = pin
+		}
+		return false
+	})
+	return best.Backend
+}
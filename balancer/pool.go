@@ -0,0 +1,349 @@
+package balancer
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+
+	"loadbalancer/balancer/affinity"
+	"loadbalancer/balancer/backend"
+	"loadbalancer/balancer/health"
+	"loadbalancer/balancer/strategy"
+)
+
+const DefaultPool = "default"
+
+// Pool is a named group of backends with its own selection strategy and
+// health policy. Runtime changes to membership go through the pool.
+type Pool struct {
+	name string
+	lb   *LoadBalancer
+	//tenant owns the pool, nil for the operator's own pools
+	tenant *Tenant
+
+	mu       sync.RWMutex
+	backends []*Backend
+	strategy strategy.Strategy
+	//fallback overrules a strategy that fails
+	fallback *strategy.RoundRobin
+	subsets  []Subset
+	checker  *health.Checker
+	tls      tlsConfig
+	tlsRoots tlsRoots
+	affinity *affinity.Table
+	timeouts Timeouts
+	started  bool
+	//away are the backends going away, by the signal that said so
+	away map[string]string
+	//requests are those of HTTP mode routed to the pool
+	requests backend.Requests
+	//tlsOverrides are the per-backend TLS settings, by address
+	tlsOverrides tlsOverrides
+	//pins send clients to a backend of choice, see PinClients
+	pins []ClientPin
+}
+
+func newPool(lb *LoadBalancer, name string, addrs []string) *Pool {
+	p := &Pool{
+		name:     name,
+		lb:       lb,
+		strategy: strategy.NewRoundRobin(),
+		fallback: strategy.NewRoundRobin(),
+		checker:  health.NewChecker(lb.clock, lb.healthPolicy),
+	}
+
+	for _, addr := range addrs {
+		b := backend.New(addr)
+		lb.slowStart.join(b, false)
+		p.backends = append(p.backends, b)
+	}
+	p.checker.SetLogger(lb.log.With("pool", name))
+	p.checker.OnResult(p.observeProbe)
+	p.checker.Throttle(func() int {
+		return lb.shedder.healthSlowdown()
+	})
+
+	return p
+}
+
+func (p *Pool) Name() string {
+	return p.name
+}
+
+// Backends returns the current members. The slice must not be modified.
+func (p *Pool) Backends() []*Backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.backends
+}
+
+func (p *Pool) Backend(addr string) *Backend {
+	for _, b := range p.Backends() {
+		if b.Addr == addr {
+			return b
+		}
+	}
+	return nil
+}
+
+// AddBackend adds a new member. It starts out healthy and is picked up by
+// the next health check round.
+func (p *Pool) AddBackend(addr string) (*Backend, error) {
+	return p.addBackend(addr, false)
+}
+
+// AddStandby adds a new member kept in reserve: health checked like the
+// others, but given no new connections until admitted.
+func (p *Pool) AddStandby(addr string) (*Backend, error) {
+	return p.addBackend(addr, true)
+}
+
+func (p *Pool) addBackend(addr string, standby bool) (*Backend, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid backend address %q: %w", addr, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, b := range p.backends {
+		if b.Addr == addr {
+			return nil, fmt.Errorf("backend %s already in pool %s", addr, p.name)
+		}
+	}
+
+	b := backend.New(addr)
+	b.SetStandby(standby)
+	//those joining a running pool start cold
+	p.lb.slowStart.join(b, p.started)
+
+	//copy on write so readers can keep iterating the old slice
+	backends := make([]*Backend, 0, len(p.backends)+1)
+	backends = append(backends, p.backends...)
+	p.backends = append(backends, b)
+
+	if standby {
+		p.lb.log.Info("Standby backend added", "backend", addr, "pool", p.name)
+	} else {
+		p.lb.log.Info("Backend added", "backend", addr, "pool", p.name)
+	}
+	return b, nil
+}
+
+// RemoveBackend stops routing new connections to addr. Connections already
+// proxied to it are left to finish.
+func (p *Pool) RemoveBackend(addr string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, b := range p.backends {
+		if b.Addr != addr {
+			continue
+		}
+
+		backends := make([]*Backend, 0, len(p.backends)-1)
+		backends = append(backends, p.backends[:i]...)
+		p.backends = append(backends, p.backends[i+1:]...)
+		delete(p.away, addr)
+		p.lb.standby.forget(b)
+		p.lb.breakers.Forget(b)
+
+		p.lb.log.Info("Backend removed", "backend", addr, "pool", p.name)
+		return nil
+	}
+
+	return fmt.Errorf("backend %s not in pool %s", addr, p.name)
+}
+
+func (p *Pool) Strategy() strategy.Strategy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.strategy
+}
+
+func (p *Pool) SetStrategy(s strategy.Strategy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.strategy = s
+}
+
+// Affinity returns the sticky-session table, or nil when sessions are not
+// sticky.
+func (p *Pool) Affinity() *affinity.Table {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.affinity
+}
+
+// SetAffinity makes the pool send each client IP back to the backend it was
+// last sent to, as long as that backend is healthy and the entry in t has
+// not expired. Pass nil to turn it off.
+func (p *Pool) SetAffinity(t *affinity.Table) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.affinity = t
+}
+
+func (p *Pool) HealthPolicy() health.Policy {
+	return p.checker.Policy()
+}
+
+// SetHealthPolicy changes how the pool is health checked, taking effect on
+// a running checker immediately.
+func (p *Pool) SetHealthPolicy(policy health.Policy) {
+	p.checker.SetPolicy(policy)
+}
+
+// SetHealthChecker checks the pool's backends with hc instead of the
+// probe of its policy, or with the probe again when hc is nil.
+func (p *Pool) SetHealthChecker(hc HealthChecker) {
+	policy := p.checker.Policy()
+	policy.Check = p.lb.healthCheck(hc)
+	p.checker.SetPolicy(policy)
+}
+
+// Timeouts returns the pool's own timeouts, without the inherited ones.
+func (p *Pool) Timeouts() Timeouts {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.timeouts
+}
+
+// SetTimeouts overrides the balancer's timeouts for connections to this
+// pool; listeners can override them again. It applies to new connections.
+func (p *Pool) SetTimeouts(t Timeouts) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timeouts = t
+}
+
+// healthyBackends are the members that may take new connections: healthy,
+// not draining and not in reserve.
+func (p *Pool) healthyBackends() []*Backend {
+	all := p.Backends()
+	healthy := make([]*Backend, 0, len(all))
+	for _, b := range all {
+		if b.Healthy() && !b.Draining() && !b.Reserved() {
+			healthy = append(healthy, b)
+		}
+	}
+	return healthy
+}
+
+// take is next, and takes a slot of the backend it picked. A backend that
+// filled up in between is skipped like a full one.
+func (p *Pool) take(client net.Conn, tried []*Backend) *Backend {
+	for {
+		b := p.next(client, tried)
+		if b == nil || b.Acquire() {
+			return b
+		}
+		tried = append(slices.Clip(tried), b)
+	}
+}
+
+// atCapacity reports whether the pool turned a connection away for full
+// backends rather than for unhealthy ones: every healthy backend that is
+// not draining is full.
+func (p *Pool) atCapacity() bool {
+	full := false
+	for _, b := range p.healthyBackends() {
+		if !b.Full() {
+			return false
+		}
+		full = true
+	}
+	return full
+}
+
+// drainingOut reports whether the pool's healthy backends are all being
+// drained.
+func (p *Pool) drainingOut() bool {
+	draining := false
+	for _, b := range p.Backends() {
+		if b.Healthy() && !b.Reserved() {
+			if !b.Draining() {
+				return false
+			}
+			draining = true
+		}
+	}
+	return draining
+}
+
+// next picks the backend of client among the healthy ones but those
+// already tried, those at their MaxConnections and those an open circuit
+// routes around.
+func (p *Pool) next(client net.Conn, tried []*Backend) *Backend {
+	healthy := slices.DeleteFunc(p.healthyBackends(), func(b *Backend) bool {
+		return slices.Contains(tried, b) || b.Full() || !p.lb.breakers.Allow(b)
+	})
+	if addr := p.pinnedBackend(client); addr != "" {
+		if i := slices.IndexFunc(healthy, func(b *Backend) bool { return b.Addr == addr }); i >= 0 {
+			return healthy[i]
+		}
+	}
+	candidates := p.lb.selectCandidates(client, p.subsetCandidates(client, healthy))
+
+	table := p.Affinity()
+	if table == nil {
+		return p.pick(client, candidates)
+	}
+
+	key := p.lb.clientKey(client.RemoteAddr())
+	if addr, ok := table.Lookup(key); ok {
+		for _, b := range candidates {
+			if b.Addr == addr {
+				return b
+			}
+		}
+	}
+
+	b := p.pick(client, candidates)
+	if b != nil {
+		table.Set(key, b.Addr)
+	}
+	return b
+}
+
+// pick asks the strategy, passing the client IP to those that hash it.
+// A strategy that panics or returns a backend it wasn't offered is
+// overruled by round robin, so a faulty custom one can't take the pool
+// down.
+func (p *Pool) pick(client net.Conn, candidates []*Backend) *Backend {
+	s := p.Strategy()
+
+	var b *Backend
+	err := p.lb.safeCall("strategy", func() error {
+		if keyed, ok := s.(strategy.Keyed); ok {
+			b = keyed.PickKey(p.lb.clientKey(client.RemoteAddr()), candidates)
+		} else {
+			b = s.Pick(candidates)
+		}
+		return nil
+	})
+	if err == nil && (b == nil || slices.Contains(candidates, b)) {
+		return b
+	}
+
+	if err == nil {
+		p.lb.log.Warn("Strategy picked a backend that is not a candidate, using round robin", "pool", p.name, "backend", b.Addr)
+	}
+	return p.fallback.Pick(candidates)
+}
+
+// start launches the pool's health checker once.
+func (p *Pool) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.started {
+		return
+	}
+	p.started = true
+
+	p.lb.goSafe("health checker for pool "+p.name, func() {
+		p.checker.Run(p.Backends)
+	})
+}
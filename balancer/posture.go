@@ -0,0 +1,218 @@
+package balancer
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/ratelimit"
+)
+
+// UnderAttackPolicy is the tightened posture applied to every listener
+// while under-attack mode is on.
+type UnderAttackPolicy struct {
+	//AcceptRate caps new connections per second per listener
+	AcceptRate float64
+	//HandshakeTimeout caps how long adapters (TLS, PROXY, HTTP head) may take
+	HandshakeTimeout time.Duration
+	//IdleTimeout closes proxied connections with no traffic
+	IdleTimeout time.Duration
+	//PerIP is an extra, stricter per-client limit
+	PerIP ratelimit.Config
+	//Duration is how long the mode stays on before reverting, default 15m
+	Duration time.Duration
+}
+
+func DefaultUnderAttackPolicy() UnderAttackPolicy {
+	return UnderAttackPolicy{
+		AcceptRate:       500,
+		HandshakeTimeout: 2 * time.Second,
+		IdleTimeout:      30 * time.Second,
+		PerIP: ratelimit.Config{
+			Rate:        2,
+			Burst:       5,
+			BanAfter:    3,
+			BanWindow:   time.Minute,
+			BanDuration: 5 * time.Minute,
+			MaxBan:      time.Hour,
+		},
+		Duration: 15 * time.Minute,
+	}
+}
+
+// posture holds the under-attack state; its limiters are rebuilt on every
+// activation so a new attack starts from clean buckets.
+type posture struct {
+	policy UnderAttackPolicy
+	clock  clock.Clock
+
+	mu         sync.Mutex
+	until      time.Time
+	perIP      *ratelimit.Limiter
+	accept     map[*frontend]*ratelimit.Bucket
+	generation uint64
+	enabled    atomic.Bool
+}
+
+// EnableUnderAttack tightens limits on every listener for d, or for the
+// policy's Duration when d is zero. Calling it again extends the period.
+func (lb *LoadBalancer) EnableUnderAttack(d time.Duration) {
+	p := &lb.posture
+	if d <= 0 {
+		d = p.policy.Duration
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.until = p.clock.Now().Add(d)
+	if p.enabled.Load() {
+		lb.log.Warn("Under-attack mode extended", "duration", d)
+		return
+	}
+
+	p.perIP = ratelimit.New(p.policy.PerIP, p.clock)
+	p.accept = make(map[*frontend]*ratelimit.Bucket)
+	p.enabled.Store(true)
+	p.generation++
+	lb.log.Warn("Under-attack mode ENABLED", "duration", d)
+
+	generation := p.generation
+	lb.goSafe("under-attack timer", func() {
+		lb.expireUnderAttack(generation)
+	})
+}
+
+// expireUnderAttack sleeps until the current activation ends, following
+// extensions, and exits early if the mode was switched off meanwhile.
+func (lb *LoadBalancer) expireUnderAttack(generation uint64) {
+	p := &lb.posture
+	for {
+		p.mu.Lock()
+		current := p.enabled.Load() && p.generation == generation
+		remaining := p.until.Sub(p.clock.Now())
+		p.mu.Unlock()
+
+		if !current {
+			return
+		}
+		if remaining <= 0 {
+			lb.DisableUnderAttack()
+			return
+		}
+		p.clock.Sleep(remaining)
+	}
+}
+
+// DisableUnderAttack reverts to normal limits immediately.
+func (lb *LoadBalancer) DisableUnderAttack() {
+	p := &lb.posture
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.enabled.Load() {
+		return
+	}
+	p.enabled.Store(false)
+	lb.log.Info("Under-attack mode DISABLED")
+}
+
+// UnderAttack reports whether the mode is on and until when.
+func (lb *LoadBalancer) UnderAttack() (bool, time.Time) {
+	p := &lb.posture
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.enabled.Load(), p.until
+}
+
+// admit applies the posture's accept rate and per-IP limit.
+func (p *posture) admit(fe *frontend, ip netip.Addr) (bool, string) {
+	if !p.enabled.Load() {
+		return true, ""
+	}
+
+	p.mu.Lock()
+	bucket, ok := p.accept[fe]
+	if !ok && p.policy.AcceptRate > 0 {
+		bucket = ratelimit.NewBucket(p.policy.AcceptRate, 0, p.clock)
+		p.accept[fe] = bucket
+	}
+	perIP := p.perIP
+	p.mu.Unlock()
+
+	if !bucket.Allow() {
+		return false, "under attack: listener accept rate exceeded"
+	}
+	if allowed, reason := perIP.Allow(ip); !allowed {
+		return false, "under attack: " + reason
+	}
+	return true, ""
+}
+
+// handshakeDeadline wraps conn so adapters cannot wait longer than the
+// posture's handshake timeout. The returned release lifts the cap.
+func (p *posture) handshakeDeadline(conn net.Conn) (net.Conn, func()) {
+	if !p.enabled.Load() || p.policy.HandshakeTimeout <= 0 {
+		return conn, func() {}
+	}
+
+	capped := &cappedConn{Conn: conn}
+	capped.limit.Store(time.Now().Add(p.policy.HandshakeTimeout).UnixNano())
+	capped.Conn.SetDeadline(time.Unix(0, capped.limit.Load()))
+
+	return capped, func() {
+		capped.limit.Store(0)
+		capped.Conn.SetDeadline(time.Time{})
+	}
+}
+
+func (p *posture) idleTimeout() time.Duration {
+	if !p.enabled.Load() {
+		return 0
+	}
+	return p.policy.IdleTimeout
+}
+
+// cappedConn never lets a deadline be set beyond limit while it is non-zero.
+type cappedConn struct {
+	net.Conn
+	limit atomic.Int64
+}
+
+func (c *cappedConn) capped(t time.Time) time.Time {
+	limit := c.limit.Load()
+	if limit == 0 {
+		return t
+	}
+	if t.IsZero() || t.UnixNano() > limit {
+		return time.Unix(0, limit)
+	}
+	return t
+}
+
+func (c *cappedConn) SetDeadline(t time.Time) error {
+	return c.Conn.SetDeadline(c.capped(t))
+}
+
+func (c *cappedConn) SetReadDeadline(t time.Time) error {
+	return c.Conn.SetReadDeadline(c.capped(t))
+}
+
+func (c *cappedConn) SetWriteDeadline(t time.Time) error {
+	return c.Conn.SetWriteDeadline(c.capped(t))
+}
+
+func (c *cappedConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// WithUnderAttackPolicy sets the limits used while under-attack mode is on.
+func WithUnderAttackPolicy(policy UnderAttackPolicy) Option {
+	return func(lb *LoadBalancer) {
+		lb.posture.policy = policy
+	}
+}
@@ -0,0 +1,181 @@
+//go:build !nohttp
+
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTPOptions hooks into the HTTP proxy loop.
+type HTTPOptions struct {
+	//Request runs before a request is forwarded. Returning a response answers
+	//the client directly and the request never reaches the backend.
+	Request func(req *http.Request) *http.Response
+	//Response runs before a backend response is written to the client.
+	Response func(req *http.Request, resp *http.Response)
+	//Observe sees every request once it was answered or failed.
+	Observe func(Exchange)
+	//HeaderTimeout limits the wait for each request head, including the
+	//wait for the next request on a kept-alive connection
+	HeaderTimeout time.Duration
+}
+
+// Exchange is one request as the proxy saw it.
+type Exchange struct {
+	Request *http.Request
+	//Response is nil when the backend failed to answer, with Err
+	Response *http.Response
+	//Local responses came from the Request hook rather than the backend
+	Local bool
+	//Latency is from sending the request to reading the response head
+	Latency time.Duration
+	Err     error
+}
+
+func (o HTTPOptions) observe(x Exchange) {
+	if o.Observe != nil {
+		o.Observe(x)
+	}
+}
+
+// ServeHTTP proxies HTTP/1.x requests from the client to the backend one at
+// a time, so requests and responses can be inspected and rewritten. All
+// requests on a client connection go to the same backend. A protocol
+// upgrade (101) switches to a plain Pipe.
+func ServeHTTP(clientConn, backendConn net.Conn, meter Meter, opts HTTPOptions) error {
+	cr := getReader(clientConn)
+	br := getReader(backendConn)
+	toBackend := getWriter(&meteredWriter{w: backendConn, meter: meter, in: true})
+	toClient := getWriter(&meteredWriter{w: clientConn, meter: meter})
+
+	upgraded := false
+	defer func() {
+		putReader(br)
+		putWriter(toBackend)
+		putWriter(toClient)
+		//after an upgrade the client --> backend copy may still be reading cr
+		if !upgraded {
+			putReader(cr)
+		}
+	}()
+
+	for {
+		if opts.HeaderTimeout > 0 {
+			clientConn.SetReadDeadline(time.Now().Add(opts.HeaderTimeout))
+		}
+		req, err := http.ReadRequest(cr)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if opts.HeaderTimeout > 0 {
+			//the body is read as it is forwarded, under the idle timeout
+			clientConn.SetReadDeadline(time.Time{})
+		}
+
+		//ask Request.Write not to add a Go User-Agent the client never sent
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header["User-Agent"] = []string{""}
+		}
+
+		if opts.Request != nil {
+			if resp := opts.Request(req); resp != nil {
+				io.Copy(io.Discard, req.Body)
+				req.Body.Close()
+				opts.observe(Exchange{Request: req, Response: resp, Local: true})
+
+				if err := writeResponse(toClient, resp); err != nil {
+					return err
+				}
+				if req.Close || resp.Close {
+					return nil
+				}
+				continue
+			}
+		}
+
+		sent := time.Now()
+		if err := req.Write(toBackend); err != nil {
+			opts.observe(Exchange{Request: req, Err: err})
+			return err
+		}
+		if err := toBackend.Flush(); err != nil {
+			opts.observe(Exchange{Request: req, Err: err})
+			return &BackendError{Err: err}
+		}
+
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			opts.observe(Exchange{Request: req, Err: err})
+			return &BackendError{Err: err}
+		}
+		opts.observe(Exchange{Request: req, Response: resp, Latency: time.Since(sent)})
+
+		if opts.Response != nil {
+			opts.Response(req, resp)
+		}
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			if err := writeResponse(toClient, resp); err != nil {
+				return err
+			}
+			//hand the connection over, including anything already buffered
+			upgraded = true
+			return Pipe(&readerConn{Conn: clientConn, r: cr}, &readerConn{Conn: backendConn, r: br}, meter)
+		}
+
+		if err := writeResponse(toClient, resp); err != nil {
+			return err
+		}
+
+		if req.Close || resp.Close {
+			return nil
+		}
+	}
+}
+
+func writeResponse(w *bufio.Writer, resp *http.Response) error {
+	defer func() {
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+	}()
+
+	if err := resp.Write(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// TextResponse builds a small plain-text response for answering a client
+// without involving a backend.
+func TextResponse(req *http.Request, status int, body string) *http.Response {
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        make(http.Header),
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+	}
+	resp.Header.Set("Content-Type", "text/plain")
+	return resp
+}
+
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
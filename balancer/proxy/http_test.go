@@ -0,0 +1,40 @@
+//go:build !nohttp
+
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"testing"
+)
+
+const benchResponse = "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nConnection: close\r\n\r\nhello"
+
+// BenchmarkServeHTTP proxies one request per connection, so the readers
+// and writers ServeHTTP takes for each come from the pools.
+func BenchmarkServeHTTP(b *testing.B) {
+	b.ReportAllocs()
+
+	for b.Loop() {
+		client, clientSide, backendSide, backend := pipes()
+		go func() {
+			br := bufio.NewReader(backend)
+			if req, err := http.ReadRequest(br); err == nil {
+				io.Copy(io.Discard, req.Body)
+				io.WriteString(backend, benchResponse)
+			}
+			backend.Close()
+		}()
+		go func() {
+			io.WriteString(client, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+			io.Copy(io.Discard, client)
+			client.Close()
+		}()
+		if err := ServeHTTP(clientSide, backendSide, nopMeter{}, HTTPOptions{}); err != nil {
+			b.Fatal(err)
+		}
+		clientSide.Close()
+		backendSide.Close()
+	}
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// IdleConn closes a connection that sees no reads for Timeout by pushing the
+// read deadline forward before every read, and one whose writes block for
+// WriteTimeout likewise. Deadline, if set, ends the connection regardless
+// of traffic, and deadlines set on the IdleConn still apply; the earliest
+// wins. FirstByte, if set, closes it when nothing was read for that long
+// from the first read or the last write until the first byte comes in.
+type IdleConn struct {
+	net.Conn
+	Timeout      time.Duration
+	WriteTimeout time.Duration
+	Deadline     time.Time
+	FirstByte    time.Duration
+
+	//readDeadline and writeDeadline are those set through
+	//SetReadDeadline and SetWriteDeadline, in UnixNano
+	readDeadline  atomic.Int64
+	writeDeadline atomic.Int64
+
+	//firstByte is the deadline for the first byte in UnixNano, 0 until
+	//the first read; answered once it came in, timedOut if it didn't
+	firstByte atomic.Int64
+	answered  atomic.Bool
+	timedOut  atomic.Bool
+}
+
+func WithIdleTimeout(conn net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return conn
+	}
+	return &IdleConn{Conn: conn, Timeout: timeout}
+}
+
+// WithTimeouts is WithIdleTimeout plus a hard deadline for the whole
+// connection. Either may be zero.
+func WithTimeouts(conn net.Conn, idle time.Duration, deadline time.Time) net.Conn {
+	conn.SetWriteDeadline(deadline)
+	return &IdleConn{Conn: conn, Timeout: idle, Deadline: deadline}
+}
+
+func (c *IdleConn) Read(p []byte) (int, error) {
+	waiting := c.FirstByte > 0 && !c.answered.Load()
+	if waiting {
+		c.firstByte.CompareAndSwap(0, time.Now().Add(c.FirstByte).UnixNano())
+	}
+	c.Conn.SetReadDeadline(c.nextDeadline())
+	n, err := c.Conn.Read(p)
+	if waiting {
+		if n > 0 {
+			c.answered.Store(true)
+		} else if errors.Is(err, os.ErrDeadlineExceeded) && !time.Now().Before(time.Unix(0, c.firstByte.Load())) {
+			c.timedOut.Store(true)
+		}
+	}
+	return n, err
+}
+
+// FirstByteTimedOut reports whether the connection ended because nothing
+// came in within FirstByte.
+func (c *IdleConn) FirstByteTimedOut() bool {
+	return c.timedOut.Load()
+}
+
+func (c *IdleConn) SetReadDeadline(t time.Time) error {
+	if t.IsZero() {
+		c.readDeadline.Store(0)
+	} else {
+		c.readDeadline.Store(t.UnixNano())
+	}
+	return c.Conn.SetReadDeadline(c.nextDeadline())
+}
+
+func (c *IdleConn) Write(p []byte) (int, error) {
+	if c.WriteTimeout > 0 {
+		c.Conn.SetWriteDeadline(c.nextWriteDeadline())
+	}
+	n, err := c.Conn.Write(p)
+	//the peer gets FirstByte again to answer what it was just sent
+	if n > 0 && c.FirstByte > 0 && !c.answered.Load() {
+		c.firstByte.Store(time.Now().Add(c.FirstByte).UnixNano())
+		c.Conn.SetReadDeadline(c.nextDeadline())
+	}
+	return n, err
+}
+
+func (c *IdleConn) SetWriteDeadline(t time.Time) error {
+	if t.IsZero() {
+		c.writeDeadline.Store(0)
+	} else {
+		c.writeDeadline.Store(t.UnixNano())
+	}
+	return c.Conn.SetWriteDeadline(c.nextWriteDeadline())
+}
+
+func (c *IdleConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *IdleConn) nextDeadline() time.Time {
+	d := c.Deadline
+	if c.Timeout > 0 {
+		d = earliest(d, time.Now().Add(c.Timeout))
+	}
+	if ns := c.readDeadline.Load(); ns != 0 {
+		d = earliest(d, time.Unix(0, ns))
+	}
+	if ns := c.firstByte.Load(); ns != 0 && !c.answered.Load() {
+		d = earliest(d, time.Unix(0, ns))
+	}
+	return d
+}
+
+func (c *IdleConn) nextWriteDeadline() time.Time {
+	d := c.Deadline
+	if c.WriteTimeout > 0 {
+		d = earliest(d, time.Now().Add(c.WriteTimeout))
+	}
+	if ns := c.writeDeadline.Load(); ns != 0 {
+		d = earliest(d, time.Unix(0, ns))
+	}
+	return d
+}
+
+func (c *IdleConn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+// earliest returns the earlier of two deadlines, where zero means none.
+func earliest(a, b time.Time) time.Time {
+	switch {
+	case a.IsZero():
+		return b
+	case b.IsZero() || a.Before(b):
+		return a
+	}
+	return b
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// Per-connection buffers are recycled through these pools, so memory held
+// by connections is bounded by the number open at once rather than growing
+// with connection churn, and the collector has less to do in steady state.
+
+// DefaultCopyBuffer matches io.Copy's buffer.
+const DefaultCopyBuffer = 32 * 1024
+
+var (
+	copyPoolsMu sync.Mutex
+	//one pool per buffer size in use, normally just one or two
+	copyPools = make(map[int]*sync.Pool)
+
+	readerPool = sync.Pool{New: func() any { return bufio.NewReader(nil) }}
+	writerPool = sync.Pool{New: func() any { return bufio.NewWriter(nil) }}
+)
+
+func copyPool(size int) *sync.Pool {
+	copyPoolsMu.Lock()
+	defer copyPoolsMu.Unlock()
+
+	p, ok := copyPools[size]
+	if !ok {
+		p = &sync.Pool{New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		}}
+		copyPools[size] = p
+	}
+	return p
+}
+
+func getReader(r io.Reader) *bufio.Reader {
+	br := readerPool.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func putReader(br *bufio.Reader) {
+	//drop the connection so a pooled reader doesn't keep it reachable
+	br.Reset(nil)
+	readerPool.Put(br)
+}
+
+func getWriter(w io.Writer) *bufio.Writer {
+	bw := writerPool.Get().(*bufio.Writer)
+	bw.Reset(w)
+	return bw
+}
+
+func putWriter(bw *bufio.Writer) {
+	bw.Reset(nil)
+	writerPool.Put(bw)
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+type nopMeter struct{}
+
+func (nopMeter) AddBytesIn(int)  {}
+func (nopMeter) AddBytesOut(int) {}
+
+func TestCopyBufferReused(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items under the race detector")
+	}
+	pool := copyPool(DefaultCopyBuffer)
+	data := make([]byte, 4*DefaultCopyBuffer)
+	src := bytes.NewReader(nil)
+	dst := &meteredWriter{w: io.Discard, meter: nopMeter{}}
+
+	//the wrapper hiding WriteTo is the only allocation left
+	allocs := testing.AllocsPerRun(100, func() {
+		src.Reset(data)
+		if read, write := copyBuffer(dst, src, pool); read != nil || write != nil {
+			t.Fatal(read, write)
+		}
+	})
+	if allocs > 1 {
+		t.Errorf("copyBuffer: %v allocations per copy, want at most 1", allocs)
+	}
+}
+
+func TestBufioReused(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items under the race detector")
+	}
+	var conn bytes.Buffer
+	allocs := testing.AllocsPerRun(100, func() {
+		putReader(getReader(&conn))
+		putWriter(getWriter(&conn))
+	})
+	if allocs != 0 {
+		t.Errorf("%v allocations per reader and writer, want 0", allocs)
+	}
+}
+
+// pipes connects a client and a backend through net.Pipe, which PipeBuffer
+// can't splice: the proxy gets clientSide and backendSide.
+func pipes() (client, clientSide, backendSide, backend net.Conn) {
+	client, clientSide = net.Pipe()
+	backendSide, backend = net.Pipe()
+	return
+}
+
+func BenchmarkPipeBuffer(b *testing.B) {
+	data := make([]byte, 256<<10)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+
+	for b.Loop() {
+		client, clientSide, backendSide, backend := pipes()
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+		go func() {
+			io.Copy(io.Discard, backend)
+			backend.Close()
+		}()
+		PipeBuffer(clientSide, backendSide, nopMeter{}, 0)
+	}
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// Meter receives byte counts as data flows through a proxied connection.
+type Meter interface {
+	//client --> backend
+	AddBytesIn(n int)
+	//backend --> client
+	AddBytesOut(n int)
+}
+
+// Pipe copies data in both directions between the client and the backend
+// and returns once both are finished. A side that ends its data cleanly
+// has that passed on as a half-close of the other, which may keep sending;
+// an error on either direction, or a side that can't half-close, ends
+// both. The error returned is a *BackendError for a failure on the
+// backend's side, reading from it or writing to it, and nil otherwise.
+func Pipe(clientConn, backendConn net.Conn, meter Meter) error {
+	return PipeBuffer(clientConn, backendConn, meter, 0)
+}
+
+// PipeBuffer is Pipe with a copy buffer of size bytes per direction instead
+// of the default 32KB. Smaller buffers bound memory with many idle
+// connections; larger ones mean fewer syscalls for bulk transfers. Buffers
+// come from a pool shared by every connection using the same size. On
+// Linux, plain TCP connections are spliced in the kernel and use none.
+func PipeBuffer(clientConn, backendConn net.Conn, meter Meter, size int) error {
+	if size <= 0 {
+		size = DefaultCopyBuffer
+	}
+	pool := copyPool(size)
+
+	var sent error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		//client --> backend
+		_, sent = copyHalf(&meteredWriter{w: backendConn, meter: meter, in: true}, backendConn, clientConn, pool)
+	}()
+
+	//backend --> client
+	received, _ := copyHalf(&meteredWriter{w: clientConn, meter: meter}, clientConn, backendConn, pool)
+	<-done
+
+	for _, err := range []error{received, sent} {
+		//a side closed after the other failed, or a timeout, is no failure
+		//of the backend's
+		if err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return &BackendError{Err: err}
+		}
+	}
+	return nil
+}
+
+// copyHalf copies one direction, from src to dst, and then half-closes dst,
+// or closes both when the copy failed. It returns the copy's error, as
+// copyBuffer does.
+func copyHalf(w *meteredWriter, dst, src net.Conn, pool *sync.Pool) (read, write error) {
+	read, write = copyBuffer(w, src, pool)
+	if read == nil && write == nil && closeWrite(dst) == nil {
+		return nil, nil
+	}
+	dst.Close()
+	src.Close()
+	return read, write
+}
+
+// copyBuffer copies with a pooled buffer, which it owns until the copy ends,
+// unless the platform can move the data without one. It returns nil once
+// src ended cleanly, or the error that ended the copy as read or write.
+func copyBuffer(dst *meteredWriter, src io.Reader, pool *sync.Pool) (read, write error) {
+	if ok, read, write := splice(dst, src); ok {
+		return read, write
+	}
+
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+
+	//hide WriteTo, which would copy through a buffer of its own
+	_, err := io.CopyBuffer(dst, struct{ io.Reader }{src}, *buf)
+	if err != nil && (dst.err != nil || err == io.ErrShortWrite) {
+		return nil, err
+	}
+	return err, nil
+}
+
+var errNoCloseWrite = errors.New("connection can't half-close")
+
+// closeWrite shuts down the writing side of conn: of the outermost layer
+// able to, so TLS sends its close_notify rather than a bare FIN.
+func closeWrite(conn net.Conn) error {
+	for conn != nil {
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			return cw.CloseWrite()
+		}
+		w, ok := conn.(interface{ Unwrap() net.Conn })
+		if !ok {
+			break
+		}
+		conn = w.Unwrap()
+	}
+	return errNoCloseWrite
+}
+
+// meteredWriter reports written bytes to the meter. It holds the meter and
+// a direction rather than a method value, which would be one more
+// allocation per connection.
+type meteredWriter struct {
+	w     io.Writer
+	meter Meter
+	//in is client --> backend
+	in bool
+	//err is the first failed write's, telling those from failed reads
+	err error
+}
+
+func (m *meteredWriter) Write(p []byte) (int, error) {
+	n, err := m.w.Write(p)
+	m.record(n)
+	if err != nil && m.err == nil {
+		m.err = err
+	}
+	return n, err
+}
+
+func (m *meteredWriter) record(n int) {
+	if m.in {
+		m.meter.AddBytesIn(n)
+	} else {
+		m.meter.AddBytesOut(n)
+	}
+}
+
+// BackendError is returned for failures on the backend's side of a
+// proxied connection, such as a reset before the response.
+type BackendError struct {
+	Err error
+}
+
+func (e *BackendError) Error() string { return e.Err.Error() }
+func (e *BackendError) Unwrap() error { return e.Err }
+
+// Reason codes of the error responses the balancer writes itself, so that
+// clients and dashboards can tell the failures apart.
+const (
+	ReasonNoHealthyBackend = "no_healthy_backend"
+	ReasonDialTimeout      = "dial_timeout"
+	ReasonDialFailed       = "dial_failed"
+	ReasonPoolDraining     = "pool_draining"
+	ReasonOverCapacity     = "over_capacity"
+)
+
+// ReasonHeader carries the reason code of an error response.
+const ReasonHeader = "X-LB-Reason"
+
+// WriteServiceUnavailable tells an HTTP client no backend may take it now.
+func WriteServiceUnavailable(conn net.Conn, reason string) {
+	writeError(conn, "503 Service Unavailable", "service unavailable", reason)
+}
+
+func WriteBadGateway(conn net.Conn, reason string) {
+	writeError(conn, "502 Bad Gateway", "backend unavailable", reason)
+}
+
+// writeError writes status with a JSON body naming the error and reason.
+func writeError(conn net.Conn, status, msg, reason string) {
+	body := fmt.Sprintf(`{"error":%q,"reason":%q}`+"\n", msg, reason)
+	response := "HTTP/1.1 " + status + "\r\n"
+	response += "Content-Type: application/json\r\n"
+	response += "Content-Length: " + strconv.Itoa(len(body)) + "\r\n"
+	response += ReasonHeader + ": " + reason + "\r\n"
+	response += "\r\n"
+	response += body
+	conn.Write([]byte(response))
+}
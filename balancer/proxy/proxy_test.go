@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+// reset closes conn with a RST instead of a FIN.
+func reset(conn *net.TCPConn) {
+	conn.SetLinger(0)
+	conn.Close()
+}
+
+func TestPipeBackendReset(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	backendSide, backend := tcpPair(t)
+	defer client.Close()
+
+	go func() {
+		io.ReadFull(backend, make([]byte, 5))
+		reset(backend)
+	}()
+	io.WriteString(client, "hello")
+
+	err := PipeBuffer(clientSide, backendSide, nopMeter{}, 0)
+	var backendErr *BackendError
+	if !errors.As(err, &backendErr) {
+		t.Errorf("PipeBuffer: %v, want a BackendError", err)
+	}
+}
+
+func TestPipeClientReset(t *testing.T) {
+	client, clientSide := tcpPair(t)
+	backendSide, backend := tcpPair(t)
+	defer backend.Close()
+
+	//the backend keeps sending while the client goes away
+	go func() {
+		data := make([]byte, 64<<10)
+		for {
+			if _, err := backend.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		io.ReadFull(client, make([]byte, 1<<20))
+		reset(client)
+	}()
+
+	if err := PipeBuffer(clientSide, backendSide, nopMeter{}, 0); err != nil {
+		t.Errorf("PipeBuffer: %v, want nil", err)
+	}
+}
+
+func TestPipeBufferedBackendError(t *testing.T) {
+	client, clientSide, backendSide, backend := pipes()
+	failing := &failingConn{Conn: backendSide, err: errors.New("connection reset by peer")}
+
+	go io.Copy(io.Discard, client)
+	go io.Copy(io.Discard, backend)
+	err := PipeBuffer(clientSide, failing, nopMeter{}, 0)
+	var backendErr *BackendError
+	if !errors.As(err, &backendErr) || backendErr.Err != failing.err {
+		t.Errorf("PipeBuffer: %v, want %v", err, failing.err)
+	}
+	client.Close()
+	backend.Close()
+}
+
+// failingConn fails reads with err.
+type failingConn struct {
+	net.Conn
+	err error
+}
+
+func (c *failingConn) Read([]byte) (int, error) {
+	return 0, c.err
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package proxy
+
+// raceEnabled skips allocation checks: under the race detector sync.Pool
+// drops items at random, so pooled values are allocated again.
+const raceEnabled = true
@@ -0,0 +1,75 @@
+//go:build linux
+
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"syscall"
+)
+
+// spliceChunk bounds each splice so the meter keeps up with long transfers.
+const spliceChunk = 1 << 20
+
+// splice copies between two plain TCP connections without passing the data
+// through user space, with the error that ended the copy as read or
+// write, nil at the end of src. It reports false, having copied nothing, when either side is
+// wrapped (TLS, idle timeouts, buffered adapters).
+func splice(dst *meteredWriter, src io.Reader) (ok bool, read, write error) {
+	to, ok := dst.w.(*net.TCPConn)
+	if !ok {
+		return false, nil, nil
+	}
+	from, ok := src.(*net.TCPConn)
+	if !ok {
+		return false, nil, nil
+	}
+
+	//ReadFrom splices from a TCPConn or a LimitedReader around one. The
+	//first byte goes on its own, so the meter can time it.
+	lr := &io.LimitedReader{R: from}
+	chunk := int64(1)
+	for {
+		lr.N = chunk
+		n, err := to.ReadFrom(lr)
+		if n > 0 {
+			dst.record(int(n))
+		}
+		switch {
+		case err == nil && n == 0:
+			return true, nil, nil
+		//the error says nothing of the side it came from, the state of src
+		//does
+		case err != nil && broken(from):
+			return true, err, nil
+		case err != nil:
+			return true, nil, err
+		}
+		chunk = spliceChunk
+	}
+}
+
+// tcpClose is TCP_CLOSE, the state of a connection that was reset or timed
+// out, from include/net/tcp_states.h.
+const tcpClose = 7
+
+// broken reports whether conn's connection is gone in the kernel, rather
+// than open or ended by the peer's FIN.
+func broken(conn *net.TCPConn) bool {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var state byte
+	raw.Control(func(fd uintptr) {
+		//the state is the first byte of struct tcp_info
+		v, err := syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_INFO)
+		if err == nil {
+			var b [4]byte
+			binary.NativeEndian.PutUint32(b[:], uint32(v))
+			state = b[0]
+		}
+	})
+	return state == tcpClose
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package proxy
+
+import "io"
+
+func splice(dst *meteredWriter, src io.Reader) (ok bool, read, write error) {
+	return false, nil, nil
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net"
+	"time"
+)
+
+// throttleChunk bounds the bytes moved between two waits, so that a large
+// buffer does not turn into one long pause
+const throttleChunk = 16 << 10
+
+// Shaper paces traffic: Reserve takes n bytes from the budget and returns
+// how long to wait before going on.
+type Shaper interface {
+	Reserve(n int) time.Duration
+}
+
+// ThrottledConn paces reads and writes by the slowest of its shapers.
+// It hides the underlying TCPConn, so throttled connections are never
+// spliced.
+type ThrottledConn struct {
+	net.Conn
+	Shapers []Shaper
+}
+
+func Throttle(conn net.Conn, shapers ...Shaper) net.Conn {
+	if len(shapers) == 0 {
+		return conn
+	}
+	return &ThrottledConn{Conn: conn, Shapers: shapers}
+}
+
+func (c *ThrottledConn) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := c.Conn.Read(p)
+	c.wait(n)
+	return n, err
+}
+
+func (c *ThrottledConn) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		c.wait(len(chunk))
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *ThrottledConn) wait(n int) {
+	if n <= 0 {
+		return
+	}
+	var d time.Duration
+	for _, s := range c.Shapers {
+		d = max(d, s.Reserve(n))
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (c *ThrottledConn) Unwrap() net.Conn {
+	return c.Conn
+}
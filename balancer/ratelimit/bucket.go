@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/clock"
+)
+
+// Bucket is a single token bucket, e.g. for a listener-wide accept rate.
+type Bucket struct {
+	rate  float64
+	burst float64
+	clock clock.Clock
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate float64, burst int, c clock.Clock) *Bucket {
+	if burst <= 0 {
+		burst = max(1, int(rate))
+	}
+	return &Bucket{rate: rate, burst: float64(burst), clock: c, tokens: float64(burst), last: c.Now()}
+}
+
+func (b *Bucket) Allow() bool {
+	if b == nil {
+		return true
+	}
+
+	now := b.clock.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Reserve takes n tokens even when that leaves the bucket in debt, and
+// returns how long to wait until the debt is paid off. It suits shaping
+// bandwidth, where the bytes have been read by the time they are counted.
+func (b *Bucket) Reserve(n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	now := b.clock.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
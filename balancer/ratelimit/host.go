@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"strings"
+
+	"loadbalancer/balancer/clock"
+)
+
+// HostConfig limits one hostname. A zero rate leaves that side unlimited.
+type HostConfig struct {
+	ConnRate     float64
+	ConnBurst    int
+	RequestRate  float64
+	RequestBurst int
+}
+
+type hostBuckets struct {
+	conns, requests *Bucket
+}
+
+func newHostBuckets(cfg HostConfig, c clock.Clock) *hostBuckets {
+	b := &hostBuckets{}
+	if cfg.ConnRate > 0 {
+		b.conns = NewBucket(cfg.ConnRate, cfg.ConnBurst, c)
+	}
+	if cfg.RequestRate > 0 {
+		b.requests = NewBucket(cfg.RequestRate, cfg.RequestBurst, c)
+	}
+	return b
+}
+
+// HostLimiter keeps separate buckets per hostname, so a spike on one tenant
+// cannot use up capacity shared with the others. Names match exactly or
+// through a "*.example.com" entry, which all its subdomains share. Every
+// other name shares the default buckets, so clients cannot grow the table
+// by inventing names.
+type HostLimiter struct {
+	hosts    map[string]*hostBuckets
+	fallback *hostBuckets
+}
+
+func NewHostLimiter(hosts map[string]HostConfig, fallback HostConfig, c clock.Clock) *HostLimiter {
+	l := &HostLimiter{
+		hosts:    make(map[string]*hostBuckets, len(hosts)),
+		fallback: newHostBuckets(fallback, c),
+	}
+	for name, cfg := range hosts {
+		l.hosts[strings.ToLower(name)] = newHostBuckets(cfg, c)
+	}
+	return l
+}
+
+func (l *HostLimiter) buckets(host string) *hostBuckets {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if b, ok := l.hosts[host]; ok {
+		return b
+	}
+	for rest := host; ; {
+		_, parent, found := strings.Cut(rest, ".")
+		if !found {
+			break
+		}
+		if b, ok := l.hosts["*."+parent]; ok {
+			return b
+		}
+		rest = parent
+	}
+	return l.fallback
+}
+
+// AllowConn takes a token for a new connection to host. A nil limiter
+// allows everything.
+func (l *HostLimiter) AllowConn(host string) bool {
+	if l == nil {
+		return true
+	}
+	return l.buckets(host).conns.Allow()
+}
+
+// AllowRequest takes a token for an HTTP request to host.
+func (l *HostLimiter) AllowRequest(host string) bool {
+	if l == nil {
+		return true
+	}
+	return l.buckets(host).requests.Allow()
+}
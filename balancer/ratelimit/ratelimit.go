@@ -0,0 +1,250 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/clock"
+)
+
+// Config for a per-IP limiter on new connections.
+type Config struct {
+	//Rate is the sustained number of new connections per second per IP, 0
+	//for no limit
+	Rate float64
+	//Burst is the bucket size, default max(1, Rate)
+	Burst int
+
+	//BanAfter rate-limit trips within BanWindow ban the IP; zero disables bans
+	BanAfter  int
+	BanWindow time.Duration
+	//BanDuration is the first ban; each further ban doubles it up to MaxBan
+	BanDuration time.Duration
+	MaxBan      time.Duration
+
+	//IPv6Prefix is the IPv6 network counted as one client, default /64 so
+	//that rotating privacy addresses share a bucket; 128 counts every address
+	IPv6Prefix int
+
+	//MaxConns caps the connections each IP holds open at once, see Acquire;
+	//0 for no limit
+	MaxConns int
+}
+
+func (c Config) withDefaults() Config {
+	if c.Burst <= 0 {
+		c.Burst = max(1, int(c.Rate))
+	}
+	if c.BanWindow <= 0 {
+		c.BanWindow = time.Minute
+	}
+	if c.BanDuration <= 0 {
+		c.BanDuration = time.Minute
+	}
+	if c.MaxBan <= 0 {
+		c.MaxBan = time.Hour
+	}
+	if c.IPv6Prefix <= 0 || c.IPv6Prefix > 128 {
+		c.IPv6Prefix = DefaultIPv6Prefix
+	}
+	return c
+}
+
+// DefaultIPv6Prefix is the usual size of one subscriber's IPv6 network.
+const DefaultIPv6Prefix = 64
+
+// ClientNet is the address ip is counted under: IPv4 addresses as they
+// are, IPv6 ones masked to bits.
+func ClientNet(ip netip.Addr, bits int) netip.Addr {
+	ip = ip.Unmap().WithZone("")
+	if !ip.Is6() || bits <= 0 || bits >= 128 {
+		return ip
+	}
+	p, _ := ip.Prefix(bits)
+	return p.Addr()
+}
+
+// Limiter is a token bucket per client IP with ban escalation for repeat
+// offenders. It is safe for concurrent use.
+type Limiter struct {
+	cfg   Config
+	clock clock.Clock
+
+	mu        sync.Mutex
+	clients   map[netip.Addr]*client
+	lastSweep time.Time
+}
+
+type client struct {
+	tokens   float64
+	last     time.Time
+	strikes  []time.Time
+	banUntil time.Time
+	bans     int
+	//open connections, see Acquire
+	open int
+}
+
+func New(cfg Config, c clock.Clock) *Limiter {
+	return &Limiter{
+		cfg:       cfg.withDefaults(),
+		clock:     c,
+		clients:   make(map[netip.Addr]*client),
+		lastSweep: c.Now(),
+	}
+}
+
+// Allow takes a token for ip. When it returns false the reason says whether
+// the client was rate limited or is banned.
+func (l *Limiter) Allow(ip netip.Addr) (bool, string) {
+	if l == nil || l.cfg.Rate <= 0 {
+		return true, ""
+	}
+
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	ip = ClientNet(ip, l.cfg.IPv6Prefix)
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &client{tokens: float64(l.cfg.Burst), last: now}
+		l.clients[ip] = c
+	}
+
+	if now.Before(c.banUntil) {
+		return false, fmt.Sprintf("banned for %s", c.banUntil.Sub(now).Round(time.Second))
+	}
+
+	c.tokens = min(float64(l.cfg.Burst), c.tokens+now.Sub(c.last).Seconds()*l.cfg.Rate)
+	c.last = now
+
+	if c.tokens >= 1 {
+		c.tokens--
+		return true, ""
+	}
+
+	if l.strike(c, now) {
+		return false, fmt.Sprintf("rate limit exceeded, banned for %s", c.banUntil.Sub(now))
+	}
+	return false, "rate limit exceeded"
+}
+
+// Acquire counts a connection of ip as open until Release, and reports
+// false with a reason once ip already holds MaxConns of them.
+func (l *Limiter) Acquire(ip netip.Addr) (bool, string) {
+	if l == nil || l.cfg.MaxConns <= 0 {
+		return true, ""
+	}
+
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	ip = ClientNet(ip, l.cfg.IPv6Prefix)
+	c, ok := l.clients[ip]
+	if !ok {
+		c = &client{tokens: float64(l.cfg.Burst), last: now}
+		l.clients[ip] = c
+	}
+	if c.open >= l.cfg.MaxConns {
+		return false, fmt.Sprintf("limit of %d concurrent connections reached", l.cfg.MaxConns)
+	}
+	c.open++
+	return true, ""
+}
+
+// Release ends a connection Acquire let through. Without a rate there is
+// no bucket or ban to remember, so the client is forgotten with its last
+// connection.
+func (l *Limiter) Release(ip netip.Addr) {
+	if l == nil || l.cfg.MaxConns <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ip = ClientNet(ip, l.cfg.IPv6Prefix)
+	c := l.clients[ip]
+	if c == nil || c.open == 0 {
+		return
+	}
+	c.open--
+	if c.open == 0 && l.cfg.Rate <= 0 {
+		delete(l.clients, ip)
+	}
+}
+
+// strike records a rate-limit trip and bans the client when it has tripped
+// too often, reporting whether a ban started.
+func (l *Limiter) strike(c *client, now time.Time) bool {
+	if l.cfg.BanAfter <= 0 {
+		return false
+	}
+
+	cutoff := now.Add(-l.cfg.BanWindow)
+	kept := c.strikes[:0]
+	for _, t := range c.strikes {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	c.strikes = append(kept, now)
+
+	if len(c.strikes) < l.cfg.BanAfter {
+		return false
+	}
+
+	ban := l.cfg.BanDuration << c.bans
+	if ban > l.cfg.MaxBan || ban <= 0 {
+		ban = l.cfg.MaxBan
+	}
+	c.bans++
+	c.banUntil = now.Add(ban)
+	c.strikes = c.strikes[:0]
+	return true
+}
+
+// sweep forgets clients that are idle with a full bucket, no ban and no open
+// connection, so memory stays bounded by recently active IPs. Ban history
+// survives for MaxBan after the last ban so escalation is not reset too
+// early.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for ip, c := range l.clients {
+		refilled := c.tokens+now.Sub(c.last).Seconds()*l.cfg.Rate >= float64(l.cfg.Burst)
+		if refilled && c.open == 0 && now.After(c.banUntil.Add(l.cfg.MaxBan)) {
+			delete(l.clients, ip)
+		}
+	}
+}
+
+// Banned returns the IPs currently banned and when their ban ends. IPv6
+// clients are listed by the network address of their prefix.
+func (l *Limiter) Banned() map[netip.Addr]time.Time {
+	now := l.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	banned := make(map[netip.Addr]time.Time)
+	for ip, c := range l.clients {
+		if now.Before(c.banUntil) {
+			banned[ip] = c.banUntil
+		}
+	}
+	return banned
+}
@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"loadbalancer/balancer/clock"
+)
+
+func TestConcurrencyOnlyForgetsClients(t *testing.T) {
+	l := New(Config{MaxConns: 2}, clock.NewFake(time.Unix(0, 0)))
+	for i := range 100 {
+		ip := netip.AddrFrom4([4]byte{10, 0, 0, byte(i)})
+		if ok, _ := l.Acquire(ip); !ok {
+			t.Fatalf("%s refused", ip)
+		}
+		l.Release(ip)
+	}
+	if n := len(l.clients); n != 0 {
+		t.Errorf("%d clients kept after their connections ended", n)
+	}
+}
+
+func TestAcquireCap(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	l := New(Config{Rate: 10, MaxConns: 1}, fake)
+	ip := netip.MustParseAddr("192.0.2.1")
+	if ok, _ := l.Acquire(ip); !ok {
+		t.Fatal("first connection refused")
+	}
+	if ok, _ := l.Acquire(ip); ok {
+		t.Fatal("second connection let through")
+	}
+	l.Release(ip)
+	if ok, _ := l.Acquire(ip); !ok {
+		t.Fatal("refused after a release")
+	}
+	l.Release(ip)
+
+	//with a rate the bucket is kept until a sweep finds it idle
+	fake.Advance(2 * time.Hour)
+	l.Acquire(netip.MustParseAddr("192.0.2.2"))
+	if _, ok := l.clients[ip]; ok {
+		t.Error("idle client not swept by Acquire")
+	}
+}
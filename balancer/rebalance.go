@@ -0,0 +1,221 @@
+package balancer
+
+import (
+	"math"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RebalancePolicy ends long-lived connections to backends that carry more
+// than their share, so that backends added later get load from clients
+// that never reconnect on their own. Connections are ended oldest first.
+// In ModeHTTP the client is told with Connection: close on its next
+// response and Grace later the connection is closed regardless; plain TCP
+// has no way to warn, so those connections are closed straight away.
+type RebalancePolicy struct {
+	//Interval between checks, default 30s
+	Interval time.Duration
+	//Threshold is how far above the pool's average a backend may be before
+	//connections are moved off it, default 1.5
+	Threshold float64
+	//MaxPerRound caps the connections ended per check and pool, default 10
+	MaxPerRound int
+	//MinAge spares connections younger than this, default 1m
+	MinAge time.Duration
+	//Grace is how long an HTTP client has to finish after its notice,
+	//default 30s
+	Grace time.Duration
+}
+
+func (p RebalancePolicy) withDefaults() RebalancePolicy {
+	if p.Interval <= 0 {
+		p.Interval = 30 * time.Second
+	}
+	if p.Threshold <= 1 {
+		p.Threshold = 1.5
+	}
+	if p.MaxPerRound <= 0 {
+		p.MaxPerRound = 10
+	}
+	if p.MinAge <= 0 {
+		p.MinAge = time.Minute
+	}
+	if p.Grace <= 0 {
+		p.Grace = 30 * time.Second
+	}
+	return p
+}
+
+// WithRebalancing moves long-lived connections off overloaded backends by
+// policy. Reconnecting clients go wherever the strategy sends them, so it
+// works best with least_conn.
+func WithRebalancing(policy RebalancePolicy) Option {
+	return func(lb *LoadBalancer) {
+		lb.rebalancer = &rebalancer{
+			policy: policy.withDefaults(),
+			conns:  make(map[*Backend]map[*liveConn]struct{}),
+		}
+	}
+}
+
+// rebalancer keeps the open connections of every backend, which it needs
+// to pick the oldest.
+type rebalancer struct {
+	policy RebalancePolicy
+
+	mu    sync.Mutex
+	conns map[*Backend]map[*liveConn]struct{}
+
+	//ended counts connections ended to rebalance
+	ended atomic.Uint64
+}
+
+// liveConn is one proxied connection that may be asked to go away.
+type liveConn struct {
+	backend        *Backend
+	started        time.Time
+	client, server net.Conn
+	//http clients get notice through their next response
+	http      bool
+	goingAway atomic.Bool
+}
+
+// track registers a connection; the caller ends it with untrack. It does
+// nothing when rebalancing is off.
+func (r *rebalancer) track(b *Backend, client, server net.Conn, http bool, started time.Time) *liveConn {
+	if r == nil {
+		return nil
+	}
+	lc := &liveConn{backend: b, started: started, client: client, server: server, http: http}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns[b] == nil {
+		r.conns[b] = make(map[*liveConn]struct{})
+	}
+	r.conns[b][lc] = struct{}{}
+	return lc
+}
+
+func (r *rebalancer) untrack(lc *liveConn) {
+	if r == nil || lc == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns[lc.backend], lc)
+	if len(r.conns[lc.backend]) == 0 {
+		delete(r.conns, lc.backend)
+	}
+}
+
+// leaving reports whether the connection was asked to end, so an HTTP
+// response can carry the notice.
+func (lc *liveConn) leaving() bool {
+	return lc != nil && lc.goingAway.Load()
+}
+
+func (lc *liveConn) close() {
+	lc.client.Close()
+	lc.server.Close()
+}
+
+// runRebalancer checks every pool once per interval until Shutdown.
+func (lb *LoadBalancer) runRebalancer() {
+	r := lb.rebalancer
+	ticker := lb.clock.NewTicker(r.policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lb.stop:
+			return
+		case <-ticker.C():
+		}
+		if lb.shedder.paused("rebalance") {
+			continue
+		}
+		for _, p := range lb.Pools() {
+			lb.rebalance(p)
+		}
+	}
+}
+
+// rebalance ends the oldest connections of the backends of p that are over
+// the threshold, down to the pool's average.
+func (lb *LoadBalancer) rebalance(p *Pool) {
+	r := lb.rebalancer
+	healthy := p.healthyBackends()
+	if len(healthy) < 2 {
+		return
+	}
+
+	var total int64
+	for _, b := range healthy {
+		total += b.Active()
+	}
+	avg := float64(total) / float64(len(healthy))
+
+	now := lb.clock.Now()
+	budget := r.policy.MaxPerRound
+	for _, b := range healthy {
+		active := float64(b.Active())
+		if budget == 0 || active <= avg*r.policy.Threshold || active-avg < 1 {
+			continue
+		}
+
+		//HTTP connections told to leave in an earlier round still count as
+		//active until their grace runs out
+		candidates, leaving := r.oldest(b, now.Add(-r.policy.MinAge))
+		n := int(active-math.Ceil(avg)) - leaving
+		victims := candidates[:min(len(candidates), max(n, 0), budget)]
+		if len(victims) == 0 {
+			continue
+		}
+		budget -= len(victims)
+
+		lb.log.Info("Rebalancing pool", "pool", p.name, "backend", b.Addr, "ending", len(victims), "connections", b.Active(), "average", avg)
+		for _, lc := range victims {
+			r.ended.Add(1)
+			lc.goingAway.Store(true)
+			if !lc.http {
+				lc.close()
+				continue
+			}
+			lb.goSafe("rebalance grace", func() {
+				lb.clock.Sleep(r.policy.Grace)
+				lc.close()
+			})
+		}
+	}
+}
+
+// oldest returns the connections to b started before cutoff, oldest first,
+// and the number already going away, which it leaves out.
+func (r *rebalancer) oldest(b *Backend, cutoff time.Time) ([]*liveConn, int) {
+	r.mu.Lock()
+	var conns []*liveConn
+	leaving := 0
+	for lc := range r.conns[b] {
+		switch {
+		case lc.goingAway.Load():
+			leaving++
+		case lc.started.Before(cutoff):
+			conns = append(conns, lc)
+		}
+	}
+	r.mu.Unlock()
+
+	slices.SortFunc(conns, func(a, b *liveConn) int { return a.started.Compare(b.started) })
+	return conns, leaving
+}
+
+func (r *rebalancer) endedCount() uint64 {
+	if r == nil {
+		return 0
+	}
+	return r.ended.Load()
+}
@@ -0,0 +1,43 @@
+package balancer
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// goSafe runs fn on its own goroutine and recovers any panic, so a single
+// misbehaving connection or hook cannot silently take down the process.
+func (lb *LoadBalancer) goSafe(where string, fn func()) {
+	go func() {
+		defer lb.recoverPanic(where)
+		fn()
+	}()
+}
+
+// safeCall runs a synchronous hook, converting a panic into an error for the
+// caller while still logging and counting it.
+func (lb *LoadBalancer) safeCall(where string, fn func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			lb.logPanic(where, r)
+			err = fmt.Errorf("panic in %s: %v", where, r)
+		}
+	}()
+	return fn()
+}
+
+func (lb *LoadBalancer) recoverPanic(where string) {
+	if r := recover(); r != nil {
+		lb.logPanic(where, r)
+	}
+}
+
+func (lb *LoadBalancer) logPanic(where string, r any) {
+	lb.panics.Add(1)
+	lb.log.Error("Recovered panic", "component", where, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+}
+
+// Panics returns how many panics have been recovered since start.
+func (lb *LoadBalancer) Panics() uint64 {
+	return lb.panics.Load()
+}
@@ -0,0 +1,236 @@
+package balancer
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultRegionInterval = 5 * time.Second
+	defaultRegionTimeout  = 2 * time.Second
+	defaultRegionMargin   = 0.2
+	//regionLatencyWeight is the share of a round in a region's average
+	regionLatencyWeight = 0.3
+)
+
+// RegionFailover sends a listener's connections to the fastest healthy of
+// several regional pools, a lightweight global traffic manager. Every
+// interval it connects to each region's backends; the region with the
+// lowest average connect time takes the traffic, and when it loses its
+// healthy backends or goes over MaxLatency the listener fails over to the
+// next best one. Listener routes and GeoIP routes still come first.
+type RegionFailover struct {
+	//Pools are the regions, the first taking the traffic until probed
+	Pools []string
+	//Interval between probing rounds, default 5s
+	Interval time.Duration
+	//Timeout of each connect, default 2s
+	Timeout time.Duration
+	//MaxLatency counts a region as degraded above it, 0 for no limit
+	MaxLatency time.Duration
+	//Margin is how much faster, as a share, a region must be than the
+	//current one to take over from it while that one is fine, default 0.2
+	Margin float64
+}
+
+func (r RegionFailover) withDefaults() RegionFailover {
+	if r.Interval <= 0 {
+		r.Interval = defaultRegionInterval
+	}
+	if r.Timeout <= 0 {
+		r.Timeout = defaultRegionTimeout
+	}
+	if r.Margin <= 0 {
+		r.Margin = defaultRegionMargin
+	}
+	return r
+}
+
+// regions is the failover state of one listener.
+type regions struct {
+	policy RegionFailover
+	pools  []*Pool
+	//current takes the listener's connections
+	current atomic.Pointer[Pool]
+
+	mu sync.Mutex
+	//latency is the moving average of each region's connect time, 0 until
+	//probed
+	latency map[*Pool]time.Duration
+	//up is whether a region passed its last round
+	up     map[*Pool]bool
+	rounds int
+}
+
+// RegionStats is one region of a listener with RegionFailover.
+type RegionStats struct {
+	Pool string
+	//Latency is the moving average of the connect time to its backends
+	Latency time.Duration
+	//Up regions have healthy backends that answered within MaxLatency
+	Up bool
+	//Active is the region taking the traffic
+	Active bool
+}
+
+// newRegions checks the regions of cfg and starts out on the first.
+func (lb *LoadBalancer) newRegions(cfg *RegionFailover, tenant *Tenant) (*regions, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if len(cfg.Pools) == 0 {
+		return nil, fmt.Errorf("region failover without pools")
+	}
+	r := &regions{
+		policy:  cfg.withDefaults(),
+		latency: make(map[*Pool]time.Duration),
+		up:      make(map[*Pool]bool),
+	}
+	for _, name := range cfg.Pools {
+		p := lb.lookupPool(tenant, name)
+		if p == nil {
+			return nil, fmt.Errorf("region failover to unknown pool %s", name)
+		}
+		r.pools = append(r.pools, p)
+	}
+	r.current.Store(r.pools[0])
+	return r, nil
+}
+
+// pool is the region taking the traffic, nil without RegionFailover.
+func (r *regions) pool() *Pool {
+	if r == nil {
+		return nil
+	}
+	return r.current.Load()
+}
+
+// runRegions probes the regions of fe once per interval until Shutdown.
+func (lb *LoadBalancer) runRegions(fe *frontend) {
+	r := fe.regions
+	ticker := lb.clock.NewTicker(r.policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		//the current region keeps the traffic while paused
+		if !lb.shedder.paused("regions") {
+			lb.probeRegions(fe)
+		}
+		select {
+		case <-lb.stop:
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+// probeRegions runs one round: it probes every region at once, then moves
+// the traffic if the current region degraded or another is clearly faster.
+func (lb *LoadBalancer) probeRegions(fe *frontend) {
+	r := fe.regions
+	samples := make([]time.Duration, len(r.pools))
+	var wg sync.WaitGroup
+	for i, p := range r.pools {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			samples[i] = lb.probeRegion(p, r.policy.Timeout)
+		}()
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var best *Pool
+	for i, p := range r.pools {
+		up := samples[i] > 0
+		if up {
+			avg := r.latency[p]
+			if avg == 0 {
+				avg = samples[i]
+			}
+			avg += time.Duration(regionLatencyWeight * float64(samples[i]-avg))
+			r.latency[p] = avg
+			up = r.policy.MaxLatency <= 0 || avg <= r.policy.MaxLatency
+		}
+		switch {
+		case up == r.up[p]:
+		case !up && r.rounds > 0:
+			lb.log.Warn("Region degraded", "region", p.name, "listener", fe.addr, "reason", r.describe(p, samples[i]))
+		case up && r.rounds > 0:
+			lb.log.Info("Region recovered", "region", p.name, "listener", fe.addr, "latency", r.latency[p])
+		}
+		r.up[p] = up
+		if up && (best == nil || r.latency[p] < r.latency[best]) {
+			best = p
+		}
+	}
+
+	r.rounds++
+
+	current := r.current.Load()
+	switch {
+	case best == nil || best == current:
+	case !r.up[current]:
+		lb.log.Warn("Listener failing over", "listener", fe.addr, "from", current.name, "to", best.name, "latency", r.latency[best])
+		r.current.Store(best)
+	case float64(r.latency[best]) < float64(r.latency[current])*(1-r.policy.Margin):
+		lb.log.Info("Listener moving to a faster region", "listener", fe.addr, "from", current.name, "from_latency", r.latency[current], "to", best.name, "latency", r.latency[best])
+		r.current.Store(best)
+	}
+}
+
+// describe says why p is down; the caller holds r.mu.
+func (r *regions) describe(p *Pool, sample time.Duration) string {
+	if sample == 0 {
+		return "no healthy backend answered"
+	}
+	return fmt.Sprintf("%s, above %s", r.latency[p].Round(time.Microsecond), r.policy.MaxLatency)
+}
+
+// probeRegion is the average connect time to the backends of p that may
+// take connections, 0 when none answered within timeout.
+func (lb *LoadBalancer) probeRegion(p *Pool, timeout time.Duration) time.Duration {
+	var total time.Duration
+	var answered int
+	for _, b := range p.healthyBackends() {
+		start := lb.clock.Now()
+		dialer := net.Dialer{Deadline: time.Now().Add(timeout)}
+		conn, err := lb.dial(&dialer, b.Addr)
+		if err != nil {
+			continue
+		}
+		total += max(lb.clock.Since(start), time.Nanosecond)
+		answered++
+		conn.Close()
+	}
+	if answered == 0 {
+		return 0
+	}
+	return total / time.Duration(answered)
+}
+
+// stats reports the regions of a listener, nil without RegionFailover.
+func (r *regions) stats() []RegionStats {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := r.current.Load()
+	stats := make([]RegionStats, 0, len(r.pools))
+	for _, p := range r.pools {
+		stats = append(stats, RegionStats{
+			Pool:    p.name,
+			Latency: r.latency[p],
+			Up:      r.up[p],
+			Active:  p == current,
+		})
+	}
+	return stats
+}
@@ -0,0 +1,177 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// RegistrationPolicy lets backends join a pool on their own and stay as
+// long as they renew their registration, for small deployments without a
+// service registry.
+type RegistrationPolicy struct {
+	//TTL is how long a registration lasts without a heartbeat, default 30s
+	TTL time.Duration
+	//Pools backends may register in, default only the default pool
+	Pools []string
+}
+
+func (p RegistrationPolicy) withDefaults() RegistrationPolicy {
+	if p.TTL <= 0 {
+		p.TTL = 30 * time.Second
+	}
+	if len(p.Pools) == 0 {
+		p.Pools = []string{DefaultPool}
+	}
+	return p
+}
+
+// WithRegistration enables Register and Deregister by policy, which the
+// admin API offers to backends through AdminConfig.RegisterToken.
+func WithRegistration(policy RegistrationPolicy) Option {
+	return func(lb *LoadBalancer) {
+		lb.registry = &registry{
+			policy:  policy.withDefaults(),
+			expires: make(map[registration]time.Time),
+			leaving: make(map[registration]bool),
+		}
+	}
+}
+
+var errNoRegistration = errors.New("registration is not enabled")
+
+type registry struct {
+	policy RegistrationPolicy
+
+	mu sync.Mutex
+	//expires are the deadlines of the backends that registered
+	expires map[registration]time.Time
+	//leaving are those being drained since they expired or deregistered
+	leaving map[registration]bool
+}
+
+type registration struct {
+	pool, addr string
+}
+
+// Registration is a backend's answer to Register.
+type Registration struct {
+	Pool string
+	Addr string
+	//New is true when the backend joined rather than renewed
+	New bool
+	TTL time.Duration
+}
+
+// Register adds the backend at addr to pool, or renews its registration
+// when it registered before. Either way it stays for the policy's TTL.
+// Members the backend did not add itself, such as configured ones, are
+// left as they are and never expire.
+func (lb *LoadBalancer) Register(pool, addr string) (Registration, *Backend, error) {
+	r := lb.registry
+	if r == nil {
+		return Registration{}, nil, errNoRegistration
+	}
+	if pool == "" {
+		pool = DefaultPool
+	}
+	reg := Registration{Pool: pool, Addr: addr, TTL: r.policy.TTL}
+	p := lb.Pool(pool)
+	if p == nil || !slices.Contains(r.policy.Pools, pool) {
+		return reg, nil, fmt.Errorf("backends may not register in pool %s", pool)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := registration{pool: pool, addr: addr}
+	_, registered := r.expires[key]
+	b := p.Backend(addr)
+	switch {
+	case b == nil:
+		var err error
+		if b, err = p.AddBackend(addr); err != nil {
+			return reg, nil, err
+		}
+		reg.New = true
+		lb.log.Info("Backend registered", "backend", addr, "pool", pool)
+	case registered:
+	case !r.leaving[key]:
+		return reg, b, nil
+	default:
+		//back before its drain ended, which then keeps it
+		b.SetDraining(false)
+		delete(r.leaving, key)
+		lb.log.Info("Backend registered again", "backend", addr, "pool", pool)
+	}
+	r.expires[key] = lb.clock.Now().Add(r.policy.TTL)
+	return reg, b, nil
+}
+
+// Deregister drains a backend that registered itself and removes it from
+// pool. It returns at once; the drain runs in the background.
+func (lb *LoadBalancer) Deregister(pool, addr string) error {
+	r := lb.registry
+	if r == nil {
+		return errNoRegistration
+	}
+	if pool == "" {
+		pool = DefaultPool
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := registration{pool: pool, addr: addr}
+	if _, ok := r.expires[key]; !ok {
+		return fmt.Errorf("backend %s is not registered in pool %s", addr, pool)
+	}
+	lb.log.Info("Backend deregistered", "backend", addr, "pool", pool)
+	r.retire(lb, key)
+	return nil
+}
+
+// retire drains and removes a registered backend; the caller holds r.mu.
+func (r *registry) retire(lb *LoadBalancer, key registration) {
+	delete(r.expires, key)
+	p := lb.Pool(key.pool)
+	if p == nil {
+		return
+	}
+	r.leaving[key] = true
+	lb.goSafe("deregistration", func() {
+		p.RetireBackend(context.Background(), key.addr)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.leaving, key)
+	})
+}
+
+// runRegistry retires the backends whose registration expired until
+// Shutdown.
+func (lb *LoadBalancer) runRegistry() {
+	r := lb.registry
+	ticker := lb.clock.NewTicker(max(r.policy.TTL/4, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lb.stop:
+			return
+		case <-ticker.C():
+		}
+
+		now := lb.clock.Now()
+		r.mu.Lock()
+		for key, deadline := range r.expires {
+			if now.Before(deadline) {
+				continue
+			}
+			lb.log.Warn("Registration expired", "backend", key.addr, "pool", key.pool)
+			r.retire(lb, key)
+		}
+		r.mu.Unlock()
+	}
+}
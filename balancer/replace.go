@@ -0,0 +1,65 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+)
+
+// InstanceLabel names the logical instance behind a backend address, such
+// as a pod or VM name. A config reload that drops an address and adds
+// another with the same instance replaces one with the other, see
+// ReplaceBackend.
+const InstanceLabel = "instance"
+
+// ReplaceBackend moves the backend at old to addr, as when an instance was
+// rescheduled onto a new address, rather than treating them as unrelated.
+// The new backend takes over the weight, labels, connection limit, standby
+// state and TLS override of old, and its client pins and sticky sessions;
+// old then drains in the background and leaves the pool, as with
+// RetireBackend.
+func (p *Pool) ReplaceBackend(old, addr string) (*Backend, error) {
+	prev := p.Backend(old)
+	if prev == nil {
+		return nil, fmt.Errorf("backend %s not in pool %s", old, p.name)
+	}
+	add := p.AddBackend
+	if prev.Standby() {
+		add = p.AddStandby
+	}
+	b, err := add(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if prev.Pinned() {
+		b.Pin(prev.Weight())
+	} else {
+		b.SetWeight(prev.Weight())
+	}
+	b.SetLabels(prev.Labels())
+	b.SetMaxConnections(prev.MaxConnections())
+	b.SetAdmitted(prev.Admitted())
+
+	p.mu.Lock()
+	if o, ok := p.tlsOverrides[old]; ok {
+		p.tlsOverrides[addr] = o
+	}
+	for i := range p.pins {
+		if p.pins[i].Backend == old {
+			p.pins[i].Backend = addr
+		}
+	}
+	sessions := p.affinity
+	p.mu.Unlock()
+
+	moved := 0
+	if sessions != nil {
+		moved = sessions.Move(old, addr)
+	}
+	p.lb.log.Info("Backend replaced", "backend", old, "pool", p.name, "by", addr, "sessions", moved)
+
+	p.lb.goSafe("replaced backend drain", func() {
+		p.RetireBackend(context.Background(), old)
+	})
+	return b, nil
+}
@@ -0,0 +1,105 @@
+package replay
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/logging"
+)
+
+// stages a connection can fail at
+const (
+	//StageSelect found no backend to send the connection to
+	StageSelect = "select"
+	//StageDial could not connect to the picked backend
+	StageDial = "dial"
+	//StageProxy failed while relaying an HTTP exchange
+	StageProxy = "proxy"
+)
+
+// Record is the metadata of one failed connection. It holds nothing the
+// client sent, so recording is safe on production traffic.
+type Record struct {
+	Time       time.Time `json:"time"`
+	Listener   string    `json:"listener"`
+	Mode       string    `json:"mode"`
+	Pool       string    `json:"pool"`
+	Client     string    `json:"client"`
+	ServerName string    `json:"server_name,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+	Stage      string    `json:"stage"`
+	//Backend was picked for the connection, empty at StageSelect
+	Backend string `json:"backend,omitempty"`
+	Error   string `json:"error"`
+	//ElapsedMS is from the accept to the failure
+	ElapsedMS     float64 `json:"elapsed_ms"`
+	DialTimeoutMS float64 `json:"dial_timeout_ms,omitempty"`
+	//Healthy of Backends in the pool at the time
+	Healthy  int `json:"healthy"`
+	Backends int `json:"backends"`
+}
+
+// Recorder writes Records as JSON lines for a window of time after it is
+// created, so that leaving it on doesn't fill the disk.
+type Recorder struct {
+	clock clock.Clock
+	until time.Time
+	//log is logging.Default unless SetLogger changed it
+	log *slog.Logger
+
+	mu      sync.Mutex
+	enc     *json.Encoder
+	written uint64
+	over    bool
+}
+
+// NewRecorder records to w for window, or for good when window is 0.
+func NewRecorder(w io.Writer, window time.Duration, c clock.Clock) *Recorder {
+	r := &Recorder{clock: c, log: logging.Default(), enc: json.NewEncoder(w)}
+	if window > 0 {
+		r.until = c.Now().Add(window)
+	}
+	return r
+}
+
+// SetLogger sends what the recorder logs to l; call it before the first
+// Record.
+func (r *Recorder) SetLogger(l *slog.Logger) {
+	r.log = l
+}
+
+// Record writes rec unless the window is over.
+func (r *Recorder) Record(rec Record) {
+	if r == nil {
+		return
+	}
+
+	now := r.clock.Now()
+	if rec.Time.IsZero() {
+		rec.Time = now
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.until.IsZero() && now.After(r.until) {
+		if !r.over {
+			r.over = true
+			r.log.Info("Failure recording window over", "records", r.written)
+		}
+		return
+	}
+	r.written++
+	r.enc.Encode(rec)
+}
+
+// Written returns how many records were written.
+func (r *Recorder) Written() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.written
+}
@@ -0,0 +1,219 @@
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outcomes of a replayed connection
+const (
+	//OutcomeOK got a response, or stayed open, as a healthy connection does
+	OutcomeOK = "ok"
+	//OutcomeRefused could not connect to the target
+	OutcomeRefused = "refused"
+	//OutcomeError got an HTTP 5xx, such as the balancer's 502
+	OutcomeError = "5xx"
+	//OutcomeClosed was closed without a response
+	OutcomeClosed = "closed"
+	//OutcomeTimeout got no response to an HTTP request within the timeout
+	OutcomeTimeout = "timeout"
+)
+
+// Options tell Replay where and how to replay.
+type Options struct {
+	//Target is the staging listener to connect to
+	Target string
+	//Speed divides the time between records, default 1
+	Speed float64
+	//Proxy starts each connection with a PROXY protocol v1 header from the
+	//recorded client, so a staging listener with the ProxyProtocol adapter
+	//hashes and pins clients the way production did
+	Proxy bool
+	//Timeout bounds each connection, default 2s
+	Timeout time.Duration
+}
+
+// Result is how the replay of one record went.
+type Result struct {
+	Record  Record
+	Outcome string
+	Err     string
+	Elapsed time.Duration
+}
+
+// Reproduced reports whether the replay failed too.
+func (r Result) Reproduced() bool { return r.Outcome != OutcomeOK }
+
+// Load reads records written by a Recorder.
+func Load(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+	dec := json.NewDecoder(f)
+	for {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: record %d: %w", path, len(records)+1, err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// Replay opens a synthetic connection to the target for every record,
+// spaced as they were recorded. HTTP records send a GET / with the
+// recorded server name as Host; TCP ones send nothing and wait for the
+// balancer to refuse or close them. Results are in the order of records.
+func Replay(records []Record, opts Options) []Result {
+	if opts.Speed <= 0 {
+		opts.Speed = 1
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 2 * time.Second
+	}
+
+	order := make([]int, len(records))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return records[order[a]].Time.Before(records[order[b]].Time)
+	})
+
+	results := make([]Result, len(records))
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, i := range order {
+		rec := records[i]
+		offset := rec.Time.Sub(records[order[0]].Time)
+		time.Sleep(time.Until(start.Add(time.Duration(float64(offset) / opts.Speed))))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = replayOne(rec, opts)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func replayOne(rec Record, opts Options) Result {
+	start := time.Now()
+	r := Result{Record: rec}
+	r.Outcome, r.Err = dial(rec, opts)
+	r.Elapsed = time.Since(start)
+	return r
+}
+
+func dial(rec Record, opts Options) (string, string) {
+	conn, err := net.DialTimeout("tcp", opts.Target, opts.Timeout)
+	if err != nil {
+		return OutcomeRefused, err.Error()
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(opts.Timeout))
+
+	if opts.Proxy {
+		if err := writeProxyHeader(conn, rec.Client); err != nil {
+			return OutcomeClosed, err.Error()
+		}
+	}
+	http := rec.Mode == "http"
+	if http {
+		host := rec.ServerName
+		if host == "" {
+			host = opts.Target
+		}
+		if _, err := fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nUser-Agent: loadbalancer-replay\r\nConnection: close\r\n\r\n", host); err != nil {
+			return OutcomeClosed, err.Error()
+		}
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	var ne net.Error
+	switch {
+	case err != nil && line == "" && errors.As(err, &ne) && ne.Timeout():
+		//a TCP connection that is still open was relayed to a backend
+		if http {
+			return OutcomeTimeout, err.Error()
+		}
+		return OutcomeOK, ""
+	case err != nil && line == "":
+		return OutcomeClosed, err.Error()
+	}
+	//the balancer answers a failed connection with a 502 in both modes
+	if fields := strings.Fields(line); len(fields) >= 2 && strings.HasPrefix(fields[0], "HTTP/") && strings.HasPrefix(fields[1], "5") {
+		return OutcomeError, strings.TrimSpace(line)
+	}
+	return OutcomeOK, ""
+}
+
+func writeProxyHeader(conn net.Conn, client string) error {
+	src, err := net.ResolveTCPAddr("tcp", client)
+	if err != nil {
+		return fmt.Errorf("client %q: %w", client, err)
+	}
+	dst := conn.RemoteAddr().(*net.TCPAddr)
+	family := "TCP4"
+	if src.IP.To4() == nil {
+		family = "TCP6"
+	}
+	_, err = fmt.Fprintf(conn, "PROXY %s %s %s %d %d\r\n", family, src.IP, dst.IP, src.Port, dst.Port)
+	return err
+}
+
+// Report sums the results up by stage and outcome, and lists the records
+// that replayed differently from how they failed.
+func Report(results []Result) string {
+	type key struct{ stage, outcome string }
+	counts := make(map[key]int)
+	var keys []key
+	reproduced := 0
+	for _, r := range results {
+		k := key{r.Record.Stage, r.Outcome}
+		if counts[k] == 0 {
+			keys = append(keys, k)
+		}
+		counts[k]++
+		if r.Reproduced() {
+			reproduced++
+		}
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		if keys[a].stage != keys[b].stage {
+			return keys[a].stage < keys[b].stage
+		}
+		return keys[a].outcome < keys[b].outcome
+	})
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d connection(s) replayed, %d failed again\n", len(results), reproduced)
+	fmt.Fprintf(&b, "  %-10s %-10s %6s\n", "stage", "outcome", "conns")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "  %-10s %-10s %6d\n", k.stage, k.outcome, counts[k])
+	}
+	for _, r := range results {
+		if r.Reproduced() {
+			continue
+		}
+		fmt.Fprintf(&b, "not reproduced: %s %s failure from %s: %s\n",
+			r.Record.Time.Format(time.RFC3339Nano), r.Record.Stage, r.Record.Client, r.Record.Error)
+	}
+	return b.String()
+}
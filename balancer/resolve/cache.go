@@ -0,0 +1,251 @@
+package resolve
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/logging"
+)
+
+const (
+	DefaultCacheTTL    = 30 * time.Second
+	DefaultNegativeTTL = 5 * time.Second
+	DefaultStale       = time.Minute
+)
+
+// CachePolicy tunes a Cache. Answers are kept for their TTL, bounded by
+// MinTTL and MaxTTL, or for TTL when the answer's is unknown.
+type CachePolicy struct {
+	TTL    time.Duration
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	//NegativeTTL is how long a failed lookup is kept
+	NegativeTTL time.Duration
+	//Stale is how long past its TTL an answer is still served while a
+	//lookup in the background refreshes it
+	Stale time.Duration
+}
+
+func DefaultCachePolicy() CachePolicy {
+	return CachePolicy{
+		TTL:         DefaultCacheTTL,
+		MinTTL:      time.Second,
+		MaxTTL:      DefaultMaxInterval,
+		NegativeTTL: DefaultNegativeTTL,
+		Stale:       DefaultStale,
+	}
+}
+
+func (p CachePolicy) withDefaults() CachePolicy {
+	def := DefaultCachePolicy()
+	if p.TTL <= 0 {
+		p.TTL = def.TTL
+	}
+	if p.MinTTL <= 0 {
+		p.MinTTL = def.MinTTL
+	}
+	if p.MaxTTL <= 0 {
+		p.MaxTTL = def.MaxTTL
+	}
+	if p.NegativeTTL <= 0 {
+		p.NegativeTTL = def.NegativeTTL
+	}
+	if p.Stale < 0 {
+		p.Stale = 0
+	}
+	return p
+}
+
+// CacheStats count how lookups were answered.
+type CacheStats struct {
+	Hosts int
+	//Hits were answered from the cache, Stale ones past their TTL while
+	//being refreshed, Negative ones with a cached failure
+	Hits     uint64
+	Stale    uint64
+	Negative uint64
+	//Misses had to wait for a lookup, Errors are lookups that failed
+	Misses uint64
+	Errors uint64
+}
+
+// Cache resolves host names for dialing and discovery, so that every
+// connection to a backend host name doesn't cost a lookup and a
+// nameserver hiccup doesn't fail connections while an answer is at hand.
+type Cache struct {
+	clock  clock.Clock
+	policy CachePolicy
+	//log is logging.Default unless SetLogger changed it
+	log *slog.Logger
+
+	//Lookup and TTL can be replaced before use, e.g. with fixed answers
+	Lookup func(ctx context.Context, host string) ([]netip.Addr, error)
+	TTL    func(host string) (time.Duration, error)
+
+	mu    sync.Mutex
+	hosts map[string]*cached
+	stats CacheStats
+}
+
+type cached struct {
+	addrs   []netip.Addr
+	err     error
+	expires time.Time
+	//retry holds back the next background refresh after one failed
+	retry time.Time
+	//pending is closed when the lookup in flight is done, nil without one
+	pending chan struct{}
+}
+
+func NewCache(c clock.Clock, policy CachePolicy) *Cache {
+	return &Cache{
+		clock:  c,
+		policy: policy.withDefaults(),
+		log:    logging.Default(),
+		Lookup: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+		TTL: func(host string) (time.Duration, error) {
+			return queryTTL(host, 2*time.Second)
+		},
+		hosts: make(map[string]*cached),
+	}
+}
+
+// SetLogger sends what the cache logs to l; call it before the first
+// lookup.
+func (c *Cache) SetLogger(l *slog.Logger) {
+	c.log = l
+}
+
+// LookupNetIP returns the addresses of host, sorted. A fresh answer comes
+// from the cache. One past its TTL is still returned within the stale
+// window, and refreshed in the background. Otherwise callers wait for one
+// shared lookup, or ctx.
+func (c *Cache) LookupNetIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{ip.Unmap()}, nil
+	}
+
+	c.mu.Lock()
+	now := c.clock.Now()
+	e := c.hosts[host]
+	switch {
+	case e != nil && e.pending == nil && now.Before(e.expires):
+		if e.err != nil {
+			c.stats.Negative++
+		} else {
+			c.stats.Hits++
+		}
+		addrs, err := e.addrs, e.err
+		c.mu.Unlock()
+		return addrs, err
+
+	case e != nil && e.err == nil && e.addrs != nil && now.Before(e.expires.Add(c.policy.Stale)):
+		c.stats.Stale++
+		if e.pending == nil && !now.Before(e.retry) {
+			e.pending = make(chan struct{})
+			go c.refresh(host, e)
+		}
+		addrs := e.addrs
+		c.mu.Unlock()
+		return addrs, nil
+	}
+
+	if e == nil {
+		c.evict(now)
+		e = &cached{}
+		c.hosts[host] = e
+	}
+	c.stats.Misses++
+	pending := e.pending
+	if pending == nil {
+		pending = make(chan struct{})
+		e.pending = pending
+		go c.refresh(host, e)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-pending:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return e.addrs, e.err
+}
+
+// evict drops the hosts nobody asked for since well past their stale
+// window, such as those of removed backends.
+func (c *Cache) evict(now time.Time) {
+	for host, e := range c.hosts {
+		if e.pending == nil && now.After(e.expires.Add(c.policy.Stale+c.policy.MaxTTL)) {
+			delete(c.hosts, host)
+		}
+	}
+}
+
+// refresh looks host up and stores the answer in e, which has a pending
+// channel to close.
+func (c *Cache) refresh(host string, e *cached) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	addrs, err := c.Lookup(ctx, host)
+	cancel()
+
+	var ttl time.Duration
+	if err == nil {
+		//the TTL is only a hint, so failing to get one is not an error
+		ttl, _ = c.TTL(host)
+		if ttl <= 0 {
+			ttl = c.policy.TTL
+		}
+		ttl = min(max(ttl, c.policy.MinTTL), c.policy.MaxTTL)
+
+		for i, ip := range addrs {
+			addrs[i] = ip.Unmap()
+		}
+		slices.SortFunc(addrs, netip.Addr.Compare)
+		addrs = slices.Compact(addrs)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock.Now()
+	switch {
+	case err == nil:
+		e.addrs, e.err, e.expires = addrs, nil, now.Add(ttl)
+		e.retry = time.Time{}
+	case e.addrs != nil && now.Before(e.expires.Add(c.policy.Stale)):
+		//keep serving the stale answer and try again after NegativeTTL
+		c.stats.Errors++
+		if e.retry.IsZero() {
+			c.log.Warn("Resolving failed, serving the last answer", "host", host, "error", err)
+		}
+		e.retry = now.Add(c.policy.NegativeTTL)
+	default:
+		c.stats.Errors++
+		e.addrs, e.err, e.expires = nil, err, now.Add(c.policy.NegativeTTL)
+	}
+	close(e.pending)
+	e.pending = nil
+}
+
+// Stats returns the counters of the cache, zero for a nil Cache.
+func (c *Cache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Hosts = len(c.hosts)
+	return s
+}
@@ -0,0 +1,177 @@
+package resolve
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const resolvConf = "/etc/resolv.conf"
+
+const (
+	typeA    = 1
+	typeAAAA = 28
+)
+
+// queryTTL asks the first nameserver of /etc/resolv.conf for the A and
+// AAAA records of host and returns the lowest TTL among the answers. Go's
+// resolver doesn't expose TTLs, so this is a hint next to its answer, not
+// a replacement: names from /etc/hosts or search domains have none.
+func queryTTL(host string, timeout time.Duration) (time.Duration, error) {
+	server, err := nameserver()
+	if err != nil {
+		return 0, err
+	}
+
+	var ttl time.Duration
+	for _, qtype := range []uint16{typeA, typeAAAA} {
+		t, err := query(server, host, qtype, timeout)
+		if err != nil {
+			return 0, err
+		}
+		if t > 0 && (ttl == 0 || t < ttl) {
+			ttl = t
+		}
+	}
+	return ttl, nil
+}
+
+func nameserver() (string, error) {
+	data, err := os.ReadFile(resolvConf)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("no nameserver in " + resolvConf)
+}
+
+func query(server, host string, qtype uint16, timeout time.Duration) (time.Duration, error) {
+	msg, id, err := buildQuery(host, qtype)
+	if err != nil {
+		return 0, err
+	}
+
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := conn.Write(msg); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1232)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		//answers to other queries are dropped, as a resolver would
+		if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+			return answerTTL(buf[:n])
+		}
+	}
+}
+
+func buildQuery(host string, qtype uint16) ([]byte, uint16, error) {
+	var idBytes [2]byte
+	rand.Read(idBytes[:])
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	//header: id, recursion desired, one question
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0)
+
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, 0, errors.New("invalid name " + host)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	return msg, id, nil
+}
+
+var errShort = errors.New("truncated dns message")
+
+// answerTTL returns the lowest TTL in the answer section, CNAMEs included,
+// and 0 when there are no answers.
+func answerTTL(msg []byte) (time.Duration, error) {
+	if len(msg) < 12 {
+		return 0, errShort
+	}
+	if rcode := msg[3] & 0x0f; rcode != 0 {
+		return 0, errors.New("dns query failed with rcode " + rcodeName(rcode))
+	}
+	questions := binary.BigEndian.Uint16(msg[4:])
+	answers := binary.BigEndian.Uint16(msg[6:])
+
+	off := 12
+	for range questions {
+		end, ok := skipName(msg, off)
+		if !ok || end+4 > len(msg) {
+			return 0, errShort
+		}
+		off = end + 4
+	}
+
+	var ttl uint32
+	for i := range answers {
+		end, ok := skipName(msg, off)
+		if !ok || end+10 > len(msg) {
+			return 0, errShort
+		}
+		t := binary.BigEndian.Uint32(msg[end+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[end+8:]))
+		if i == 0 || t < ttl {
+			ttl = t
+		}
+		off = end + 10 + rdlen
+		if off > len(msg) {
+			return 0, errShort
+		}
+	}
+	return time.Duration(ttl) * time.Second, nil
+}
+
+// skipName returns the offset just past the name starting at off.
+func skipName(msg []byte, off int) (int, bool) {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, true
+		case n&0xc0 == 0xc0:
+			//a compression pointer ends the name
+			return off + 2, off+2 <= len(msg)
+		}
+		off += 1 + n
+	}
+	return 0, false
+}
+
+func rcodeName(rcode byte) string {
+	switch rcode {
+	case 2:
+		return "SERVFAIL"
+	case 3:
+		return "NXDOMAIN"
+	case 5:
+		return "REFUSED"
+	}
+	return strconv.Itoa(int(rcode))
+}
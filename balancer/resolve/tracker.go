@@ -0,0 +1,314 @@
+package resolve
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/backend"
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/logging"
+)
+
+const (
+	DefaultInterval    = 30 * time.Second
+	DefaultMinInterval = 5 * time.Second
+	DefaultMaxInterval = 5 * time.Minute
+	DefaultHistory     = 10
+)
+
+// Policy paces re-resolution. A host is looked up again when its TTL runs
+// out, kept between MinInterval and MaxInterval, or after Interval when
+// the TTL is unknown. Hosts with an unhealthy backend are looked up every
+// MinInterval, as a moved backend usually shows up as a failing one first.
+type Policy struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	//History is how many address changes are kept per host
+	History int
+}
+
+func DefaultPolicy() Policy {
+	return Policy{
+		Interval:    DefaultInterval,
+		MinInterval: DefaultMinInterval,
+		MaxInterval: DefaultMaxInterval,
+		History:     DefaultHistory,
+	}
+}
+
+func (p Policy) withDefaults() Policy {
+	def := DefaultPolicy()
+	if p.Interval <= 0 {
+		p.Interval = def.Interval
+	}
+	if p.MinInterval <= 0 {
+		p.MinInterval = def.MinInterval
+	}
+	if p.MaxInterval <= 0 {
+		p.MaxInterval = def.MaxInterval
+	}
+	if p.History <= 0 {
+		p.History = def.History
+	}
+	return p
+}
+
+// Resolution is what a backend host name resolved to over time.
+type Resolution struct {
+	Host string
+	//Addrs are the current addresses, sorted
+	Addrs []netip.Addr
+	//TTL is the lowest record TTL of the last answer, 0 when unknown
+	TTL     time.Duration
+	Checked time.Time
+	//Changed is when Addrs last changed, the first lookup included
+	Changed time.Time
+	//Err is the last lookup's error; Addrs stay those of the last success
+	Err string
+	//History are the latest changes, oldest first
+	History []Change
+
+	//LastDialed is the address the last connection to the backend went to
+	LastDialed netip.Addr
+	DialedAt   time.Time
+	//Stale is set when LastDialed is no longer among Addrs, e.g. because
+	//the dialer still has an old answer cached
+	Stale bool
+}
+
+type Change struct {
+	At    time.Time
+	Addrs []netip.Addr
+}
+
+// Tracker keeps the resolution history of backends addressed by host name.
+// It only observes: dialing still resolves the name on every connection.
+type Tracker struct {
+	clock  clock.Clock
+	policy Policy
+	//log is logging.Default unless SetLogger changed it
+	log *slog.Logger
+
+	//Lookup and TTL can be replaced before Run, e.g. with fixed answers
+	Lookup func(ctx context.Context, host string) ([]netip.Addr, error)
+	TTL    func(host string) (time.Duration, error)
+
+	mu    sync.Mutex
+	hosts map[string]*entry
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type entry struct {
+	res  Resolution
+	next time.Time
+}
+
+func New(c clock.Clock, policy Policy) *Tracker {
+	return &Tracker{
+		clock:  c,
+		policy: policy.withDefaults(),
+		log:    logging.Default(),
+		Lookup: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+		TTL: func(host string) (time.Duration, error) {
+			return queryTTL(host, 2*time.Second)
+		},
+		hosts: make(map[string]*entry),
+		stop:  make(chan struct{}),
+	}
+}
+
+// HostName returns the host of a backend address when it is a name rather
+// than an IP.
+func HostName(addr string) (string, bool) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", false
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return "", false
+	}
+	return host, true
+}
+
+// SetLogger sends what the tracker logs to l; call it before Run.
+func (t *Tracker) SetLogger(l *slog.Logger) {
+	t.log = l
+}
+
+// Run refreshes the hosts of the backends returned by targets until Stop.
+func (t *Tracker) Run(targets func() []*backend.Backend) {
+	ticker := t.clock.NewTicker(t.policy.MinInterval)
+	defer ticker.Stop()
+
+	t.Refresh(targets())
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C():
+			t.Refresh(targets())
+		}
+	}
+}
+
+// Stop ends Run.
+func (t *Tracker) Stop() {
+	t.stopOnce.Do(func() { close(t.stop) })
+}
+
+// Refresh looks up the hosts that are due and forgets those no backend
+// uses any more.
+func (t *Tracker) Refresh(backends []*backend.Backend) {
+	//a host is unhealthy when any of its backends is
+	healthy := make(map[string]bool)
+	for _, b := range backends {
+		if host, ok := HostName(b.Addr); ok {
+			h, seen := healthy[host]
+			healthy[host] = b.Healthy() && (h || !seen)
+		}
+	}
+
+	now := t.clock.Now()
+	var due []string
+
+	t.mu.Lock()
+	for host := range t.hosts {
+		if _, ok := healthy[host]; !ok {
+			delete(t.hosts, host)
+		}
+	}
+	for host, ok := range healthy {
+		e := t.hosts[host]
+		switch {
+		case e == nil:
+			t.hosts[host] = &entry{res: Resolution{Host: host}}
+			due = append(due, host)
+		case !now.Before(e.next):
+			due = append(due, host)
+		case !ok && now.Sub(e.res.Checked) >= t.policy.MinInterval:
+			due = append(due, host)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, host := range due {
+		t.resolve(host)
+	}
+}
+
+func (t *Tracker) resolve(host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	addrs, err := t.Lookup(ctx, host)
+	cancel()
+
+	var ttl time.Duration
+	if err == nil {
+		//the TTL is only a hint, so failing to get one is not an error
+		ttl, _ = t.TTL(host)
+	}
+
+	for i, ip := range addrs {
+		addrs[i] = ip.Unmap()
+	}
+	slices.SortFunc(addrs, netip.Addr.Compare)
+	addrs = slices.Compact(addrs)
+
+	now := t.clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.hosts[host]
+	if e == nil {
+		return
+	}
+	res := &e.res
+	res.Checked = now
+
+	next := t.policy.Interval
+	if ttl > 0 {
+		next = min(max(ttl, t.policy.MinInterval), t.policy.MaxInterval)
+	}
+	e.next = now.Add(next)
+
+	if err != nil {
+		if res.Err == "" {
+			t.log.Warn("Resolving backend host failed", "host", host, "error", err)
+		}
+		res.Err = err.Error()
+		return
+	}
+	res.Err = ""
+	res.TTL = ttl
+
+	if slices.Equal(addrs, res.Addrs) {
+		return
+	}
+	if res.Addrs != nil {
+		t.log.Info("Backend host resolves to new addresses", "host", host, "addrs", fmt.Sprint(addrs), "was", fmt.Sprint(res.Addrs))
+	}
+	res.Addrs = addrs
+	res.Changed = now
+	res.History = append(res.History, Change{At: now, Addrs: addrs})
+	if len(res.History) > t.policy.History {
+		res.History = slices.Clone(res.History[len(res.History)-t.policy.History:])
+	}
+	res.Stale = res.LastDialed.IsValid() && !slices.Contains(addrs, res.LastDialed)
+}
+
+// Dialed records the address a connection to the backend at addr went to.
+// It does nothing on a nil Tracker or for backends addressed by IP.
+func (t *Tracker) Dialed(addr string, remote net.Addr) {
+	host, ok := HostName(addr)
+	if t == nil || !ok {
+		return
+	}
+	ap, err := netip.ParseAddrPort(remote.String())
+	if err != nil {
+		return
+	}
+	ip := ap.Addr().Unmap()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.hosts[host]
+	if e == nil {
+		return
+	}
+	e.res.LastDialed = ip
+	e.res.DialedAt = t.clock.Now()
+	e.res.Stale = e.res.Addrs != nil && !slices.Contains(e.res.Addrs, ip)
+}
+
+// Get returns the resolution of the host of the backend at addr, nil for
+// backends addressed by IP and hosts not looked up yet.
+func (t *Tracker) Get(addr string) *Resolution {
+	host, ok := HostName(addr)
+	if t == nil || !ok {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.hosts[host]
+	if e == nil || e.res.Checked.IsZero() {
+		return nil
+	}
+	res := e.res
+	res.Addrs = slices.Clone(res.Addrs)
+	res.History = slices.Clone(res.History)
+	return &res
+}
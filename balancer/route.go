@@ -0,0 +1,108 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+
+	"loadbalancer/balancer/listener"
+)
+
+// Route sends connections that match all of its criteria to Pool; an empty
+// criterion matches everything. Routes are decided once the listener's
+// adapters have run, so with a listener.Sniff adapter one port can take
+// TLS, HTTP and SSH and hand each to its own pool. The bytes the adapters
+// read are replayed to whichever backend is picked.
+type Route struct {
+	//Protocol is one of the listener.Protocol names. Without Sniff, TLS
+	//connections are "tls" and those under the HTTP adapter "http".
+	Protocol string
+	//ServerNames are SNI or Host names; "*.example.com" matches subdomains
+	ServerNames []string
+	//ALPN matches when the client offered one of these protocols
+	ALPN []string
+	//Pool is named without the tenant prefix on tenant listeners
+	Pool string
+	//BudgetShare guarantees the route that share of WithConnectionBudget,
+	//from 0 to 1; without one its connections count to the listener's
+	BudgetShare float64
+}
+
+func (r Route) matches(conn net.Conn) bool {
+	if r.Protocol != "" && r.Protocol != connProtocol(conn) {
+		return false
+	}
+
+	if len(r.ServerNames) > 0 {
+		host := strings.ToLower(stripPort(requestedHost(conn)))
+		if !slices.ContainsFunc(r.ServerNames, func(name string) bool { return matchServerName(name, host) }) {
+			return false
+		}
+	}
+
+	if len(r.ALPN) > 0 {
+		offered := connALPN(conn)
+		if !slices.ContainsFunc(r.ALPN, func(p string) bool { return slices.Contains(offered, p) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// connProtocol tells the protocol of conn from the adapters that ran on it;
+// empty when none of them knows.
+func connProtocol(conn net.Conn) string {
+	if c, ok := listener.Find[*listener.SniffConn](conn); ok {
+		return c.Protocol
+	}
+	if isTLSConn(conn) || tlsServerName(conn) != "" {
+		return listener.ProtocolTLS
+	}
+	if httpHost(conn) != "" {
+		return listener.ProtocolHTTP
+	}
+	return ""
+}
+
+// connALPN are the protocols the client offered, or the one negotiated by
+// a terminating TLS adapter.
+func connALPN(conn net.Conn) []string {
+	if c, ok := listener.Find[*listener.SniffConn](conn); ok {
+		return c.ALPN
+	}
+	if p := tlsALPN(conn); p != "" {
+		return []string{p}
+	}
+	return nil
+}
+
+// route returns the pool and index of the first route conn matches, or
+// -1 when none does.
+func (lb *LoadBalancer) route(fe *frontend, conn net.Conn) (*Pool, int) {
+	for i, r := range fe.cfg.Routes {
+		if !r.matches(conn) {
+			continue
+		}
+		if p := lb.lookupPool(fe.tenant, r.Pool); p != nil {
+			return p, i
+		}
+		lb.log.Warn("Route to unknown pool", "pool", r.Pool, "using", fe.pool.name)
+		return fe.pool, i
+	}
+	return nil, -1
+}
+
+// checkRoutes makes sure every route of cfg names a pool that exists.
+func (lb *LoadBalancer) checkRoutes(cfg ListenerConfig, tenant *Tenant) error {
+	for _, r := range cfg.Routes {
+		if r.Pool == "" {
+			return errors.New("route without a pool")
+		}
+		if lb.lookupPool(tenant, r.Pool) == nil {
+			return fmt.Errorf("route to unknown pool %s", r.Pool)
+		}
+	}
+	return nil
+}
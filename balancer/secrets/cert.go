@@ -0,0 +1,56 @@
+//go:build !notls
+
+package secrets
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync/atomic"
+)
+
+// Certificate is a TLS key pair built from two secrets and rebuilt whenever
+// either of them rotates. Plug GetCertificate into a tls.Config.
+type Certificate struct {
+	cert, key *Secret
+	current   atomic.Pointer[tls.Certificate]
+}
+
+func NewCertificate(cert, key *Secret) (*Certificate, error) {
+	c := &Certificate{cert: cert, key: key}
+	if err := c.rebuild(); err != nil {
+		return nil, err
+	}
+
+	reload := func([]byte) {
+		if err := c.rebuild(); err != nil {
+			//cert and key rotate separately; wait for the matching half
+			cert.log.Warn("Certificate reload failed, keeping previous", "error", err)
+		}
+	}
+	cert.OnChange(reload)
+	key.OnChange(reload)
+
+	return c, nil
+}
+
+func (c *Certificate) rebuild() error {
+	pair, err := tls.X509KeyPair(c.cert.Value(), c.key.Value())
+	if err != nil {
+		return fmt.Errorf("certificate %s: %w", c.cert.source, err)
+	}
+	c.current.Store(&pair)
+	return nil
+}
+
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.current.Load(), nil
+}
+
+func (c *Certificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.current.Load(), nil
+}
+
+// Current returns the key pair in use.
+func (c *Certificate) Current() *tls.Certificate {
+	return c.current.Load()
+}
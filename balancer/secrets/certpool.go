@@ -0,0 +1,45 @@
+//go:build !notls
+
+package secrets
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sync/atomic"
+)
+
+// CertPool is a CA bundle built from a PEM secret and rebuilt whenever it
+// rotates, so new handshakes trust the new CAs. Plug Pool into a
+// listener.TLS or Pool.SetTLSRoots.
+type CertPool struct {
+	bundle  *Secret
+	current atomic.Pointer[x509.CertPool]
+}
+
+func NewCertPool(bundle *Secret) (*CertPool, error) {
+	p := &CertPool{bundle: bundle}
+	if err := p.rebuild(); err != nil {
+		return nil, err
+	}
+
+	bundle.OnChange(func([]byte) {
+		if err := p.rebuild(); err != nil {
+			bundle.log.Warn("CA bundle reload failed, keeping previous", "error", err)
+		}
+	})
+	return p, nil
+}
+
+func (p *CertPool) rebuild() error {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(p.bundle.Value()) {
+		return fmt.Errorf("CA bundle %s: no certificates found", p.bundle.source)
+	}
+	p.current.Store(pool)
+	return nil
+}
+
+// Pool returns the CAs in use.
+func (p *CertPool) Pool() *x509.CertPool {
+	return p.current.Load()
+}
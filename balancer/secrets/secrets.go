@@ -0,0 +1,179 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/logging"
+)
+
+var ErrNoField = errors.New("secret has several fields, pick one with #field")
+
+// Source fetches the current value of a secret.
+type Source interface {
+	Fetch() ([]byte, error)
+	String() string
+}
+
+// Parse turns a secret reference into a Source:
+//
+//	file:/etc/lb/tls.key         or a bare path
+//	env:LB_ADMIN_TOKEN
+//	vault:secret/data/lb#tls_key  (VAULT_ADDR and VAULT_TOKEN from the environment)
+//	https://pki.internal/ca.pem
+func Parse(ref string) (Source, error) {
+	scheme, rest, found := strings.Cut(ref, ":")
+	if !found {
+		return File(ref), nil
+	}
+
+	switch scheme {
+	case "file":
+		return File(rest), nil
+	case "env":
+		return Env(rest), nil
+	case "vault":
+		return parseVault(rest)
+	case "http", "https":
+		return parseURL(ref)
+	}
+
+	//not a known scheme, e.g. a Windows drive or a path containing ':'
+	return File(ref), nil
+}
+
+// File reads a secret from disk; surrounding whitespace is kept.
+type File string
+
+func (f File) Fetch() ([]byte, error) { return os.ReadFile(string(f)) }
+func (f File) String() string         { return "file:" + string(f) }
+
+// Env reads a secret from an environment variable.
+type Env string
+
+func (e Env) Fetch() ([]byte, error) {
+	v, ok := os.LookupEnv(string(e))
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", string(e))
+	}
+	return []byte(v), nil
+}
+
+func (e Env) String() string { return "env:" + string(e) }
+
+// Secret caches the value of a Source and notifies listeners when a refresh
+// finds it rotated.
+type Secret struct {
+	source Source
+	value  atomic.Pointer[[]byte]
+	//log is logging.Default unless SetLogger changed it
+	log *slog.Logger
+
+	mu        sync.Mutex
+	listeners []func([]byte)
+}
+
+// Load fetches the secret once; it fails if the first fetch fails.
+func Load(source Source) (*Secret, error) {
+	s := &Secret{source: source, log: logging.Default()}
+	v, err := source.Fetch()
+	if err != nil {
+		return nil, fmt.Errorf("secret %s: %w", source, err)
+	}
+	s.value.Store(&v)
+	return s, nil
+}
+
+// LoadRef parses and loads a secret reference.
+func LoadRef(ref string) (*Secret, error) {
+	source, err := Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	return Load(source)
+}
+
+func (s *Secret) Value() []byte {
+	return *s.value.Load()
+}
+
+// String returns the trimmed value, convenient for tokens and passwords.
+func (s *Secret) String() string {
+	return strings.TrimSpace(string(s.Value()))
+}
+
+// SetLogger sends what Watch logs about the secret to l, and what its
+// listeners log; call it before Watch.
+func (s *Secret) SetLogger(l *slog.Logger) {
+	s.log = l
+}
+
+// Logger is where the secret logs, for OnChange listeners to log alike.
+func (s *Secret) Logger() *slog.Logger {
+	return s.log
+}
+
+// OnChange registers fn to run with the new value after each rotation.
+func (s *Secret) OnChange(fn func([]byte)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// Refresh re-fetches the secret and reports whether it changed. On error
+// the previous value is kept.
+func (s *Secret) Refresh() (bool, error) {
+	v, err := s.source.Fetch()
+	if err != nil {
+		return false, fmt.Errorf("secret %s: %w", s.source, err)
+	}
+
+	if bytes.Equal(v, s.Value()) {
+		return false, nil
+	}
+	s.value.Store(&v)
+
+	s.mu.Lock()
+	listeners := slices.Clone(s.listeners)
+	s.mu.Unlock()
+
+	for _, fn := range listeners {
+		fn(v)
+	}
+	return true, nil
+}
+
+// Watch refreshes the secrets every interval until stop is closed; run it
+// on its own goroutine.
+func Watch(c clock.Clock, interval time.Duration, stop <-chan struct{}, secrets ...*Secret) {
+	ticker := c.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+		}
+
+		for _, s := range secrets {
+			changed, err := s.Refresh()
+			if err != nil {
+				s.log.Warn("Secret refresh failed, keeping previous value", "error", err)
+				continue
+			}
+			if changed {
+				s.log.Info("Secret rotated", "source", s.source.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build nohttp
+
+package secrets
+
+import "errors"
+
+func parseURL(ref string) (Source, error) {
+	return nil, errors.New("http secrets: not built in (nohttp build tag)")
+}
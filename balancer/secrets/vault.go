@@ -0,0 +1,158 @@
+//go:build !nohttp
+
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// VaultClient talks to the HashiCorp Vault HTTP API.
+type VaultClient struct {
+	Addr  string
+	Token Source
+	HTTP  *http.Client
+}
+
+// VaultFromEnv uses VAULT_ADDR and VAULT_TOKEN, or VAULT_TOKEN_FILE for a
+// token that is rotated on disk (e.g. by a Vault agent).
+func VaultFromEnv() (*VaultClient, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return nil, errors.New("vault: VAULT_ADDR is not set")
+	}
+
+	var token Source = Env("VAULT_TOKEN")
+	if path := os.Getenv("VAULT_TOKEN_FILE"); path != "" {
+		token = File(path)
+	}
+
+	return &VaultClient{
+		Addr:  strings.TrimRight(addr, "/"),
+		Token: token,
+		HTTP:  &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Read returns the data of a secret, handling both KV v1 and v2 layouts.
+func (c *VaultClient) Read(path string) (map[string]any, error) {
+	data, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	//KV v2 nests the payload under data.data next to data.metadata
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, hasMeta := data["metadata"]; hasMeta {
+			return inner, nil
+		}
+	}
+	return data, nil
+}
+
+// Write posts body to path and returns the data of the response, e.g. for
+// the transit engine's encrypt and decrypt endpoints.
+func (c *VaultClient) Write(path string, body any) (map[string]any, error) {
+	return c.do(http.MethodPost, path, body)
+}
+
+func (c *VaultClient) do(method, path string, body any) (map[string]any, error) {
+	token, err := c.Token.Fetch()
+	if err != nil {
+		return nil, fmt.Errorf("vault token: %w", err)
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, c.Addr+"/v1/"+strings.TrimLeft(path, "/"), reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", strings.TrimSpace(string(token)))
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("vault %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var out struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("vault %s: %w", path, err)
+	}
+	return out.Data, nil
+}
+
+func parseVault(ref string) (Source, error) {
+	client, err := VaultFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	path, field, _ := strings.Cut(ref, "#")
+	return &Vault{Client: client, Path: path, Field: field}, nil
+}
+
+// Vault is a secret stored in a Vault KV engine.
+type Vault struct {
+	Client *VaultClient
+	Path   string
+	//Field selects one key of the secret; optional if it has only one
+	Field string
+}
+
+func (v *Vault) Fetch() ([]byte, error) {
+	data, err := v.Client.Read(v.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	field := v.Field
+	if field == "" {
+		if len(data) != 1 {
+			return nil, ErrNoField
+		}
+		for k := range data {
+			field = k
+		}
+	}
+
+	value, ok := data[field]
+	if !ok {
+		return nil, fmt.Errorf("vault %s: no field %q", v.Path, field)
+	}
+
+	switch value := value.(type) {
+	case string:
+		return []byte(value), nil
+	default:
+		return json.Marshal(value)
+	}
+}
+
+func (v *Vault) String() string {
+	if v.Field == "" {
+		return "vault:" + v.Path
+	}
+	return "vault:" + v.Path + "#" + v.Field
+}
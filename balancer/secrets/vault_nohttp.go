@@ -0,0 +1,9 @@
+//go:build nohttp
+
+package secrets
+
+import "errors"
+
+func parseVault(ref string) (Source, error) {
+	return nil, errors.New("vault: not built in (nohttp build tag)")
+}
@@ -0,0 +1,64 @@
+package balancer
+
+import (
+	"net"
+
+	"loadbalancer/balancer/backend"
+	"loadbalancer/balancer/strategy"
+)
+
+// Backend is an upstream server as seen by strategies and callbacks.
+type Backend = backend.Backend
+
+// Strategy picks the backend of each new connection among the candidates
+// of a pool; see the strategy package for the built-in ones.
+type Strategy = strategy.Strategy
+
+// SelectFunc is called for every accepted connection with the healthy
+// backends. It may return a single backend to force it, a subset to
+// constrain the strategy, or nil to let the strategy choose from all of them.
+type SelectFunc func(client net.Conn, backends []*Backend) []*Backend
+
+// WithSelector registers a per-connection override of the backend choice,
+// e.g. to force a specific backend for a debug client IP.
+func WithSelector(fn SelectFunc) Option {
+	return func(lb *LoadBalancer) {
+		lb.selector = fn
+	}
+}
+
+// selectCandidates applies the selector, falling back to every healthy
+// backend when it declines, panics, or returns backends that are not healthy.
+func (lb *LoadBalancer) selectCandidates(client net.Conn, healthy []*Backend) []*Backend {
+	if lb.selector == nil || len(healthy) == 0 {
+		return healthy
+	}
+
+	var chosen []*Backend
+	err := lb.safeCall("selector", func() error {
+		chosen = lb.selector(client, healthy)
+		return nil
+	})
+	if err != nil || len(chosen) == 0 {
+		return healthy
+	}
+
+	allowed := make(map[*Backend]bool, len(healthy))
+	for _, b := range healthy {
+		allowed[b] = true
+	}
+
+	filtered := make([]*Backend, 0, len(chosen))
+	for _, b := range chosen {
+		if allowed[b] {
+			filtered = append(filtered, b)
+		}
+	}
+
+	if len(filtered) == 0 {
+		lb.log.Warn("Selector returned no healthy backend, using strategy", "client", client.RemoteAddr().String())
+		return healthy
+	}
+
+	return filtered
+}
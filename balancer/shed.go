@@ -0,0 +1,305 @@
+package balancer
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"runtime"
+	"runtime/metrics"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"loadbalancer/balancer/audit"
+	"loadbalancer/balancer/clock"
+)
+
+const (
+	heapMetric = "/memory/classes/heap/objects:bytes"
+	//defaultHealthSlowdown is how many times less often health checks run
+	//while paused
+	defaultHealthSlowdown = 4
+)
+
+// BackgroundTasks are the names ShedPolicy.Background gives priorities to:
+// health checks, polling the discovery source for health, pushing fleet
+// stats, probing regions and rebalancing connections.
+var BackgroundTasks = [...]string{"health", "discovery", "fleet", "regions", "rebalance"}
+
+// ShedPolicy sheds traffic by priority while the balancer itself is
+// overloaded. Traffic classes are tags: a connection has the highest
+// priority among its tags, and untagged connections have priority 0.
+type ShedPolicy struct {
+	//Interval between samples of the signals, default 1s
+	Interval time.Duration
+	//Thresholds; a zero one ignores the signal
+	MaxGoroutines int
+	//MaxAcceptLatency bounds the average wait between accept and the start
+	//of the connection's handler, which grows when the scheduler falls behind
+	MaxAcceptLatency time.Duration
+	//MaxMemory bounds the bytes of live Go heap objects
+	MaxMemory uint64
+	//Priorities by tag; higher is shed later and the highest never
+	Priorities map[string]int
+	//RecoverAfter is the number of calm samples before one class is let
+	//back in, default 5
+	RecoverAfter int
+
+	//Background gives BackgroundTasks a priority, so they pause along with
+	//the traffic of that priority and leave the CPU to the data path.
+	//Paused tasks skip their rounds, except health checks, which run
+	//HealthSlowdown times less often. Tasks without one never pause.
+	Background map[string]int
+	//HealthSlowdown defaults to 4
+	HealthSlowdown int
+}
+
+func (p ShedPolicy) withDefaults() ShedPolicy {
+	if p.Interval <= 0 {
+		p.Interval = time.Second
+	}
+	if p.RecoverAfter <= 0 {
+		p.RecoverAfter = 5
+	}
+	if p.HealthSlowdown <= 0 {
+		p.HealthSlowdown = defaultHealthSlowdown
+	}
+	return p
+}
+
+// ShedStats show what the shedder last measured and what it sheds.
+type ShedStats struct {
+	//Level is the number of priority classes being shed, 0 when none
+	Level int
+	//Cutoff is the highest priority shed, meaningful when Level > 0
+	Cutoff        int
+	Goroutines    int
+	AcceptLatency time.Duration
+	Memory        uint64
+	//Shed counts connections refused while shedding
+	Shed uint64
+	//Paused are the BackgroundTasks paused now
+	Paused []string
+}
+
+// shedder samples the signals and keeps the shedding level. Connections
+// refused by admission checks never reach it, so a flood of refused
+// clients does not count as load.
+type shedder struct {
+	policy ShedPolicy
+	//classes are the distinct priorities in ascending order
+	classes []int
+
+	//acceptWait sums the measured waits since the last sample
+	acceptWait  atomic.Int64
+	acceptCount atomic.Int64
+
+	level atomic.Int64
+	shed  atomic.Uint64
+
+	mu    sync.Mutex
+	last  ShedStats
+	calm  int
+	heapS []metrics.Sample
+}
+
+func newShedder(policy ShedPolicy) *shedder {
+	s := &shedder{policy: policy.withDefaults(), heapS: []metrics.Sample{{Name: heapMetric}}}
+
+	classes := []int{0}
+	for _, p := range s.policy.Priorities {
+		classes = append(classes, p)
+	}
+	for _, p := range s.policy.Background {
+		classes = append(classes, p)
+	}
+	slices.Sort(classes)
+	s.classes = slices.Compact(classes)
+	return s
+}
+
+// WithLoadShedding turns on shedding by policy.
+func WithLoadShedding(policy ShedPolicy) Option {
+	return func(lb *LoadBalancer) {
+		lb.shedder = newShedder(policy)
+	}
+}
+
+// observeAccept records how long a connection waited for its handler. It
+// does nothing when shedding is off.
+func (s *shedder) observeAccept(wait time.Duration) {
+	if s == nil {
+		return
+	}
+	s.acceptWait.Add(int64(wait))
+	s.acceptCount.Add(1)
+}
+
+// run samples the signals once per interval until stop is closed.
+func (s *shedder) run(c clock.Clock, stop <-chan struct{}, log *slog.Logger) {
+	ticker := c.NewTicker(s.policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C():
+			s.sample(log)
+		}
+	}
+}
+
+// sample measures the signals and moves the level: one class more for
+// every sample over a threshold, one class less after RecoverAfter calm
+// samples in a row.
+func (s *shedder) sample(log *slog.Logger) {
+	stats := ShedStats{Goroutines: runtime.NumGoroutine()}
+	if n := s.acceptCount.Swap(0); n > 0 {
+		stats.AcceptLatency = time.Duration(s.acceptWait.Swap(0) / n)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metrics.Read(s.heapS)
+	if s.heapS[0].Value.Kind() == metrics.KindUint64 {
+		stats.Memory = s.heapS[0].Value.Uint64()
+	}
+
+	p := s.policy
+	var over []string
+	if p.MaxGoroutines > 0 && stats.Goroutines > p.MaxGoroutines {
+		over = append(over, fmt.Sprintf("goroutines %d > %d", stats.Goroutines, p.MaxGoroutines))
+	}
+	if p.MaxAcceptLatency > 0 && stats.AcceptLatency > p.MaxAcceptLatency {
+		over = append(over, fmt.Sprintf("accept latency %s > %s", stats.AcceptLatency, p.MaxAcceptLatency))
+	}
+	if p.MaxMemory > 0 && stats.Memory > p.MaxMemory {
+		over = append(over, fmt.Sprintf("heap %dMB > %dMB", stats.Memory>>20, p.MaxMemory>>20))
+	}
+
+	level := int(s.level.Load())
+	//the highest class is never shed
+	maxLevel := len(s.classes) - 1
+
+	switch {
+	case len(over) > 0:
+		s.calm = 0
+		if level < maxLevel {
+			level++
+			log.Warn("Shedding load", "priority", s.classes[level-1], "over", strings.Join(over, ", "))
+		}
+	case level > 0:
+		s.calm++
+		if s.calm >= p.RecoverAfter {
+			s.calm = 0
+			level--
+			if level == 0 {
+				log.Info("Load shedding stopped")
+			} else {
+				log.Info("Load shedding eased", "priority", s.classes[level-1])
+			}
+		}
+	}
+	s.level.Store(int64(level))
+
+	stats.Level = level
+	if level > 0 {
+		stats.Cutoff = s.classes[level-1]
+	}
+	stats.Paused = s.pausedTasks()
+	if !slices.Equal(stats.Paused, s.last.Paused) {
+		if len(stats.Paused) > 0 {
+			log.Warn("Pausing background work under load", "tasks", strings.Join(stats.Paused, ", "))
+		} else {
+			log.Info("Background work resumed")
+		}
+	}
+	s.last = stats
+}
+
+// paused reports whether task, one of BackgroundTasks, should skip its
+// round now. Nil-safe, like the other methods.
+func (s *shedder) paused(task string) bool {
+	if s == nil {
+		return false
+	}
+	level := int(s.level.Load())
+	if level == 0 {
+		return false
+	}
+	priority, ok := s.policy.Background[task]
+	return ok && priority <= s.classes[level-1]
+}
+
+// pausedTasks are the BackgroundTasks paused at the current level.
+func (s *shedder) pausedTasks() []string {
+	var paused []string
+	for _, task := range BackgroundTasks {
+		if s.paused(task) {
+			paused = append(paused, task)
+		}
+	}
+	return paused
+}
+
+// healthSlowdown is the Throttle factor of the health checkers.
+func (s *shedder) healthSlowdown() int {
+	if s.paused("health") {
+		return s.policy.HealthSlowdown
+	}
+	return 1
+}
+
+func (s *shedder) stats() ShedStats {
+	if s == nil {
+		return ShedStats{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.last
+	stats.Shed = s.shed.Load()
+	return stats
+}
+
+func (s *shedder) active() bool {
+	return s != nil && s.level.Load() > 0
+}
+
+// admit refuses connections whose priority, taken from their tags, is
+// among the shed classes.
+func (s *shedder) admit(tags []string) (bool, string) {
+	if s == nil {
+		return true, ""
+	}
+	level := int(s.level.Load())
+	if level == 0 {
+		return true, ""
+	}
+
+	priority := 0
+	for i, t := range tags {
+		if p := s.policy.Priorities[t]; i == 0 || p > priority {
+			priority = p
+		}
+	}
+	if priority > s.classes[level-1] {
+		return true, ""
+	}
+	s.shed.Add(1)
+	return false, fmt.Sprintf("shedding load up to priority %d", s.classes[level-1])
+}
+
+// admitLoad applies load shedding to a connection with the given tags.
+// Listeners without a TagFunc know every tag at accept and shed there,
+// before paying for a TLS handshake; the others shed once tagged.
+func (lb *LoadBalancer) admitLoad(fe *frontend, addr net.Addr, tags []string) bool {
+	if allowed, reason := lb.shedder.admit(tags); !allowed {
+		lb.reject(fe, addr, audit.KindShed, reason)
+		return false
+	}
+	return true
+}
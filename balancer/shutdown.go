@@ -0,0 +1,257 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ShutdownReport sums up a balancer's run once Shutdown is done, for
+// post-deploy checks and audits.
+type ShutdownReport struct {
+	Time          time.Time `json:"time"`
+	UptimeSeconds float64   `json:"uptime_seconds"`
+	//Drained connections were open when the shutdown began and finished
+	//in time, Closed ones were still open at the deadline
+	Drained  int64  `json:"drained"`
+	Closed   int    `json:"closed"`
+	Accepted uint64 `json:"accepted"`
+	Failed   uint64 `json:"failed"`
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+
+	Backends []ShutdownBackend `json:"backends"`
+}
+
+// ShutdownBackend are the totals of one backend over the run.
+type ShutdownBackend struct {
+	Pool        string `json:"pool"`
+	Addr        string `json:"addr"`
+	Connections uint64 `json:"connections"`
+	Failed      uint64 `json:"failed"`
+	BytesIn     uint64 `json:"bytes_in"`
+	BytesOut    uint64 `json:"bytes_out"`
+}
+
+// WithShutdownReport writes the report of Shutdown to path as JSON, in
+// addition to logging it.
+func WithShutdownReport(path string) Option {
+	return func(lb *LoadBalancer) {
+		lb.reportFile = path
+	}
+}
+
+// Shutdown stops the balancer for good. Like Drain it closes the listeners
+// and waits for the connections in flight, until ctx ends; those still open
+// then are closed. It then stops the health checks, tarpits and other
+// background work, saves the state file, shuts down the admin API and
+// metrics and logs a ShutdownReport. Listen, Serve, ListenAdmin and
+// ListenMetrics return nil once it is done.
+//
+// Shutdown during a Drain waits for it, or ctx, before going on. Calling it
+// again only repeats the last steps.
+func (lb *LoadBalancer) Shutdown(ctx context.Context) error {
+	var err error
+	if lb.startDrain() == nil {
+		defer close(lb.drain.done)
+		err = lb.drainAll(ctx)
+	} else {
+		select {
+		case <-lb.drain.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	closed := 0
+	if err != nil {
+		if closed = lb.open.closeAll(); closed > 0 {
+			lb.log.Warn("Closed connections still open at shutdown", "connections", closed)
+		}
+	}
+
+	lb.stopOnce.Do(func() { close(lb.stop) })
+	for _, p := range lb.Pools() {
+		p.checker.Stop()
+	}
+	for _, fe := range lb.frontendList() {
+		if fe.cfg.Tarpit != nil {
+			fe.cfg.Tarpit.Stop()
+		}
+	}
+	lb.learner.Stop()
+	lb.resolver.Stop()
+	if lb.cluster != nil {
+		lb.cluster.Close()
+	}
+
+	if lb.stateStore != nil {
+		if serr := lb.saveSnapshot(lb.stateStore); serr != nil {
+			lb.log.Error("Saving state failed", "store", fmt.Sprint(lb.stateStore), "error", serr)
+			err = errors.Join(err, serr)
+		}
+	}
+
+	if serr := lb.shutdownServers(ctx); serr != nil {
+		lb.log.Warn("Closed HTTP servers still busy at shutdown", "error", serr)
+	}
+
+	report := lb.shutdownReport(closed)
+	report.log(lb.log)
+	if lb.reportFile != "" {
+		if rerr := writeReport(lb.reportFile, report); rerr != nil {
+			lb.log.Error("Writing the shutdown report failed", "file", lb.reportFile, "error", rerr)
+			err = errors.Join(err, rerr)
+		}
+	}
+
+	lb.log.Info("Shut down")
+	return err
+}
+
+// Done is closed once Shutdown stopped the background work, for that of
+// one's own started next to the balancer, such as secrets.Watch.
+func (lb *LoadBalancer) Done() <-chan struct{} {
+	return lb.stop
+}
+
+// server is an http.Server as Shutdown sees it.
+type server interface {
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// addServer has Shutdown stop srv, or reports false when it already ran.
+func (lb *LoadBalancer) addServer(srv server) bool {
+	lb.serversMu.Lock()
+	defer lb.serversMu.Unlock()
+	select {
+	case <-lb.stop:
+		return false
+	default:
+	}
+	lb.servers = append(lb.servers, srv)
+	return true
+}
+
+// shutdownServers lets the servers finish their requests until ctx ends,
+// then closes those still busy.
+func (lb *LoadBalancer) shutdownServers(ctx context.Context) error {
+	lb.serversMu.Lock()
+	servers := lb.servers
+	lb.servers = nil
+	lb.serversMu.Unlock()
+
+	var err error
+	for _, srv := range servers {
+		if serr := srv.Shutdown(ctx); serr != nil {
+			srv.Close()
+			err = serr
+		}
+	}
+	return err
+}
+
+func (lb *LoadBalancer) shutdownReport(closed int) ShutdownReport {
+	lb.drain.mu.Lock()
+	open := lb.drain.open
+	lb.drain.mu.Unlock()
+	global := lb.counters.Snapshot()
+
+	r := ShutdownReport{
+		Time:     lb.clock.Now(),
+		Drained:  max(open-int64(closed), 0),
+		Closed:   closed,
+		Accepted: global.Connections,
+		Failed:   global.Failed,
+		BytesIn:  global.BytesIn,
+		BytesOut: global.BytesOut,
+		Backends: []ShutdownBackend{},
+	}
+	if !lb.startedAt.IsZero() {
+		r.UptimeSeconds = r.Time.Sub(lb.startedAt).Seconds()
+	}
+	for _, p := range lb.Pools() {
+		for _, b := range p.Backends() {
+			s := b.Snapshot()
+			r.Backends = append(r.Backends, ShutdownBackend{
+				Pool:        p.name,
+				Addr:        b.Addr,
+				Connections: s.Connections,
+				Failed:      s.Failed,
+				BytesIn:     s.BytesIn,
+				BytesOut:    s.BytesOut,
+			})
+		}
+	}
+	return r
+}
+
+func (r ShutdownReport) log(log *slog.Logger) {
+	uptime := time.Duration(r.UptimeSeconds * float64(time.Second)).Round(time.Second)
+	log.Info("Shutdown report", "uptime", uptime, "drained", r.Drained, "closed", r.Closed,
+		"accepted", r.Accepted, "failed", r.Failed, "bytes_in", r.BytesIn, "bytes_out", r.BytesOut)
+	for _, b := range r.Backends {
+		log.Info("Shutdown report", "pool", b.Pool, "backend", b.Addr, "connections", b.Connections,
+			"failed", b.Failed, "bytes_in", b.BytesIn, "bytes_out", b.BytesOut)
+	}
+}
+
+func writeReport(path string, r ShutdownReport) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// openConns are the proxied connections, so that Shutdown can close those
+// that outlive its deadline.
+type openConns struct {
+	mu sync.Mutex
+	//conns maps client connections to their backend's, nil until dialed
+	conns map[net.Conn]net.Conn
+}
+
+func (o *openConns) add(client net.Conn) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.conns == nil {
+		o.conns = make(map[net.Conn]net.Conn)
+	}
+	o.conns[client] = nil
+}
+
+func (o *openConns) dialed(client, server net.Conn) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.conns[client]; ok {
+		o.conns[client] = server
+	}
+}
+
+func (o *openConns) remove(client net.Conn) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.conns, client)
+}
+
+// closeAll closes both sides of every connection and returns how many
+// there were.
+func (o *openConns) closeAll() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for client, server := range o.conns {
+		client.Close()
+		if server != nil {
+			server.Close()
+		}
+	}
+	return len(o.conns)
+}
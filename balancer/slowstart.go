@@ -0,0 +1,124 @@
+package balancer
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSlowStartWindow = 30 * time.Second
+	defaultSlowStartFrom   = 0.1
+)
+
+// SlowStartPolicy ramps up the weight of a backend that turned healthy
+// again, or joined a running pool, so that cold caches and JIT warmup
+// don't meet a full share of the traffic at once.
+type SlowStartPolicy struct {
+	//Window is how long the ramp takes, default 30s
+	Window time.Duration
+	//From is the share of its weight the backend starts at, default 0.1
+	From float64
+}
+
+func (p SlowStartPolicy) withDefaults() SlowStartPolicy {
+	if p.Window <= 0 {
+		p.Window = defaultSlowStartWindow
+	}
+	if p.From <= 0 || p.From >= 1 {
+		p.From = defaultSlowStartFrom
+	}
+	return p
+}
+
+// WithSlowStart ramps up returning backends by policy. The ramp scales the
+// effective weight, so only weight-aware strategies such as
+// WeightedRoundRobin, LeastConn and BoundedHash slow start; round robin
+// and plain consistent hashing ignore weights.
+func WithSlowStart(policy SlowStartPolicy) Option {
+	return func(lb *LoadBalancer) {
+		lb.slowStart = &slowStart{
+			policy:  policy.withDefaults(),
+			ramping: make(map[*Backend]ramp),
+		}
+	}
+}
+
+type slowStart struct {
+	policy SlowStartPolicy
+
+	mu sync.Mutex
+	//ramping are the backends being ramped up
+	ramping map[*Backend]ramp
+}
+
+type ramp struct {
+	start time.Time
+	//share is what the ramp last set, so a restart shows as a drop
+	share float64
+}
+
+// join puts b under slow start, ramping it from now when cold; nil-safe for
+// balancers without WithSlowStart.
+func (s *slowStart) join(b *Backend, cold bool) {
+	if s == nil {
+		return
+	}
+	b.SetSlowStart(s.policy.From)
+	if cold {
+		b.SetRamp(s.policy.From)
+	}
+}
+
+// runSlowStart raises the ramps in small steps until Shutdown.
+func (lb *LoadBalancer) runSlowStart() {
+	s := lb.slowStart
+	ticker := lb.clock.NewTicker(min(max(s.policy.Window/20, 100*time.Millisecond), time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lb.stop:
+			return
+		case <-ticker.C():
+		}
+		s.step(lb.allBackends(), lb.clock.Now(), lb.log)
+	}
+}
+
+// step moves every ramp along to where it should be at now.
+func (s *slowStart) step(backends []*Backend, now time.Time, log *slog.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[*Backend]bool, len(backends))
+	for _, b := range backends {
+		seen[b] = true
+		share := b.Ramp()
+		r, ok := s.ramping[b]
+		switch {
+		case share >= 1:
+			delete(s.ramping, b)
+			continue
+		case !ok || share < r.share:
+			r = ramp{start: now}
+			log.Info("Backend slow starting", "backend", b.Addr, "share", share, "window", s.policy.Window)
+		}
+
+		elapsed := now.Sub(r.start)
+		r.share = s.policy.From + (1-s.policy.From)*float64(elapsed)/float64(s.policy.Window)
+		if elapsed >= s.policy.Window {
+			b.SetRamp(1)
+			delete(s.ramping, b)
+			log.Info("Backend slow start done", "backend", b.Addr)
+			continue
+		}
+		b.SetRamp(r.share)
+		s.ramping[b] = r
+	}
+	for b := range s.ramping {
+		if !seen[b] {
+			delete(s.ramping, b)
+		}
+	}
+}
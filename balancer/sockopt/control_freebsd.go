@@ -0,0 +1,25 @@
+//go:build freebsd
+
+package sockopt
+
+import (
+	"errors"
+	"syscall"
+)
+
+const (
+	reusePortSupported   = true
+	transparentSupported = false
+)
+
+// plain SO_REUSEPORT does not spread connections on FreeBSD; the _LB
+// variant (FreeBSD 12+) does
+const soReusePortLB = 0x10000
+
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePortLB, 1)
+}
+
+func setTransparent(fd uintptr, network string) error {
+	return errors.ErrUnsupported
+}
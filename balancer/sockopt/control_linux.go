@@ -0,0 +1,28 @@
+//go:build linux
+
+package sockopt
+
+import "syscall"
+
+const (
+	reusePortSupported   = true
+	transparentSupported = true
+)
+
+// not in package syscall for linux
+const (
+	soReusePort     = 0xf
+	ipv6Transparent = 0x4b
+)
+
+func setReusePort(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
+
+// setTransparent needs CAP_NET_ADMIN.
+func setTransparent(fd uintptr, network string) error {
+	if network == "tcp6" {
+		return syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+}
@@ -0,0 +1,21 @@
+//go:build !linux && !freebsd
+
+package sockopt
+
+import "errors"
+
+// macOS and the other BSDs accept SO_REUSEPORT but hand every connection to
+// one socket, and Windows' SO_REUSEADDR lets another process steal the port,
+// so neither is offered
+const (
+	reusePortSupported   = false
+	transparentSupported = false
+)
+
+func setReusePort(fd uintptr) error {
+	return errors.ErrUnsupported
+}
+
+func setTransparent(fd uintptr, network string) error {
+	return errors.ErrUnsupported
+}
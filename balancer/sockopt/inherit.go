@@ -0,0 +1,42 @@
+package sockopt
+
+import (
+	"net"
+	"sync"
+)
+
+var (
+	inheritOnce sync.Once
+	inheritMu   sync.Mutex
+	inherited   []net.Listener
+)
+
+// Inherited returns a listening socket passed in by the parent process for
+// address, as systemd socket activation or a restarting balancer does, or
+// nil if there is none. Each socket is handed out once. Platforms without
+// descriptor inheritance always return nil.
+func Inherited(address string) net.Listener {
+	inheritOnce.Do(func() {
+		inherited = inheritListeners()
+	})
+
+	want, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil
+	}
+
+	inheritMu.Lock()
+	defer inheritMu.Unlock()
+	for i, ln := range inherited {
+		have, ok := ln.Addr().(*net.TCPAddr)
+		if !ok || have.Port != want.Port {
+			continue
+		}
+		//":8090" matches a socket bound to 0.0.0.0 or [::]
+		if have.IP.Equal(want.IP) || (have.IP.IsUnspecified() && (want.IP == nil || want.IP.IsUnspecified())) {
+			inherited = append(inherited[:i], inherited[i+1:]...)
+			return ln
+		}
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package sockopt
+
+import "net"
+
+func inheritListeners() []net.Listener {
+	return nil
+}
@@ -0,0 +1,41 @@
+//go:build unix
+
+package sockopt
+
+import (
+	"net"
+	"os"
+	"strconv"
+
+	"loadbalancer/balancer/logging"
+)
+
+// listenFDsStart is the first descriptor passed under the systemd
+// LISTEN_FDS protocol.
+const listenFDsStart = 3
+
+func inheritListeners() []net.Listener {
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid != os.Getpid() {
+		return nil
+	}
+	count, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+
+	//not for our children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var lns []net.Listener
+	for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+		f := os.NewFile(uintptr(fd), "listen-fd-"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		//FileListener dups the descriptor
+		f.Close()
+		if err != nil {
+			logging.Default().Warn("Ignoring inherited descriptor", "fd", fd, "error", err)
+			continue
+		}
+		lns = append(lns, ln)
+	}
+	return lns
+}
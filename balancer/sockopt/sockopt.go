@@ -0,0 +1,62 @@
+// Package sockopt hides the platform-specific socket features behind one
+// API. Each feature reports whether the running platform has it, so callers
+// can fall back instead of failing.
+package sockopt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Options are socket options for a listening socket.
+type Options struct {
+	//ReusePort lets several sockets bind the same address, with the kernel
+	//spreading new connections between them
+	ReusePort bool
+	//Transparent accepts connections for addresses that are not local, as
+	//redirected by TPROXY rules
+	Transparent bool
+}
+
+// CanReusePort reports whether SO_REUSEPORT load-spreads on this platform.
+func CanReusePort() bool {
+	return reusePortSupported
+}
+
+// CanTransparent reports whether transparent listening is available.
+func CanTransparent() bool {
+	return transparentSupported
+}
+
+// Listen is net.Listen with socket options applied before bind. Options
+// the platform lacks fail with an error wrapping errors.ErrUnsupported.
+func Listen(network, address string, opts Options) (net.Listener, error) {
+	if opts.ReusePort && !reusePortSupported {
+		return nil, fmt.Errorf("SO_REUSEPORT: %w", errors.ErrUnsupported)
+	}
+	if opts.Transparent && !transparentSupported {
+		return nil, fmt.Errorf("transparent listening: %w", errors.ErrUnsupported)
+	}
+
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var optErr error
+		err := c.Control(func(fd uintptr) {
+			if opts.ReusePort {
+				if optErr = setReusePort(fd); optErr != nil {
+					return
+				}
+			}
+			if opts.Transparent {
+				optErr = setTransparent(fd, network)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return optErr
+	}}
+	return lc.Listen(context.Background(), network, address)
+}
@@ -0,0 +1,202 @@
+//go:build !notls
+
+// Package spiffe gives the balancer a SPIFFE identity for mutual TLS with
+// backends. Only file-based SVIDs are supported: the certificate, key and
+// trust bundle are read from files that the SPIRE agent or spiffe-helper
+// keeps current. The package does not talk to the Workload API socket,
+// which is a gRPC service and this module has no dependencies.
+package spiffe
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"loadbalancer/balancer/secrets"
+)
+
+// ID is a SPIFFE ID such as spiffe://example.org/ns/prod/sa/api.
+type ID struct {
+	TrustDomain string
+	Path        string
+}
+
+func ParseID(s string) (ID, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return ID{}, fmt.Errorf("invalid SPIFFE ID %q: %w", s, err)
+	}
+	if u.Scheme != "spiffe" || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return ID{}, fmt.Errorf("invalid SPIFFE ID %q", s)
+	}
+	return ID{TrustDomain: strings.ToLower(u.Host), Path: u.Path}, nil
+}
+
+func (id ID) String() string {
+	return "spiffe://" + id.TrustDomain + id.Path
+}
+
+// IDFromCert extracts the SPIFFE ID from an X.509 SVID, which carries
+// exactly one spiffe:// URI SAN.
+func IDFromCert(cert *x509.Certificate) (ID, error) {
+	var ids []ID
+	for _, u := range cert.URIs {
+		if u.Scheme != "spiffe" {
+			continue
+		}
+		id, err := ParseID(u.String())
+		if err != nil {
+			return ID{}, err
+		}
+		ids = append(ids, id)
+	}
+
+	if len(ids) != 1 {
+		return ID{}, fmt.Errorf("certificate has %d SPIFFE IDs, want 1", len(ids))
+	}
+	return ids[0], nil
+}
+
+// Authorizer decides whether a verified peer SPIFFE ID is acceptable.
+type Authorizer func(ID) error
+
+func AuthorizeAny() Authorizer {
+	return func(ID) error { return nil }
+}
+
+func AuthorizeID(allowed ...ID) Authorizer {
+	return func(id ID) error {
+		if slices.Contains(allowed, id) {
+			return nil
+		}
+		return fmt.Errorf("SPIFFE ID %s is not authorized", id)
+	}
+}
+
+func AuthorizeMemberOf(trustDomain string) Authorizer {
+	trustDomain = strings.ToLower(trustDomain)
+	return func(id ID) error {
+		if id.TrustDomain == trustDomain {
+			return nil
+		}
+		return fmt.Errorf("SPIFFE ID %s is not in trust domain %s", id, trustDomain)
+	}
+}
+
+// Source provides this workload's X.509 SVID and the trust bundle used to
+// verify peers. SVIDs are read from secrets kept current by the SPIRE agent
+// or spiffe-helper, so rotation needs no restart.
+type Source struct {
+	svid   *secrets.Certificate
+	bundle atomic.Pointer[x509.CertPool]
+}
+
+// NewSource builds a source from the SVID certificate (chain), its key and
+// the trust bundle, all PEM encoded.
+func NewSource(cert, key, bundle *secrets.Secret) (*Source, error) {
+	svid, err := secrets.NewCertificate(cert, key)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Source{svid: svid}
+	if err := s.setBundle(bundle.Value()); err != nil {
+		return nil, err
+	}
+	bundle.OnChange(func(v []byte) {
+		if err := s.setBundle(v); err != nil {
+			bundle.Logger().Warn("SPIFFE bundle reload failed, keeping previous", "error", err)
+		}
+	})
+
+	return s, nil
+}
+
+func (s *Source) setBundle(data []byte) error {
+	pool := x509.NewCertPool()
+	found := false
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		pool.AddCert(cert)
+		found = true
+	}
+	if !found {
+		return errors.New("trust bundle has no certificates")
+	}
+	s.bundle.Store(pool)
+	return nil
+}
+
+// ClientConfig returns a tls.Config for dialling backends with mutual TLS:
+// it presents our SVID and accepts a backend only if its SVID chains to the
+// bundle and its SPIFFE ID passes authorize. Hostnames are not checked.
+func (s *Source) ClientConfig(authorize Authorizer) *tls.Config {
+	return &tls.Config{
+		GetClientCertificate: s.svid.GetClientCertificate,
+		//verification is done below against the SPIFFE bundle instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			return s.verify(raw, authorize)
+		},
+	}
+}
+
+// ServerConfig is the listener-side equivalent, requiring client SVIDs.
+func (s *Source) ServerConfig(authorize Authorizer) *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.svid.GetCertificate,
+		ClientAuth:     tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			return s.verify(raw, authorize)
+		},
+	}
+}
+
+func (s *Source) verify(raw [][]byte, authorize Authorizer) error {
+	if len(raw) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(raw))
+	for _, der := range raw {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         s.bundle.Load(),
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("verifying SVID: %w", err)
+	}
+
+	id, err := IDFromCert(certs[0])
+	if err != nil {
+		return err
+	}
+	return authorize(id)
+}
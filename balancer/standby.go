@@ -0,0 +1,172 @@
+package balancer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/health"
+)
+
+// StandbyPolicy admits standby backends to rotation on its own, one per
+// round while a trigger holds, and returns them to reserve one per round
+// once the pool manages without. Backends admitted with AdmitStandby are
+// left to ReturnStandby.
+type StandbyPolicy struct {
+	//MinActive admits standbys while fewer than this many of a pool's
+	//regular backends are healthy, 0 for no minimum
+	MinActive int
+	//MaxLoad admits one while the backends in rotation average more than
+	//this many open connections, 0 for no limit
+	MaxLoad int
+	//Interval between checks, default the health check interval
+	Interval time.Duration
+}
+
+// WithStandby admits standby backends by policy. Without it they only come
+// into rotation through AdmitStandby or the admin API.
+func WithStandby(policy StandbyPolicy) Option {
+	return func(lb *LoadBalancer) {
+		lb.standby = &standby{policy: policy, auto: make(map[*Backend]bool)}
+	}
+}
+
+type standby struct {
+	policy StandbyPolicy
+
+	mu sync.Mutex
+	//auto are the backends the policy admitted, which it may return
+	auto map[*Backend]bool
+}
+
+// forget leaves b to the operator; nil-safe for balancers without a policy.
+func (s *standby) forget(b *Backend) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.auto, b)
+}
+
+// runStandby checks every pool once per interval until Shutdown.
+func (lb *LoadBalancer) runStandby() {
+	interval := lb.standby.policy.Interval
+	if interval <= 0 {
+		interval = lb.healthPolicy.Interval
+	}
+	if interval <= 0 {
+		interval = health.DefaultInterval
+	}
+	ticker := lb.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lb.stop:
+			return
+		case <-ticker.C():
+		}
+		for _, p := range lb.Pools() {
+			lb.standby.check(p)
+		}
+	}
+}
+
+// check admits or returns at most one of p's standby backends.
+func (s *standby) check(p *Pool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var regular, serving int
+	var load int64
+	//reserve are the standbys that could be admitted, admitted those the
+	//policy may return
+	var reserve, admitted []*Backend
+	for _, b := range p.Backends() {
+		up := b.Healthy() && !b.Draining()
+		switch {
+		case b.Reserved():
+			if up {
+				reserve = append(reserve, b)
+			}
+			continue
+		case !b.Standby():
+			if up {
+				regular++
+			}
+		case s.auto[b]:
+			admitted = append(admitted, b)
+		}
+		if up {
+			serving++
+			load += b.Load()
+		}
+	}
+
+	short := s.policy.MinActive > 0 && regular < s.policy.MinActive
+	busy := func(n int) bool {
+		return s.policy.MaxLoad > 0 && (n == 0 || load > int64(s.policy.MaxLoad*n))
+	}
+
+	switch {
+	case (short || busy(serving)) && len(reserve) > 0:
+		b := reserve[0]
+		b.SetAdmitted(true)
+		s.auto[b] = true
+		reason := fmt.Sprintf("%d connection(s) on %d backend(s)", load, serving)
+		if short {
+			reason = fmt.Sprintf("%d of %d regular backend(s) healthy", regular, s.policy.MinActive)
+		}
+		p.lb.log.Info("Standby backend admitted", "backend", b.Addr, "pool", p.name, "reason", reason)
+	case !short && len(admitted) > 0 && !busy(serving-1):
+		b := admitted[len(admitted)-1]
+		b.SetAdmitted(false)
+		delete(s.auto, b)
+		p.lb.log.Info("Standby backend returned to reserve", "backend", b.Addr, "pool", p.name)
+	}
+}
+
+// AdmitStandby lets the standby backend at addr, in every pool that has
+// it, take new connections until ReturnStandby, whatever the policy of
+// WithStandby says.
+func (lb *LoadBalancer) AdmitStandby(addr string) error {
+	backends, pools := backendsAt(lb.Pools(), addr)
+	if len(backends) == 0 {
+		return fmt.Errorf("unknown backend %s", addr)
+	}
+	return lb.admitStandby(addr, backends, pools, true)
+}
+
+// ReturnStandby puts the standby backend at addr back in reserve. Its open
+// connections are left to finish.
+func (lb *LoadBalancer) ReturnStandby(addr string) error {
+	backends, pools := backendsAt(lb.Pools(), addr)
+	if len(backends) == 0 {
+		return fmt.Errorf("unknown backend %s", addr)
+	}
+	return lb.admitStandby(addr, backends, pools, false)
+}
+
+func (lb *LoadBalancer) admitStandby(addr string, backends []*Backend, pools []string, on bool) error {
+	found := false
+	for i, b := range backends {
+		if !b.Standby() {
+			continue
+		}
+		found = true
+		lb.standby.forget(b)
+		if !b.SetAdmitted(on) {
+			continue
+		}
+		if on {
+			lb.log.Info("Standby backend admitted", "backend", addr, "pool", pools[i])
+		} else {
+			lb.log.Info("Standby backend returned to reserve", "backend", addr, "pool", pools[i])
+		}
+	}
+	if !found {
+		return fmt.Errorf("backend %s is not a standby", addr)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package balancer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+
+	"loadbalancer/balancer/affinity"
+	"loadbalancer/balancer/statestore"
+)
+
+// health learned before a restart is only trusted for this long; the
+// checker confirms it on its first round anyway
+const maxSnapshotHealthAge = 10 * time.Minute
+
+// Snapshot is the runtime state kept across restarts so a routine restart
+// does not reshuffle clients or send traffic to backends known to be down.
+type Snapshot struct {
+	Version int
+	Taken   time.Time
+	Pools   []PoolSnapshot
+}
+
+type PoolSnapshot struct {
+	Name     string
+	Backends []BackendState
+	Affinity []affinity.Entry `json:",omitempty"`
+}
+
+type BackendState struct {
+	Addr    string
+	Healthy bool
+	//CircuitOpened is when the backend's circuit opened, if it is open
+	CircuitOpened time.Time `json:",omitzero"`
+}
+
+const snapshotVersion = 1
+
+// StateStore keeps runtime state under a few keys: "snapshot" for Snapshot
+// and "configs" for the config versions. Load returns nil for a key never
+// saved. The statestore package has a directory, Redis and in-memory
+// store; anything else, such as an embedded database, only needs the two
+// methods.
+type StateStore interface {
+	Load(key string) ([]byte, error)
+	Save(key string, data []byte) error
+}
+
+const (
+	snapshotKey = "snapshot"
+	configsKey  = "configs"
+)
+
+// WithStateStore restores the snapshot in store when the first listener
+// starts, so pools and sticky tables set up after New are included, and
+// saves it there every interval, default 30s, from then on.
+func WithStateStore(store StateStore, interval time.Duration) Option {
+	return func(lb *LoadBalancer) {
+		lb.stateStore = store
+		lb.stateInterval = interval
+	}
+}
+
+// WithStateFile is WithStateStore with the snapshot in a single file at
+// path, and nowhere to keep config versions.
+func WithStateFile(path string, interval time.Duration) Option {
+	return WithStateStore(stateFile(path), interval)
+}
+
+// stateFile keeps only the snapshot, in a file of its own.
+type stateFile string
+
+func (f stateFile) Load(key string) ([]byte, error) {
+	if key != snapshotKey {
+		return nil, fmt.Errorf("state file %s only keeps the snapshot", string(f))
+	}
+	data, err := os.ReadFile(string(f))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (f stateFile) Save(key string, data []byte) error {
+	if key != snapshotKey {
+		return fmt.Errorf("state file %s only keeps the snapshot", string(f))
+	}
+	return statestore.WriteFile(string(f), data)
+}
+
+func (f stateFile) String() string { return string(f) }
+
+// Snapshot captures the current state of every pool.
+func (lb *LoadBalancer) Snapshot() Snapshot {
+	s := Snapshot{Version: snapshotVersion, Taken: lb.clock.Now()}
+
+	for _, p := range lb.Pools() {
+		ps := PoolSnapshot{Name: p.name}
+		for _, b := range p.Backends() {
+			ps.Backends = append(ps.Backends, BackendState{
+				Addr:          b.Addr,
+				Healthy:       b.Healthy(),
+				CircuitOpened: lb.breakers.Opened(b),
+			})
+		}
+		if t := p.Affinity(); t != nil {
+			ps.Affinity = t.Entries()
+		}
+		s.Pools = append(s.Pools, ps)
+	}
+	return s
+}
+
+// Restore applies a snapshot to pools and backends that still exist.
+// Anything the snapshot knows that the current config does not is ignored.
+func (lb *LoadBalancer) Restore(s Snapshot) {
+	trustHealth := lb.clock.Since(s.Taken) < maxSnapshotHealthAge
+
+	for _, ps := range s.Pools {
+		p := lb.Pool(ps.Name)
+		if p == nil {
+			continue
+		}
+
+		if trustHealth {
+			for _, state := range ps.Backends {
+				b := p.Backend(state.Addr)
+				if b == nil {
+					continue
+				}
+				b.SetHealthy(state.Healthy)
+				if !state.CircuitOpened.IsZero() {
+					lb.breakers.Reopen(b, state.CircuitOpened, "open before the restart")
+				}
+			}
+		}
+
+		if t := p.Affinity(); t != nil {
+			for _, e := range ps.Affinity {
+				if p.Backend(e.Backend) != nil {
+					t.Apply(e)
+				}
+			}
+		}
+	}
+}
+
+// SaveSnapshot writes the current state to path atomically.
+func (lb *LoadBalancer) SaveSnapshot(path string) error {
+	return lb.saveSnapshot(stateFile(path))
+}
+
+// LoadSnapshot restores the state saved in path. A missing file is not an
+// error; it is what a first start looks like.
+func (lb *LoadBalancer) LoadSnapshot(path string) error {
+	return lb.loadSnapshot(stateFile(path))
+}
+
+func (lb *LoadBalancer) saveSnapshot(store StateStore) error {
+	data, err := json.Marshal(lb.Snapshot())
+	if err != nil {
+		return err
+	}
+	return store.Save(snapshotKey, data)
+}
+
+func (lb *LoadBalancer) loadSnapshot(store StateStore) error {
+	data, err := store.Load(snapshotKey)
+	if err != nil || data == nil {
+		return err
+	}
+
+	var s Snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("state in %v: %w", store, err)
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("state in %v: unsupported version %d", store, s.Version)
+	}
+
+	lb.Restore(s)
+	lb.log.Info("Restored state", "store", fmt.Sprint(store), "saved", s.Taken)
+	return nil
+}
+
+// saveState is the periodic writer started with the first listener. It
+// returns on Shutdown, which saves once more.
+func (lb *LoadBalancer) saveState() {
+	interval := lb.stateInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	ticker := lb.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-lb.stop:
+			return
+		case <-ticker.C():
+		}
+		if err := lb.saveSnapshot(lb.stateStore); err != nil {
+			lb.log.Error("Saving state failed", "store", fmt.Sprint(lb.stateStore), "error", err)
+		}
+	}
+}
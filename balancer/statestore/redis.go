@@ -0,0 +1,127 @@
+package statestore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultRedisPrefix  = "loadbalancer:"
+	DefaultRedisTimeout = 2 * time.Second
+)
+
+// Redis keeps every key as a string value in a Redis server, speaking RESP
+// itself so no client library is needed, for state that outlives the host.
+// Each Load and Save is a connection of its own; state is saved every few
+// seconds at most. Instances sharing a server need a Prefix each.
+type Redis struct {
+	//Addr is the TCP address, e.g. "redis:6379"
+	Addr     string
+	Password string
+	DB       int
+	//Prefix goes before every key, default "loadbalancer:"
+	Prefix string
+	//Timeout bounds each Load and Save, default 2s
+	Timeout time.Duration
+}
+
+func (r Redis) Load(key string) ([]byte, error) {
+	return r.do("GET", r.key(key))
+}
+
+func (r Redis) Save(key string, data []byte) error {
+	_, err := r.do("SET", r.key(key), string(data))
+	return err
+}
+
+func (r Redis) String() string { return "redis " + r.Addr }
+
+func (r Redis) key(key string) string {
+	if r.Prefix == "" {
+		return DefaultRedisPrefix + key
+	}
+	return r.Prefix + key
+}
+
+// do runs one command after AUTH and SELECT, and returns its bulk reply,
+// nil for a missing key.
+func (r Redis) do(cmd ...string) ([]byte, error) {
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultRedisTimeout
+	}
+	conn, err := net.DialTimeout("tcp", r.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	var cmds [][]string
+	if r.Password != "" {
+		cmds = append(cmds, []string{"AUTH", r.Password})
+	}
+	if r.DB != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(r.DB)})
+	}
+	cmds = append(cmds, cmd)
+
+	//pipelined, then the replies in order
+	w := bufio.NewWriter(conn)
+	for _, c := range cmds {
+		fmt.Fprintf(w, "*%d\r\n", len(c))
+		for _, arg := range c {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	rd := bufio.NewReader(conn)
+	var reply []byte
+	for _, c := range cmds {
+		if reply, err = readReply(rd); err != nil {
+			return nil, fmt.Errorf("redis %s: %w", c[0], err)
+		}
+	}
+	return reply, nil
+}
+
+// readReply reads a simple string, integer, error or bulk string reply.
+func readReply(rd *bufio.Reader) ([]byte, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("malformed reply")
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.New("malformed reply")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
@@ -0,0 +1,100 @@
+// Package statestore keeps the balancer's runtime state, such as health,
+// sticky sessions, open circuits and config versions, across restarts.
+// Every store satisfies balancer.StateStore: values are opaque bytes under
+// short keys like "snapshot", and loading a key never saved is not an
+// error, it is what a first start looks like.
+package statestore
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Dir keeps every key in a file of its own, Path/<key>.json, written
+// atomically. It suits a single instance with a local disk.
+type Dir struct {
+	Path string
+}
+
+func (d Dir) Load(key string) ([]byte, error) {
+	path, err := d.file(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (d Dir) Save(key string, data []byte) error {
+	path, err := d.file(key)
+	if err != nil {
+		return err
+	}
+	return WriteFile(path, data)
+}
+
+func (d Dir) String() string { return d.Path }
+
+func (d Dir) file(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `/\`) || strings.HasPrefix(key, ".") {
+		return "", fmt.Errorf("invalid state key %q", key)
+	}
+	return filepath.Join(d.Path, key+".json"), nil
+}
+
+// WriteFile replaces path with data through a temporary file next to it,
+// so a crash leaves the old or the new content but never a torn one. The
+// temporary file is unique, so writers of the same path don't collide.
+func WriteFile(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Memory keeps the state in the process, for tests or embedders that
+// persist it themselves. The zero value is ready to use.
+type Memory struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (m *Memory) Load(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[key], nil
+}
+
+func (m *Memory) Save(key string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values == nil {
+		m.values = make(map[string][]byte)
+	}
+	m.values[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *Memory) String() string { return "memory" }
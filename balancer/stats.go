@@ -0,0 +1,300 @@
+package balancer
+
+import (
+	"sync/atomic"
+	"time"
+
+	"loadbalancer/balancer/backend"
+	"loadbalancer/balancer/resolve"
+)
+
+// Stats is a snapshot of the balancer's counters, meant for embedders that
+// feed their own telemetry pipeline.
+type Stats struct {
+	Accepted uint64
+	Active   int64
+	Failed   uint64
+	BytesIn  uint64
+	BytesOut uint64
+	Rejected uint64
+	Panics   uint64
+	//FDPressure counts accepts that failed because the process or system
+	//ran out of file descriptors or socket memory
+	FDPressure uint64
+	//Retried counts failed dials retried with another backend, see
+	//WithDialRetries
+	Retried uint64
+
+	Listeners    []ListenerStats
+	Backends     []BackendStats
+	Certificates []CertificateStats
+	//CAs count the connections each CA verified
+	CAs      []CAStats
+	Tenants  []TenantStats
+	Tags     []TagStats
+	Shedding ShedStats
+	//Rebalanced counts connections ended to even out backends
+	Rebalanced uint64
+	//DNSCache counts how backend host names were resolved
+	DNSCache resolve.CacheStats
+	//Requests count the HTTP mode requests by the pool they were routed
+	//to, pools without any left out
+	Requests []RequestStats
+	//Budget are the listeners and routes of WithConnectionBudget
+	Budget []BudgetStats
+	//ErrorResponses count the 502s and 503s the balancer answered itself
+	//by reason code, such as proxy.ReasonDialTimeout
+	ErrorResponses map[string]uint64
+	//ConnectionLimit is the state of WithConnectionLimit, nil without
+	ConnectionLimit *ConnectionLimitStats
+}
+
+// RequestStats are the HTTP requests of one pool, counted apart from its
+// connections since HTTP mode can carry many requests on one.
+type RequestStats struct {
+	Pool string
+	backend.RequestSnapshot
+}
+
+type ListenerStats struct {
+	Address string
+	Pool    string
+	//Tenant is empty for listeners that belong to no tenant
+	Tenant   string
+	Accepted uint64
+	//Rejected counts connections refused before reaching a backend, e.g. by the ACL
+	Rejected uint64
+	//Tarpitted counts refused connections that were held in the tarpit
+	Tarpitted uint64
+	//AcceptErrors counts failed accepts that were retried after a pause
+	AcceptErrors uint64
+	//FDPressure is true while accepts are failing for lack of file descriptors
+	FDPressure bool
+	//Filtered counts connections refused by the accept filter, including
+	//FilterTimeouts when it fails closed
+	Filtered       uint64
+	FilterTimeouts uint64
+	//Regions are those of RegionFailover, nil without
+	Regions []RegionStats
+}
+
+// TenantStats are the counters of one tenant's listeners together, so each
+// tenant can be graphed under its own name.
+type TenantStats struct {
+	Name  string
+	Quota TenantQuota
+	//Rejected includes connections refused for exceeding the quota
+	Rejected uint64
+	backend.Snapshot
+}
+
+type BackendStats struct {
+	Pool    string
+	Addr    string
+	Healthy bool
+	//Draining backends are healthy but take no new connections
+	Draining bool
+	//Standby backends take none either unless Admitted
+	Standby  bool
+	Admitted bool
+	//Circuit is the state of the circuit breaker, see WithCircuitBreaker
+	Circuit string
+	//Probed and Reported are what Healthy was gated from: the checks and
+	//the discovery source
+	Probed   backend.View
+	Reported backend.View
+	//Weight is the operator's, Factor the learned multiplier on top
+	Weight int
+	Factor float64
+	Pinned bool
+	//Ramp is the share of the weight during slow start, 1 otherwise
+	Ramp   float64
+	Labels map[string]string
+	//MaxConnections is the backend's limit, 0 for none
+	MaxConnections int
+	//Latency is the moving average from connect to first byte
+	Latency time.Duration
+	//Requests are counted in HTTP mode only
+	Requests backend.RequestSnapshot
+	//Probes count and time the health checks
+	Probes backend.ProbeSnapshot
+	//DNS is the resolution history of a backend addressed by host name,
+	//nil for IP backends
+	DNS *resolve.Resolution
+	backend.Snapshot
+}
+
+func (lb *LoadBalancer) Stats() Stats {
+	global := lb.counters.Snapshot()
+
+	stats := Stats{
+		Accepted: global.Connections,
+		Active:   global.Active,
+		Failed:   global.Failed,
+		BytesIn:  global.BytesIn,
+		BytesOut: global.BytesOut,
+		Rejected: lb.rejected.Load(),
+		Panics:   lb.panics.Load(),
+
+		FDPressure: lb.fdPressure.Load(),
+		Retried:    lb.retried.Load(),
+	}
+
+	lb.addStats(&stats, nil)
+	stats.Certificates = lb.certificateStats()
+	stats.CAs = lb.cas.stats()
+	stats.Tags = lb.tagStats()
+	stats.Shedding = lb.shedder.stats()
+	stats.Rebalanced = lb.rebalancer.endedCount()
+	stats.DNSCache = lb.dnsCache.Stats()
+	stats.Budget = lb.budget.stats()
+	stats.ConnectionLimit = lb.connLimit.stats()
+	lb.errorResponses.Range(func(reason, n any) bool {
+		if stats.ErrorResponses == nil {
+			stats.ErrorResponses = make(map[string]uint64)
+		}
+		stats.ErrorResponses[reason.(string)] = n.(*atomic.Uint64).Load()
+		return true
+	})
+
+	for _, t := range lb.Tenants() {
+		stats.Tenants = append(stats.Tenants, t.tenantStats())
+	}
+
+	return stats
+}
+
+// Stats is the part of the balancer's stats that belongs to the tenant:
+// its own totals, listeners and backends. It is the view to hand to the
+// tenant rather than the whole of Stats.
+func (t *Tenant) Stats() Stats {
+	own := t.counters.Snapshot()
+
+	stats := Stats{
+		Accepted: own.Connections,
+		Active:   own.Active,
+		Failed:   own.Failed,
+		BytesIn:  own.BytesIn,
+		BytesOut: own.BytesOut,
+		Rejected: t.rejected.Load(),
+		Tenants:  []TenantStats{t.tenantStats()},
+	}
+
+	t.lb.addStats(&stats, t)
+	return stats
+}
+
+func (t *Tenant) tenantStats() TenantStats {
+	return TenantStats{
+		Name:     t.name,
+		Quota:    t.quota,
+		Rejected: t.rejected.Load(),
+		Snapshot: t.counters.Snapshot(),
+	}
+}
+
+// addStats fills in listeners and backends, only the tenant's unless it is nil.
+func (lb *LoadBalancer) addStats(stats *Stats, tenant *Tenant) {
+	for _, fe := range lb.frontendList() {
+		if tenant != nil && fe.tenant != tenant {
+			continue
+		}
+
+		ls := ListenerStats{
+			Address:   fe.addr.String(),
+			Pool:      fe.pool.name,
+			Accepted:  fe.accepted.Load(),
+			Rejected:  fe.rejected.Load(),
+			Tarpitted: fe.tarpitted.Load(),
+
+			AcceptErrors:   fe.acceptErrors.Load(),
+			FDPressure:     fe.fdPressure.Load(),
+			Filtered:       fe.filtered.Load(),
+			FilterTimeouts: fe.filterTimeouts.Load(),
+
+			Regions: fe.regions.stats(),
+		}
+		if fe.tenant != nil {
+			ls.Tenant = fe.tenant.name
+		}
+		stats.Listeners = append(stats.Listeners, ls)
+	}
+
+	for _, p := range lb.Pools() {
+		if tenant != nil && p.tenant != tenant {
+			continue
+		}
+
+		if r := p.requests.Snapshot(); r.Requests > 0 {
+			stats.Requests = append(stats.Requests, RequestStats{Pool: p.name, RequestSnapshot: r})
+		}
+		for _, b := range p.Backends() {
+			stats.Backends = append(stats.Backends, BackendStats{
+				Pool:     p.name,
+				Addr:     b.Addr,
+				Healthy:  b.Healthy(),
+				Draining: b.Draining(),
+				Standby:  b.Standby(),
+				Admitted: b.Admitted(),
+				Ramp:     b.Ramp(),
+				Circuit:  lb.breakers.State(b).String(),
+				Probed:   b.Probed(),
+				Reported: b.Reported(),
+				Weight:   b.Weight(),
+				Factor:   b.Factor(),
+				Pinned:   b.Pinned(),
+				Labels:   b.Labels(),
+				Latency:  b.Latency(),
+				Requests: b.Requests.Snapshot(),
+				Probes:   b.Probes.Snapshot(),
+				DNS:      lb.resolver.Get(b.Addr),
+				Snapshot: b.Snapshot(),
+
+				MaxConnections: b.MaxConnections(),
+			})
+		}
+	}
+}
+
+// connMeter attributes proxied bytes to the backend, the global counters,
+// the tenant's and those of the connection's tags, and times the backend's
+// first byte.
+type connMeter struct {
+	lb      *LoadBalancer
+	backend *backend.Backend
+	tenant  *Tenant
+	tags    connTags
+	first   *firstByte
+}
+
+// firstByte times the backend's first byte from the start of the connect,
+// the latency the backend's moving average is made of.
+type firstByte struct {
+	start time.Time
+	seen  atomic.Bool
+}
+
+func (m connMeter) AddBytesIn(n int) {
+	m.lb.counters.AddBytesIn(n)
+	m.backend.AddBytesIn(n)
+	if m.tenant != nil {
+		m.tenant.counters.AddBytesIn(n)
+	}
+	for _, t := range m.tags {
+		t.counters.AddBytesIn(n)
+	}
+}
+
+func (m connMeter) AddBytesOut(n int) {
+	if m.first != nil && n > 0 && !m.first.seen.Swap(true) {
+		m.backend.ObserveLatency(m.lb.clock.Since(m.first.start))
+	}
+	m.lb.counters.AddBytesOut(n)
+	m.backend.AddBytesOut(n)
+	if m.tenant != nil {
+		m.tenant.counters.AddBytesOut(n)
+	}
+	for _, t := range m.tags {
+		t.counters.AddBytesOut(n)
+	}
+}
@@ -0,0 +1,82 @@
+package strategy
+
+import (
+	"math"
+
+	"loadbalancer/balancer/backend"
+)
+
+// DefaultLoadFactor lets a backend take 25% more than its share.
+const DefaultLoadFactor = 1.25
+
+// BoundedHash is consistent hashing with bounded loads: a key maps to the
+// same backend as long as that backend stays below LoadFactor times its
+// share of the active connections. Past that the key walks on along the
+// ring, so the excess spills to the same neighbours every time and a hot
+// key can't overload one backend.
+type BoundedHash struct {
+	//LoadFactor is the bound relative to the average, at least 1
+	LoadFactor float64
+	//Replicas is the average number of ring points per backend, default
+	//100; backends get more or fewer by their effective weight
+	Replicas int
+
+	rings ringCache
+}
+
+func NewBoundedHash(loadFactor float64) *BoundedHash {
+	return &BoundedHash{LoadFactor: loadFactor}
+}
+
+// Pick hashes the empty key; pools call PickKey with the client address.
+func (h *BoundedHash) Pick(backends []*backend.Backend) *backend.Backend {
+	return h.PickKey("", backends)
+}
+
+func (h *BoundedHash) PickKey(key string, backends []*backend.Backend) *backend.Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	r := h.rings.get(backends, h.Replicas)
+
+	factor := h.LoadFactor
+	if factor == 0 {
+		factor = DefaultLoadFactor
+	}
+	factor = max(factor, 1)
+
+	var total int64
+	for _, b := range backends {
+		total += b.Active()
+	}
+
+	//with one more connection, every backend's bound is its weighted share
+	//scaled by the factor, rounded up so that the bounds add up to at least
+	//the new total and someone always has room
+	limit := func(b *backend.Backend) int64 {
+		share := float64(total+1) * r.weights[b] / r.totalWeight
+		return int64(math.Ceil(share * factor))
+	}
+
+	start := r.search(key)
+
+	seen := make(map[*backend.Backend]bool, len(backends))
+	for i := range r.points {
+		b := r.points[(start+i)%len(r.points)].backend
+		if seen[b] {
+			continue
+		}
+		seen[b] = true
+
+		if b.Active() < limit(b) {
+			return b
+		}
+		if len(seen) == len(backends) {
+			break
+		}
+	}
+
+	//only reachable when loads moved while walking
+	return r.points[start%len(r.points)].backend
+}
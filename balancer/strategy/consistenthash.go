@@ -0,0 +1,33 @@
+package strategy
+
+import "loadbalancer/balancer/backend"
+
+// ConsistentHash maps a key to the first backend after it on a ring of
+// virtual nodes, so a client keeps its backend for as long as that backend
+// is a candidate. Adding or removing a backend only moves the keys of the
+// ring segments it gains or loses. Unlike BoundedHash it never spills, so
+// a hot key stays on its backend however busy that gets.
+type ConsistentHash struct {
+	//Replicas is the average number of ring points per backend, default
+	//100; backends get more or fewer by their effective weight
+	Replicas int
+
+	rings ringCache
+}
+
+func NewConsistentHash(replicas int) *ConsistentHash {
+	return &ConsistentHash{Replicas: replicas}
+}
+
+// Pick hashes the empty key; pools call PickKey with the client address.
+func (h *ConsistentHash) Pick(backends []*backend.Backend) *backend.Backend {
+	return h.PickKey("", backends)
+}
+
+func (h *ConsistentHash) PickKey(key string, backends []*backend.Backend) *backend.Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+	r := h.rings.get(backends, h.Replicas)
+	return r.points[r.search(key)%len(r.points)].backend
+}
@@ -0,0 +1,117 @@
+package strategy
+
+import (
+	"hash/fnv"
+	"math"
+	"slices"
+	"strconv"
+	"sync"
+
+	"loadbalancer/balancer/backend"
+)
+
+const defaultReplicas = 100
+
+type point struct {
+	hash    uint64
+	backend *backend.Backend
+}
+
+type ring struct {
+	points      []point
+	weights     map[*backend.Backend]float64
+	totalWeight float64
+}
+
+// matches reports whether the ring was built for exactly these backends
+// with their current weights.
+func (r *ring) matches(backends []*backend.Backend) bool {
+	if len(r.weights) != len(backends) {
+		return false
+	}
+	for _, b := range backends {
+		if w, ok := r.weights[b]; !ok || w != b.EffectiveWeight() {
+			return false
+		}
+	}
+	return true
+}
+
+// ringCache keeps the ring of the last candidate set.
+type ringCache struct {
+	mu   sync.Mutex
+	ring *ring
+}
+
+// get returns the ring of the candidate set, rebuilding it when the set or
+// a weight changed since the last pick.
+func (c *ringCache) get(backends []*backend.Backend, replicas int) *ring {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ring != nil && c.ring.matches(backends) {
+		return c.ring
+	}
+
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+
+	r := &ring{weights: make(map[*backend.Backend]float64, len(backends))}
+	for _, b := range backends {
+		w := b.EffectiveWeight()
+		r.weights[b] = w
+		r.totalWeight += w
+	}
+
+	//points are spread by weight so the ring stays the same size however
+	//the weights are scaled
+	for _, b := range backends {
+		n := int(math.Round(r.weights[b] / r.totalWeight * float64(replicas*len(backends))))
+		for i := range max(n, 1) {
+			r.points = append(r.points, point{hash: hashKey(b.Addr + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b point) int {
+		switch {
+		case a.hash < b.hash:
+			return -1
+		case a.hash > b.hash:
+			return 1
+		}
+		return 0
+	})
+
+	c.ring = r
+	return r
+}
+
+// search returns the index of the first point at or after the hash of key,
+// which may be one past the end.
+func (r *ring) search(key string) int {
+	i, _ := slices.BinarySearchFunc(r.points, hashKey(key), func(p point, k uint64) int {
+		switch {
+		case p.hash < k:
+			return -1
+		case p.hash > k:
+			return 1
+		}
+		return 0
+	})
+	return i
+}
+
+// hashKey is FNV-1a with a final mix, as FNV alone clusters similar keys
+// such as "10.0.0.1#1" and "10.0.0.1#2" on the ring.
+func hashKey(key string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(key))
+	x := f.Sum64()
+
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,42 @@
+package strategy
+
+import (
+	"sync"
+
+	"loadbalancer/balancer/backend"
+)
+
+// LeastConn picks the backend with the fewest connections relative to its
+// effective weight, counting those still being dialed so that a burst
+// doesn't all land on the same idle backend. Ties go to the backends in
+// turn.
+type LeastConn struct {
+	mu   sync.Mutex
+	next int
+}
+
+func NewLeastConn() *LeastConn {
+	return &LeastConn{}
+}
+
+func (l *LeastConn) Pick(backends []*backend.Backend) *backend.Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	start := l.next % len(backends)
+	l.next = start + 1
+	l.mu.Unlock()
+
+	var best *backend.Backend
+	var bestLoad float64
+	for i := range backends {
+		b := backends[(start+i)%len(backends)]
+		load := float64(b.Load()) / b.EffectiveWeight()
+		if best == nil || load < bestLoad {
+			best, bestLoad = b, load
+		}
+	}
+	return best
+}
@@ -0,0 +1,59 @@
+package strategy
+
+import (
+	"sync"
+
+	"loadbalancer/balancer/backend"
+)
+
+// LeastLatency prefers the backends that answer fastest. Each is scored by
+// its moving average latency, from the connect to its first byte, times
+// one more than its open and dialing connections, per unit of effective
+// weight; the lowest score wins. Counting the load keeps the fastest
+// backend from taking everything until it slows down. Backends without a
+// sample yet are scored with the fastest known latency, so they get tried;
+// with no samples at all it behaves like LeastConn.
+type LeastLatency struct {
+	mu   sync.Mutex
+	next int
+}
+
+func NewLeastLatency() *LeastLatency {
+	return &LeastLatency{}
+}
+
+func (l *LeastLatency) Pick(backends []*backend.Backend) *backend.Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	start := l.next % len(backends)
+	l.next = start + 1
+	l.mu.Unlock()
+
+	var fastest float64
+	for _, b := range backends {
+		if lat := float64(b.Latency()); lat > 0 && (fastest == 0 || lat < fastest) {
+			fastest = lat
+		}
+	}
+	if fastest == 0 {
+		fastest = 1
+	}
+
+	var best *backend.Backend
+	var bestScore float64
+	for i := range backends {
+		b := backends[(start+i)%len(backends)]
+		lat := float64(b.Latency())
+		if lat == 0 {
+			lat = fastest
+		}
+		score := lat * float64(b.Load()+1) / b.EffectiveWeight()
+		if best == nil || score < bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
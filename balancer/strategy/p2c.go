@@ -0,0 +1,40 @@
+package strategy
+
+import (
+	"math/rand/v2"
+
+	"loadbalancer/balancer/backend"
+)
+
+// PowerOfTwo picks two backends at random and takes the one with fewer
+// connections relative to its effective weight, counting those still being
+// dialed. It comes close to LeastConn at a constant cost per pick, and the
+// randomness keeps concurrent picks from all landing on the one backend
+// that looked least loaded.
+type PowerOfTwo struct{}
+
+func NewPowerOfTwo() *PowerOfTwo {
+	return &PowerOfTwo{}
+}
+
+func (p *PowerOfTwo) Pick(backends []*backend.Backend) *backend.Backend {
+	switch len(backends) {
+	case 0:
+		return nil
+	case 1:
+		return backends[0]
+	}
+
+	i := rand.IntN(len(backends))
+	//the second choice is drawn from the others so the two always differ
+	j := rand.IntN(len(backends) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := backends[i], backends[j]
+	if float64(b.Load())/b.EffectiveWeight() < float64(a.Load())/a.EffectiveWeight() {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,30 @@
+package strategy
+
+import (
+	"sync"
+
+	"loadbalancer/balancer/backend"
+)
+
+// RoundRobin hands out backends in turn.
+type RoundRobin struct {
+	mu      sync.Mutex
+	current int
+}
+
+func NewRoundRobin() *RoundRobin {
+	return &RoundRobin{}
+}
+
+func (r *RoundRobin) Pick(backends []*backend.Backend) *backend.Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b := backends[r.current%len(backends)]
+	r.current = (r.current + 1) % len(backends)
+	return b
+}
@@ -0,0 +1,16 @@
+package strategy
+
+import "loadbalancer/balancer/backend"
+
+// Strategy chooses one backend out of the healthy candidates for a new
+// connection. It returns nil if none of them can be used.
+type Strategy interface {
+	Pick(backends []*backend.Backend) *backend.Backend
+}
+
+// Keyed is a Strategy that maps a key, the client IP for pools, to a
+// backend so the same client keeps landing on the same one.
+type Keyed interface {
+	Strategy
+	PickKey(key string, backends []*backend.Backend) *backend.Backend
+}
@@ -0,0 +1,54 @@
+package strategy
+
+import (
+	"sync"
+
+	"loadbalancer/balancer/backend"
+)
+
+// WeightedRoundRobin hands out backends in proportion to their effective
+// weight, interleaved the way nginx does it: weights 5, 1 and 1 give
+// a a b a c a a rather than five a in a row.
+type WeightedRoundRobin struct {
+	mu sync.Mutex
+	//current are the running scores of the smooth algorithm
+	current map[*backend.Backend]float64
+}
+
+func NewWeightedRoundRobin() *WeightedRoundRobin {
+	return &WeightedRoundRobin{current: make(map[*backend.Backend]float64)}
+}
+
+func (w *WeightedRoundRobin) Pick(backends []*backend.Backend) *backend.Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	//forget backends that left the candidates, so one coming back starts
+	//over instead of with a stale score
+	if len(w.current) > len(backends) {
+		kept := make(map[*backend.Backend]float64, len(backends))
+		for _, b := range backends {
+			if s, ok := w.current[b]; ok {
+				kept[b] = s
+			}
+		}
+		w.current = kept
+	}
+
+	var best *backend.Backend
+	var total float64
+	for _, b := range backends {
+		weight := b.EffectiveWeight()
+		total += weight
+		w.current[b] += weight
+		if best == nil || w.current[b] > w.current[best] {
+			best = b
+		}
+	}
+	w.current[best] -= total
+	return best
+}
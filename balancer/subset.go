@@ -0,0 +1,100 @@
+package balancer
+
+import (
+	"hash/fnv"
+	"net"
+	"slices"
+)
+
+// Subset routes part of a pool's traffic to the backends carrying Labels,
+// e.g. version=v2 during a rollout. A connection goes to the subset when
+// it matches Header or falls into Percent; connections that match no
+// subset stay off every subset's backends, so a canary only gets what its
+// rules send it.
+type Subset struct {
+	//Name shows up in logs
+	Name   string
+	Labels map[string]string
+	//Header is looked up in the first request of the connection, which
+	//needs ModeHTTP or the HTTP adapter. With Values empty any value
+	//matches.
+	Header string
+	Values []string
+	//Percent of the clients, from 0 to 100. Clients are hashed, so each
+	//keeps landing in the same subset; the shares of several subsets add up.
+	Percent float64
+}
+
+// SetSubsets replaces the pool's subsets, checked in order for each new
+// connection.
+func (p *Pool) SetSubsets(subsets ...Subset) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subsets = slices.Clone(subsets)
+}
+
+func (p *Pool) Subsets() []Subset {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.subsets
+}
+
+// subsetCandidates narrows the healthy backends to the subset client
+// belongs to, or to the ones outside every subset. Should that leave none,
+// all of them are used.
+func (p *Pool) subsetCandidates(client net.Conn, healthy []*Backend) []*Backend {
+	subsets := p.Subsets()
+	if len(subsets) == 0 || len(healthy) == 0 {
+		return healthy
+	}
+
+	chosen := -1
+	bucket := clientBucket(p.name, p.lb.clientKey(client.RemoteAddr()))
+	var share float64
+	for i, s := range subsets {
+		if s.Header != "" {
+			if v := httpHeader(client, s.Header); v != "" && (len(s.Values) == 0 || slices.Contains(s.Values, v)) {
+				chosen = i
+				break
+			}
+		}
+		if s.Percent > 0 {
+			share += s.Percent
+			if bucket < share {
+				chosen = i
+				break
+			}
+		}
+	}
+
+	var filtered []*Backend
+	for _, b := range healthy {
+		if chosen >= 0 && b.HasLabels(subsets[chosen].Labels) {
+			filtered = append(filtered, b)
+		}
+		if chosen < 0 && !slices.ContainsFunc(subsets, func(s Subset) bool { return b.HasLabels(s.Labels) }) {
+			filtered = append(filtered, b)
+		}
+	}
+
+	if len(filtered) == 0 {
+		if chosen >= 0 {
+			p.lb.log.Warn("Subset has no healthy backend, using the whole pool", "subset", subsets[chosen].Name, "pool", p.name)
+		}
+		return healthy
+	}
+	return filtered
+}
+
+// clientBucket places a client in [0, 100), differently in every pool so
+// that the canaries of two pools don't get the same clients.
+func clientBucket(pool, key string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(pool + "#" + key))
+	//FNV alone puts neighbouring addresses in neighbouring buckets
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return float64(x%10000) / 100
+}
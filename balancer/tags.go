@@ -0,0 +1,246 @@
+package balancer
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"loadbalancer/balancer/audit"
+	"loadbalancer/balancer/backend"
+	"loadbalancer/balancer/proxy"
+	"loadbalancer/balancer/ratelimit"
+)
+
+// TagFunc returns the tags of a connection once the listener's adapters
+// have run, so it can look at the client address, SNI name or identity.
+type TagFunc func(conn net.Conn) []string
+
+// TagRule tags connections that match all of its criteria; an empty
+// criterion matches everything.
+type TagRule struct {
+	Tag string
+	//Sources are client networks
+	Sources []netip.Prefix
+	//ServerNames are SNI names or, in ModeHTTP, Host names; "*.example.com"
+	//matches subdomains
+	ServerNames []string
+}
+
+// TagRules returns a TagFunc applying rules in order; a connection gets
+// the tag of every rule it matches.
+func TagRules(rules ...TagRule) TagFunc {
+	return func(conn net.Conn) []string {
+		var tags []string
+		for _, r := range rules {
+			if r.matches(conn) {
+				tags = append(tags, r.Tag)
+			}
+		}
+		return tags
+	}
+}
+
+func (r TagRule) matches(conn net.Conn) bool {
+	if len(r.Sources) > 0 {
+		ip := clientIP(conn.RemoteAddr())
+		if !slices.ContainsFunc(r.Sources, func(p netip.Prefix) bool { return p.Contains(ip) }) {
+			return false
+		}
+	}
+
+	if len(r.ServerNames) > 0 {
+		host := strings.ToLower(stripPort(requestedHost(conn)))
+		if !slices.ContainsFunc(r.ServerNames, func(name string) bool { return matchServerName(name, host) }) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchServerName(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == pattern
+}
+
+// TagLimit is the budget shared by every connection carrying a tag. Zero
+// fields are unlimited.
+type TagLimit struct {
+	MaxConnections int
+	//Bandwidth caps bytes per second, both directions together
+	Bandwidth int64
+}
+
+// tag is the shared state of one tag, created on first use so every tag
+// shows up in the stats.
+type tag struct {
+	name   string
+	budget atomic.Pointer[tagBudget]
+
+	//slots counts open connections carrying the tag
+	slots    atomic.Int64
+	counters backend.Counters
+	rejected atomic.Uint64
+}
+
+type tagBudget struct {
+	limit     TagLimit
+	bandwidth *ratelimit.Bucket
+}
+
+// SetTagLimit sets the budget of a tag. The connection limit applies to
+// new connections; open ones keep the bandwidth budget they started with.
+func (lb *LoadBalancer) SetTagLimit(name string, limit TagLimit) {
+	b := &tagBudget{limit: limit}
+	if limit.Bandwidth > 0 {
+		b.bandwidth = ratelimit.NewBucket(float64(limit.Bandwidth), int(limit.Bandwidth), lb.clock)
+	}
+	lb.tag(name).budget.Store(b)
+}
+
+func (lb *LoadBalancer) tag(name string) *tag {
+	lb.mu.RLock()
+	t := lb.tags[name]
+	lb.mu.RUnlock()
+	if t != nil {
+		return t
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if t = lb.tags[name]; t == nil {
+		t = &tag{name: name}
+		t.budget.Store(&tagBudget{})
+		lb.tags[name] = t
+	}
+	return t
+}
+
+func (t *tag) admit() bool {
+	limit := t.budget.Load().limit
+	if t.slots.Add(1) > int64(limit.MaxConnections) && limit.MaxConnections > 0 {
+		t.slots.Add(-1)
+		t.rejected.Add(1)
+		return false
+	}
+	return true
+}
+
+// listenerTags are the tags every connection on a listener gets.
+func listenerTags(cfg ListenerConfig, tenant *Tenant) []string {
+	names := slices.Clone(cfg.Tags)
+	if tenant != nil {
+		names = append(names, "tenant:"+tenant.name)
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// connTags are the tags of one connection.
+type connTags []*tag
+
+// tagConn collects the tags of conn: the listener's own, its tenant's and
+// those of its TagFunc. It takes a slot in every tag's budget and refuses
+// the connection when one of them is full.
+func (lb *LoadBalancer) tagConn(fe *frontend, conn net.Conn) (connTags, bool) {
+	names := fe.staticTags
+	if fe.cfg.Tagger != nil {
+		names = append(slices.Clone(names), fe.cfg.Tagger(conn)...)
+		slices.Sort(names)
+		names = slices.Compact(names)
+
+		if !lb.admitLoad(fe, conn.RemoteAddr(), names) {
+			return nil, false
+		}
+	}
+	if len(names) == 0 {
+		return nil, true
+	}
+
+	tags := make(connTags, 0, len(names))
+	for _, name := range names {
+		t := lb.tag(name)
+		if !t.admit() {
+			tags.release()
+			lb.reject(fe, conn.RemoteAddr(), audit.KindRateLimit, "tag "+name+" connection limit reached")
+			return nil, false
+		}
+		tags = append(tags, t)
+	}
+	return tags, true
+}
+
+func (tags connTags) release() {
+	for _, t := range tags {
+		t.slots.Add(-1)
+	}
+}
+
+func (tags connTags) connStarted() {
+	for _, t := range tags {
+		t.counters.ConnStarted()
+	}
+}
+
+func (tags connTags) connFinished() {
+	for _, t := range tags {
+		t.counters.ConnFinished()
+	}
+}
+
+func (tags connTags) connFailed() {
+	for _, t := range tags {
+		t.counters.ConnFailed()
+	}
+}
+
+// throttle paces conn by the bandwidth budgets of its tags.
+func (tags connTags) throttle(conn net.Conn) net.Conn {
+	var shapers []proxy.Shaper
+	for _, t := range tags {
+		if b := t.budget.Load().bandwidth; b != nil {
+			shapers = append(shapers, b)
+		}
+	}
+	return proxy.Throttle(conn, shapers...)
+}
+
+// names formats the tags for log lines, as a comma separated list.
+func (tags connTags) names() string {
+	names := make([]string, len(tags))
+	for i, t := range tags {
+		names[i] = t.name
+	}
+	return strings.Join(names, ",")
+}
+
+// TagStats are the counters of every connection carrying a tag.
+type TagStats struct {
+	Tag   string
+	Limit TagLimit
+	//Rejected counts connections refused because the tag was full
+	Rejected uint64
+	backend.Snapshot
+}
+
+func (lb *LoadBalancer) tagStats() []TagStats {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	stats := make([]TagStats, 0, len(lb.tags))
+	for _, t := range lb.tags {
+		stats = append(stats, TagStats{
+			Tag:      t.name,
+			Limit:    t.budget.Load().limit,
+			Rejected: t.rejected.Load(),
+			Snapshot: t.counters.Snapshot(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Tag < stats[j].Tag })
+	return stats
+}
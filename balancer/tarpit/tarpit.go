@@ -0,0 +1,172 @@
+package tarpit
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/clock"
+)
+
+type Config struct {
+	//Hold is how long a connection is kept before it is closed, default 1m
+	Hold time.Duration
+	//Interval between bytes sent to each held connection, default 5s
+	Interval time.Duration
+	//Max held connections; beyond it new ones are closed right away, default 10000
+	Max int
+}
+
+func (c Config) withDefaults() Config {
+	if c.Hold <= 0 {
+		c.Hold = time.Minute
+	}
+	if c.Interval <= 0 {
+		c.Interval = 5 * time.Second
+	}
+	if c.Max <= 0 {
+		c.Max = 10000
+	}
+	return c
+}
+
+// the drip looks like the start of an HTTP response that never ends, which
+// keeps most clients waiting
+var (
+	prefix = []byte("HTTP/1.1 429 Too Many Requests\r\nRetry-After: 60\r\n")
+	filler = []byte("X-Wait: 1\r\n")
+)
+
+const writeTimeout = 10 * time.Millisecond
+
+type held struct {
+	conn    net.Conn
+	expires time.Time
+	sent    int
+}
+
+// Tarpit keeps unwanted connections open and trickles bytes to them,
+// raising the cost of abuse. All held connections are served by one
+// goroutine, started with the first Hold, until Stop.
+type Tarpit struct {
+	cfg   Config
+	clock clock.Clock
+
+	once     sync.Once
+	stop     chan struct{}
+	stopOnce sync.Once
+	mu       sync.Mutex
+	held     []*held
+	//count includes connections the run loop has taken out of held
+	count int
+}
+
+func New(cfg Config, c clock.Clock) *Tarpit {
+	return &Tarpit{cfg: cfg.withDefaults(), clock: c, stop: make(chan struct{})}
+}
+
+// Hold takes ownership of conn. It returns false when the tarpit is full,
+// in which case the caller still owns conn and should close it, and once
+// stopped.
+func (t *Tarpit) Hold(conn net.Conn) bool {
+	t.once.Do(func() { go t.run() })
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.count >= t.cfg.Max || t.stopped() {
+		return false
+	}
+	t.count++
+	t.held = append(t.held, &held{conn: conn, expires: t.clock.Now().Add(t.cfg.Hold)})
+	return true
+}
+
+// Len returns the number of connections currently held.
+func (t *Tarpit) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.count
+}
+
+// Stop ends the drip and closes the connections held.
+func (t *Tarpit) Stop() {
+	t.stopOnce.Do(func() { close(t.stop) })
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, h := range t.held {
+		h.conn.Close()
+	}
+	t.count -= len(t.held)
+	t.held = nil
+}
+
+func (t *Tarpit) stopped() bool {
+	select {
+	case <-t.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *Tarpit) run() {
+	ticker := t.clock.NewTicker(t.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C():
+		}
+
+		t.mu.Lock()
+		current := t.held
+		t.held = nil
+		t.mu.Unlock()
+
+		now := t.clock.Now()
+		keep := current[:0]
+		for _, h := range current {
+			if now.After(h.expires) || !h.drip() {
+				h.conn.Close()
+				continue
+			}
+			keep = append(keep, h)
+		}
+
+		t.mu.Lock()
+		//a Stop while we were writing left the kept ones to close
+		if t.stopped() {
+			for _, h := range keep {
+				h.conn.Close()
+			}
+			keep = keep[:0]
+		}
+		//connections added while we were writing go after the kept ones
+		t.count -= len(current) - len(keep)
+		t.held = append(keep, t.held...)
+		t.mu.Unlock()
+	}
+}
+
+// drip writes the next byte. A client that stopped reading fills its
+// receive window and the short deadline makes us drop it instead of
+// blocking the loop.
+func (h *held) drip() bool {
+	var b byte
+	if h.sent < len(prefix) {
+		b = prefix[h.sent]
+	} else {
+		b = filler[(h.sent-len(prefix))%len(filler)]
+	}
+
+	h.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := h.conn.Write([]byte{b}); err != nil {
+		return false
+	}
+	h.sent++
+	return true
+}
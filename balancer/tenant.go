@@ -0,0 +1,153 @@
+package balancer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"loadbalancer/balancer/backend"
+	"loadbalancer/balancer/ratelimit"
+)
+
+// TenantQuota limits what one tenant may take from a shared balancer. Zero
+// fields are unlimited.
+type TenantQuota struct {
+	//MaxConnections caps open connections across all the tenant's listeners
+	MaxConnections int
+	//ConnRate caps new connections per second across all its listeners
+	ConnRate  float64
+	ConnBurst int
+}
+
+// Tenant owns a set of pools and the listeners routed to them, so that
+// several teams can share one deployment. A tenant's listeners only reach
+// its own pools, and its quota and counters are kept apart from the rest.
+type Tenant struct {
+	name   string
+	lb     *LoadBalancer
+	quota  TenantQuota
+	accept *ratelimit.Bucket
+
+	//slots counts connections holding a place in the quota, from accept on
+	slots    atomic.Int64
+	counters backend.Counters
+	rejected atomic.Uint64
+}
+
+// AddTenant registers a tenant. Its name prefixes the names of its pools.
+func (lb *LoadBalancer) AddTenant(name string, quota TenantQuota) (*Tenant, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid tenant name %q", name)
+	}
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if _, ok := lb.tenants[name]; ok {
+		return nil, fmt.Errorf("tenant %s already exists", name)
+	}
+
+	t := &Tenant{name: name, lb: lb, quota: quota}
+	if quota.ConnRate > 0 {
+		t.accept = ratelimit.NewBucket(quota.ConnRate, quota.ConnBurst, lb.clock)
+	}
+	lb.tenants[name] = t
+	return t, nil
+}
+
+// Tenant returns the tenant with the given name, or nil if there is none.
+func (lb *LoadBalancer) Tenant(name string) *Tenant {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.tenants[name]
+}
+
+// Tenants returns every tenant sorted by name.
+func (lb *LoadBalancer) Tenants() []*Tenant {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	tenants := make([]*Tenant, 0, len(lb.tenants))
+	for _, t := range lb.tenants {
+		tenants = append(tenants, t)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].name < tenants[j].name })
+	return tenants
+}
+
+func (t *Tenant) Name() string {
+	return t.name
+}
+
+func (t *Tenant) Quota() TenantQuota {
+	return t.quota
+}
+
+// AddPool creates a pool owned by the tenant. It is registered on the
+// balancer as "tenant/name".
+func (t *Tenant) AddPool(name string, servers []string) (*Pool, error) {
+	return t.lb.addPool(t.poolName(name), servers, t)
+}
+
+// Pool returns one of the tenant's pools by its short name.
+func (t *Tenant) Pool(name string) *Pool {
+	return t.lb.Pool(t.poolName(name))
+}
+
+// Pools returns the tenant's pools sorted by name.
+func (t *Tenant) Pools() []*Pool {
+	var pools []*Pool
+	for _, p := range t.lb.Pools() {
+		if p.tenant == t {
+			pools = append(pools, p)
+		}
+	}
+	return pools
+}
+
+func (t *Tenant) poolName(name string) string {
+	return t.name + "/" + name
+}
+
+// admit takes a place in the tenant's quota for a new connection. Every
+// admitted connection must be released once it is done.
+func (t *Tenant) admit() (bool, string) {
+	if t == nil {
+		return true, ""
+	}
+
+	if !t.accept.Allow() {
+		return false, "tenant " + t.name + " connection rate exceeded"
+	}
+
+	if t.slots.Add(1) > int64(t.quota.MaxConnections) && t.quota.MaxConnections > 0 {
+		t.slots.Add(-1)
+		return false, "tenant " + t.name + " connection quota exceeded"
+	}
+	return true, ""
+}
+
+func (t *Tenant) release() {
+	if t != nil {
+		t.slots.Add(-1)
+	}
+}
+
+func (t *Tenant) connStarted() {
+	if t != nil {
+		t.counters.ConnStarted()
+	}
+}
+
+func (t *Tenant) connFinished() {
+	if t != nil {
+		t.counters.ConnFinished()
+	}
+}
+
+func (t *Tenant) connFailed() {
+	if t != nil {
+		t.counters.ConnFailed()
+	}
+}
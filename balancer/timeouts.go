@@ -0,0 +1,112 @@
+package balancer
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"loadbalancer/balancer/proxy"
+)
+
+const defaultDialTimeout = 10 * time.Second
+
+// DefaultDialRetries are the other backends tried after a failed dial.
+const DefaultDialRetries = 2
+
+var errFirstByte = errors.New("backend sent nothing within the first byte timeout")
+
+// Timeouts bound the phases of a proxied connection. They can be set for
+// the balancer, a pool and a listener. A zero field inherits from the
+// next level out, in that order, and a negative one turns the timeout off.
+type Timeouts struct {
+	//Dial covers connecting to a backend, including its TLS handshake
+	Dial time.Duration
+	//Idle closes a connection after this long without reads on a side
+	Idle time.Duration
+	//Total caps how long a proxied connection may stay open
+	Total time.Duration
+	//HeaderRead caps the wait for each request head in ModeHTTP
+	HeaderRead time.Duration
+	//Write closes a connection when a write to a side blocks this long,
+	//e.g. for a client that stopped reading
+	Write time.Duration
+	//FirstByte closes a connection whose backend sends nothing this long
+	//after the connect or the last data sent to it, until its first byte;
+	//shorter than Idle, it catches hung backends without cutting quiet
+	//connections later on
+	FirstByte time.Duration
+}
+
+// DefaultTimeouts only bounds dialing; everything else is left to the
+// clients and backends.
+func DefaultTimeouts() Timeouts {
+	return Timeouts{Dial: defaultDialTimeout}
+}
+
+// inherit fills the unset fields of t from parent.
+func (t Timeouts) inherit(parent Timeouts) Timeouts {
+	pick := func(own, inherited time.Duration) time.Duration {
+		if own != 0 {
+			return own
+		}
+		return inherited
+	}
+	return Timeouts{
+		Dial:       pick(t.Dial, parent.Dial),
+		Idle:       pick(t.Idle, parent.Idle),
+		Total:      pick(t.Total, parent.Total),
+		HeaderRead: pick(t.HeaderRead, parent.HeaderRead),
+		Write:      pick(t.Write, parent.Write),
+		FirstByte:  pick(t.FirstByte, parent.FirstByte),
+	}
+}
+
+// effective turns turned-off timeouts into zero, which the rest of the
+// code reads as no limit.
+func (t Timeouts) effective() Timeouts {
+	off := func(d time.Duration) time.Duration {
+		return max(d, 0)
+	}
+	return Timeouts{
+		Dial:       off(t.Dial),
+		Idle:       off(t.Idle),
+		Total:      off(t.Total),
+		HeaderRead: off(t.HeaderRead),
+		Write:      off(t.Write),
+		FirstByte:  off(t.FirstByte),
+	}
+}
+
+// timeouts resolves the timeouts of a connection on fe routed to pool.
+// Under-attack mode may shorten the idle timeout further.
+func (lb *LoadBalancer) timeouts(fe *frontend, pool *Pool) Timeouts {
+	t := fe.cfg.Timeouts.inherit(pool.Timeouts()).inherit(lb.timeoutPolicy).effective()
+	if idle := lb.posture.idleTimeout(); idle > 0 && (t.Idle == 0 || idle < t.Idle) {
+		t.Idle = idle
+	}
+	return t
+}
+
+// limitConn applies the idle, write, first byte and total timeouts to one
+// side of a proxied connection. Without an idle, write or first byte
+// timeout a plain deadline is enough, which keeps the connection eligible
+// for splicing; in ModeHTTP the header timeout moves the read deadline, so
+// a total deadline needs the wrapper. elapsed is the part of the total
+// already gone; deadlines are wall-clock times, so they don't come from
+// lb.clock.
+func limitConn(conn net.Conn, t Timeouts, elapsed time.Duration, mode Mode) net.Conn {
+	var deadline time.Time
+	if t.Total > 0 {
+		deadline = time.Now().Add(t.Total - elapsed)
+	}
+
+	switch {
+	case t.Idle > 0 || t.Write > 0 || t.FirstByte > 0 || (mode == ModeHTTP && !deadline.IsZero()):
+		c := &proxy.IdleConn{Conn: conn, Timeout: t.Idle, WriteTimeout: t.Write, Deadline: deadline, FirstByte: t.FirstByte}
+		c.SetWriteDeadline(time.Time{})
+		return c
+	case !deadline.IsZero():
+		conn.SetDeadline(deadline)
+	}
+	return conn
+}
@@ -0,0 +1,161 @@
+//go:build !notls
+
+package balancer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"time"
+
+	"loadbalancer/balancer/listener"
+)
+
+// TLS termination and backend re-encryption; builds tagged notls leave
+// them out, see tls_notls.go.
+
+type tlsConfig = *tls.Config
+
+type tlsRoots = func() *x509.CertPool
+
+type tlsOverrides = map[string]BackendTLS
+
+// BackendTLS overrides the pool's TLS config for one backend, since backend
+// certificates often don't match the address the balancer dials. Empty
+// fields keep the pool's.
+type BackendTLS struct {
+	//ServerName is sent as SNI and verified against the certificate
+	ServerName string
+	//NextProtos are the ALPN protocols offered
+	NextProtos []string
+	//Roots verify the backend instead of the pool's CAs; called at each
+	//handshake, like those of SetTLSRoots
+	Roots func() *x509.CertPool
+}
+
+func (o BackendTLS) empty() bool {
+	return o.ServerName == "" && len(o.NextProtos) == 0 && o.Roots == nil
+}
+
+// TLS returns the config used to re-encrypt traffic to backends, or nil for
+// plain TCP.
+func (p *Pool) TLS() *tls.Config {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.tls
+}
+
+// SetTLS makes new connections to the pool's backends use TLS. An empty
+// ServerName defaults to the host part of each backend address.
+func (p *Pool) SetTLS(cfg *tls.Config) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tls = cfg
+}
+
+// SetTLSRoots makes the pool verify backends against the CAs roots returns
+// at each handshake instead of the config's RootCAs, so that a reloaded CA
+// bundle applies to new connections. Pass nil to go back to RootCAs.
+func (p *Pool) SetTLSRoots(roots func() *x509.CertPool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tlsRoots = roots
+}
+
+// SetBackendTLS overrides the pool's TLS config for the backend at addr,
+// which need not be a member yet. A zero BackendTLS drops the override.
+// Overrides only apply while the pool has a TLS config.
+func (p *Pool) SetBackendTLS(addr string, o BackendTLS) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if o.empty() {
+		delete(p.tlsOverrides, addr)
+		return
+	}
+	if p.tlsOverrides == nil {
+		p.tlsOverrides = make(tlsOverrides)
+	}
+	p.tlsOverrides[addr] = o
+}
+
+// BackendTLS is the override for the backend at addr, zero without one.
+func (p *Pool) BackendTLS(addr string) BackendTLS {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.tlsOverrides[addr]
+}
+
+// backendTLS wraps a new backend connection in TLS when the pool has a
+// config for it. The handshake must finish by deadline, if set.
+func (lb *LoadBalancer) backendTLS(pool *Pool, b *Backend, conn net.Conn, deadline time.Time) (net.Conn, error) {
+	pool.mu.RLock()
+	cfg, roots, override := pool.tls, pool.tlsRoots, pool.tlsOverrides[b.Addr]
+	pool.mu.RUnlock()
+	if cfg == nil {
+		return conn, nil
+	}
+
+	if override.Roots != nil {
+		roots = override.Roots
+	}
+	if cfg.ServerName == "" || roots != nil || !override.empty() {
+		cfg = cfg.Clone()
+	}
+	if override.ServerName != "" {
+		cfg.ServerName = override.ServerName
+	}
+	if len(override.NextProtos) > 0 {
+		cfg.NextProtos = override.NextProtos
+	}
+	if cfg.ServerName == "" {
+		host, _, _ := net.SplitHostPort(b.Addr)
+		cfg.ServerName = host
+	}
+	if roots != nil {
+		cfg.RootCAs = roots()
+	}
+
+	tlsConn := tls.Client(conn, cfg)
+	tlsConn.SetDeadline(deadline)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	state := tlsConn.ConnectionState()
+	if peer := state.PeerCertificates; len(peer) > 0 {
+		lb.certs.observe("backend "+b.Addr, peer[0])
+	}
+	lb.cas.add("pool "+pool.name, listener.VerifiedBy(state))
+
+	return tlsConn, nil
+}
+
+// tlsServerName is the SNI of a passthrough or terminated TLS connection.
+func tlsServerName(conn net.Conn) string {
+	if c, ok := listener.Find[*listener.SNIConn](conn); ok {
+		return c.ServerName
+	}
+	if c, ok := listener.Find[*listener.TLSConn](conn); ok {
+		return c.ConnectionState().ServerName
+	}
+	return ""
+}
+
+// tlsALPN is the protocol negotiated by a terminating TLS adapter.
+func tlsALPN(conn net.Conn) string {
+	if c, ok := listener.Find[*listener.TLSConn](conn); ok {
+		return c.ConnectionState().NegotiatedProtocol
+	}
+	return ""
+}
+
+func isTLSConn(conn net.Conn) bool {
+	_, ok := listener.Find[*listener.TLSConn](conn)
+	return ok
+}
+
+func isTLSAdapter(name string) bool {
+	return name == (listener.TLS{}).Name()
+}
@@ -0,0 +1,37 @@
+//go:build notls
+
+package balancer
+
+import (
+	"net"
+	"time"
+)
+
+// Without TLS support pools only dial plain TCP and there are no
+// certificates to monitor.
+
+type tlsConfig = struct{}
+
+type tlsRoots = struct{}
+
+type tlsOverrides = map[string]struct{}
+
+func (lb *LoadBalancer) backendTLS(pool *Pool, b *Backend, conn net.Conn, deadline time.Time) (net.Conn, error) {
+	return conn, nil
+}
+
+func tlsServerName(conn net.Conn) string { return "" }
+
+func tlsALPN(conn net.Conn) string { return "" }
+
+func isTLSConn(conn net.Conn) bool { return false }
+
+func isTLSAdapter(name string) bool { return false }
+
+type certMonitor struct {
+	warning time.Duration
+}
+
+func (lb *LoadBalancer) certificateStats() []CertificateStats { return nil }
+
+func (lb *LoadBalancer) watchCertificates() {}
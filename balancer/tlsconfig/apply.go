@@ -0,0 +1,104 @@
+//go:build !notls
+
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var curves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+}
+
+// Apply sets the policy on cfg. Unknown names and insecure cipher suites
+// are errors rather than being silently ignored.
+func (p Policy) Apply(cfg *tls.Config) error {
+	var errs []error
+
+	if p.MinVersion != "" {
+		v, err := parseVersion(p.MinVersion)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("min_version: %w", err))
+		}
+		cfg.MinVersion = v
+	}
+
+	if p.MaxVersion != "" {
+		v, err := parseVersion(p.MaxVersion)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("max_version: %w", err))
+		}
+		cfg.MaxVersion = v
+	}
+
+	if cfg.MinVersion != 0 && cfg.MaxVersion != 0 && cfg.MinVersion > cfg.MaxVersion {
+		errs = append(errs, errors.New("min_version is above max_version"))
+	}
+
+	if len(p.CipherSuites) > 0 {
+		cfg.CipherSuites = nil
+		for _, name := range p.CipherSuites {
+			id, err := parseCipher(name)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("cipher_suites: %w", err))
+				continue
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+
+	if len(p.Curves) > 0 {
+		cfg.CurvePreferences = nil
+		for _, name := range p.Curves {
+			id, ok := curves[strings.ToUpper(strings.ReplaceAll(name, "-", ""))]
+			if !ok {
+				errs = append(errs, fmt.Errorf("curves: unknown curve %q", name))
+				continue
+			}
+			cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Validate reports errors without changing anything.
+func (p Policy) Validate() error {
+	return p.Apply(&tls.Config{})
+}
+
+func parseVersion(s string) (uint16, error) {
+	v, ok := versions[strings.TrimPrefix(strings.ToUpper(s), "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", s)
+	}
+	return v, nil
+}
+
+func parseCipher(name string) (uint16, error) {
+	for _, c := range tls.CipherSuites() {
+		if c.Name == name {
+			return c.ID, nil
+		}
+	}
+	for _, c := range tls.InsecureCipherSuites() {
+		if c.Name == name {
+			return 0, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
@@ -0,0 +1,14 @@
+package tlsconfig
+
+// Policy is an organisational TLS baseline written with human-friendly
+// names, applied to both terminating listeners and backend dials.
+type Policy struct {
+	//MinVersion and MaxVersion are "1.0" to "1.3"; empty keeps Go's defaults
+	MinVersion string `json:"min_version"`
+	MaxVersion string `json:"max_version"`
+	//CipherSuites uses Go/IANA names such as TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256.
+	//They only affect TLS 1.2 and below; TLS 1.3 suites are not configurable.
+	CipherSuites []string `json:"cipher_suites"`
+	//Curves are X25519, P256, P384, P521 or X25519MLKEM768, in preference order
+	Curves []string `json:"curves"`
+}
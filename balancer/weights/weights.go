@@ -0,0 +1,229 @@
+package weights
+
+import (
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"loadbalancer/balancer/backend"
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/logging"
+)
+
+const (
+	DefaultInterval   = 10 * time.Second
+	DefaultDamping    = 0.3
+	DefaultMinFactor  = 0.1
+	DefaultMaxFactor  = 2
+	DefaultMinSamples = 5
+)
+
+// Policy tunes the feedback loop.
+type Policy struct {
+	//Interval is how often factors are adjusted
+	Interval time.Duration
+	//Damping is the fraction of the way to the target factor moved each
+	//round, from 0 to 1; lower is slower but steadier
+	Damping float64
+	//MinFactor and MaxFactor bound the learned factor
+	MinFactor float64
+	MaxFactor float64
+	//MinSamples is how many connections a backend needs in a round before
+	//it is judged; with fewer its factor drifts back towards 1
+	MinSamples int
+}
+
+func DefaultPolicy() Policy {
+	return Policy{
+		Interval:   DefaultInterval,
+		Damping:    DefaultDamping,
+		MinFactor:  DefaultMinFactor,
+		MaxFactor:  DefaultMaxFactor,
+		MinSamples: DefaultMinSamples,
+	}
+}
+
+func (p Policy) withDefaults() Policy {
+	def := DefaultPolicy()
+	if p.Interval <= 0 {
+		p.Interval = def.Interval
+	}
+	if p.Damping <= 0 || p.Damping > 1 {
+		p.Damping = def.Damping
+	}
+	if p.MinFactor <= 0 {
+		p.MinFactor = def.MinFactor
+	}
+	if p.MaxFactor <= 0 {
+		p.MaxFactor = def.MaxFactor
+	}
+	if p.MinSamples <= 0 {
+		p.MinSamples = def.MinSamples
+	}
+	return p
+}
+
+// Learner scales backend weights by how well each backend does compared to
+// the others: the factor follows connect latency inversely and drops
+// quadratically with the share of failed connects. Pinned backends are
+// left alone.
+type Learner struct {
+	clock  clock.Clock
+	policy Policy
+	//log is logging.Default unless SetLogger changed it
+	log *slog.Logger
+
+	mu      sync.Mutex
+	windows map[*backend.Backend]*window
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// window is what one backend did since the last round.
+type window struct {
+	attempts int
+	failures int
+	latency  time.Duration
+}
+
+func New(c clock.Clock, policy Policy) *Learner {
+	return &Learner{
+		clock:   c,
+		policy:  policy.withDefaults(),
+		log:     logging.Default(),
+		windows: make(map[*backend.Backend]*window),
+		stop:    make(chan struct{}),
+	}
+}
+
+func (l *Learner) Policy() Policy {
+	return l.policy
+}
+
+// Observe records one connect to b that took latency, failing with err.
+// It does nothing on a nil Learner.
+func (l *Learner) Observe(b *backend.Backend, latency time.Duration, err error) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	w := l.windows[b]
+	if w == nil {
+		w = &window{}
+		l.windows[b] = w
+	}
+	w.attempts++
+	if err != nil {
+		w.failures++
+		return
+	}
+	w.latency += latency
+}
+
+// SetLogger sends what the learner logs to log; call it before Run.
+func (l *Learner) SetLogger(log *slog.Logger) {
+	l.log = log
+}
+
+// Run adjusts the backends returned by targets once per interval until
+// Stop.
+func (l *Learner) Run(targets func() []*backend.Backend) {
+	ticker := l.clock.NewTicker(l.policy.Interval)
+	defer ticker.Stop()
+
+	l.log.Info("Weight learning started", "interval", l.policy.Interval)
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C():
+			l.Adjust(targets())
+		}
+	}
+}
+
+// Stop ends Run. It does nothing on a nil Learner.
+func (l *Learner) Stop() {
+	if l == nil {
+		return
+	}
+	l.stopOnce.Do(func() { close(l.stop) })
+}
+
+// Adjust runs one round: it moves each factor part of the way towards the
+// backend's score relative to the average score, then starts new windows.
+func (l *Learner) Adjust(backends []*backend.Backend) {
+	l.mu.Lock()
+	windows := l.windows
+	l.windows = make(map[*backend.Backend]*window)
+	l.mu.Unlock()
+
+	scores := make(map[*backend.Backend]float64, len(backends))
+	var total float64
+	for _, b := range backends {
+		w := windows[b]
+		if b.Pinned() || w == nil || w.attempts < l.policy.MinSamples {
+			continue
+		}
+		scores[b] = score(w)
+		total += scores[b]
+	}
+
+	//scores only mean something next to each other
+	judged := len(scores) >= 2 && total > 0
+
+	for _, b := range backends {
+		if b.Pinned() {
+			continue
+		}
+
+		target := 1.0
+		s, ok := scores[b]
+		if judged && ok {
+			target = s / (total / float64(len(scores)))
+		}
+		target = min(max(target, l.policy.MinFactor), l.policy.MaxFactor)
+
+		old := b.Factor()
+		f := old + l.policy.Damping*(target-old)
+		b.SetFactor(f)
+
+		if math.Abs(f-old) >= 0.05 {
+			w := windows[b]
+			if w != nil && w.attempts > 0 {
+				l.log.Info("Weight factor adjusted", "backend", b.Addr, "factor", math.Round(f*100)/100,
+					"connects", w.attempts, "failed", w.failures, "average", w.average())
+			} else {
+				l.log.Info("Weight factor adjusted, no traffic", "backend", b.Addr, "factor", math.Round(f*100)/100)
+			}
+		}
+	}
+}
+
+// score is higher for faster, more reliable backends; a backend whose
+// connects all failed scores zero.
+func score(w *window) float64 {
+	ok := w.attempts - w.failures
+	if ok == 0 {
+		return 0
+	}
+	success := float64(ok) / float64(w.attempts)
+	//a floor keeps a local backend connecting in microseconds from taking
+	//everything
+	latency := max(w.average().Seconds(), 0.001)
+	return success * success / latency
+}
+
+func (w *window) average() time.Duration {
+	ok := w.attempts - w.failures
+	if ok == 0 {
+		return 0
+	}
+	return w.latency / time.Duration(ok)
+}
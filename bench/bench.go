@@ -0,0 +1,346 @@
+package bench
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"loadbalancer/balancer"
+)
+
+// Config describes one benchmark run.
+type Config struct {
+	//Mode is "tcp" (echo through a TCP listener) or "http"
+	Mode        string
+	Backends    int
+	Concurrency int
+	Duration    time.Duration
+	//Size is the payload per request: echoed in tcp mode, the response body in http mode
+	Size int
+	//KeepAlive reuses one client connection per worker instead of a new one per request
+	KeepAlive bool
+	//Target benchmarks a running balancer instead of one started in-process;
+	//its backends must behave like Serve's (echo for tcp, any 200 for http)
+	Target string
+
+	//Acceptors and CopyBuffer tune the in-process balancer, see
+	//balancer.ListenerConfig and balancer.WithCopyBuffer
+	Acceptors  int
+	CopyBuffer int
+}
+
+func (c Config) withDefaults() Config {
+	if c.Mode == "" {
+		c.Mode = "tcp"
+	}
+	if c.Backends <= 0 {
+		c.Backends = 3
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 32
+	}
+	if c.Duration <= 0 {
+		c.Duration = 10 * time.Second
+	}
+	if c.Size <= 0 {
+		c.Size = 1024
+	}
+	return c
+}
+
+// Result is what a run measured. Allocations are for the whole process,
+// so they include the load generator and the dummy backends.
+type Result struct {
+	Config   Config
+	Requests uint64
+	Errors   uint64
+	Elapsed  time.Duration
+	Bytes    uint64
+
+	P50, P90, P99, Max time.Duration
+
+	AllocsPerRequest float64
+	BytesPerRequest  float64
+	GCCycles         uint32
+
+	GoroutinesPeak int
+	GoroutinesEnd  int
+}
+
+func (r Result) RequestsPerSecond() float64 {
+	return float64(r.Requests) / r.Elapsed.Seconds()
+}
+
+func (r Result) String() string {
+	var b strings.Builder
+	conns := "new connection per request"
+	if r.Config.KeepAlive {
+		conns = "keep-alive"
+	}
+	fmt.Fprintf(&b, "mode %s, %d backends, %d workers, %d byte payload, %s, GOMAXPROCS %d\n",
+		r.Config.Mode, r.Config.Backends, r.Config.Concurrency, r.Config.Size, conns, runtime.GOMAXPROCS(0))
+	fmt.Fprintf(&b, "requests:    %d in %s (%d errors)\n", r.Requests, r.Elapsed.Round(time.Millisecond), r.Errors)
+	fmt.Fprintf(&b, "throughput:  %.0f req/s, %.2f MB/s\n", r.RequestsPerSecond(), float64(r.Bytes)/r.Elapsed.Seconds()/1e6)
+	fmt.Fprintf(&b, "latency:     p50 %s  p90 %s  p99 %s  max %s\n", r.P50, r.P90, r.P99, r.Max)
+	fmt.Fprintf(&b, "allocations: %.1f allocs/req, %.0f B/req, %d GC cycles\n", r.AllocsPerRequest, r.BytesPerRequest, r.GCCycles)
+	fmt.Fprintf(&b, "goroutines:  peak %d, after run %d\n", r.GoroutinesPeak, r.GoroutinesEnd)
+	return b.String()
+}
+
+// Run starts dummy backends and a balancer in front of them, unless
+// cfg.Target is set, and drives traffic through it for cfg.Duration.
+func Run(cfg Config) (Result, error) {
+	cfg = cfg.withDefaults()
+	if cfg.Mode != "tcp" && cfg.Mode != "http" {
+		return Result{}, fmt.Errorf("unknown mode %q", cfg.Mode)
+	}
+
+	target := cfg.Target
+	if target == "" {
+		addr, stop, err := serve(cfg)
+		if err != nil {
+			return Result{}, err
+		}
+		defer stop()
+		target = addr
+	}
+
+	var requests, errs, bytes atomic.Uint64
+	latencies := make([][]time.Duration, cfg.Concurrency)
+
+	peak := 0
+	stopSampling := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			peak = max(peak, runtime.NumGoroutine())
+			select {
+			case <-ticker.C:
+			case <-stopSampling:
+				return
+			}
+		}
+	}()
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	start := time.Now()
+	deadline := start.Add(cfg.Duration)
+
+	var wg sync.WaitGroup
+	for i := range cfg.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := worker{cfg: cfg, target: target, payload: make([]byte, cfg.Size), buf: make([]byte, cfg.Size)}
+			defer w.close()
+
+			for time.Now().Before(deadline) {
+				t0 := time.Now()
+				n, err := w.request()
+				if err != nil {
+					errs.Add(1)
+					w.close()
+					continue
+				}
+				latencies[i] = append(latencies[i], time.Since(t0))
+				requests.Add(1)
+				bytes.Add(uint64(n))
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	close(stopSampling)
+	<-sampled
+
+	res := Result{
+		Config:         cfg,
+		Requests:       requests.Load(),
+		Errors:         errs.Load(),
+		Elapsed:        elapsed,
+		Bytes:          bytes.Load(),
+		GCCycles:       after.NumGC - before.NumGC,
+		GoroutinesPeak: peak,
+	}
+
+	all := slices.Concat(latencies...)
+	slices.Sort(all)
+	if len(all) > 0 {
+		res.P50 = all[len(all)*50/100]
+		res.P90 = all[len(all)*90/100]
+		res.P99 = all[len(all)*99/100]
+		res.Max = all[len(all)-1]
+	}
+	if res.Requests > 0 {
+		res.AllocsPerRequest = float64(after.Mallocs-before.Mallocs) / float64(res.Requests)
+		res.BytesPerRequest = float64(after.TotalAlloc-before.TotalAlloc) / float64(res.Requests)
+	}
+
+	//let connections from the run wind down before counting what is left
+	time.Sleep(200 * time.Millisecond)
+	res.GoroutinesEnd = runtime.NumGoroutine()
+
+	return res, nil
+}
+
+// serve starts the dummy backends and an in-process balancer and returns
+// the balancer's address.
+func serve(cfg Config) (string, func(), error) {
+	var listeners []net.Listener
+	stop := func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}
+
+	body := strings.Repeat("x", cfg.Size)
+	var addrs []string
+	for range cfg.Backends {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			stop()
+			return "", nil, err
+		}
+		listeners = append(listeners, ln)
+		addrs = append(addrs, ln.Addr().String())
+
+		if cfg.Mode == "http" {
+			go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, body)
+			}))
+		} else {
+			go echo(ln)
+		}
+	}
+
+	//the balancer logs every connection; keep that out of the measurement
+	lb, err := balancer.New(balancer.WithBackends(addrs...), balancer.WithCopyBuffer(cfg.CopyBuffer),
+		balancer.WithLogger(slog.New(slog.DiscardHandler)))
+	if err != nil {
+		stop()
+		return "", nil, err
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		stop()
+		return "", nil, err
+	}
+	listeners = append(listeners, ln)
+
+	mode := balancer.ModeTCP
+	if cfg.Mode == "http" {
+		mode = balancer.ModeHTTP
+	}
+
+	go lb.Serve(ln, balancer.ListenerConfig{Mode: mode, Acceptors: cfg.Acceptors})
+	return ln.Addr().String(), stop, nil
+}
+
+func echo(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// worker is one simulated client.
+type worker struct {
+	cfg     Config
+	target  string
+	payload []byte
+	buf     []byte
+
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func (w *worker) close() {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+}
+
+func (w *worker) request() (int, error) {
+	if w.conn == nil {
+		conn, err := net.Dial("tcp", w.target)
+		if err != nil {
+			return 0, err
+		}
+		w.conn = conn
+		//reuse the reader so the client side adds little to the allocations
+		if w.br == nil {
+			w.br = bufio.NewReader(conn)
+		} else {
+			w.br.Reset(conn)
+		}
+	}
+	if !w.cfg.KeepAlive {
+		defer w.close()
+	}
+	w.conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if w.cfg.Mode == "http" {
+		return w.httpRequest()
+	}
+
+	if _, err := w.conn.Write(w.payload); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(w.br, w.buf); err != nil {
+		return 0, err
+	}
+	return 2 * len(w.payload), nil
+}
+
+var errStatus = errors.New("unexpected status")
+
+func (w *worker) httpRequest() (int, error) {
+	req := "GET / HTTP/1.1\r\nHost: bench\r\n\r\n"
+	if !w.cfg.KeepAlive {
+		req = "GET / HTTP/1.1\r\nHost: bench\r\nConnection: close\r\n\r\n"
+	}
+	if _, err := io.WriteString(w.conn, req); err != nil {
+		return 0, err
+	}
+
+	resp, err := http.ReadResponse(w.br, nil)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, errStatus
+	}
+	return len(req) + int(n), nil
+}
@@ -0,0 +1,63 @@
+//go:build !nohttp
+
+package bench
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	for _, mode := range []string{"tcp", "http"} {
+		res, err := Run(Config{Mode: mode, Concurrency: 4, Duration: 100 * time.Millisecond})
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		if res.Requests == 0 || res.Errors > 0 {
+			t.Errorf("%s: %d requests, %d errors", mode, res.Requests, res.Errors)
+		}
+	}
+}
+
+// benchmarkRun runs cfg against a balancer and backends in the process,
+// for half a second per iteration, and reports what Run measured.
+func benchmarkRun(b *testing.B, cfg Config) {
+	cfg.Duration = 500 * time.Millisecond
+
+	var total Result
+	for b.Loop() {
+		res, err := Run(cfg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		total.Requests += res.Requests
+		total.Errors += res.Errors
+		total.Elapsed += res.Elapsed
+		total.AllocsPerRequest += res.AllocsPerRequest * float64(res.Requests)
+		total.P99 = max(total.P99, res.P99)
+	}
+	if total.Requests == 0 {
+		b.Fatal("no requests")
+	}
+
+	b.ReportMetric(total.RequestsPerSecond(), "req/s")
+	b.ReportMetric(total.AllocsPerRequest/float64(total.Requests), "allocs/req")
+	b.ReportMetric(float64(total.P99.Nanoseconds()), "p99-ns")
+	b.ReportMetric(float64(total.Errors), "errors")
+}
+
+func BenchmarkTCP(b *testing.B) {
+	benchmarkRun(b, Config{Mode: "tcp"})
+}
+
+func BenchmarkTCPKeepAlive(b *testing.B) {
+	benchmarkRun(b, Config{Mode: "tcp", KeepAlive: true})
+}
+
+func BenchmarkHTTP(b *testing.B) {
+	benchmarkRun(b, Config{Mode: "http"})
+}
+
+func BenchmarkHTTPKeepAlive(b *testing.B) {
+	benchmarkRun(b, Config{Mode: "http", KeepAlive: true})
+}
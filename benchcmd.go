@@ -0,0 +1,62 @@
+//go:build !nohttp
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+
+	"loadbalancer/bench"
+)
+
+// runBench implements "loadbalancer bench".
+func runBench(args []string) {
+	var cfg bench.Config
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	fs.StringVar(&cfg.Mode, "mode", "tcp", "tcp (echo) or http")
+	fs.IntVar(&cfg.Backends, "backends", 3, "dummy backends to start")
+	fs.IntVar(&cfg.Concurrency, "c", 32, "concurrent clients")
+	fs.DurationVar(&cfg.Duration, "d", 0, "duration of the run (default 10s)")
+	fs.IntVar(&cfg.Size, "size", 1024, "payload bytes per request")
+	fs.BoolVar(&cfg.KeepAlive, "keepalive", false, "reuse client connections instead of one per request")
+	fs.StringVar(&cfg.Target, "target", "", "benchmark a running balancer at this address instead")
+	fs.IntVar(&cfg.Acceptors, "acceptors", 1, "accept goroutines of the in-process balancer")
+	fs.IntVar(&cfg.CopyBuffer, "copy-buffer", 0, "tcp copy buffer per direction in bytes (default io.Copy's 32KB)")
+	procs := fs.Int("gomaxprocs", 0, "override GOMAXPROCS for the run")
+	memprofile := fs.String("memprofile", "", "write a heap profile to this file after the run")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: loadbalancer bench [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *procs > 0 {
+		runtime.GOMAXPROCS(*procs)
+	}
+
+	res, err := bench.Run(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Benchmark failed:", err)
+		os.Exit(1)
+	}
+	fmt.Print(res)
+
+	if *memprofile != "" {
+		if err := writeHeapProfile(*memprofile); err != nil {
+			fmt.Fprintln(os.Stderr, "Writing heap profile failed:", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pprof.WriteHeapProfile(f)
+}
@@ -0,0 +1,14 @@
+//go:build nohttp
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// runBench needs HTTP for its dummy backends and http mode.
+func runBench(args []string) {
+	fmt.Fprintln(os.Stderr, "bench is not built in (nohttp build tag)")
+	os.Exit(1)
+}
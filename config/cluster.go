@@ -0,0 +1,156 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"loadbalancer/balancer/affinity"
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/peer"
+	"loadbalancer/balancer/secrets"
+)
+
+// Cluster connects the instances over the peer protocol, authenticated by
+// a shared token and optionally mutual TLS. Fleet stats, sticky sessions
+// and HA use it when they set cluster: true.
+type Cluster struct {
+	//ID names this instance, default the hostname; unique per instance
+	ID     string   `json:"id"`
+	Listen string   `json:"listen"`
+	Peers  []string `json:"peers"`
+	//DNS finds the peers instead: "host:port" for every A/AAAA record of
+	//host or an SRV name such as "_lb-peer._tcp.example.org"
+	DNS string `json:"dns"`
+	//Token is a secret reference to the key shared by every instance
+	Token string `json:"token"`
+	//TLS adds mutual TLS with certificates signed by CA
+	TLS *ClusterTLS `json:"tls"`
+	//Interval between heartbeats, default 2s
+	Interval Duration `json:"interval"`
+}
+
+// ClusterTLS are secret references; every instance presents Cert and
+// accepts peers whose certificate chains to CA.
+type ClusterTLS struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	CA   string `json:"ca"`
+}
+
+func (c *Config) validateCluster() []error {
+	var errs []error
+	cl := c.Cluster
+	if cl == nil {
+		if f := c.Fleet; f != nil && f.Cluster {
+			errs = append(errs, errors.New("fleet: cluster requires a cluster section"))
+		}
+		if s := c.Sticky; s != nil && s.Cluster {
+			errs = append(errs, errors.New("sticky: cluster requires a cluster section"))
+		}
+		if h := c.HA; h != nil && h.Cluster {
+			errs = append(errs, errors.New("ha: cluster requires a cluster section"))
+		}
+		return errs
+	}
+
+	if cl.Token == "" {
+		errs = append(errs, errors.New("cluster: token is required"))
+	}
+	if len(cl.Peers) > 0 && cl.DNS != "" {
+		errs = append(errs, errors.New("cluster: set peers or dns, not both"))
+	}
+	for _, addr := range cl.Peers {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("cluster: peer %q: %w", addr, err))
+		}
+	}
+	if cl.Interval < 0 {
+		errs = append(errs, errors.New("cluster: interval must not be negative"))
+	}
+	if t := cl.TLS; t != nil && (t.Cert == "" || t.Key == "" || t.CA == "") {
+		errs = append(errs, errors.New("cluster.tls: cert, key and ca are required"))
+	}
+	return append(errs, validateClusterTLS(cl)...)
+}
+
+// node starts this instance's end of the cluster, logging to log.
+func (cl *Cluster) node(log *slog.Logger) (*peer.Node, error) {
+	token, err := secrets.LoadRef(cl.Token)
+	if err != nil {
+		return nil, err
+	}
+	cfg := peer.Config{
+		ID:        cl.ID,
+		Listen:    cl.Listen,
+		Discovery: peer.Static(cl.Peers),
+		Token:     token.Value(),
+		Interval:  time.Duration(cl.Interval),
+	}
+	if cl.DNS != "" {
+		cfg.Discovery = peer.DNS(cl.DNS)
+	}
+	if cl.TLS != nil {
+		if cfg.Upgrade, err = cl.TLS.upgrade(); err != nil {
+			return nil, err
+		}
+	}
+
+	node, err := peer.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	node.SetLogger(log)
+	go node.Run()
+	return node, nil
+}
+
+// kindAffinity are sticky table entries sent over the peer protocol
+const kindAffinity = "affinity"
+
+type affinityMessage struct {
+	Table   string           `json:"table"`
+	Entries []affinity.Entry `json:"entries"`
+}
+
+// shareTable replicates t under name over the cluster the way
+// affinity.Gossip does over UDP: changes right away, everything every 30s.
+func shareTable(node *peer.Node, name string, t *affinity.Table) {
+	node.Handle(kindAffinity, func(from string, body json.RawMessage) {
+		var msg affinityMessage
+		if json.Unmarshal(body, &msg) != nil || msg.Table != name {
+			return
+		}
+		for _, e := range msg.Entries {
+			t.Apply(e)
+		}
+	})
+
+	//sends run apart from the connections that set entries
+	changes := make(chan affinity.Entry, 1024)
+	t.OnSet(func(e affinity.Entry) {
+		select {
+		case changes <- e:
+		default:
+			//the full resend catches up
+		}
+	})
+
+	go func() {
+		ticker := clock.Real.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-node.Done():
+				return
+			case e := <-changes:
+				node.Broadcast(kindAffinity, affinityMessage{Table: name, Entries: []affinity.Entry{e}})
+			case <-ticker.C():
+				node.Broadcast(kindAffinity, affinityMessage{Table: name, Entries: t.Entries()})
+			}
+		}
+	}()
+}
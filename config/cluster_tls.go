@@ -0,0 +1,76 @@
+//go:build !notls
+
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+
+	"loadbalancer/balancer/secrets"
+)
+
+func validateClusterTLS(cl *Cluster) []error { return nil }
+
+// upgrade returns the mutual TLS wrapper of peer connections. Peers are
+// usually addressed by IP, so a certificate is accepted when it chains to
+// the CA, whatever names it carries.
+func (t *ClusterTLS) upgrade() (func(net.Conn, bool) (net.Conn, error), error) {
+	cert, err := secrets.LoadRef(t.Cert)
+	if err != nil {
+		return nil, err
+	}
+	key, err := secrets.LoadRef(t.Key)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair(cert.Value(), key.Value())
+	if err != nil {
+		return nil, err
+	}
+	ca, err := secrets.LoadRef(t.CA)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca.Value()) {
+		return nil, errors.New("cluster.tls: no certificates in ca")
+	}
+
+	verify := func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("peer sent no certificate")
+		}
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}
+		for _, c := range state.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(c)
+		}
+		_, err := state.PeerCertificates[0].Verify(opts)
+		return err
+	}
+	cfg := &tls.Config{
+		Certificates:       []tls.Certificate{pair},
+		MinVersion:         tls.VersionTLS12,
+		ClientAuth:         tls.RequireAnyClientCert,
+		InsecureSkipVerify: true, //verified by VerifyConnection
+		VerifyConnection:   verify,
+	}
+
+	return func(conn net.Conn, server bool) (net.Conn, error) {
+		var tc *tls.Conn
+		if server {
+			tc = tls.Server(conn, cfg)
+		} else {
+			tc = tls.Client(conn, cfg)
+		}
+		if err := tc.Handshake(); err != nil {
+			return nil, err
+		}
+		return tc, nil
+	}, nil
+}
@@ -0,0 +1,2515 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"loadbalancer/balancer"
+	"loadbalancer/balancer/acl"
+	"loadbalancer/balancer/affinity"
+	"loadbalancer/balancer/audit"
+	"loadbalancer/balancer/breaker"
+	"loadbalancer/balancer/capture"
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/election"
+	"loadbalancer/balancer/geoip"
+	"loadbalancer/balancer/health"
+	"loadbalancer/balancer/listener"
+	"loadbalancer/balancer/logging"
+	"loadbalancer/balancer/peer"
+	"loadbalancer/balancer/ratelimit"
+	"loadbalancer/balancer/replay"
+	"loadbalancer/balancer/resolve"
+	"loadbalancer/balancer/secrets"
+	"loadbalancer/balancer/sockopt"
+	"loadbalancer/balancer/statestore"
+	"loadbalancer/balancer/strategy"
+	"loadbalancer/balancer/tarpit"
+	"loadbalancer/balancer/tlsconfig"
+	"loadbalancer/balancer/weights"
+)
+
+const DefaultListen = ":8090"
+
+// Config is the parsed form of a balancer configuration. The binary and
+// library embedders both go through Build to get a LoadBalancer.
+type Config struct {
+	Listen   string   `json:"listen"`
+	Backends []string `json:"backends"`
+	Health   Health   `json:"health"`
+
+	//Addresses are more addresses for the listener, e.g. "[::]:8090" next
+	//to "0.0.0.0:8090"
+	Addresses []string `json:"addresses"`
+	//Network is "tcp" (default, dual stack on wildcard addresses), "tcp4"
+	//or "tcp6"
+	Network string `json:"network"`
+	//IPv6Prefix is the IPv6 network length counted as one client by rate
+	//limits, hashing and sticky sessions, default 64
+	IPv6Prefix int `json:"ipv6_prefix"`
+
+	//Allow and Deny are CIDR rules checked against clients of the listener
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+
+	GeoIP *GeoIP `json:"geoip"`
+
+	RateLimit *RateLimit `json:"rate_limit"`
+
+	//Tarpit holds refused clients open and answers them slowly
+	Tarpit *Tarpit `json:"tarpit"`
+
+	//HostLimits rate-limit per SNI name (tcp) or Host header (http)
+	HostLimits *HostLimits `json:"host_limits"`
+
+	//Transparent accepts connections redirected by TPROXY rules (Linux)
+	Transparent bool `json:"transparent"`
+
+	//Mode is "tcp" (default) or "http"
+	Mode string `json:"mode"`
+	TLS  *TLS   `json:"tls"`
+
+	//BackendTLS re-encrypts traffic to the backends
+	BackendTLS *BackendTLS `json:"backend_tls"`
+
+	//Log sets the level and format of the connection log lines
+	Log      *Log      `json:"log"`
+	AuditLog *AuditLog `json:"audit_log"`
+
+	//FailureLog records failed connections for "loadbalancer replay"
+	FailureLog *FailureLog `json:"failure_log"`
+
+	UnderAttack *UnderAttack `json:"under_attack"`
+
+	//Auth protects routes with basic-auth or API keys; needs mode "http"
+	Auth *Auth `json:"auth"`
+
+	//JWT requires bearer tokens on every request; needs mode "http"
+	JWT *JWT `json:"jwt"`
+
+	//Sticky pins each client IP to a backend, optionally shared with peers
+	Sticky *Sticky `json:"sticky"`
+
+	//StateFile keeps health and sticky sessions across restarts
+	StateFile string `json:"state_file"`
+	//StateInterval is how often the state file is written, default 30s
+	StateInterval Duration `json:"state_interval"`
+	//State keeps health, sticky sessions, open circuits and the config
+	//versions in a store, instead of StateFile
+	State *State `json:"state"`
+	//ShutdownReport is where the report of a graceful shutdown is written
+	ShutdownReport string `json:"shutdown_report"`
+
+	//HA runs this instance as one of an active-passive pair
+	HA *HA `json:"ha"`
+
+	//CertificateWarning flags certificates this close to expiry, default 30 days
+	CertificateWarning Duration `json:"certificate_warning"`
+
+	//Encryption tells where the key for ENC[...] values comes from
+	Encryption *Encryption `json:"encryption"`
+
+	//SecretsRefresh is how often secret references are re-fetched, default 1m
+	SecretsRefresh Duration `json:"secrets_refresh"`
+
+	//Tuning holds CPU and memory knobs for very high connection counts
+	Tuning *Tuning `json:"tuning"`
+
+	//Tenants are teams with their own listener, backends and quota
+	Tenants []Tenant `json:"tenants"`
+
+	//DNS answers queries for service names with healthy backend addresses
+	DNS *DNS `json:"dns"`
+
+	//Admin serves an HTTP API to list, add, drain and remove backends
+	Admin *Admin `json:"admin"`
+	//Debug shows the backend of each connection while the admin API has
+	//debugging on
+	Debug *Debug `json:"debug"`
+	//Metrics serves the stats in the Prometheus text format
+	Metrics *Metrics `json:"metrics"`
+
+	//Timeouts are the defaults for every pool and listener
+	Timeouts *Timeouts `json:"timeouts"`
+	//DialRetries are the other backends tried when a dial fails, default
+	//2, negative for none
+	DialRetries int `json:"dial_retries"`
+
+	//Capture tees a sample of connections to a pcap file or socket
+	Capture *Capture `json:"capture"`
+
+	//Strategy picks the backend for each connection, in every pool
+	Strategy *Strategy `json:"strategy"`
+
+	//WeightLearning scales backend weights by observed connect latency
+	//and failures
+	WeightLearning *WeightLearning `json:"weight_learning"`
+
+	//CircuitBreaker routes around backends whose requests keep failing
+	CircuitBreaker *CircuitBreaker `json:"circuit_breaker"`
+
+	//SlowStart ramps up the weight of backends returning to a pool
+	SlowStart *SlowStart `json:"slow_start"`
+
+	//ConnectionBudget caps the open connections and guarantees shares of
+	//them to the listener, routes and tenants
+	ConnectionBudget *ConnectionBudget `json:"connection_budget"`
+	//ConnectionLimit pauses accepting while that many connections are open
+	ConnectionLimit *ConnectionLimit `json:"connection_limit"`
+
+	//Rebalance ends the oldest connections of overloaded backends so that
+	//new backends get long-lived clients too
+	Rebalance *Rebalance `json:"rebalance"`
+
+	//DNSTracking tunes how often host name backends are re-resolved
+	DNSTracking *DNSTracking `json:"dns_tracking"`
+	//DNSCache tunes the cache backend host names are dialed through
+	DNSCache *DNSCache `json:"dns_cache"`
+
+	//Fleet shares stats with the other instances so one or all of them
+	//can show the load of the whole fleet
+	Fleet *Fleet `json:"fleet"`
+
+	//Cluster connects the instances over the authenticated peer protocol
+	//for the fleet, sticky and ha sections that set cluster: true
+	Cluster *Cluster `json:"cluster"`
+
+	//Drain calls webhooks when a drain of a backend or of the balancer
+	//starts and completes
+	Drain *Drain `json:"drain"`
+
+	//Tags are given to every connection on the listener, TagRules add
+	//more by client network or server name
+	Tags     []string  `json:"tags"`
+	TagRules []TagRule `json:"tag_rules"`
+	//TagLimits are budgets shared by all connections carrying a tag, on
+	//any listener
+	TagLimits map[string]TagLimit `json:"tag_limits"`
+
+	//Shedding refuses low-priority tags while the balancer is overloaded
+	Shedding *Shedding `json:"shedding"`
+
+	//Pools are named sets of backends next to the default one, for routes
+	//to send connections to; they share the strategy and timeouts
+	Pools map[string][]string `json:"pools"`
+	//Routes pick the pool of a connection by protocol, server name or
+	//ALPN, first match wins; the rest go to the default pool
+	Routes []Route `json:"routes"`
+	//Regions send the connections no route picked to the fastest healthy
+	//of several pools instead of the default pool
+	Regions *Regions `json:"regions"`
+
+	//Labels are metadata by backend address, such as a version
+	Labels map[string]map[string]string `json:"labels"`
+	//MaxBackendConnections caps the open connections by backend address;
+	//a full backend is skipped for the next one of its pool
+	MaxBackendConnections map[string]int `json:"max_backend_connections"`
+	//Standby keeps some of the backends in reserve until admitted
+	Standby *Standby `json:"standby"`
+	//Subsets send part of the default pool's traffic to the backends with
+	//some labels, by header or by a share of the clients
+	Subsets []Subset `json:"subsets"`
+
+	//source is the file Load read, kept as a config version
+	source []byte
+	//stop is Done of the balancer Build made, which ends the watchers
+	//started for it
+	stop <-chan struct{}
+	//log is what logger returns once set
+	log *slog.Logger
+}
+
+// logger is where the parts the config builds apart from the balancer
+// log: the balancer's own once Build made it, Log's or logging.Default
+// before that.
+func (c *Config) logger() *slog.Logger {
+	switch {
+	case c.log != nil:
+		return c.log
+	case c.Log != nil:
+		c.log = c.Log.logger()
+		return c.log
+	}
+	return logging.Default()
+}
+
+// Subset is part of the default pool picked by labels.
+type Subset struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	//Header of the first request, with one of Values if given; needs
+	//mode "http"
+	Header  string   `json:"header"`
+	Values  []string `json:"values"`
+	Percent float64  `json:"percent"`
+}
+
+func (c *Config) subsets() []balancer.Subset {
+	subsets := make([]balancer.Subset, 0, len(c.Subsets))
+	for _, s := range c.Subsets {
+		subsets = append(subsets, balancer.Subset{
+			Name:    s.Name,
+			Labels:  s.Labels,
+			Header:  s.Header,
+			Values:  s.Values,
+			Percent: s.Percent,
+		})
+	}
+	return subsets
+}
+
+// headerSubsets reports whether a subset looks at request headers.
+func (c *Config) headerSubsets() bool {
+	for _, s := range c.Subsets {
+		if s.Header != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) applyLabels(pool *balancer.Pool) {
+	for _, b := range pool.Backends() {
+		if labels, ok := c.Labels[b.Addr]; ok {
+			b.SetLabels(labels)
+		}
+		if n, ok := c.MaxBackendConnections[b.Addr]; ok {
+			b.SetMaxConnections(n)
+		}
+		if c.standby(b.Addr) {
+			b.SetStandby(true)
+		}
+	}
+}
+
+// Standby backends, of any pool or tenant, are health checked but get no
+// new connections until the admin API admits them or one of the triggers
+// does.
+type Standby struct {
+	Backends []string `json:"backends"`
+	//MinActive admits one per check while fewer regular backends of the
+	//pool are healthy
+	MinActive int `json:"min_active"`
+	//MaxLoad admits one per check while the backends in rotation average
+	//more open connections
+	MaxLoad int `json:"max_load"`
+	//Interval between checks, default the health interval
+	Interval Duration `json:"interval"`
+}
+
+func (c *Config) standby(addr string) bool {
+	return c.Standby != nil && slices.Contains(c.Standby.Backends, addr)
+}
+
+func (c *Config) validateStandby() []error {
+	s := c.Standby
+	if s == nil {
+		return nil
+	}
+	var errs []error
+	if s.MinActive < 0 || s.MaxLoad < 0 || s.Interval < 0 {
+		errs = append(errs, errors.New("standby: values must not be negative"))
+	}
+	for _, addr := range s.Backends {
+		known := slices.Contains(c.Backends, addr)
+		for _, addrs := range c.Pools {
+			known = known || slices.Contains(addrs, addr)
+		}
+		for _, t := range c.Tenants {
+			known = known || slices.Contains(t.Backends, addr)
+		}
+		if !known {
+			errs = append(errs, fmt.Errorf("standby: %s is not a backend", addr))
+		}
+	}
+	return errs
+}
+
+// Route sends the connections matching all of its criteria to Pool.
+type Route struct {
+	//Protocol is "tls", "http", "ssh" or "other"
+	Protocol string `json:"protocol"`
+	//ServerNames are SNI or Host names, "*.example.com" for subdomains
+	ServerNames []string `json:"server_names"`
+	//ALPN are protocols offered in the TLS ClientHello, such as "h2"
+	ALPN []string `json:"alpn"`
+	Pool string   `json:"pool"`
+	//BudgetShare guarantees the route that share of the connection budget
+	BudgetShare float64 `json:"budget_share"`
+}
+
+// Regions probes the connect latency of regional pools and fails over
+// between them; unset fields take the defaults of balancer.RegionFailover.
+type Regions struct {
+	//Pools are the regions, "default" naming the default pool
+	Pools      []string `json:"pools"`
+	Interval   Duration `json:"interval"`
+	Timeout    Duration `json:"timeout"`
+	MaxLatency Duration `json:"max_latency"`
+	Margin     float64  `json:"margin"`
+}
+
+func (r *Regions) failover() *balancer.RegionFailover {
+	if r == nil {
+		return nil
+	}
+	return &balancer.RegionFailover{
+		Pools:      r.Pools,
+		Interval:   time.Duration(r.Interval),
+		Timeout:    time.Duration(r.Timeout),
+		MaxLatency: time.Duration(r.MaxLatency),
+		Margin:     r.Margin,
+	}
+}
+
+func (c *Config) routes() []balancer.Route {
+	routes := make([]balancer.Route, 0, len(c.Routes))
+	for _, r := range c.Routes {
+		routes = append(routes, balancer.Route{
+			Protocol:    r.Protocol,
+			ServerNames: r.ServerNames,
+			ALPN:        r.ALPN,
+			Pool:        r.Pool,
+			BudgetShare: r.BudgetShare,
+		})
+	}
+	return routes
+}
+
+// TagRule tags the connections matching all of its criteria.
+type TagRule struct {
+	Tag string `json:"tag"`
+	//Sources are CIDRs or addresses of clients
+	Sources []string `json:"sources"`
+	//ServerNames are SNI or Host names, "*.example.com" for subdomains
+	ServerNames []string `json:"server_names"`
+}
+
+type TagLimit struct {
+	MaxConnections int `json:"max_connections"`
+	//Bandwidth is in bytes per second, both directions together
+	Bandwidth int64 `json:"bandwidth"`
+}
+
+func (c *Config) tagger() (balancer.TagFunc, error) {
+	if len(c.TagRules) == 0 {
+		return nil, nil
+	}
+
+	rules := make([]balancer.TagRule, 0, len(c.TagRules))
+	for _, tr := range c.TagRules {
+		rule := balancer.TagRule{Tag: tr.Tag, ServerNames: tr.ServerNames}
+		for _, src := range tr.Sources {
+			p, err := acl.ParsePrefix(src)
+			if err != nil {
+				return nil, fmt.Errorf("tag %s: %w", tr.Tag, err)
+			}
+			rule.Sources = append(rule.Sources, p)
+		}
+		rules = append(rules, rule)
+	}
+	return balancer.TagRules(rules...), nil
+}
+
+// needsHost reports whether some setting looks at the requested host.
+func (c *Config) needsHost() bool {
+	if c.HostLimits != nil {
+		return true
+	}
+	for _, tr := range c.TagRules {
+		if len(tr.ServerNames) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Strategy selects the balancing algorithm.
+type Strategy struct {
+	//Type is "round_robin" (default), "weighted_round_robin",
+	//"least_conn", "least_latency", "power_of_two", "consistent_hash",
+	//which keeps every client IP on one backend, or "bounded_hash", which
+	//hashes the client IP and caps each backend at load_factor times its
+	//share
+	Type       string  `json:"type"`
+	LoadFactor float64 `json:"load_factor"`
+	//Replicas is the average number of ring points per backend of the
+	//hashing strategies, default 100
+	Replicas int `json:"replicas"`
+	//Weights by backend address scale a backend's share in every strategy
+	//but round_robin; weight learning multiplies them by what it learned
+	Weights map[string]int `json:"weights"`
+	//Pinned weights by backend address are never adjusted by learning
+	Pinned map[string]int `json:"pinned"`
+}
+
+func (s *Strategy) build() strategy.Strategy {
+	if s == nil {
+		return strategy.NewRoundRobin()
+	}
+	switch s.Type {
+	case "bounded_hash":
+		h := strategy.NewBoundedHash(s.LoadFactor)
+		h.Replicas = s.Replicas
+		return h
+	case "consistent_hash":
+		return strategy.NewConsistentHash(s.Replicas)
+	case "least_conn":
+		return strategy.NewLeastConn()
+	case "power_of_two":
+		return strategy.NewPowerOfTwo()
+	case "least_latency":
+		return strategy.NewLeastLatency()
+	case "weighted_round_robin":
+		return strategy.NewWeightedRoundRobin()
+	}
+	return strategy.NewRoundRobin()
+}
+
+// apply sets the strategy and the weights of pool's backends.
+func (s *Strategy) apply(pool *balancer.Pool) {
+	pool.SetStrategy(s.build())
+	s.weights(pool)
+}
+
+// weights sets the weights and pins of pool's backends.
+func (s *Strategy) weights(pool *balancer.Pool) {
+	if s == nil {
+		return
+	}
+	for _, b := range pool.Backends() {
+		if w, ok := s.Weights[b.Addr]; ok {
+			b.SetWeight(w)
+		}
+		if w, ok := s.Pinned[b.Addr]; ok {
+			b.Pin(w)
+		}
+	}
+}
+
+// WeightLearning tunes the feedback loop; unset fields take the defaults
+// of weights.DefaultPolicy.
+type WeightLearning struct {
+	Interval   Duration `json:"interval"`
+	Damping    float64  `json:"damping"`
+	MinFactor  float64  `json:"min_factor"`
+	MaxFactor  float64  `json:"max_factor"`
+	MinSamples int      `json:"min_samples"`
+}
+
+// CircuitBreaker opens a backend's circuit after failures in a row or an
+// error rate, at least one of which must be set; unset fields take the
+// defaults of breaker.DefaultPolicy.
+type CircuitBreaker struct {
+	Failures    int      `json:"failures"`
+	ErrorRate   float64  `json:"error_rate"`
+	MinRequests int      `json:"min_requests"`
+	Window      Duration `json:"window"`
+	Cooldown    Duration `json:"cooldown"`
+	Trials      int      `json:"trials"`
+}
+
+// ConnectionLimit caps the open connections by holding back accepts; after
+// Wait, if set, new ones are closed at once until a connection ends.
+type ConnectionLimit struct {
+	Max  int      `json:"max"`
+	Wait Duration `json:"wait"`
+}
+
+// ConnectionBudget is the most connections open at once, and the share of
+// them guaranteed to the main listener's connections no route with a
+// share of its own took.
+type ConnectionBudget struct {
+	Max   int     `json:"max"`
+	Share float64 `json:"share"`
+}
+
+// SlowStart tunes the ramp; unset fields take the defaults of
+// balancer.SlowStartPolicy.
+type SlowStart struct {
+	Window Duration `json:"window"`
+	//From is the share of its weight a backend starts at
+	From float64 `json:"from"`
+}
+
+// Rebalance tunes connection rebalancing; unset fields take the defaults
+// of balancer.RebalancePolicy.
+type Rebalance struct {
+	Interval    Duration `json:"interval"`
+	Threshold   float64  `json:"threshold"`
+	MaxPerRound int      `json:"max_per_round"`
+	MinAge      Duration `json:"min_age"`
+	Grace       Duration `json:"grace"`
+}
+
+// DNSTracking paces the re-resolution of backends given by host name, so
+// the stats show what they resolve to and when that last changed.
+type DNSTracking struct {
+	//Interval applies when the TTL is unknown, default 30s
+	Interval Duration `json:"interval"`
+	//MinInterval and MaxInterval bound the TTL, default 5s and 5m
+	MinInterval Duration `json:"min_interval"`
+	MaxInterval Duration `json:"max_interval"`
+	//History is how many changes are kept per host, default 10
+	History int `json:"history"`
+}
+
+// DNSCache keeps answers for their TTL, failures for NegativeTTL, and
+// serves answers up to Stale past their TTL while refreshing them.
+type DNSCache struct {
+	//TTL applies when the answer's is unknown, default 30s
+	TTL Duration `json:"ttl"`
+	//MinTTL and MaxTTL bound the TTL, default 1s and 5m
+	MinTTL Duration `json:"min_ttl"`
+	MaxTTL Duration `json:"max_ttl"`
+	//NegativeTTL default 5s, Stale default 1m
+	NegativeTTL Duration `json:"negative_ttl"`
+	Stale       Duration `json:"stale"`
+}
+
+// Fleet pushes this instance's stats to peers and, with Listen, collects
+// theirs.
+type Fleet struct {
+	//Instance names this instance, default the hostname
+	Instance string   `json:"instance"`
+	Listen   string   `json:"listen"`
+	Peers    []string `json:"peers"`
+	//Secret is a secret reference to the key signing the summaries
+	Secret   string   `json:"secret"`
+	Interval Duration `json:"interval"`
+	Expiry   Duration `json:"expiry"`
+	//Cluster sends the summaries over the cluster instead of Listen and Peers
+	Cluster bool `json:"cluster"`
+}
+
+func (f *Fleet) policy(node *peer.Node) (balancer.FleetPolicy, error) {
+	if f.Cluster {
+		return balancer.FleetPolicy{
+			Instance: f.Instance,
+			Interval: time.Duration(f.Interval),
+			Expiry:   time.Duration(f.Expiry),
+			Cluster:  node,
+		}, nil
+	}
+	secret, err := secrets.LoadRef(f.Secret)
+	if err != nil {
+		return balancer.FleetPolicy{}, err
+	}
+	return balancer.FleetPolicy{
+		Instance: f.Instance,
+		Listen:   f.Listen,
+		Peers:    f.Peers,
+		Interval: time.Duration(f.Interval),
+		Expiry:   time.Duration(f.Expiry),
+		Secret:   secret.Value(),
+	}, nil
+}
+
+// Drain configures drains, started by SIGUSR2 for the whole balancer.
+type Drain struct {
+	//Webhooks get every drain event as a JSON POST
+	Webhooks []string `json:"webhooks"`
+	//Timeout gives up waiting for connections, default never
+	Timeout Duration `json:"timeout"`
+}
+
+// Capture writes sampled traffic between the balancer and the backends in
+// pcap format. Set one of File and Socket.
+type Capture struct {
+	//File is overwritten when the balancer starts
+	File string `json:"file"`
+	//Socket is "host:port" or a unix socket path
+	Socket string `json:"socket"`
+	//Sample is the fraction of connections captured, default 1
+	Sample       float64 `json:"sample"`
+	MaxConnBytes int     `json:"max_conn_bytes"`
+	MaxBytes     int64   `json:"max_bytes"`
+	//RedactHeaders masks these HTTP headers, e.g. ["Authorization", "Cookie"]
+	RedactHeaders []string `json:"redact_headers"`
+}
+
+func (c *Capture) capturer(log *slog.Logger) (*capture.Capturer, error) {
+	var sink io.Writer
+	switch {
+	case c.File != "":
+		f, err := os.Create(c.File)
+		if err != nil {
+			return nil, err
+		}
+		sink = f
+	case strings.HasPrefix(c.Socket, "/"):
+		sink = capture.Dial("unix", c.Socket)
+	default:
+		sink = capture.Dial("tcp", c.Socket)
+	}
+
+	cfg := capture.Config{
+		Sample:       c.Sample,
+		MaxConnBytes: c.MaxConnBytes,
+		MaxBytes:     c.MaxBytes,
+	}
+	if cfg.Sample == 0 {
+		cfg.Sample = 1
+	}
+	if len(c.RedactHeaders) > 0 {
+		cfg.Redact = capture.RedactHeaders(c.RedactHeaders...)
+	}
+	capturer := capture.New(cfg, sink)
+	capturer.SetLogger(log)
+	return capturer, nil
+}
+
+// Timeouts of proxied connections. Unset fields are inherited; a negative
+// duration such as "-1s" turns one off.
+type Timeouts struct {
+	Dial       Duration `json:"dial"`
+	Idle       Duration `json:"idle"`
+	Total      Duration `json:"total"`
+	HeaderRead Duration `json:"header_read"`
+	Write      Duration `json:"write"`
+	FirstByte  Duration `json:"first_byte"`
+}
+
+func (t *Timeouts) policy() balancer.Timeouts {
+	if t == nil {
+		return balancer.Timeouts{}
+	}
+	return balancer.Timeouts{
+		Dial:       time.Duration(t.Dial),
+		Idle:       time.Duration(t.Idle),
+		Total:      time.Duration(t.Total),
+		HeaderRead: time.Duration(t.HeaderRead),
+		Write:      time.Duration(t.Write),
+		FirstByte:  time.Duration(t.FirstByte),
+	}
+}
+
+// DNS serves the backends by name for clients that balance themselves.
+type DNS struct {
+	//Listen is the UDP address, e.g. ":53"
+	Listen string `json:"listen"`
+	//Services maps names to pools: "default", or "<tenant>/default"
+	Services map[string]string `json:"services"`
+	//TTL of the answers, default 5s
+	TTL        Duration `json:"ttl"`
+	MaxAnswers int      `json:"max_answers"`
+}
+
+// Admin is the admin HTTP API. Tokens are secret references.
+type Admin struct {
+	//Listen is the TCP address, e.g. "127.0.0.1:9090"
+	Listen string `json:"listen"`
+	//Token may manage every pool, TenantTokens by tenant name only the
+	//tenant's
+	Token        string            `json:"token"`
+	TenantTokens map[string]string `json:"tenant_tokens"`
+	//Registration lets backends add themselves
+	Registration *Registration `json:"registration"`
+}
+
+// State picks the store of the runtime state: Dir for a single instance,
+// Redis for state that outlives the host.
+type State struct {
+	//Dir keeps each kind of state in a file of its own
+	Dir   string      `json:"dir"`
+	Redis *StateRedis `json:"redis"`
+	//Interval is how often the state is saved, default 30s
+	Interval Duration `json:"interval"`
+}
+
+type StateRedis struct {
+	Addr string `json:"addr"`
+	//Password is a secret reference
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	//Prefix goes before every key, default "loadbalancer:"; instances
+	//sharing a server need their own
+	Prefix string `json:"prefix"`
+}
+
+func (s *State) store() (balancer.StateStore, error) {
+	if s.Dir != "" {
+		return statestore.Dir{Path: s.Dir}, nil
+	}
+	r := statestore.Redis{Addr: s.Redis.Addr, DB: s.Redis.DB, Prefix: s.Redis.Prefix}
+	if s.Redis.Password != "" {
+		password, err := secrets.LoadRef(s.Redis.Password)
+		if err != nil {
+			return nil, fmt.Errorf("redis: password: %w", err)
+		}
+		r.Password = password.String()
+	}
+	return r, nil
+}
+
+// recordVersion keeps the file c was loaded from as a config version.
+func (c *Config) recordVersion(lb *balancer.LoadBalancer) {
+	if c.State == nil || c.source == nil {
+		return
+	}
+	if _, err := lb.RecordConfig(c.source); err != nil {
+		lb.Logger().Warn("Keeping the config version failed", "error", err)
+	}
+}
+
+// Metrics is the Prometheus endpoint, serving /metrics.
+type Metrics struct {
+	//Listen is the TCP address, e.g. "127.0.0.1:9100"
+	Listen string `json:"listen"`
+}
+
+// Registration lets backends join their pool with Token and stay while
+// they renew within TTL.
+type Registration struct {
+	//Token is a secret reference that only registers backends, from
+	//their own address
+	Token string `json:"token"`
+	//TTL defaults to 30s
+	TTL Duration `json:"ttl"`
+	//Pools backends may join, default only the default pool
+	Pools []string `json:"pools"`
+}
+
+func (a *Admin) config() (balancer.AdminConfig, error) {
+	cfg := balancer.AdminConfig{Address: a.Listen}
+	if a.Token != "" {
+		token, err := secrets.LoadRef(a.Token)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Token = token.Value()
+	}
+	if r := a.Registration; r != nil && r.Token != "" {
+		token, err := secrets.LoadRef(r.Token)
+		if err != nil {
+			return cfg, fmt.Errorf("registration: %w", err)
+		}
+		cfg.RegisterToken = token.Value()
+	}
+	for name, ref := range a.TenantTokens {
+		token, err := secrets.LoadRef(ref)
+		if err != nil {
+			return cfg, fmt.Errorf("tenant %s: %w", name, err)
+		}
+		if cfg.TenantTokens == nil {
+			cfg.TenantTokens = make(map[string][]byte)
+		}
+		cfg.TenantTokens[name] = token.Value()
+	}
+	return cfg, nil
+}
+
+// Debug names the response header that carries the backend in HTTP mode.
+type Debug struct {
+	//Header defaults to X-Backend
+	Header string `json:"header"`
+	//On starts with debugging on rather than waiting for the admin API
+	On bool `json:"on"`
+}
+
+// Tenant is one team on a shared deployment. Its listener reaches only its
+// own backends, and its quota counts across everything it owns.
+type Tenant struct {
+	Name     string   `json:"name"`
+	Listen   string   `json:"listen"`
+	Backends []string `json:"backends"`
+
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+	//RateLimit limits each client IP, like the top-level setting
+	RateLimit *RateLimit `json:"rate_limit"`
+
+	//MaxConnections caps the tenant's open connections
+	MaxConnections int `json:"max_connections"`
+	//ConnRate caps the tenant's new connections per second
+	ConnRate  float64 `json:"conn_rate"`
+	ConnBurst int     `json:"conn_burst"`
+
+	//Timeouts override the top-level ones for the tenant's pool
+	Timeouts *Timeouts `json:"timeouts"`
+
+	//Tags are given to the tenant's connections besides "tenant:<name>"
+	Tags []string `json:"tags"`
+
+	//BudgetShare guarantees the tenant's listener that share of the
+	//connection budget
+	BudgetShare float64 `json:"budget_share"`
+}
+
+// Tuning settings are all optional; zero keeps the default.
+type Tuning struct {
+	//GOMAXPROCS overrides the number of processors Go schedules on
+	GOMAXPROCS int `json:"gomaxprocs"`
+	//Acceptors is the number of goroutines accepting on the listener
+	Acceptors int `json:"acceptors"`
+	//CPUs pins the accept goroutines to these processors (Linux only)
+	CPUs []int `json:"cpus"`
+	//CopyBuffer is the per-direction copy buffer of tcp connections in bytes
+	CopyBuffer int `json:"copy_buffer"`
+	//ReusePort gives each acceptor its own SO_REUSEPORT socket
+	ReusePort bool `json:"reuse_port"`
+}
+
+type RateLimit struct {
+	//Rate is new connections per second per client IP
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+
+	BanAfter    int      `json:"ban_after"`
+	BanWindow   Duration `json:"ban_window"`
+	BanDuration Duration `json:"ban_duration"`
+	MaxBan      Duration `json:"max_ban"`
+
+	//MaxConnections caps the connections each client IP holds open at once
+	MaxConnections int `json:"max_connections"`
+}
+
+func (rl *RateLimit) validate() error {
+	switch {
+	case rl.Rate < 0 || rl.MaxConnections < 0:
+		return errors.New("rate and max_connections must not be negative")
+	case rl.Rate == 0 && rl.MaxConnections == 0:
+		return errors.New("rate or max_connections is required")
+	}
+	return nil
+}
+
+func (rl *RateLimit) limiter(ipv6Prefix int) *ratelimit.Limiter {
+	return ratelimit.New(ratelimit.Config{
+		Rate:        rl.Rate,
+		Burst:       rl.Burst,
+		BanAfter:    rl.BanAfter,
+		BanWindow:   time.Duration(rl.BanWindow),
+		BanDuration: time.Duration(rl.BanDuration),
+		MaxBan:      time.Duration(rl.MaxBan),
+		IPv6Prefix:  ipv6Prefix,
+
+		MaxConns: rl.MaxConnections,
+	}, clock.Real)
+}
+
+type Sticky struct {
+	//TTL an idle client stays pinned, default 30m
+	TTL    Duration `json:"ttl"`
+	Gossip *Gossip  `json:"gossip"`
+	//Cluster replicates the table over the cluster instead of Gossip
+	Cluster bool `json:"cluster"`
+}
+
+// Gossip replicates the sticky table to the other instances in front of the
+// same backends.
+type Gossip struct {
+	Listen string   `json:"listen"`
+	Peers  []string `json:"peers"`
+	//Secret is a secret reference to the key authenticating updates
+	Secret string `json:"secret"`
+}
+
+// table builds the sticky table, replicated until stop is closed.
+func (s *Sticky) table(node *peer.Node, stop <-chan struct{}, log *slog.Logger) (*affinity.Table, error) {
+	ttl := time.Duration(s.TTL)
+	if ttl <= 0 {
+		ttl = 30 * time.Minute
+	}
+	table := affinity.NewTable(ttl, clock.Real)
+
+	if s.Cluster {
+		shareTable(node, balancer.DefaultPool, table)
+		return table, nil
+	}
+	if s.Gossip == nil {
+		return table, nil
+	}
+
+	secret, err := secrets.LoadRef(s.Gossip.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("gossip: %w", err)
+	}
+	g, err := affinity.NewGossip(s.Gossip.Listen, s.Gossip.Peers, secret.Value(), clock.Real)
+	if err != nil {
+		return nil, err
+	}
+	g.SetLogger(log)
+	g.Attach(balancer.DefaultPool, table)
+	go g.Run()
+	go func() {
+		<-stop
+		g.Close()
+	}()
+
+	return table, nil
+}
+
+// HA elects one leader among instances; only the leader binds the
+// listener.
+type HA struct {
+	//ID names this instance, default the hostname
+	ID string `json:"id"`
+	//TTL of leadership; the standby takes over within about 4/3 of it, default 10s
+	TTL Duration `json:"ttl"`
+
+	//exactly one of LeaseFile, Etcd, StateFile and Cluster picks the
+	//election backend; with Cluster, ID is the cluster's
+	LeaseFile string  `json:"lease_file"`
+	Etcd      *HAEtcd `json:"etcd"`
+	StateFile string  `json:"state_file"`
+	Cluster   bool    `json:"cluster"`
+
+	//OnElected and OnDemoted are commands run on transitions
+	OnElected []string `json:"on_elected"`
+	OnDemoted []string `json:"on_demoted"`
+}
+
+type HAEtcd struct {
+	Endpoints []string `json:"endpoints"`
+	Key       string   `json:"key"`
+}
+
+func (h *HA) backend(node *peer.Node) election.Backend {
+	switch {
+	case h.Cluster:
+		return peer.Election{Node: node}
+	case h.Etcd != nil:
+		return etcdBackend(h.Etcd)
+	case h.StateFile != "":
+		return election.StateFile{Path: h.StateFile}
+	default:
+		return &election.LeaseFile{Path: h.LeaseFile, Clock: clock.Real}
+	}
+}
+
+type Tarpit struct {
+	Hold     Duration `json:"hold"`
+	Interval Duration `json:"interval"`
+	Max      int      `json:"max"`
+}
+
+type HostLimits struct {
+	//Default is shared by every host without its own entry
+	Default HostLimit            `json:"default"`
+	Hosts   map[string]HostLimit `json:"hosts"`
+}
+
+type HostLimit struct {
+	ConnRate     float64 `json:"conn_rate"`
+	ConnBurst    int     `json:"conn_burst"`
+	RequestRate  float64 `json:"request_rate"`
+	RequestBurst int     `json:"request_burst"`
+}
+
+func (h HostLimit) config() ratelimit.HostConfig {
+	return ratelimit.HostConfig{
+		ConnRate:     h.ConnRate,
+		ConnBurst:    h.ConnBurst,
+		RequestRate:  h.RequestRate,
+		RequestBurst: h.RequestBurst,
+	}
+}
+
+func (h *HostLimits) limiter() *ratelimit.HostLimiter {
+	hosts := make(map[string]ratelimit.HostConfig, len(h.Hosts))
+	for name, limit := range h.Hosts {
+		hosts[name] = limit.config()
+	}
+	return ratelimit.NewHostLimiter(hosts, h.Default.config(), clock.Real)
+}
+
+// UnderAttack overrides the defaults of the under-attack posture; zero
+// fields keep the default.
+type UnderAttack struct {
+	AcceptRate       float64  `json:"accept_rate"`
+	HandshakeTimeout Duration `json:"handshake_timeout"`
+	IdleTimeout      Duration `json:"idle_timeout"`
+	PerIPRate        float64  `json:"per_ip_rate"`
+	PerIPBurst       int      `json:"per_ip_burst"`
+	Duration         Duration `json:"duration"`
+}
+
+func (u *UnderAttack) policy() balancer.UnderAttackPolicy {
+	p := balancer.DefaultUnderAttackPolicy()
+	if u == nil {
+		return p
+	}
+	if u.AcceptRate > 0 {
+		p.AcceptRate = u.AcceptRate
+	}
+	if u.HandshakeTimeout > 0 {
+		p.HandshakeTimeout = time.Duration(u.HandshakeTimeout)
+	}
+	if u.IdleTimeout > 0 {
+		p.IdleTimeout = time.Duration(u.IdleTimeout)
+	}
+	if u.PerIPRate > 0 {
+		p.PerIP.Rate = u.PerIPRate
+	}
+	if u.PerIPBurst > 0 {
+		p.PerIP.Burst = u.PerIPBurst
+	}
+	if u.Duration > 0 {
+		p.Duration = time.Duration(u.Duration)
+	}
+	return p
+}
+
+// Shedding thresholds; a zero one ignores its signal.
+type Shedding struct {
+	Interval         Duration `json:"interval"`
+	MaxGoroutines    int      `json:"max_goroutines"`
+	MaxAcceptLatency Duration `json:"max_accept_latency"`
+	//MaxMemory is in bytes of Go heap
+	MaxMemory uint64 `json:"max_memory"`
+	//Priorities by tag; untagged connections have 0
+	Priorities   map[string]int `json:"priorities"`
+	RecoverAfter int            `json:"recover_after"`
+
+	//Background pauses the named background tasks with the traffic of
+	//their priority, see balancer.BackgroundTasks
+	Background     map[string]int `json:"background"`
+	HealthSlowdown int            `json:"health_slowdown"`
+}
+
+func (s *Shedding) policy() balancer.ShedPolicy {
+	return balancer.ShedPolicy{
+		Interval:         time.Duration(s.Interval),
+		MaxGoroutines:    s.MaxGoroutines,
+		MaxAcceptLatency: time.Duration(s.MaxAcceptLatency),
+		MaxMemory:        s.MaxMemory,
+		Priorities:       s.Priorities,
+		RecoverAfter:     s.RecoverAfter,
+
+		Background:     s.Background,
+		HealthSlowdown: s.HealthSlowdown,
+	}
+}
+
+type Auth struct {
+	//Credentials is a secret reference to the credentials file
+	Credentials string      `json:"credentials"`
+	Routes      []AuthRoute `json:"routes"`
+}
+
+type AuthRoute struct {
+	Host       string   `json:"host"`
+	PathPrefix string   `json:"path_prefix"`
+	Basic      bool     `json:"basic"`
+	Realm      string   `json:"realm"`
+	APIKey     bool     `json:"api_key"`
+	Header     string   `json:"header"`
+	Users      []string `json:"users"`
+}
+
+type JWT struct {
+	JWKSURL  string `json:"jwks_url"`
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	//Algorithms defaults to every supported asymmetric algorithm
+	Algorithms []string `json:"algorithms"`
+	Leeway     Duration `json:"leeway"`
+	//CacheTTL is used when the JWKS response carries no max-age, default 1h
+	CacheTTL Duration `json:"cache_ttl"`
+	Optional bool     `json:"optional"`
+	//ClaimHeaders maps claim names to headers forwarded to the backends
+	ClaimHeaders map[string]string `json:"claim_headers"`
+}
+
+type Log struct {
+	//Level is debug, info, warn or error, default info; debug adds a line
+	//with the duration of every connection
+	Level string `json:"level"`
+	//Format is plain, the default, or text or json for log/slog's
+	//key=value and JSON records, all on stdout
+	Format string `json:"format"`
+}
+
+func (l *Log) logger() *slog.Logger {
+	var level slog.Level
+	level.UnmarshalText([]byte(l.Level))
+	switch l.Format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+	}
+	return slog.New(balancer.PlainLogHandler(os.Stdout, level))
+}
+
+type AuditLog struct {
+	//Path is appended to; "-" writes to stdout
+	Path string `json:"path"`
+	//Burst events per second are written in full, then one in SampleRate
+	Burst      int `json:"burst"`
+	SampleRate int `json:"sample_rate"`
+}
+
+type FailureLog struct {
+	//Path is appended to; "-" writes to stdout
+	Path string `json:"path"`
+	//Window is how long after the start failures are recorded, default 1h
+	Window Duration `json:"window"`
+}
+
+type TLS struct {
+	//Cert and Key are secret references: a path, file:, env: or vault:
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	//ClientCA, when set, requires clients to present a certificate signed
+	//by one of its CAs. It is a secret reference, also https:, and is
+	//reloaded when it changes.
+	ClientCA string `json:"client_ca"`
+
+	tlsconfig.Policy
+}
+
+type BackendTLS struct {
+	//CA verifies backend certificates; empty uses the system roots. Like
+	//ClientCA it is a reloaded secret reference.
+	CA         string `json:"ca"`
+	ServerName string `json:"server_name"`
+
+	//SPIFFE switches to mutual TLS with SPIFFE identities instead of CA/hostname checks
+	SPIFFE *SPIFFE `json:"spiffe"`
+
+	//Backends override the settings by backend address, for certificates
+	//that don't match the address dialed
+	Backends map[string]BackendTLSOverride `json:"backends"`
+
+	tlsconfig.Policy
+}
+
+// BackendTLSOverride is the TLS of one backend; empty fields keep those
+// of backend_tls.
+type BackendTLSOverride struct {
+	ServerName string   `json:"server_name"`
+	ALPN       []string `json:"alpn"`
+	//CA verifies this backend instead of backend_tls.ca, a reloaded secret
+	//reference
+	CA string `json:"ca"`
+}
+
+// SPIFFE points at the SVID files the SPIRE agent or spiffe-helper keeps
+// rotated; each is a secret reference.
+type SPIFFE struct {
+	Cert   string `json:"cert"`
+	Key    string `json:"key"`
+	Bundle string `json:"bundle"`
+
+	//Backends must present one of IDs, or any ID in TrustDomain
+	IDs         []string `json:"ids"`
+	TrustDomain string   `json:"trust_domain"`
+}
+
+type GeoIP struct {
+	//Database is a CSV file of network,country,asn,org lines
+	Database string `json:"database"`
+	//ReloadInterval is how often the file is checked for changes, default 1m
+	ReloadInterval Duration `json:"reload_interval"`
+
+	AllowCountries []string `json:"allow_countries"`
+	DenyCountries  []string `json:"deny_countries"`
+	DenyASNs       []uint32 `json:"deny_asns"`
+}
+
+type Health struct {
+	//Interval between checks, default 10s, and the Timeout of each, default 2s
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+	//Type of check: "tcp" (default) connects, "tls" also completes a
+	//TLS handshake, "http" sends a GET and wants a 2xx or 3xx
+	Type string `json:"type"`
+	//Path and Status are the request and the one healthy status of type
+	//"http", default "/" and any 2xx or 3xx
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	//MinHealthy backends per pool stay in rotation even when their checks
+	//fail, in case the check itself is broken
+	MinHealthy int `json:"min_healthy"`
+	//Rise passing checks in a row mark a backend up, Fall failing ones
+	//down, default 1
+	Rise int `json:"rise"`
+	Fall int `json:"fall"`
+	//Passive marks a backend down once that many connections to it failed
+	//in a row, without waiting for the next check
+	Passive int `json:"passive"`
+	//External disables the built-in checker; health is pushed with SetBackendHealth
+	External bool `json:"external"`
+	//Gate combines the checks with the health a discovery source reports:
+	//"local" (default), "and", "or" or "prefer_local"
+	Gate string `json:"gate"`
+	//GoingAway is the endpoint backends announce their shutdown on; they
+	//are drained until it answers otherwise
+	GoingAway *GoingAway `json:"going_away"`
+}
+
+type GoingAway struct {
+	//Path is requested with HTTP GET, e.g. "/status"
+	Path string `json:"path"`
+	//Status and Body, when set, both have to match, e.g. 503 or "draining"
+	Status int    `json:"status"`
+	Body   string `json:"body"`
+}
+
+// probe returns the check of every backend, nil for the default.
+func (h Health) probe() health.Probe {
+	if h.GoingAway == nil && h.Type == "" {
+		return nil
+	}
+	check := health.Type(h.Type).Probe()
+	if health.Type(h.Type) == health.TypeHTTP {
+		check = health.HTTP{Path: h.Path, Status: h.Status}.Probe
+	}
+	if h.GoingAway == nil {
+		return check
+	}
+	g := health.GoingAway{Path: h.GoingAway.Path, Status: h.GoingAway.Status, Body: h.GoingAway.Body}
+	return g.Probe(check)
+}
+
+func (h Health) gate() health.Gate {
+	if h.Gate == "local" {
+		return health.GateLocal
+	}
+	return health.Gate(h.Gate)
+}
+
+// Load reads and parses a config file, YAML when it is named .yaml or .yml
+// and JSON otherwise.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	parse := Parse
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		parse = ParseYAML
+	}
+
+	cfg, err := parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	cfg.source = data
+	return cfg, nil
+}
+
+// Parse decodes a JSON config, decrypts ENC[...] values, applies defaults
+// and validates it.
+func Parse(data []byte) (*Config, error) {
+	data, err := decryptValues(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	cfg.applyDefaults()
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func (c *Config) applyDefaults() {
+	if c.Listen == "" {
+		c.Listen = DefaultListen
+	}
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen: %w", err))
+	}
+	for _, addr := range c.Addresses {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("addresses: %w", err))
+		}
+	}
+	switch c.Network {
+	case "", "tcp", "tcp4", "tcp6":
+	default:
+		errs = append(errs, fmt.Errorf("network: unknown network %q", c.Network))
+	}
+	if c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		errs = append(errs, errors.New("ipv6_prefix: must be between 0 and 128"))
+	}
+
+	if len(c.Backends) == 0 {
+		errs = append(errs, errors.New("backends: at least one backend is required"))
+	}
+
+	seen := make(map[string]bool)
+	for _, addr := range c.Backends {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs = append(errs, fmt.Errorf("backend %q: %w", addr, err))
+		}
+		if seen[addr] {
+			errs = append(errs, fmt.Errorf("backend %q: listed twice", addr))
+		}
+		seen[addr] = true
+	}
+
+	if _, err := acl.New(c.Allow, c.Deny); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch balancer.Mode(c.Mode) {
+	case "", balancer.ModeTCP, balancer.ModeHTTP:
+	default:
+		errs = append(errs, fmt.Errorf("mode: unknown mode %q", c.Mode))
+	}
+
+	errs = append(errs, c.validateTLS()...)
+	errs = append(errs, c.validateHTTP()...)
+
+	if c.Auth != nil {
+		if c.Auth.Credentials == "" {
+			errs = append(errs, errors.New("auth: credentials is required"))
+		}
+		if len(c.Auth.Routes) == 0 {
+			errs = append(errs, errors.New("auth: at least one route is required"))
+		}
+		for i, r := range c.Auth.Routes {
+			if !r.Basic && !r.APIKey {
+				errs = append(errs, fmt.Errorf("auth: route %d: enable basic or api_key", i))
+			}
+		}
+		if balancer.Mode(c.Mode) != balancer.ModeHTTP {
+			errs = append(errs, errors.New(`auth: requires mode "http"`))
+		}
+	}
+
+	if c.JWT != nil {
+		if c.JWT.JWKSURL == "" {
+			errs = append(errs, errors.New("jwt: jwks_url is required"))
+		}
+		if balancer.Mode(c.Mode) != balancer.ModeHTTP {
+			errs = append(errs, errors.New(`jwt: requires mode "http"`))
+		}
+	}
+
+	if g := c.Sticky; g != nil && g.Gossip != nil && g.Cluster {
+		errs = append(errs, errors.New("sticky: set gossip or cluster, not both"))
+	}
+	if g := c.Sticky; g != nil && g.Gossip != nil {
+		if g.Gossip.Listen == "" || len(g.Gossip.Peers) == 0 || g.Gossip.Secret == "" {
+			errs = append(errs, errors.New("sticky.gossip: listen, peers and secret are required"))
+		}
+	}
+
+	if h := c.HA; h != nil {
+		backends := 0
+		if h.LeaseFile != "" {
+			backends++
+		}
+		if h.Etcd != nil {
+			backends++
+			if len(h.Etcd.Endpoints) == 0 || h.Etcd.Key == "" {
+				errs = append(errs, errors.New("ha.etcd: endpoints and key are required"))
+			}
+		}
+		if h.StateFile != "" {
+			backends++
+		}
+		if h.Cluster {
+			backends++
+			if h.ID != "" {
+				errs = append(errs, errors.New("ha: id is the cluster's with cluster set"))
+			}
+		}
+		if backends != 1 {
+			errs = append(errs, errors.New("ha: set exactly one of lease_file, etcd, state_file and cluster"))
+		}
+	}
+
+	if f := c.FailureLog; f != nil {
+		if f.Path == "" {
+			errs = append(errs, errors.New("failure_log: path is required"))
+		}
+		if f.Window < 0 {
+			errs = append(errs, errors.New("failure_log: window must not be negative"))
+		}
+	}
+
+	if l := c.Log; l != nil {
+		var level slog.Level
+		if l.Level != "" && (level.UnmarshalText([]byte(l.Level)) != nil || strings.ContainsAny(l.Level, "+-")) {
+			errs = append(errs, fmt.Errorf("log: unknown level %q", l.Level))
+		}
+		switch l.Format {
+		case "", "plain", "text", "json":
+		default:
+			errs = append(errs, fmt.Errorf("log: unknown format %q", l.Format))
+		}
+	}
+
+	if c.AuditLog != nil && c.AuditLog.Path == "" {
+		errs = append(errs, errors.New("audit_log: path is required"))
+	}
+
+	if c.RateLimit != nil {
+		if err := c.RateLimit.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("rate_limit: %w", err))
+		}
+	}
+
+	if c.HostLimits != nil {
+		for name, limit := range c.HostLimits.Hosts {
+			if limit.ConnRate < 0 || limit.RequestRate < 0 {
+				errs = append(errs, fmt.Errorf("host_limits: %s: rates must not be negative", name))
+			}
+		}
+	}
+
+	if c.GeoIP != nil && c.GeoIP.Database == "" {
+		errs = append(errs, errors.New("geoip: database is required"))
+	}
+
+	if c.Transparent && !sockopt.CanTransparent() {
+		errs = append(errs, errors.New("transparent: not supported on this platform"))
+	}
+
+	errs = append(errs, c.validateTenants()...)
+
+	if s := c.Strategy; s != nil {
+		switch s.Type {
+		case "", "round_robin", "weighted_round_robin", "least_conn", "least_latency", "power_of_two", "consistent_hash", "bounded_hash":
+		default:
+			errs = append(errs, fmt.Errorf("strategy: unknown type %q", s.Type))
+		}
+		if s.LoadFactor != 0 && s.LoadFactor < 1 {
+			errs = append(errs, errors.New("strategy: load_factor must be at least 1"))
+		}
+		if s.Replicas < 0 {
+			errs = append(errs, errors.New("strategy: replicas must not be negative"))
+		}
+		for addr, w := range s.Weights {
+			if w < 1 {
+				errs = append(errs, fmt.Errorf("strategy: weight of %s must be at least 1", addr))
+			}
+		}
+		for addr, w := range s.Pinned {
+			if w < 1 {
+				errs = append(errs, fmt.Errorf("strategy: pinned weight of %s must be at least 1", addr))
+			}
+		}
+	}
+
+	for addr, n := range c.MaxBackendConnections {
+		if n < 0 {
+			errs = append(errs, fmt.Errorf("max_backend_connections: limit of %s must not be negative", addr))
+		}
+	}
+
+	for i, tr := range c.TagRules {
+		if tr.Tag == "" {
+			errs = append(errs, fmt.Errorf("tag_rules[%d]: tag is required", i))
+		}
+		for _, src := range tr.Sources {
+			if _, err := acl.ParsePrefix(src); err != nil {
+				errs = append(errs, fmt.Errorf("tag_rules[%d]: %w", i, err))
+			}
+		}
+	}
+	for name, limit := range c.TagLimits {
+		if limit.MaxConnections < 0 || limit.Bandwidth < 0 {
+			errs = append(errs, fmt.Errorf("tag_limits: %s: limits must not be negative", name))
+		}
+	}
+
+	if sh := c.Shedding; sh != nil {
+		if sh.MaxGoroutines == 0 && sh.MaxAcceptLatency == 0 && sh.MaxMemory == 0 {
+			errs = append(errs, errors.New("shedding: set at least one of max_goroutines, max_accept_latency and max_memory"))
+		}
+		if sh.MaxGoroutines < 0 || sh.MaxAcceptLatency < 0 {
+			errs = append(errs, errors.New("shedding: thresholds must not be negative"))
+		}
+		for task := range sh.Background {
+			if !slices.Contains(balancer.BackgroundTasks[:], task) {
+				errs = append(errs, fmt.Errorf("shedding: unknown background task %q", task))
+			}
+		}
+		if sh.HealthSlowdown < 0 {
+			errs = append(errs, errors.New("shedding: health_slowdown must not be negative"))
+		}
+	}
+
+	if wl := c.WeightLearning; wl != nil {
+		if wl.Damping < 0 || wl.Damping > 1 {
+			errs = append(errs, errors.New("weight_learning: damping must be between 0 and 1"))
+		}
+		if wl.MinFactor < 0 || wl.MaxFactor < 0 {
+			errs = append(errs, errors.New("weight_learning: factors must not be negative"))
+		}
+		if wl.MinFactor > 0 && wl.MaxFactor > 0 && wl.MinFactor > wl.MaxFactor {
+			errs = append(errs, errors.New("weight_learning: min_factor is above max_factor"))
+		}
+	}
+
+	if cb := c.CircuitBreaker; cb != nil {
+		if cb.Failures == 0 && cb.ErrorRate == 0 {
+			errs = append(errs, errors.New("circuit_breaker: set failures or error_rate"))
+		}
+		if cb.ErrorRate < 0 || cb.ErrorRate > 1 {
+			errs = append(errs, errors.New("circuit_breaker: error_rate must be between 0 and 1"))
+		}
+		if cb.Failures < 0 || cb.MinRequests < 0 || cb.Window < 0 || cb.Cooldown < 0 || cb.Trials < 0 {
+			errs = append(errs, errors.New("circuit_breaker: values must not be negative"))
+		}
+	}
+
+	if c.ConnectionBudget != nil {
+		errs = append(errs, c.validateBudget()...)
+	} else if slices.ContainsFunc(c.Routes, func(r Route) bool { return r.BudgetShare != 0 }) ||
+		slices.ContainsFunc(c.Tenants, func(t Tenant) bool { return t.BudgetShare != 0 }) {
+		errs = append(errs, errors.New("budget_share: needs connection_budget"))
+	}
+
+	if cl := c.ConnectionLimit; cl != nil {
+		if cl.Max <= 0 {
+			errs = append(errs, errors.New("connection_limit: max must be positive"))
+		}
+		if cl.Wait < 0 {
+			errs = append(errs, errors.New("connection_limit: wait must not be negative"))
+		}
+	}
+
+	if ss := c.SlowStart; ss != nil {
+		if ss.Window < 0 {
+			errs = append(errs, errors.New("slow_start: window must not be negative"))
+		}
+		if ss.From < 0 || ss.From >= 1 {
+			errs = append(errs, errors.New("slow_start: from must be between 0 and 1"))
+		}
+	}
+
+	if rb := c.Rebalance; rb != nil {
+		if rb.Threshold != 0 && rb.Threshold <= 1 {
+			errs = append(errs, errors.New("rebalance: threshold must be above 1"))
+		}
+		if rb.Interval < 0 || rb.MaxPerRound < 0 || rb.MinAge < 0 || rb.Grace < 0 {
+			errs = append(errs, errors.New("rebalance: values must not be negative"))
+		}
+	}
+
+	if c.Health.Interval < 0 || c.Health.Timeout < 0 || c.Health.MinHealthy < 0 || c.Health.Rise < 0 || c.Health.Fall < 0 || c.Health.Passive < 0 {
+		errs = append(errs, errors.New("health: values must not be negative"))
+	}
+	if !health.Type(c.Health.Type).Valid() {
+		errs = append(errs, fmt.Errorf("health: unknown type %q", c.Health.Type))
+	}
+	if h := c.Health; health.Type(h.Type) == health.TypeHTTP {
+		if h.Path != "" && !strings.HasPrefix(h.Path, "/") {
+			errs = append(errs, errors.New("health: path must start with /"))
+		}
+		if h.Status != 0 && (h.Status < 100 || h.Status > 599) {
+			errs = append(errs, fmt.Errorf("health: invalid status %d", h.Status))
+		}
+	} else if h.Path != "" || h.Status != 0 {
+		errs = append(errs, errors.New(`health: path and status need type "http"`))
+	}
+	if !c.Health.gate().Valid() {
+		errs = append(errs, fmt.Errorf("health: unknown gate %q", c.Health.Gate))
+	}
+	if g := c.Health.GoingAway; g != nil {
+		if !strings.HasPrefix(g.Path, "/") {
+			errs = append(errs, errors.New("health: going_away path must start with /"))
+		}
+		if g.Status == 0 && g.Body == "" {
+			errs = append(errs, errors.New("health: going_away needs a status or body"))
+		}
+		if g.Status != 0 && (g.Status < 100 || g.Status > 599) {
+			errs = append(errs, fmt.Errorf("health: invalid going_away status %d", g.Status))
+		}
+	}
+
+	if f := c.Fleet; f != nil {
+		switch {
+		case f.Cluster && (f.Listen != "" || len(f.Peers) > 0 || f.Secret != ""):
+			errs = append(errs, errors.New("fleet: listen, peers and secret don't apply with cluster"))
+		case f.Cluster:
+		case f.Listen == "" && len(f.Peers) == 0:
+			errs = append(errs, errors.New("fleet: listen or peers is required"))
+		case f.Secret == "":
+			errs = append(errs, errors.New("fleet: secret is required"))
+		}
+		if f.Interval < 0 || f.Expiry < 0 {
+			errs = append(errs, errors.New("fleet: values must not be negative"))
+		}
+	}
+
+	errs = append(errs, c.validateCluster()...)
+
+	if d := c.Drain; d != nil {
+		if d.Timeout < 0 {
+			errs = append(errs, errors.New("drain: timeout must not be negative"))
+		}
+		for _, hook := range d.Webhooks {
+			if !strings.HasPrefix(hook, "http://") && !strings.HasPrefix(hook, "https://") {
+				errs = append(errs, fmt.Errorf("drain: webhook %q is not an http(s) URL", hook))
+			}
+		}
+	}
+
+	if dt := c.DNSTracking; dt != nil {
+		if dt.Interval < 0 || dt.MinInterval < 0 || dt.MaxInterval < 0 || dt.History < 0 {
+			errs = append(errs, errors.New("dns_tracking: values must not be negative"))
+		}
+		if dt.MinInterval > 0 && dt.MaxInterval > 0 && dt.MinInterval > dt.MaxInterval {
+			errs = append(errs, errors.New("dns_tracking: min_interval is above max_interval"))
+		}
+	}
+
+	if dc := c.DNSCache; dc != nil {
+		if dc.TTL < 0 || dc.MinTTL < 0 || dc.MaxTTL < 0 || dc.NegativeTTL < 0 || dc.Stale < 0 {
+			errs = append(errs, errors.New("dns_cache: values must not be negative"))
+		}
+		if dc.MinTTL > 0 && dc.MaxTTL > 0 && dc.MinTTL > dc.MaxTTL {
+			errs = append(errs, errors.New("dns_cache: min_ttl is above max_ttl"))
+		}
+	}
+
+	if cp := c.Capture; cp != nil {
+		if (cp.File == "") == (cp.Socket == "") {
+			errs = append(errs, errors.New("capture: set one of file and socket"))
+		}
+		if cp.Sample < 0 || cp.Sample > 1 {
+			errs = append(errs, errors.New("capture: sample must be between 0 and 1"))
+		}
+		if cp.MaxConnBytes < 0 || cp.MaxBytes < 0 {
+			errs = append(errs, errors.New("capture: limits must not be negative"))
+		}
+	}
+
+	if d := c.DNS; d != nil {
+		if _, _, err := net.SplitHostPort(d.Listen); err != nil {
+			errs = append(errs, fmt.Errorf("dns: listen: %w", err))
+		}
+		if len(d.Services) == 0 {
+			errs = append(errs, errors.New("dns: at least one service is required"))
+		}
+		pools := map[string]bool{balancer.DefaultPool: true}
+		for name := range c.Pools {
+			pools[name] = true
+		}
+		for _, t := range c.Tenants {
+			pools[t.Name+"/"+balancer.DefaultPool] = true
+		}
+		for name, pool := range d.Services {
+			if !pools[pool] {
+				errs = append(errs, fmt.Errorf("dns: %s: unknown pool %q", name, pool))
+			}
+		}
+		if d.TTL < 0 || d.MaxAnswers < 0 {
+			errs = append(errs, errors.New("dns: values must not be negative"))
+		}
+	}
+
+	if a := c.Admin; a != nil {
+		if _, _, err := net.SplitHostPort(a.Listen); err != nil {
+			errs = append(errs, fmt.Errorf("admin: listen: %w", err))
+		}
+		if a.Token == "" && len(a.TenantTokens) == 0 && (a.Registration == nil || a.Registration.Token == "") {
+			errs = append(errs, errors.New("admin: token, tenant_tokens or registration.token is required"))
+		}
+		if r := a.Registration; r != nil {
+			if r.TTL < 0 {
+				errs = append(errs, errors.New("admin.registration: ttl must not be negative"))
+			}
+			for _, name := range r.Pools {
+				if _, ok := c.Pools[name]; !ok && name != balancer.DefaultPool {
+					errs = append(errs, fmt.Errorf("admin.registration: unknown pool %q", name))
+				}
+			}
+		}
+		tenants := make(map[string]bool, len(c.Tenants))
+		for _, t := range c.Tenants {
+			tenants[t.Name] = true
+		}
+		for name := range a.TenantTokens {
+			if !tenants[name] {
+				errs = append(errs, fmt.Errorf("admin: tenant_tokens: unknown tenant %q", name))
+			}
+		}
+	}
+
+	if st := c.State; st != nil {
+		switch {
+		case c.StateFile != "":
+			errs = append(errs, errors.New("state: set state or state_file, not both"))
+		case (st.Dir == "") == (st.Redis == nil):
+			errs = append(errs, errors.New("state: set exactly one of dir and redis"))
+		case st.Redis != nil:
+			if _, _, err := net.SplitHostPort(st.Redis.Addr); err != nil {
+				errs = append(errs, fmt.Errorf("state.redis: addr: %w", err))
+			}
+			if st.Redis.DB < 0 {
+				errs = append(errs, errors.New("state.redis: db must not be negative"))
+			}
+		}
+		if st.Interval < 0 {
+			errs = append(errs, errors.New("state: interval must not be negative"))
+		}
+	}
+
+	if m := c.Metrics; m != nil {
+		if _, _, err := net.SplitHostPort(m.Listen); err != nil {
+			errs = append(errs, fmt.Errorf("metrics: listen: %w", err))
+		}
+	}
+
+	errs = append(errs, c.validateRoutes()...)
+	errs = append(errs, c.validateStandby()...)
+	if d := c.Debug; d != nil && strings.ContainsAny(d.Header, " \t\r\n:") {
+		errs = append(errs, fmt.Errorf("debug: invalid header name %q", d.Header))
+	}
+
+	if t := c.Tuning; t != nil {
+		if t.GOMAXPROCS < 0 || t.Acceptors < 0 || t.CopyBuffer < 0 {
+			errs = append(errs, errors.New("tuning: values must not be negative"))
+		}
+		for _, cpu := range t.CPUs {
+			if cpu < 0 || cpu >= 1024 {
+				errs = append(errs, fmt.Errorf("tuning: cpu %d out of range", cpu))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Options translates the config into balancer options.
+func (c *Config) Options() []balancer.Option {
+	var opts []balancer.Option
+
+	if h := c.Health; h.Interval > 0 || h.Timeout > 0 || h.Type != "" || h.MinHealthy > 0 || h.Rise > 0 || h.Fall > 0 || h.Passive > 0 || h.GoingAway != nil {
+		opts = append(opts, balancer.WithHealthPolicy(health.Policy{
+			Interval:   time.Duration(h.Interval),
+			Timeout:    time.Duration(h.Timeout),
+			Type:       health.Type(h.Type),
+			Probe:      h.probe(),
+			MinHealthy: h.MinHealthy,
+			Rise:       h.Rise,
+			Fall:       h.Fall,
+			Passive:    h.Passive,
+		}))
+	}
+
+	if c.Health.External {
+		opts = append(opts, balancer.WithExternalHealth())
+	}
+
+	if g := c.Health.gate(); g != health.GateLocal {
+		opts = append(opts, balancer.WithHealthGate(g))
+	}
+
+	if c.Shedding != nil {
+		opts = append(opts, balancer.WithLoadShedding(c.Shedding.policy()))
+	}
+
+	if c.IPv6Prefix > 0 {
+		opts = append(opts, balancer.WithIPv6Prefix(c.IPv6Prefix))
+	}
+
+	if c.UnderAttack != nil || c.IPv6Prefix > 0 {
+		policy := c.UnderAttack.policy()
+		policy.PerIP.IPv6Prefix = c.IPv6Prefix
+		opts = append(opts, balancer.WithUnderAttackPolicy(policy))
+	}
+
+	if c.Log != nil {
+		opts = append(opts, balancer.WithLogger(c.logger()))
+	}
+
+	if c.StateFile != "" {
+		opts = append(opts, balancer.WithStateFile(c.StateFile, time.Duration(c.StateInterval)))
+	}
+
+	if c.ShutdownReport != "" {
+		opts = append(opts, balancer.WithShutdownReport(c.ShutdownReport))
+	}
+
+	if c.CertificateWarning > 0 {
+		opts = append(opts, balancer.WithCertificateWarning(time.Duration(c.CertificateWarning)))
+	}
+
+	if c.Timeouts != nil {
+		opts = append(opts, balancer.WithTimeouts(c.Timeouts.policy()))
+	}
+
+	if wl := c.WeightLearning; wl != nil {
+		opts = append(opts, balancer.WithWeightLearning(weights.Policy{
+			Interval:   time.Duration(wl.Interval),
+			Damping:    wl.Damping,
+			MinFactor:  wl.MinFactor,
+			MaxFactor:  wl.MaxFactor,
+			MinSamples: wl.MinSamples,
+		}))
+	}
+
+	if cb := c.CircuitBreaker; cb != nil {
+		opts = append(opts, balancer.WithCircuitBreaker(breaker.Policy{
+			Failures:    cb.Failures,
+			ErrorRate:   cb.ErrorRate,
+			MinRequests: cb.MinRequests,
+			Window:      time.Duration(cb.Window),
+			Cooldown:    time.Duration(cb.Cooldown),
+			Trials:      cb.Trials,
+		}))
+	}
+
+	if cb := c.ConnectionBudget; cb != nil {
+		opts = append(opts, balancer.WithConnectionBudget(cb.Max))
+	}
+	if cl := c.ConnectionLimit; cl != nil {
+		opts = append(opts, balancer.WithConnectionLimit(balancer.ConnectionLimit{
+			Max:  cl.Max,
+			Wait: time.Duration(cl.Wait),
+		}))
+	}
+
+	if ss := c.SlowStart; ss != nil {
+		opts = append(opts, balancer.WithSlowStart(balancer.SlowStartPolicy{
+			Window: time.Duration(ss.Window),
+			From:   ss.From,
+		}))
+	}
+
+	if d := c.Debug; d != nil {
+		opts = append(opts, balancer.WithDebugHeader(d.Header))
+	}
+
+	if a := c.Admin; a != nil && a.Registration != nil {
+		opts = append(opts, balancer.WithRegistration(balancer.RegistrationPolicy{
+			TTL:   time.Duration(a.Registration.TTL),
+			Pools: a.Registration.Pools,
+		}))
+	}
+
+	if c.DialRetries != 0 {
+		opts = append(opts, balancer.WithDialRetries(max(c.DialRetries, 0)))
+	}
+
+	if s := c.Standby; s != nil && (s.MinActive > 0 || s.MaxLoad > 0) {
+		opts = append(opts, balancer.WithStandby(balancer.StandbyPolicy{
+			MinActive: s.MinActive,
+			MaxLoad:   s.MaxLoad,
+			Interval:  time.Duration(s.Interval),
+		}))
+	}
+
+	if rb := c.Rebalance; rb != nil {
+		opts = append(opts, balancer.WithRebalancing(balancer.RebalancePolicy{
+			Interval:    time.Duration(rb.Interval),
+			Threshold:   rb.Threshold,
+			MaxPerRound: rb.MaxPerRound,
+			MinAge:      time.Duration(rb.MinAge),
+			Grace:       time.Duration(rb.Grace),
+		}))
+	}
+
+	if d := c.Drain; d != nil {
+		policy := balancer.DrainPolicy{Timeout: time.Duration(d.Timeout)}
+		for _, hook := range d.Webhooks {
+			policy.Hooks = append(policy.Hooks, drainWebhook(hook, c.logger()))
+		}
+		opts = append(opts, balancer.WithDrainPolicy(policy))
+	}
+
+	if dt := c.DNSTracking; dt != nil {
+		opts = append(opts, balancer.WithDNSTracking(resolve.Policy{
+			Interval:    time.Duration(dt.Interval),
+			MinInterval: time.Duration(dt.MinInterval),
+			MaxInterval: time.Duration(dt.MaxInterval),
+			History:     dt.History,
+		}))
+	}
+
+	if dc := c.DNSCache; dc != nil {
+		opts = append(opts, balancer.WithDNSCache(resolve.CachePolicy{
+			TTL:         time.Duration(dc.TTL),
+			MinTTL:      time.Duration(dc.MinTTL),
+			MaxTTL:      time.Duration(dc.MaxTTL),
+			NegativeTTL: time.Duration(dc.NegativeTTL),
+			Stale:       time.Duration(dc.Stale),
+		}))
+	}
+
+	if c.Tuning != nil && c.Tuning.CopyBuffer > 0 {
+		opts = append(opts, balancer.WithCopyBuffer(c.Tuning.CopyBuffer))
+	}
+
+	return opts
+}
+
+// ListenerConfig returns the frontend described by the config. A configured
+// GeoIP database is loaded and watched for changes from here on.
+func (c *Config) ListenerConfig() (balancer.ListenerConfig, error) {
+	rules, err := acl.New(c.Allow, c.Deny)
+	if err != nil {
+		return balancer.ListenerConfig{}, err
+	}
+
+	listenerCfg := balancer.ListenerConfig{
+		Address:     c.Listen,
+		Addresses:   c.Addresses,
+		Network:     c.Network,
+		Mode:        balancer.Mode(c.Mode),
+		ACL:         rules,
+		Transparent: c.Transparent,
+	}
+	if c.ConnectionBudget != nil {
+		listenerCfg.BudgetShare = c.ConnectionBudget.Share
+	}
+
+	if c.Tuning != nil {
+		listenerCfg.Acceptors = c.Tuning.Acceptors
+		listenerCfg.CPUs = c.Tuning.CPUs
+		listenerCfg.ReusePort = c.Tuning.ReusePort
+	}
+
+	if c.RateLimit != nil {
+		listenerCfg.RateLimit = c.RateLimit.limiter(c.IPv6Prefix)
+	}
+
+	if err := c.httpListener(&listenerCfg); err != nil {
+		return balancer.ListenerConfig{}, err
+	}
+
+	if err := c.tlsListener(&listenerCfg); err != nil {
+		return balancer.ListenerConfig{}, err
+	}
+
+	if t := c.Tarpit; t != nil {
+		listenerCfg.Tarpit = tarpit.New(tarpit.Config{
+			Hold:     time.Duration(t.Hold),
+			Interval: time.Duration(t.Interval),
+			Max:      t.Max,
+		}, clock.Real)
+	}
+
+	if c.HostLimits != nil {
+		listenerCfg.HostLimit = c.HostLimits.limiter()
+	}
+
+	switch {
+	case len(c.Routes) > 0 && c.TLS == nil && listenerCfg.Mode != balancer.ModeHTTP:
+		//one port may carry several protocols, so sniff rather than insist
+		//on a ClientHello; the sniffed name serves host limits and tags too
+		listenerCfg.Adapters = append(listenerCfg.Adapters, listener.Sniff{})
+	case c.needsHost():
+		//without TLS termination the host comes from the ClientHello or the
+		//first request head
+		if c.TLS == nil {
+			if listenerCfg.Mode == balancer.ModeHTTP {
+				listenerCfg.Adapters = append(listenerCfg.Adapters, httpHostAdapter())
+			} else {
+				listenerCfg.Adapters = append(listenerCfg.Adapters, sniAdapter())
+			}
+		}
+	}
+
+	//header subsets read the first request, after any TLS termination
+	if c.headerSubsets() && (c.TLS != nil || !c.needsHost()) {
+		listenerCfg.Adapters = append(listenerCfg.Adapters, httpHostAdapter())
+	}
+
+	listenerCfg.Routes = c.routes()
+	listenerCfg.Regions = c.Regions.failover()
+
+	listenerCfg.Tags = c.Tags
+	tagger, err := c.tagger()
+	if err != nil {
+		return balancer.ListenerConfig{}, err
+	}
+	listenerCfg.Tagger = tagger
+
+	if c.Capture != nil {
+		capturer, err := c.Capture.capturer(c.logger())
+		if err != nil {
+			return balancer.ListenerConfig{}, fmt.Errorf("capture: %w", err)
+		}
+		listenerCfg.Capture = capturer
+	}
+
+	if c.GeoIP != nil {
+		db, err := geoip.NewReloader(c.GeoIP.Database, clock.Real)
+		if err != nil {
+			return balancer.ListenerConfig{}, fmt.Errorf("geoip: %w", err)
+		}
+		db.SetLogger(c.logger())
+		c.logger().Info("GeoIP database loaded", "path", c.GeoIP.Database, "networks", db.Len())
+
+		interval := time.Duration(c.GeoIP.ReloadInterval)
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		go db.Watch(interval, c.stop)
+
+		listenerCfg.GeoIP = &geoip.Policy{
+			DB:             db,
+			AllowCountries: c.GeoIP.AllowCountries,
+			DenyCountries:  c.GeoIP.DenyCountries,
+			DenyASNs:       c.GeoIP.DenyASNs,
+		}
+	}
+
+	return listenerCfg, nil
+}
+
+// Build validates the config and constructs a LoadBalancer from it. Extra
+// options are applied after the ones derived from the config.
+func (c *Config) Build(extra ...balancer.Option) (*balancer.LoadBalancer, error) {
+	c.applyDefaults()
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	//process wide, so it is applied here rather than as a balancer option
+	if c.Tuning != nil && c.Tuning.GOMAXPROCS > 0 {
+		runtime.GOMAXPROCS(c.Tuning.GOMAXPROCS)
+	}
+	//and so is the logger of what is built apart from the balancer
+	if c.Log != nil {
+		logging.SetDefault(c.logger())
+	}
+
+	opts := append([]balancer.Option{balancer.WithBackends(c.Backends...)}, c.Options()...)
+
+	if c.AuditLog != nil {
+		auditLog, err := c.AuditLog.open()
+		if err != nil {
+			return nil, fmt.Errorf("audit_log: %w", err)
+		}
+		opts = append(opts, balancer.WithAuditLog(auditLog))
+	}
+
+	if c.FailureLog != nil {
+		rec, err := c.FailureLog.open(c.logger())
+		if err != nil {
+			return nil, fmt.Errorf("failure_log: %w", err)
+		}
+		opts = append(opts, balancer.WithFailureRecording(rec))
+	}
+
+	var node *peer.Node
+	if c.Cluster != nil {
+		var err error
+		if node, err = c.Cluster.node(c.logger()); err != nil {
+			return nil, fmt.Errorf("cluster: %w", err)
+		}
+		opts = append(opts, balancer.WithCluster(node))
+	}
+
+	if c.State != nil {
+		store, err := c.State.store()
+		if err != nil {
+			return nil, fmt.Errorf("state: %w", err)
+		}
+		opts = append(opts, balancer.WithStateStore(store, time.Duration(c.State.Interval)))
+	}
+
+	if c.Fleet != nil {
+		policy, err := c.Fleet.policy(node)
+		if err != nil {
+			return nil, fmt.Errorf("fleet: %w", err)
+		}
+		opts = append(opts, balancer.WithFleetStats(policy))
+	}
+
+	lb, err := balancer.New(append(opts, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+	c.stop = lb.Done()
+	c.log = lb.Logger()
+	if c.Debug != nil && c.Debug.On {
+		lb.SetDebug(true)
+	}
+
+	if c.Strategy != nil {
+		c.Strategy.apply(lb.DefaultPool())
+	}
+	c.applyLabels(lb.DefaultPool())
+	lb.DefaultPool().SetSubsets(c.subsets()...)
+
+	for name, backends := range c.Pools {
+		pool, err := lb.AddPool(name, backends)
+		if err != nil {
+			return nil, fmt.Errorf("pool %s: %w", name, err)
+		}
+		if c.Strategy != nil {
+			c.Strategy.apply(pool)
+		}
+		c.applyLabels(pool)
+	}
+
+	for name, limit := range c.TagLimits {
+		lb.SetTagLimit(name, balancer.TagLimit{
+			MaxConnections: limit.MaxConnections,
+			Bandwidth:      limit.Bandwidth,
+		})
+	}
+
+	if c.Sticky != nil {
+		table, err := c.Sticky.table(node, c.stop, c.logger())
+		if err != nil {
+			return nil, fmt.Errorf("sticky: %w", err)
+		}
+		lb.DefaultPool().SetAffinity(table)
+	}
+
+	if err := c.applyBackendTLS(lb); err != nil {
+		return nil, err
+	}
+
+	for _, tc := range c.Tenants {
+		t, err := lb.AddTenant(tc.Name, balancer.TenantQuota{
+			MaxConnections: tc.MaxConnections,
+			ConnRate:       tc.ConnRate,
+			ConnBurst:      tc.ConnBurst,
+		})
+		if err != nil {
+			return nil, err
+		}
+		pool, err := t.AddPool(balancer.DefaultPool, tc.Backends)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", tc.Name, err)
+		}
+		pool.SetTimeouts(tc.Timeouts.policy())
+		if c.Strategy != nil {
+			c.Strategy.apply(pool)
+		}
+		c.applyLabels(pool)
+	}
+
+	c.recordVersion(lb)
+	return lb, nil
+}
+
+func (c *Config) validateRoutes() []error {
+	var errs []error
+
+	for name, backends := range c.Pools {
+		if name == "" || name == balancer.DefaultPool {
+			errs = append(errs, fmt.Errorf("pools: invalid name %q", name))
+		}
+		if len(backends) == 0 {
+			errs = append(errs, fmt.Errorf("pools: %s: at least one backend is required", name))
+		}
+		for _, addr := range backends {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				errs = append(errs, fmt.Errorf("pools: %s: backend %q: %w", name, addr, err))
+			}
+		}
+	}
+
+	var share float64
+	for i, s := range c.Subsets {
+		if len(s.Labels) == 0 {
+			errs = append(errs, fmt.Errorf("subsets[%d]: labels are required", i))
+		}
+		if s.Header == "" && s.Percent == 0 {
+			errs = append(errs, fmt.Errorf("subsets[%d]: set header or percent", i))
+		}
+		if s.Header != "" && balancer.Mode(c.Mode) != balancer.ModeHTTP {
+			errs = append(errs, fmt.Errorf(`subsets[%d]: header requires mode "http"`, i))
+		}
+		if s.Percent < 0 || s.Percent > 100 {
+			errs = append(errs, fmt.Errorf("subsets[%d]: percent must be between 0 and 100", i))
+		}
+		share += s.Percent
+	}
+	if share > 100 {
+		errs = append(errs, errors.New("subsets: percents add up to more than 100"))
+	}
+
+	for i, r := range c.Routes {
+		switch r.Protocol {
+		case "", listener.ProtocolTLS, listener.ProtocolHTTP, listener.ProtocolSSH, listener.ProtocolOther:
+		default:
+			errs = append(errs, fmt.Errorf("routes[%d]: unknown protocol %q", i, r.Protocol))
+		}
+		if _, ok := c.Pools[r.Pool]; !ok && r.Pool != balancer.DefaultPool {
+			errs = append(errs, fmt.Errorf("routes[%d]: unknown pool %q", i, r.Pool))
+		}
+	}
+
+	if r := c.Regions; r != nil {
+		if len(r.Pools) == 0 {
+			errs = append(errs, errors.New("regions: at least one pool is required"))
+		}
+		for _, name := range r.Pools {
+			if _, ok := c.Pools[name]; !ok && name != balancer.DefaultPool {
+				errs = append(errs, fmt.Errorf("regions: unknown pool %q", name))
+			}
+		}
+		if r.Interval < 0 || r.Timeout < 0 || r.MaxLatency < 0 {
+			errs = append(errs, errors.New("regions: durations must not be negative"))
+		}
+		if r.Margin < 0 || r.Margin >= 1 {
+			errs = append(errs, errors.New("regions: margin must be between 0 and 1"))
+		}
+	}
+	return errs
+}
+
+// validateBudget checks that the shares of the connection budget fit in
+// it.
+func (c *Config) validateBudget() []error {
+	var errs []error
+	cb := c.ConnectionBudget
+	if cb.Max <= 0 {
+		errs = append(errs, errors.New("connection_budget: max must be positive"))
+	}
+
+	share := func(name string, s float64) float64 {
+		if s < 0 || s > 1 {
+			errs = append(errs, fmt.Errorf("%s: budget share must be between 0 and 1", name))
+		}
+		return s
+	}
+	total := share("connection_budget", cb.Share)
+	for i, r := range c.Routes {
+		total += share(fmt.Sprintf("routes[%d]", i), r.BudgetShare)
+	}
+	for i, t := range c.Tenants {
+		total += share(fmt.Sprintf("tenants[%d]", i), t.BudgetShare)
+	}
+	if total > 1 {
+		errs = append(errs, errors.New("connection_budget: shares add up to more than 1"))
+	}
+	return errs
+}
+
+func (c *Config) validateTenants() []error {
+	var errs []error
+
+	names := make(map[string]bool)
+	addrs := map[string]bool{c.Listen: true}
+	for _, addr := range c.Addresses {
+		addrs[addr] = true
+	}
+	for i, t := range c.Tenants {
+		prefix := fmt.Sprintf("tenants[%d]", i)
+		if t.Name != "" {
+			prefix = "tenant " + t.Name
+		}
+
+		switch {
+		case t.Name == "" || strings.Contains(t.Name, "/"):
+			errs = append(errs, fmt.Errorf("%s: name is required and must not contain /", prefix))
+		case names[t.Name]:
+			errs = append(errs, fmt.Errorf("%s: listed twice", prefix))
+		}
+		names[t.Name] = true
+
+		if _, _, err := net.SplitHostPort(t.Listen); err != nil {
+			errs = append(errs, fmt.Errorf("%s: listen: %w", prefix, err))
+		} else if addrs[t.Listen] {
+			errs = append(errs, fmt.Errorf("%s: listen %s is already used", prefix, t.Listen))
+		}
+		addrs[t.Listen] = true
+
+		if len(t.Backends) == 0 {
+			errs = append(errs, fmt.Errorf("%s: at least one backend is required", prefix))
+		}
+		for _, addr := range t.Backends {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				errs = append(errs, fmt.Errorf("%s: backend %q: %w", prefix, addr, err))
+			}
+		}
+
+		if _, err := acl.New(t.Allow, t.Deny); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+		}
+		if t.RateLimit != nil {
+			if err := t.RateLimit.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: rate_limit: %w", prefix, err))
+			}
+		}
+		if t.MaxConnections < 0 || t.ConnRate < 0 || t.ConnBurst < 0 {
+			errs = append(errs, fmt.Errorf("%s: quotas must not be negative", prefix))
+		}
+	}
+
+	return errs
+}
+
+// TenantListenerConfigs returns the frontends of the configured tenants.
+func (c *Config) TenantListenerConfigs() ([]balancer.ListenerConfig, error) {
+	var cfgs []balancer.ListenerConfig
+	for _, t := range c.Tenants {
+		rules, err := acl.New(t.Allow, t.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", t.Name, err)
+		}
+
+		listenerCfg := balancer.ListenerConfig{
+			Address:     t.Listen,
+			Tenant:      t.Name,
+			ACL:         rules,
+			Tags:        t.Tags,
+			BudgetShare: t.BudgetShare,
+		}
+		if t.RateLimit != nil {
+			listenerCfg.RateLimit = t.RateLimit.limiter(c.IPv6Prefix)
+		}
+		cfgs = append(cfgs, listenerCfg)
+	}
+	return cfgs, nil
+}
+
+// Serve runs the listener, those of the tenants and the DNS server on lb.
+// With HA configured the instance joins the election first and binds the
+// listeners only while it leads; the DNS server answers on both instances.
+func (c *Config) Serve(lb *balancer.LoadBalancer, listenerCfg balancer.ListenerConfig) error {
+	tenantCfgs, err := c.TenantListenerConfigs()
+	if err != nil {
+		return err
+	}
+	cfgs := append([]balancer.ListenerConfig{listenerCfg}, tenantCfgs...)
+
+	listen := lb.Listen
+	if c.HA != nil {
+		id := c.HA.ID
+		if c.HA.Cluster {
+			id = lb.Cluster().ID()
+		}
+		e := election.New(c.HA.backend(lb.Cluster()), id, time.Duration(c.HA.TTL), clock.Real)
+		e.SetLogger(lb.Logger())
+		if len(c.HA.OnElected) > 0 || len(c.HA.OnDemoted) > 0 {
+			e.OnChange(election.Exec(c.HA.OnElected, c.HA.OnDemoted, lb.Logger()))
+		}
+		go e.Run()
+		//the lease goes with the balancer, so the standby takes over at once
+		//rather than after the TTL
+		go func() {
+			<-lb.Done()
+			if err := e.Resign(); err != nil {
+				lb.Logger().Warn("Releasing leadership failed", "error", err)
+			}
+		}()
+
+		lb.Logger().Info("Joined leader election, waiting to lead before binding", "id", e.ID(), "listener", listenerCfg.Address)
+		listen = func(cfg balancer.ListenerConfig) error {
+			network := cfg.Network
+			if network == "" {
+				network = "tcp"
+			}
+			return lb.Serve(election.Listen(e, network, cfg.Address), cfg)
+		}
+
+		//an election listener binds one address, so every extra address
+		//becomes a listener of its own
+		var split []balancer.ListenerConfig
+		for _, cfg := range cfgs {
+			extra := cfg.Addresses
+			cfg.Addresses = nil
+			split = append(split, cfg)
+			for _, addr := range extra {
+				cfg.Address = addr
+				split = append(split, cfg)
+			}
+		}
+		cfgs = split
+	}
+
+	var run []func() error
+	for _, cfg := range cfgs {
+		run = append(run, func() error { return listen(cfg) })
+	}
+	if d := c.DNS; d != nil {
+		run = append(run, func() error {
+			return lb.ListenDNS(balancer.DNSConfig{
+				Address:    d.Listen,
+				Services:   d.Services,
+				TTL:        time.Duration(d.TTL),
+				MaxAnswers: d.MaxAnswers,
+			})
+		})
+	}
+	if c.Admin != nil {
+		adminCfg, err := c.Admin.config()
+		if err != nil {
+			return fmt.Errorf("admin: %w", err)
+		}
+		run = append(run, func() error { return lb.ListenAdmin(adminCfg) })
+	}
+	if m := c.Metrics; m != nil {
+		run = append(run, func() error { return lb.ListenMetrics(m.Listen) })
+	}
+
+	if len(run) == 1 {
+		return run[0]()
+	}
+
+	//the first one to fail ends Serve
+	errc := make(chan error, len(run))
+	for _, fn := range run {
+		go func() {
+			errc <- fn()
+		}()
+	}
+	return <-errc
+}
+
+func (c *Config) watchSecrets(list ...*secrets.Secret) {
+	interval := time.Duration(c.SecretsRefresh)
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	for _, s := range list {
+		s.SetLogger(c.logger())
+	}
+	go secrets.Watch(clock.Real, interval, c.stop, list...)
+}
+
+func (f *FailureLog) open(log *slog.Logger) (*replay.Recorder, error) {
+	var w io.Writer = os.Stdout
+	if f.Path != "-" {
+		file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+		if err != nil {
+			return nil, err
+		}
+		w = file
+	}
+
+	window := time.Duration(f.Window)
+	if window <= 0 {
+		window = time.Hour
+	}
+	rec := replay.NewRecorder(w, window, clock.Real)
+	rec.SetLogger(log)
+	return rec, nil
+}
+
+func (a *AuditLog) open() (*audit.Logger, error) {
+	var w io.Writer = os.Stdout
+	if a.Path != "-" {
+		f, err := os.OpenFile(a.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o640)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+
+	return audit.New(w, clock.Real, audit.Sampling{Burst: a.Burst, Rate: a.SampleRate}), nil
+}
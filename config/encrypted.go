@@ -0,0 +1,237 @@
+package config
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Environment variables holding the data key for encrypted values when the
+// config has no encryption section.
+const (
+	EnvConfigKey     = "LB_CONFIG_KEY"
+	EnvConfigKeyFile = "LB_CONFIG_KEY_FILE"
+)
+
+// Encryption says where the data key for ENC[...] values comes from. It is
+// safe to commit: with Vault transit as the KMS the data key is stored
+// wrapped and only unwrapped at load time.
+type Encryption struct {
+	//VaultTransitKey names the transit key, optionally as "mount/key"
+	VaultTransitKey string `json:"vault_transit_key"`
+	//DataKey is the wrapped data key, "vault:v1:..."
+	DataKey string `json:"data_key"`
+}
+
+// DataKey returns the AES-256 key for encrypted values: unwrapped through
+// Vault when enc configures it, otherwise read from LB_CONFIG_KEY or
+// LB_CONFIG_KEY_FILE as base64.
+func DataKey(enc *Encryption) ([]byte, error) {
+	if enc != nil && enc.VaultTransitKey != "" {
+		data, err := transitWrite(transitPath(enc.VaultTransitKey, "decrypt"), map[string]string{"ciphertext": enc.DataKey})
+		if err != nil {
+			return nil, err
+		}
+		plaintext, _ := data["plaintext"].(string)
+		return decodeKey(plaintext)
+	}
+
+	encoded := os.Getenv(EnvConfigKey)
+	if path := os.Getenv(EnvConfigKeyFile); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+	if encoded == "" {
+		return nil, fmt.Errorf("config has encrypted values but neither %s nor %s is set", EnvConfigKey, EnvConfigKeyFile)
+	}
+	return decodeKey(encoded)
+}
+
+// NewDataKey generates a data key. With a transit key name it is generated
+// by Vault, and the returned Encryption holds the wrapped copy to put in
+// the config.
+func NewDataKey(vaultTransitKey string) ([]byte, *Encryption, error) {
+	if vaultTransitKey == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, nil, err
+		}
+		return key, nil, nil
+	}
+
+	data, err := transitWrite(transitPath(vaultTransitKey, "datakey/plaintext"), map[string]int{"bits": 256})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plaintext, _ := data["plaintext"].(string)
+	wrapped, _ := data["ciphertext"].(string)
+	key, err := decodeKey(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, &Encryption{VaultTransitKey: vaultTransitKey, DataKey: wrapped}, nil
+}
+
+func transitPath(key, op string) string {
+	mount, name, found := strings.Cut(key, "/")
+	if !found {
+		mount, name = "transit", key
+	}
+	return mount + "/" + op + "/" + name
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("data key must be 32 bytes, base64 encoded")
+	}
+	return key, nil
+}
+
+// EncryptValue seals plaintext into the ENC[AES256_GCM,...] form accepted
+// in place of any string in the config.
+func EncryptValue(key []byte, plaintext string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+
+	iv := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nil, iv, []byte(plaintext), nil)
+	data, tag := sealed[:len(sealed)-aead.Overhead()], sealed[len(sealed)-aead.Overhead():]
+
+	b64 := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:str]", b64(data), b64(iv), b64(tag)), nil
+}
+
+func decryptValue(key []byte, value string) (string, error) {
+	inner, ok := strings.CutPrefix(value, "ENC[AES256_GCM,")
+	if !ok || !strings.HasSuffix(inner, "]") {
+		return "", errors.New("unsupported encrypted value")
+	}
+
+	parts := make(map[string][]byte)
+	for _, field := range strings.Split(strings.TrimSuffix(inner, "]"), ",") {
+		name, encoded, _ := strings.Cut(field, ":")
+		if name == "type" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", fmt.Errorf("encrypted value: %s: %w", name, err)
+		}
+		parts[name] = decoded
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	if len(parts["iv"]) != aead.NonceSize() {
+		return "", errors.New("encrypted value: bad iv")
+	}
+
+	plaintext, err := aead.Open(nil, parts["iv"], append(parts["data"], parts["tag"]...), nil)
+	if err != nil {
+		return "", errors.New("encrypted value: wrong key or corrupted data")
+	}
+	return string(plaintext), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decryptValues replaces every ENC[...] string in a JSON config with its
+// plaintext. Configs without encrypted values are returned untouched.
+func decryptValues(data []byte) ([]byte, error) {
+	if !bytes.Contains(data, []byte("ENC[")) {
+		return data, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	//keep numbers as written so they decode into ints again
+	dec.UseNumber()
+
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var enc *Encryption
+	if raw, ok := doc["encryption"]; ok {
+		encoded, _ := json.Marshal(raw)
+		if err := json.Unmarshal(encoded, &enc); err != nil {
+			return nil, fmt.Errorf("encryption: %w", err)
+		}
+	}
+
+	key, err := DataKey(enc)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %w", err)
+	}
+
+	decrypted, err := decryptTree(key, doc, "")
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(decrypted)
+}
+
+func decryptTree(key []byte, node any, path string) (any, error) {
+	switch v := node.(type) {
+	case string:
+		if !strings.HasPrefix(v, "ENC[") {
+			return v, nil
+		}
+		plaintext, err := decryptValue(key, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return plaintext, nil
+
+	case map[string]any:
+		for name, child := range v {
+			out, err := decryptTree(key, child, joinPath(path, name))
+			if err != nil {
+				return nil, err
+			}
+			v[name] = out
+		}
+
+	case []any:
+		for i, child := range v {
+			out, err := decryptTree(key, child, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			v[i] = out
+		}
+	}
+	return node, nil
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
@@ -0,0 +1,125 @@
+//go:build !nohttp
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"loadbalancer/balancer"
+	"loadbalancer/balancer/clock"
+	"loadbalancer/balancer/edgeauth"
+	"loadbalancer/balancer/election"
+	"loadbalancer/balancer/jwt"
+	"loadbalancer/balancer/listener"
+	"loadbalancer/balancer/secrets"
+)
+
+func (c *Config) validateHTTP() []error {
+	return nil
+}
+
+// httpListener sets up the HTTP mode auth checks of the listener.
+func (c *Config) httpListener(listenerCfg *balancer.ListenerConfig) error {
+	if c.Auth != nil {
+		policy, file, err := c.Auth.policy()
+		if err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+		listenerCfg.Auth = policy
+		c.watchSecrets(file)
+	}
+
+	if c.JWT != nil {
+		listenerCfg.JWT = c.JWT.policy()
+	}
+	return nil
+}
+
+func httpHostAdapter() listener.Adapter {
+	return listener.HTTP{}
+}
+
+func etcdBackend(e *HAEtcd) election.Backend {
+	return &election.Etcd{Endpoints: e.Endpoints, Key: e.Key}
+}
+
+// drainWebhook posts drain events to url. Failures are logged to log only:
+// a drain goes ahead whether or not anyone hears about it.
+func drainWebhook(url string, log *slog.Logger) balancer.DrainHook {
+	client := &http.Client{Timeout: 5 * time.Second}
+	return func(e balancer.DrainEvent) {
+		body, _ := json.Marshal(e)
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Warn("Drain webhook failed", "url", url, "error", err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Warn("Drain webhook failed", "url", url, "status", resp.Status)
+		}
+	}
+}
+
+// transitWrite calls the Vault transit engine for encrypted config values.
+func transitWrite(path string, body any) (map[string]any, error) {
+	client, err := secrets.VaultFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return client.Write(path, body)
+}
+
+// policy loads the credentials file and returns the secret so the caller
+// keeps it refreshed.
+func (a *Auth) policy() (*edgeauth.Policy, *secrets.Secret, error) {
+	file, err := secrets.LoadRef(a.Credentials)
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := edgeauth.NewStore(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p := &edgeauth.Policy{Store: store}
+	for _, r := range a.Routes {
+		p.Rules = append(p.Rules, edgeauth.Rule{
+			Host:       r.Host,
+			PathPrefix: r.PathPrefix,
+			Basic:      r.Basic,
+			Realm:      r.Realm,
+			APIKey:     r.APIKey,
+			Header:     r.Header,
+			Users:      r.Users,
+		})
+	}
+	return p, file, nil
+}
+
+func (j *JWT) policy() *balancer.JWTPolicy {
+	keys := jwt.NewKeySet(j.JWKSURL, clock.Real)
+	if j.CacheTTL > 0 {
+		keys.TTL = time.Duration(j.CacheTTL)
+	}
+
+	return &balancer.JWTPolicy{
+		Verifier: &jwt.Verifier{
+			Keys:       keys,
+			Issuer:     j.Issuer,
+			Audience:   j.Audience,
+			Algorithms: j.Algorithms,
+			Leeway:     time.Duration(j.Leeway),
+			Clock:      clock.Real,
+		},
+		Optional:     j.Optional,
+		ClaimHeaders: j.ClaimHeaders,
+	}
+}
@@ -0,0 +1,54 @@
+//go:build nohttp
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"loadbalancer/balancer"
+	"loadbalancer/balancer/election"
+	"loadbalancer/balancer/listener"
+)
+
+var errNoHTTP = errors.New("not built in (nohttp build tag)")
+
+func (c *Config) validateHTTP() []error {
+	var errs []error
+	if balancer.Mode(c.Mode) == balancer.ModeHTTP {
+		errs = append(errs, fmt.Errorf("mode http: %w", errNoHTTP))
+	}
+	if c.Auth != nil {
+		errs = append(errs, fmt.Errorf("auth: %w", errNoHTTP))
+	}
+	if c.JWT != nil {
+		errs = append(errs, fmt.Errorf("jwt: %w", errNoHTTP))
+	}
+	if c.HA != nil && c.HA.Etcd != nil {
+		errs = append(errs, fmt.Errorf("ha.etcd: %w", errNoHTTP))
+	}
+	if c.Admin != nil {
+		errs = append(errs, fmt.Errorf("admin: %w", errNoHTTP))
+	}
+	if c.Metrics != nil {
+		errs = append(errs, fmt.Errorf("metrics: %w", errNoHTTP))
+	}
+	if c.Drain != nil && len(c.Drain.Webhooks) > 0 {
+		errs = append(errs, fmt.Errorf("drain.webhooks: %w", errNoHTTP))
+	}
+	return errs
+}
+
+func (c *Config) httpListener(listenerCfg *balancer.ListenerConfig) error { return nil }
+
+// unreachable while validateHTTP refuses mode http and etcd
+func httpHostAdapter() listener.Adapter { return listener.TCP{} }
+
+func etcdBackend(e *HAEtcd) election.Backend { return nil }
+
+func drainWebhook(string, *slog.Logger) balancer.DrainHook { return func(balancer.DrainEvent) {} }
+
+func transitWrite(path string, body any) (map[string]any, error) {
+	return nil, fmt.Errorf("vault transit: %w", errNoHTTP)
+}
@@ -0,0 +1,247 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"time"
+
+	"loadbalancer/balancer"
+	"loadbalancer/balancer/acl"
+	"loadbalancer/balancer/health"
+)
+
+// Reload applies next, the new version of the config c was built from, to
+// the running lb without dropping connections. Backends missing from next
+// are drained before they leave their pool, new ones join right away, or
+// take the place of a missing one with the same instance label, and
+// health checks, strategies, weights, labels, backend connection limits,
+// standby backends, subsets and the allow and deny rules of the listeners
+// change in place.
+// Everything else, such as listeners, only changes on a restart, which is
+// logged rather than refused. The next reload is then relative to next;
+// after an error it should stay relative to c, as next may not have been
+// applied, or only in part.
+func (c *Config) Reload(lb *balancer.LoadBalancer, next *Config) error {
+	next.applyDefaults()
+	if err := next.Validate(); err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(c.restartOnly(), next.restartOnly()) {
+		lb.Logger().Warn("Reload: only backends, pools, health, strategy, labels, connection limits, standby backends, subsets and allow/deny rules change without a restart")
+	}
+
+	//backends no longer in reserve become regular members
+	for _, pool := range lb.Pools() {
+		for _, b := range pool.Backends() {
+			if c.standby(b.Addr) && !next.standby(b.Addr) {
+				b.SetStandby(false)
+			}
+		}
+	}
+
+	var errs []error
+	newStrategy := !reflect.DeepEqual(c.Strategy, next.Strategy)
+	sync := func(pool *balancer.Pool, old, addrs []string) {
+		if err := next.syncPool(pool, old, addrs, newStrategy, lb.Logger()); err != nil {
+			errs = append(errs, fmt.Errorf("pool %s: %w", pool.Name(), err))
+		}
+	}
+
+	sync(lb.DefaultPool(), c.Backends, next.Backends)
+	lb.DefaultPool().SetSubsets(next.subsets()...)
+
+	//listeners keep their address until a restart, so c's is the one in use
+	setACL := func(address string, allow, deny, oldAllow, oldDeny []string) {
+		if reflect.DeepEqual(allow, oldAllow) && reflect.DeepEqual(deny, oldDeny) {
+			return
+		}
+		rules, err := acl.New(allow, deny)
+		if err == nil {
+			err = lb.SetACL(address, rules)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listener %s: %w", address, err))
+		}
+	}
+	//with HA every address is a listener of its own
+	for _, address := range append([]string{c.Listen}, c.Addresses...) {
+		setACL(address, next.Allow, next.Deny, c.Allow, c.Deny)
+	}
+
+	for name, addrs := range next.Pools {
+		if pool := lb.Pool(name); pool != nil {
+			sync(pool, c.Pools[name], addrs)
+			continue
+		}
+		pool, err := lb.AddPool(name, addrs)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("pool %s: %w", name, err))
+			continue
+		}
+		pool.SetStrategy(next.Strategy.build())
+		next.Strategy.weights(pool)
+		next.applyLabels(pool)
+	}
+	//pools can't be deleted while routes may point at them, so dropped
+	//ones are emptied instead
+	for name, old := range c.Pools {
+		if _, ok := next.Pools[name]; !ok {
+			if pool := lb.Pool(name); pool != nil {
+				sync(pool, old, nil)
+			}
+		}
+	}
+
+	oldTenants := make(map[string]Tenant, len(c.Tenants))
+	for _, tc := range c.Tenants {
+		oldTenants[tc.Name] = tc
+	}
+	for _, tc := range next.Tenants {
+		t := lb.Tenant(tc.Name)
+		if t == nil {
+			errs = append(errs, fmt.Errorf("tenant %s: new tenants need a restart", tc.Name))
+			continue
+		}
+		old := oldTenants[tc.Name]
+		sync(t.Pool(balancer.DefaultPool), old.Backends, tc.Backends)
+		setACL(old.Listen, tc.Allow, tc.Deny, old.Allow, old.Deny)
+	}
+
+	for _, pool := range lb.Pools() {
+		pool.SetHealthPolicy(next.Health.reload(pool.HealthPolicy()))
+	}
+
+	next.recordVersion(lb)
+	return errors.Join(errs...)
+}
+
+// syncPool moves pool from the old to the new list of addrs. Removed
+// backends drain in the background, bounded by the drain timeout. A new
+// address with the instance label of a removed one replaces it, see
+// balancer.ReplaceBackend. Members in neither list, such as those added
+// through the API, are left alone.
+func (c *Config) syncPool(pool *balancer.Pool, old, addrs []string, newStrategy bool, log *slog.Logger) error {
+	was := make(map[string]bool, len(old))
+	for _, addr := range old {
+		was[addr] = true
+	}
+
+	want := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		want[addr] = true
+	}
+
+	//removed backends by instance, for the new addresses to replace
+	moved := make(map[string]string)
+	for addr := range was {
+		b := pool.Backend(addr)
+		if want[addr] || b == nil {
+			continue
+		}
+		if instance := b.Labels()[balancer.InstanceLabel]; instance != "" {
+			moved[instance] = addr
+		}
+	}
+
+	var errs []error
+	for _, addr := range addrs {
+		instance := c.Labels[addr][balancer.InstanceLabel]
+		if prev, ok := moved[instance]; ok && pool.Backend(addr) == nil {
+			delete(moved, instance)
+			//retired by ReplaceBackend, so skipped below
+			delete(was, prev)
+			if _, err := pool.ReplaceBackend(prev, addr); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if b := pool.Backend(addr); b != nil {
+			//back in the config while it was still being retired
+			if !was[addr] && b.SetDraining(false) {
+				log.Info("Backend kept", "backend", addr, "pool", pool.Name())
+			}
+			continue
+		}
+		add := pool.AddBackend
+		if c.standby(addr) {
+			add = pool.AddStandby
+		}
+		if _, err := add(addr); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for addr := range was {
+		if want[addr] || pool.Backend(addr) == nil {
+			continue
+		}
+		go pool.RetireBackend(context.Background(), addr)
+	}
+
+	if newStrategy {
+		pool.SetStrategy(c.Strategy.build())
+	}
+	c.Strategy.weights(pool)
+	c.applyLabels(pool)
+	return errors.Join(errs...)
+}
+
+// reload returns policy with the interval, timeout, gate, type, probe,
+// minimum and thresholds of h.
+func (h Health) reload(policy health.Policy) health.Policy {
+	policy.Interval = time.Duration(h.Interval)
+	policy.Timeout = time.Duration(h.Timeout)
+	policy.Gate = h.gate()
+	policy.Type = health.Type(h.Type)
+	policy.Probe = h.probe()
+	policy.MinHealthy = h.MinHealthy
+	policy.Rise = h.Rise
+	policy.Fall = h.Fall
+	policy.Passive = h.Passive
+	return policy
+}
+
+// restartOnly is the config without the parts Reload applies.
+func (c *Config) restartOnly() map[string]any {
+	data, _ := json.Marshal(c)
+	var m map[string]any
+	json.Unmarshal(data, &m)
+
+	for _, key := range []string{"backends", "pools", "strategy", "labels", "max_backend_connections", "subsets", "allow", "deny"} {
+		delete(m, key)
+	}
+	//without triggers only the standby backends are left, which reload
+	if s := c.Standby; s != nil && s.MinActive == 0 && s.MaxLoad == 0 {
+		delete(m, "standby")
+	} else if s, ok := m["standby"].(map[string]any); ok {
+		delete(s, "backends")
+	}
+	if h, ok := m["health"].(map[string]any); ok {
+		delete(h, "interval")
+		delete(h, "timeout")
+		delete(h, "gate")
+		delete(h, "going_away")
+		delete(h, "type")
+		delete(h, "path")
+		delete(h, "status")
+		delete(h, "min_healthy")
+		delete(h, "rise")
+		delete(h, "fall")
+		delete(h, "passive")
+	}
+	if tenants, ok := m["tenants"].([]any); ok {
+		for _, t := range tenants {
+			if t, ok := t.(map[string]any); ok {
+				delete(t, "backends")
+				delete(t, "allow")
+				delete(t, "deny")
+			}
+		}
+	}
+	return m
+}
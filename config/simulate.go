@@ -0,0 +1,101 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"loadbalancer/balancer/strategy"
+	"loadbalancer/simulate"
+)
+
+// Traffic is the traffic description of "loadbalancer simulate", YAML or
+// JSON like the config.
+type Traffic struct {
+	//Clients are the distinct client IPs, default 100
+	Clients int `json:"clients"`
+	//Hold is the mean connection lifetime, default 1s
+	Hold   Duration       `json:"hold"`
+	Phases []TrafficPhase `json:"phases"`
+	//Latency by backend address, default 10ms
+	Latency map[string]Duration `json:"latency"`
+	Seed    uint64              `json:"seed"`
+}
+
+type TrafficPhase struct {
+	//Rate is new connections per second
+	Rate     float64  `json:"rate"`
+	Duration Duration `json:"duration"`
+}
+
+// simulatedTypes are the strategies a simulation compares.
+var simulatedTypes = []string{"round_robin", "weighted_round_robin", "least_conn", "least_latency", "power_of_two", "consistent_hash", "bounded_hash"}
+
+func LoadTraffic(path string) (*Traffic, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	var t Traffic
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &t, nil
+}
+
+// Simulation is what simulate.Run needs to replay t on the default pool:
+// a candidate for every strategy, the configured one first, and the
+// backends with their weights.
+func (c *Config) Simulation(t *Traffic) ([]simulate.Candidate, []simulate.Backend, simulate.Traffic) {
+	configured := Strategy{}
+	if c.Strategy != nil {
+		configured = *c.Strategy
+	}
+	if configured.Type == "" {
+		configured.Type = "round_robin"
+	}
+
+	var candidates []simulate.Candidate
+	add := func(s Strategy) {
+		candidates = append(candidates, simulate.Candidate{
+			Name: s.Type,
+			New:  func() strategy.Strategy { return s.build() },
+		})
+	}
+	add(configured)
+	for _, typ := range simulatedTypes {
+		if typ != configured.Type {
+			s := configured
+			s.Type = typ
+			add(s)
+		}
+	}
+
+	backends := make([]simulate.Backend, 0, len(c.Backends))
+	for _, addr := range c.Backends {
+		b := simulate.Backend{Addr: addr, Weight: 1, Latency: time.Duration(t.Latency[addr])}
+		if w, ok := configured.Weights[addr]; ok {
+			b.Weight = w
+		}
+		if w, ok := configured.Pinned[addr]; ok {
+			b.Weight = w
+		}
+		backends = append(backends, b)
+	}
+
+	traffic := simulate.Traffic{Clients: t.Clients, Hold: time.Duration(t.Hold), Seed: t.Seed}
+	for _, p := range t.Phases {
+		traffic.Phases = append(traffic.Phases, simulate.Phase{Rate: p.Rate, Duration: time.Duration(p.Duration)})
+	}
+	return candidates, backends, traffic
+}
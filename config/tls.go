@@ -0,0 +1,206 @@
+//go:build !notls
+
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"loadbalancer/balancer"
+	"loadbalancer/balancer/listener"
+	"loadbalancer/balancer/secrets"
+	"loadbalancer/balancer/spiffe"
+	"loadbalancer/balancer/tlsconfig"
+)
+
+func (c *Config) validateTLS() []error {
+	var errs []error
+
+	if c.TLS != nil {
+		if c.TLS.Cert == "" || c.TLS.Key == "" {
+			errs = append(errs, errors.New("tls: cert and key are required"))
+		}
+		if err := c.TLS.Policy.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("tls: %w", err))
+		}
+	}
+
+	if c.BackendTLS != nil {
+		if err := c.BackendTLS.Policy.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("backend_tls: %w", err))
+		}
+		if sp := c.BackendTLS.SPIFFE; sp != nil {
+			if sp.Cert == "" || sp.Key == "" || sp.Bundle == "" {
+				errs = append(errs, errors.New("backend_tls.spiffe: cert, key and bundle are required"))
+			}
+			if len(sp.IDs) == 0 && sp.TrustDomain == "" {
+				errs = append(errs, errors.New("backend_tls.spiffe: ids or trust_domain is required"))
+			}
+			for _, id := range sp.IDs {
+				if _, err := spiffe.ParseID(id); err != nil {
+					errs = append(errs, fmt.Errorf("backend_tls.spiffe: %w", err))
+				}
+			}
+		}
+		for addr, o := range c.BackendTLS.Backends {
+			if o.CA != "" && c.BackendTLS.SPIFFE != nil {
+				errs = append(errs, fmt.Errorf("backend_tls.backends: %s: ca does not apply with spiffe", addr))
+			}
+		}
+	}
+
+	return errs
+}
+
+// tlsListener terminates TLS on the listener when the config asks for it.
+func (c *Config) tlsListener(listenerCfg *balancer.ListenerConfig) error {
+	if c.TLS != nil {
+		adapter, secrets, err := c.TLS.adapter()
+		if err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
+		listenerCfg.Adapters = append(listenerCfg.Adapters, adapter)
+		c.watchSecrets(secrets...)
+	}
+	return nil
+}
+
+func (c *Config) applyBackendTLS(lb *balancer.LoadBalancer) error {
+	if c.BackendTLS != nil {
+		cfg, refs, err := c.BackendTLS.config()
+		if err != nil {
+			return fmt.Errorf("backend_tls: %w", err)
+		}
+		lb.DefaultPool().SetTLS(cfg)
+
+		if c.BackendTLS.SPIFFE == nil && c.BackendTLS.CA != "" {
+			roots, bundle, err := loadCertPool(c.BackendTLS.CA)
+			if err != nil {
+				return fmt.Errorf("backend_tls: %w", err)
+			}
+			lb.DefaultPool().SetTLSRoots(roots.Pool)
+			refs = append(refs, bundle)
+		}
+		for addr, o := range c.BackendTLS.Backends {
+			override := balancer.BackendTLS{ServerName: o.ServerName, NextProtos: o.ALPN}
+			if o.CA != "" {
+				roots, bundle, err := loadCertPool(o.CA)
+				if err != nil {
+					return fmt.Errorf("backend_tls.backends: %s: %w", addr, err)
+				}
+				override.Roots = roots.Pool
+				refs = append(refs, bundle)
+			}
+			lb.DefaultPool().SetBackendTLS(addr, override)
+		}
+		if len(refs) > 0 {
+			c.watchSecrets(refs...)
+		}
+	}
+	return nil
+}
+
+func sniAdapter() listener.Adapter {
+	return listener.SNI{}
+}
+
+// adapter builds the TLS adapter and returns the secrets it depends on,
+// which the caller keeps refreshed.
+func (t *TLS) adapter() (listener.Adapter, []*secrets.Secret, error) {
+	certSecret, err := secrets.LoadRef(t.Cert)
+	if err != nil {
+		return nil, nil, err
+	}
+	keySecret, err := secrets.LoadRef(t.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := secrets.NewCertificate(certSecret, keySecret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg := &tls.Config{GetCertificate: cert.GetCertificate}
+	if err := t.Policy.Apply(cfg); err != nil {
+		return nil, nil, err
+	}
+
+	adapter := listener.TLS{Config: cfg}
+	refs := []*secrets.Secret{certSecret, keySecret}
+
+	if t.ClientCA != "" {
+		pool, bundle, err := loadCertPool(t.ClientCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		adapter.ClientCAPool = pool.Pool
+		refs = append(refs, bundle)
+	}
+
+	return adapter, refs, nil
+}
+
+// config builds the backend TLS config and returns any secrets it depends
+// on, which the caller keeps refreshed.
+func (b *BackendTLS) config() (*tls.Config, []*secrets.Secret, error) {
+	if b.SPIFFE != nil {
+		return b.SPIFFE.config(b.Policy)
+	}
+
+	cfg := &tls.Config{ServerName: b.ServerName}
+	if err := b.Policy.Apply(cfg); err != nil {
+		return nil, nil, err
+	}
+	return cfg, nil, nil
+}
+
+func (s *SPIFFE) config(policy tlsconfig.Policy) (*tls.Config, []*secrets.Secret, error) {
+	var loaded []*secrets.Secret
+	for _, ref := range []string{s.Cert, s.Key, s.Bundle} {
+		secret, err := secrets.LoadRef(ref)
+		if err != nil {
+			return nil, nil, fmt.Errorf("spiffe: %w", err)
+		}
+		loaded = append(loaded, secret)
+	}
+
+	source, err := spiffe.NewSource(loaded[0], loaded[1], loaded[2])
+	if err != nil {
+		return nil, nil, fmt.Errorf("spiffe: %w", err)
+	}
+
+	authorize := spiffe.AuthorizeMemberOf(s.TrustDomain)
+	if len(s.IDs) > 0 {
+		ids := make([]spiffe.ID, 0, len(s.IDs))
+		for _, raw := range s.IDs {
+			id, err := spiffe.ParseID(raw)
+			if err != nil {
+				return nil, nil, err
+			}
+			ids = append(ids, id)
+		}
+		authorize = spiffe.AuthorizeID(ids...)
+	}
+
+	cfg := source.ClientConfig(authorize)
+	if err := policy.Apply(cfg); err != nil {
+		return nil, nil, err
+	}
+	return cfg, loaded, nil
+}
+
+// loadCertPool loads a CA bundle and returns its secret, which the caller
+// keeps refreshed.
+func loadCertPool(ref string) (*secrets.CertPool, *secrets.Secret, error) {
+	bundle, err := secrets.LoadRef(ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool, err := secrets.NewCertPool(bundle)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pool, bundle, nil
+}
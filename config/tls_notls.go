@@ -0,0 +1,50 @@
+//go:build notls
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"loadbalancer/balancer"
+	"loadbalancer/balancer/listener"
+)
+
+var errNoTLS = errors.New("not built in (notls build tag)")
+
+func (c *Config) validateTLS() []error {
+	var errs []error
+	if c.TLS != nil {
+		errs = append(errs, fmt.Errorf("tls: %w", errNoTLS))
+	}
+	if c.BackendTLS != nil {
+		errs = append(errs, fmt.Errorf("backend_tls: %w", errNoTLS))
+	}
+	if c.Health.Type == "tls" {
+		errs = append(errs, fmt.Errorf("health: type tls: %w", errNoTLS))
+	}
+	//without TLS termination tcp listeners learn the host from the SNI
+	if c.HostLimits != nil && balancer.Mode(c.Mode) != balancer.ModeHTTP {
+		errs = append(errs, fmt.Errorf("host_limits: tcp mode reads the SNI, %w", errNoTLS))
+	}
+	return errs
+}
+
+func (c *Config) tlsListener(listenerCfg *balancer.ListenerConfig) error { return nil }
+
+func (c *Config) applyBackendTLS(lb *balancer.LoadBalancer) error { return nil }
+
+// unreachable, validateTLS refuses host limits in tcp mode
+func sniAdapter() listener.Adapter { return listener.TCP{} }
+
+func validateClusterTLS(cl *Cluster) []error {
+	if cl.TLS != nil {
+		return []error{fmt.Errorf("cluster.tls: %w", errNoTLS)}
+	}
+	return nil
+}
+
+func (t *ClusterTLS) upgrade() (func(net.Conn, bool) (net.Conn, error), error) {
+	return nil, errNoTLS
+}
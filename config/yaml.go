@@ -0,0 +1,438 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseYAML decodes a YAML config. It understands the part of YAML configs
+// are written in: block mappings and sequences, one-line flow collections
+// such as [a, b] and {a: 1}, plain and quoted scalars, and comments.
+// Anchors, tags, block scalars and multiple documents are refused.
+func ParseYAML(data []byte) (*Config, error) {
+	doc, err := yamlToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(doc)
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func yamlToJSON(data []byte) ([]byte, error) {
+	lines, err := yamlLines(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return []byte("{}"), nil
+	}
+
+	p := &yamlParser{lines: lines}
+	v, err := p.block(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(lines) {
+		return nil, p.errorf(lines[p.pos], "unexpected indentation")
+	}
+	return json.Marshal(v)
+}
+
+// yamlLines drops comments and blank lines and measures indentation.
+func yamlLines(data string) ([]yamlLine, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(data, "\n") {
+		num := i + 1
+		text := strings.TrimRight(stripYAMLComment(strings.TrimSuffix(raw, "\r")), " \t")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("yaml line %d: tabs are not allowed in indentation", num)
+		}
+		if text == "---" {
+			if len(lines) > 0 {
+				return nil, fmt.Errorf("yaml line %d: only one document is supported", num)
+			}
+			continue
+		}
+		lines = append(lines, yamlLine{num: num, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	return lines, nil
+}
+
+// stripYAMLComment cuts a # that starts the line or follows a space,
+// outside quotes.
+func stripYAMLComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func (p *yamlParser) errorf(l yamlLine, format string, args ...any) error {
+	return fmt.Errorf("yaml line %d: %s", l.num, fmt.Sprintf(format, args...))
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// block parses the mapping or sequence whose lines start at indent.
+func (p *yamlParser) block(indent int) (any, error) {
+	if isSeqItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) sequence(indent int) (any, error) {
+	list := []any{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent || (l.indent == indent && !isSeqItem(l.text)) {
+			break
+		}
+		if l.indent > indent {
+			return nil, p.errorf(l, "unexpected indentation")
+		}
+		if !isSeqItem(l.text) {
+			return nil, p.errorf(l, "expected a sequence item")
+		}
+
+		rest := strings.TrimLeft(l.text[1:], " ")
+		if rest == "" {
+			p.pos++
+			v, err := p.nested(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			continue
+		}
+
+		//the item's own content continues at the column it starts at, so
+		//"- name: a" opens a mapping whose later keys line up with name
+		if _, _, ok := splitYAMLKey(rest); ok || isSeqItem(rest) {
+			p.lines[p.pos] = yamlLine{num: l.num, indent: indent + len(l.text) - len(rest), text: rest}
+			v, err := p.block(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			continue
+		}
+
+		p.pos++
+		v, err := p.value(l, rest)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+func (p *yamlParser) mapping(indent int) (any, error) {
+	m := map[string]any{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, p.errorf(l, "unexpected indentation")
+		}
+		if isSeqItem(l.text) {
+			return nil, p.errorf(l, "expected a key, found a sequence item")
+		}
+
+		key, rest, ok := splitYAMLKey(l.text)
+		if !ok {
+			return nil, p.errorf(l, "expected key: value")
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf(l, "duplicate key %q", key)
+		}
+		p.pos++
+
+		var v any
+		var err error
+		if rest == "" {
+			v, err = p.nested(indent, true)
+		} else {
+			v, err = p.value(l, rest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// nested parses the block under a key or empty sequence item, or returns
+// null when there is none. A mapping's sequence may start at the key's own
+// indentation.
+func (p *yamlParser) nested(indent int, sameIndentSeq bool) (any, error) {
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	if next.indent > indent || (sameIndentSeq && next.indent == indent && isSeqItem(next.text)) {
+		return p.block(next.indent)
+	}
+	return nil, nil
+}
+
+func (p *yamlParser) value(l yamlLine, s string) (any, error) {
+	switch s[0] {
+	case '[', '{':
+		f := &yamlFlow{s: s}
+		v, err := f.value()
+		if err == nil {
+			f.space()
+			if f.i < len(f.s) {
+				err = errors.New("unexpected text after the collection")
+			}
+		}
+		if err != nil {
+			return nil, p.errorf(l, "%v", err)
+		}
+		return v, nil
+	case '|', '>':
+		return nil, p.errorf(l, "block scalars are not supported, use a quoted string")
+	case '&', '*', '!':
+		return nil, p.errorf(l, "anchors, aliases and tags are not supported")
+	}
+	v, err := yamlScalar(s)
+	if err != nil {
+		return nil, p.errorf(l, "%v", err)
+	}
+	return v, nil
+}
+
+// splitYAMLKey splits "key: value" at the first colon followed by a space
+// or the end of the line, which leaves colons in addresses alone.
+func splitYAMLKey(text string) (string, string, bool) {
+	if text[0] == '"' || text[0] == '\'' {
+		end := quotedEnd(text)
+		if end < 0 || end >= len(text) || text[end] != ':' || (end+1 < len(text) && text[end+1] != ' ') {
+			return "", "", false
+		}
+		key, err := yamlScalar(text[:end])
+		if err != nil {
+			return "", "", false
+		}
+		return key.(string), strings.TrimSpace(text[end+1:]), true
+	}
+	if text[0] == '[' || text[0] == '{' {
+		return "", "", false
+	}
+
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// quotedEnd returns the index just past the quoted string s starts with,
+// or -1 when it is not closed.
+func quotedEnd(s string) int {
+	quote := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quote == '"' && s[i] == '\\':
+			i++
+		case quote == '\'' && s[i] == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == quote:
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// yamlScalar types a scalar. Numbers stay json.Numbers so that they decode
+// into ints again; anything not a number, bool or null is a string.
+func yamlScalar(s string) (any, error) {
+	switch s[0] {
+	case '"':
+		if quotedEnd(s) != len(s) {
+			return nil, fmt.Errorf("bad quoted string %s", s)
+		}
+		return strconv.Unquote(s)
+	case '\'':
+		if quotedEnd(s) != len(s) {
+			return nil, fmt.Errorf("bad quoted string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+
+	switch s {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if (s[0] == '-' || s[0] >= '0' && s[0] <= '9') && json.Valid([]byte(s)) {
+		return json.Number(s), nil
+	}
+	return s, nil
+}
+
+// yamlFlow parses a one-line flow collection.
+type yamlFlow struct {
+	s string
+	i int
+}
+
+func (f *yamlFlow) space() {
+	for f.i < len(f.s) && f.s[f.i] == ' ' {
+		f.i++
+	}
+}
+
+func (f *yamlFlow) value() (any, error) {
+	f.space()
+	if f.i >= len(f.s) {
+		return nil, errors.New("unexpected end of line")
+	}
+	switch f.s[f.i] {
+	case '[':
+		return f.sequence()
+	case '{':
+		return f.mapping()
+	}
+	return f.scalar(false)
+}
+
+func (f *yamlFlow) sequence() (any, error) {
+	f.i++
+	list := []any{}
+	for {
+		f.space()
+		if f.i < len(f.s) && f.s[f.i] == ']' {
+			f.i++
+			return list, nil
+		}
+		v, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+		if err := f.next(']'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (f *yamlFlow) mapping() (any, error) {
+	f.i++
+	m := map[string]any{}
+	for {
+		f.space()
+		if f.i < len(f.s) && f.s[f.i] == '}' {
+			f.i++
+			return m, nil
+		}
+		k, err := f.scalar(true)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			key = fmt.Sprint(k)
+		}
+		f.space()
+		if f.i >= len(f.s) || f.s[f.i] != ':' {
+			return nil, fmt.Errorf("expected : after %q", key)
+		}
+		f.i++
+		v, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+		if err := f.next('}'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// next moves past a comma, or stays before the closing bracket.
+func (f *yamlFlow) next(closing byte) error {
+	f.space()
+	switch {
+	case f.i < len(f.s) && f.s[f.i] == ',':
+		f.i++
+		return nil
+	case f.i < len(f.s) && f.s[f.i] == closing:
+		return nil
+	}
+	return fmt.Errorf("expected , or %c", closing)
+}
+
+// scalar reads up to the next delimiter; a key also ends at a colon
+// followed by a space or delimiter.
+func (f *yamlFlow) scalar(key bool) (any, error) {
+	if f.i >= len(f.s) {
+		return nil, errors.New("unexpected end of line")
+	}
+	start := f.i
+	if c := f.s[f.i]; c == '"' || c == '\'' {
+		end := quotedEnd(f.s[start:])
+		if end < 0 {
+			return nil, errors.New("unterminated quoted string")
+		}
+		f.i += end
+		return yamlScalar(f.s[start:f.i])
+	}
+
+	for f.i < len(f.s) {
+		c := f.s[f.i]
+		if c == ',' || c == ']' || c == '}' {
+			break
+		}
+		if key && c == ':' && (f.i+1 == len(f.s) || strings.IndexByte(" ,]}", f.s[f.i+1]) >= 0) {
+			break
+		}
+		f.i++
+	}
+	text := strings.TrimSpace(f.s[start:f.i])
+	if text == "" {
+		return nil, errors.New("empty value")
+	}
+	return yamlScalar(text)
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestYAMLFlowTruncated(t *testing.T) {
+	for _, doc := range []string{
+		"listen: {",
+		"listen: {a: 1,",
+		"listen: {a: 1, b",
+		"listen: {a:",
+		"backends: [",
+		"backends: [a, b,",
+		"backends: [{",
+		"backends: [{a: 1},",
+	} {
+		if _, err := yamlToJSON([]byte(doc)); err == nil {
+			t.Errorf("%q: no error", doc)
+		}
+	}
+}
+
+func TestYAMLFlow(t *testing.T) {
+	data, err := yamlToJSON([]byte("m: {a: 1, b: [x, \"y z\"], c: {}}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	m := got["m"].(map[string]any)
+	if m["a"] != float64(1) || len(m["b"].([]any)) != 2 || m["b"].([]any)[1] != "y z" || len(m["c"].(map[string]any)) != 0 {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestYAMLValues(t *testing.T) {
+	for _, tt := range []struct{ doc, want string }{
+		{"", `{}`},
+		{"# only a comment\n\n", `{}`},
+		{"---\na: 1\n", `{"a":1}`},
+		{"a: 1\r\nb: x\r\n", `{"a":1,"b":"x"}`},
+		{"listen: :8080\naddr: 10.0.0.1:80\n", `{"addr":"10.0.0.1:80","listen":":8080"}`},
+		{"a: \"q # not\" # comment\nb: 'it''s'\nc: x#y\n", `{"a":"q # not","b":"it's","c":"x#y"}`},
+		{"a: ~\nb: true\nc: FALSE\nd: -1.5\ne: 0x10\nf: 007\n", `{"a":null,"b":true,"c":false,"d":-1.5,"e":"0x10","f":"007"}`},
+		{"a:\nb: 1\n", `{"a":null,"b":1}`},
+		{"list:\n- a\n- b\n", `{"list":["a","b"]}`},
+		{"list:\n  - a: 1\n    b: 2\n  - c\n", `{"list":[{"a":1,"b":2},"c"]}`},
+		{"\"k: x\": 1\n", `{"k: x":1}`},
+		{"a: [\"a,b\", 'c]']\n", `{"a":["a,b","c]"]}`},
+	} {
+		got, err := yamlToJSON([]byte(tt.doc))
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%q: got %s, %v, want %s", tt.doc, got, err, tt.want)
+		}
+	}
+}
+
+func TestYAMLErrors(t *testing.T) {
+	for _, tt := range []struct{ doc, want string }{
+		{"a: 1\n---\nb: 2\n", "line 2: only one document"},
+		{"a:\n\tb: 1\n", "line 2: tabs are not allowed"},
+		{"a: 1\na: 2\n", `line 2: duplicate key "a"`},
+		{"a: 1\n  b: 2\n", "line 2: unexpected indentation"},
+		{"- a\nb: 1\n", "line 2: unexpected indentation"},
+		{"a: 1\n- b\n", "line 2: expected a key"},
+		{"just text\n", "line 1: expected key: value"},
+		{"\"k\"x: 1\n", "line 1: expected key: value"},
+		{"a: |\n  x\n", "block scalars are not supported"},
+		{"a: &x 1\n", "anchors, aliases and tags"},
+		{"a: *x\n", "anchors, aliases and tags"},
+		{"a: !!str 1\n", "anchors, aliases and tags"},
+		{"a: \"open\n", "bad quoted string"},
+		{"a: 'open\n", "bad quoted string"},
+		{"a: [1, 2] x\n", "unexpected text after the collection"},
+		{"a: {b 1}\n", "expected : after"},
+		{"a: [1,, 2]\n", "empty value"},
+		{"a: {b: }\n", "empty value"},
+	} {
+		_, err := yamlToJSON([]byte(tt.doc))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.doc, err, tt.want)
+		}
+	}
+}
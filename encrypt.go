@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"loadbalancer/config"
+)
+
+// runEncrypt implements "loadbalancer encrypt": it turns the value on stdin
+// into an ENC[...] string for the config, or with -new-key generates a
+// data key.
+func runEncrypt(args []string) {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	newKey := fs.Bool("new-key", false, "generate a data key instead of encrypting")
+	transit := fs.String("vault-transit", "", "wrap the new data key with this Vault transit key")
+	cfgPath := fs.String("config", "", "take the data key from this config's encryption section")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: loadbalancer encrypt [-config file] < value")
+		fmt.Fprintln(os.Stderr, "       loadbalancer encrypt -new-key [-vault-transit key]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *newKey {
+		key, enc, err := config.NewDataKey(*transit)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error generating key:", err)
+			os.Exit(1)
+		}
+		if enc == nil {
+			fmt.Printf("export %s=%s\n", config.EnvConfigKey, base64.StdEncoding.EncodeToString(key))
+			return
+		}
+		section, _ := json.MarshalIndent(map[string]any{"encryption": enc}, "", "  ")
+		fmt.Println(string(section))
+		return
+	}
+
+	value, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error reading value:", err)
+		os.Exit(1)
+	}
+
+	var section struct {
+		Encryption *config.Encryption `json:"encryption"`
+	}
+	if *cfgPath != "" {
+		data, err := os.ReadFile(*cfgPath)
+		if err == nil {
+			err = json.Unmarshal(data, &section)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading config:", err)
+			os.Exit(1)
+		}
+	}
+
+	key, err := config.DataKey(section.Encryption)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+
+	sealed, err := config.EncryptValue(key, strings.TrimRight(string(value), "\r\n"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error encrypting:", err)
+		os.Exit(1)
+	}
+	fmt.Println(sealed)
+}
@@ -1,24 +1,89 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"loadbalancer/balancer"
+	"loadbalancer/config"
+	"os"
 )
 
 func main()  {
-	servers := []string{
-		"localhost:9001",
-		"localhost:9002",
-		"localhost:9003",
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "encrypt":
+			runEncrypt(os.Args[2:])
+			return
+		case "bench":
+			runBench(os.Args[2:])
+			return
+		case "simulate":
+			runSimulate(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		}
 	}
 
-	lb := balancer.NewLoadBalancer(servers)
+	configPath := flag.String("config", "", "read the configuration from this YAML or JSON file")
+	flag.Parse()
+
+	cfg := &config.Config{
+		Listen: ":8090",
+		Backends: []string{
+			"localhost:9001",
+			"localhost:9002",
+			"localhost:9003",
+		},
+	}
+
+	if *configPath != "" {
+		loaded, err := config.Load(*configPath)
+		if err != nil {
+			fmt.Println("Invalid configuration:", err)
+			return
+		}
+		cfg = loaded
+	}
+
+	lb, err := cfg.Build()
+	if err != nil {
+		fmt.Println("Invalid configuration:", err)
+		return
+	}
+
+	listenerCfg, err := cfg.ListenerConfig()
+	if err != nil {
+		fmt.Println("Invalid configuration:", err)
+		return
+	}
+
+	running := cfg
+	reload := func() {
+		if *configPath == "" {
+			fmt.Println("WARNING: not reloading, no -config file was given")
+			return
+		}
+		next, err := config.Load(*configPath)
+		if err != nil {
+			fmt.Println("WARNING: reload:", err)
+			return
+		}
+		if err := running.Reload(lb, next); err != nil {
+			fmt.Println("WARNING: reload:", err)
+			return
+		}
+		running = next
+		fmt.Println("Configuration reloaded from", *configPath)
+	}
+
+	handleSignals(lb, reload)
 
 	fmt.Println("Starting New Loadbalancer...")
-	err := lb.Start(":8090")
+	err = cfg.Serve(lb, listenerCfg)
 
 	if err != nil {
 		fmt.Println("Error starting load balancer:", err)
 	}
 
-}
\ No newline at end of file
+}
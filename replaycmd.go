@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"loadbalancer/balancer/replay"
+)
+
+// runReplay implements "loadbalancer replay": it replays the connections
+// recorded by failure_log against a staging listener.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	records := fs.String("records", "", "failure_log file to replay")
+	target := fs.String("target", "", "staging listener to connect to, host:port")
+	speed := fs.Float64("speed", 1, "replay this many times faster than recorded")
+	proxy := fs.Bool("proxy", false, "send a PROXY protocol header with the recorded client address")
+	timeout := fs.Duration("timeout", 0, "bound on each connection (default 2s)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: loadbalancer replay -records file -target host:port")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *records == "" || *target == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	recs, err := replay.Load(*records)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid records:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Replaying %d connection(s) against %s\n", len(recs), *target)
+
+	results := replay.Replay(recs, replay.Options{
+		Target:  *target,
+		Speed:   *speed,
+		Proxy:   *proxy,
+		Timeout: *timeout,
+	})
+	fmt.Print(replay.Report(results))
+}
@@ -0,0 +1,47 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"loadbalancer/balancer"
+)
+
+// handleSignals lets operators toggle under-attack mode with SIGUSR1,
+// drain the balancer before a restart with SIGUSR2, reload the config
+// file with SIGHUP and shut down gracefully with SIGTERM or SIGINT. A
+// second SIGTERM or SIGINT exits right away.
+func handleSignals(lb *balancer.LoadBalancer, reload func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		stopping := false
+		for sig := range signals {
+			switch sig {
+			case syscall.SIGUSR1:
+				if on, _ := lb.UnderAttack(); on {
+					lb.DisableUnderAttack()
+				} else {
+					lb.EnableUnderAttack(0)
+				}
+			case syscall.SIGUSR2:
+				go lb.Drain(context.Background())
+			case syscall.SIGHUP:
+				reload()
+			case syscall.SIGTERM, syscall.SIGINT:
+				if stopping {
+					fmt.Println("Exiting without waiting for connections")
+					os.Exit(1)
+				}
+				stopping = true
+				go lb.Shutdown(context.Background())
+			}
+		}
+	}()
+}
@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "loadbalancer/balancer"
+
+// handleSignals is a no-op: Windows has no SIGUSR1, SIGUSR2 or SIGHUP.
+func handleSignals(lb *balancer.LoadBalancer, reload func()) {}
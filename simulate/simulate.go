@@ -0,0 +1,269 @@
+package simulate
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"loadbalancer/balancer/backend"
+	"loadbalancer/balancer/strategy"
+)
+
+// Backend is a backend as the model sees it.
+type Backend struct {
+	Addr   string
+	Weight int
+	//Latency is what the backend takes to first byte, default 10ms, fed
+	//to latency aware strategies
+	Latency time.Duration
+}
+
+// Phase is a stretch of constant arrival rate.
+type Phase struct {
+	//Rate is new connections per second
+	Rate     float64
+	Duration time.Duration
+}
+
+// Traffic describes the synthetic load.
+type Traffic struct {
+	//Clients are the distinct client IPs connections come from, default 100
+	Clients int
+	Phases  []Phase
+	//Hold is the mean connection lifetime, default 1s; lifetimes are
+	//exponentially distributed
+	Hold time.Duration
+	//Seed makes runs repeatable; every strategy sees the same arrivals
+	Seed uint64
+}
+
+func (t Traffic) withDefaults() Traffic {
+	if t.Clients <= 0 {
+		t.Clients = 100
+	}
+	if t.Hold <= 0 {
+		t.Hold = time.Second
+	}
+	return t
+}
+
+// Candidate is a strategy to try. New is called once per run so every
+// candidate starts without state.
+type Candidate struct {
+	Name string
+	New  func() strategy.Strategy
+}
+
+// Result is how one strategy spread the traffic.
+type Result struct {
+	Strategy    string
+	Connections uint64
+	Backends    []BackendResult
+	//Deviation is the largest difference between a backend's share and
+	//its fair share by weight, relative to the fair share
+	Deviation float64
+	//Moved is the share of clients sent to more than one backend
+	Moved float64
+}
+
+type BackendResult struct {
+	Addr        string
+	Weight      int
+	Connections uint64
+	Share       float64
+	//MeanActive is averaged over the simulated time
+	MeanActive float64
+	PeakActive int64
+}
+
+// Run plays traffic against backends with each candidate. Time is
+// simulated, so an hour of traffic takes as long as computing it.
+func Run(candidates []Candidate, backends []Backend, traffic Traffic) ([]Result, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("no backends to simulate")
+	}
+	if len(traffic.Phases) == 0 {
+		return nil, errors.New("traffic has no phases")
+	}
+	for i, p := range traffic.Phases {
+		if p.Rate <= 0 || p.Duration <= 0 {
+			return nil, fmt.Errorf("phase %d: rate and duration must be positive", i+1)
+		}
+	}
+	traffic = traffic.withDefaults()
+
+	results := make([]Result, 0, len(candidates))
+	for _, c := range candidates {
+		results = append(results, run(c, backends, traffic))
+	}
+	return results, nil
+}
+
+// ending is an open connection, ordered by when it closes.
+type ending struct {
+	at time.Duration
+	b  int
+}
+
+type endings []ending
+
+func (e endings) Len() int           { return len(e) }
+func (e endings) Less(i, j int) bool { return e[i].at < e[j].at }
+func (e endings) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e *endings) Push(x any)        { *e = append(*e, x.(ending)) }
+func (e *endings) Pop() any {
+	old := *e
+	x := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return x
+}
+
+func run(c Candidate, models []Backend, traffic Traffic) Result {
+	rng := rand.New(rand.NewPCG(traffic.Seed, traffic.Seed))
+	s := c.New()
+	keyed, _ := s.(strategy.Keyed)
+
+	backends := make([]*backend.Backend, len(models))
+	latency := make([]time.Duration, len(models))
+	for i, m := range models {
+		backends[i] = backend.New(m.Addr)
+		backends[i].SetWeight(max(m.Weight, 1))
+		latency[i] = m.Latency
+		if latency[i] <= 0 {
+			latency[i] = 10 * time.Millisecond
+		}
+	}
+
+	index := make(map[*backend.Backend]int, len(backends))
+	for i, b := range backends {
+		index[b] = i
+	}
+
+	conns := make([]uint64, len(backends))
+	peak := make([]int64, len(backends))
+	//area under each backend's active count, in connection-seconds
+	area := make([]float64, len(backends))
+	seen := make([]map[int]bool, traffic.Clients)
+
+	var open endings
+	var now, last time.Duration
+	//advance accounts the active counts up to t
+	advance := func(t time.Duration) {
+		for i, b := range backends {
+			area[i] += float64(b.Active()) * (t - last).Seconds()
+		}
+		last = t
+	}
+
+	var phaseEnd time.Duration
+	for _, phase := range traffic.Phases {
+		phaseEnd += phase.Duration
+		for {
+			now += time.Duration(rng.ExpFloat64() / phase.Rate * float64(time.Second))
+			if now >= phaseEnd {
+				now = phaseEnd
+				break
+			}
+
+			for len(open) > 0 && open[0].at <= now {
+				e := heap.Pop(&open).(ending)
+				advance(e.at)
+				backends[e.b].ConnFinished()
+			}
+			advance(now)
+
+			client := rng.IntN(traffic.Clients)
+			var b *backend.Backend
+			if keyed != nil {
+				b = keyed.PickKey(clientIP(client), backends)
+			} else {
+				b = s.Pick(backends)
+			}
+			i, ok := index[b]
+			if !ok {
+				continue
+			}
+
+			b.ConnStarted()
+			b.ObserveLatency(latency[i])
+			conns[i]++
+			peak[i] = max(peak[i], b.Active())
+			if seen[client] == nil {
+				seen[client] = make(map[int]bool)
+			}
+			seen[client][i] = true
+
+			hold := time.Duration(rng.ExpFloat64() * float64(traffic.Hold))
+			heap.Push(&open, ending{at: now + hold, b: i})
+		}
+	}
+	advance(now)
+
+	res := Result{Strategy: c.Name}
+	var weights int
+	for _, m := range models {
+		weights += max(m.Weight, 1)
+	}
+	for i := range backends {
+		res.Connections += conns[i]
+	}
+	for i, m := range models {
+		br := BackendResult{
+			Addr:        m.Addr,
+			Weight:      max(m.Weight, 1),
+			Connections: conns[i],
+			PeakActive:  peak[i],
+		}
+		if res.Connections > 0 {
+			br.Share = float64(conns[i]) / float64(res.Connections)
+		}
+		if now > 0 {
+			br.MeanActive = area[i] / now.Seconds()
+		}
+		fair := float64(br.Weight) / float64(weights)
+		res.Deviation = math.Max(res.Deviation, math.Abs(br.Share-fair)/fair)
+		res.Backends = append(res.Backends, br)
+	}
+
+	var clients, moved int
+	for _, s := range seen {
+		if s == nil {
+			continue
+		}
+		clients++
+		if len(s) > 1 {
+			moved++
+		}
+	}
+	if clients > 0 {
+		res.Moved = float64(moved) / float64(clients)
+	}
+	return res
+}
+
+// clientIP makes up the address of client n.
+func clientIP(n int) string {
+	return fmt.Sprintf("10.%d.%d.%d", n>>16&0xff, n>>8&0xff, n&0xff)
+}
+
+// Report formats results as a table per strategy.
+func Report(results []Result) string {
+	var b strings.Builder
+	for i, r := range results {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%s: %d connections, deviation %.1f%%, clients moved %.1f%%\n",
+			r.Strategy, r.Connections, 100*r.Deviation, 100*r.Moved)
+		fmt.Fprintf(&b, "  %-24s %6s %10s %7s %10s %6s\n", "backend", "weight", "conns", "share", "mean act", "peak")
+		for _, br := range r.Backends {
+			fmt.Fprintf(&b, "  %-24s %6d %10d %6.1f%% %10.1f %6d\n",
+				br.Addr, br.Weight, br.Connections, 100*br.Share, br.MeanActive, br.PeakActive)
+		}
+	}
+	return b.String()
+}
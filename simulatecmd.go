@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"loadbalancer/config"
+	"loadbalancer/simulate"
+)
+
+// runSimulate implements "loadbalancer simulate": it replays a traffic
+// description against the config's backends with every strategy.
+func runSimulate(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	cfgPath := fs.String("config", "", "config whose backends, weights and strategy to use")
+	trafficPath := fs.String("traffic", "", "YAML or JSON traffic description")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: loadbalancer simulate -config file -traffic file")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *cfgPath == "" || *trafficPath == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load(*cfgPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:", err)
+		os.Exit(1)
+	}
+	traffic, err := config.LoadTraffic(*trafficPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid traffic description:", err)
+		os.Exit(1)
+	}
+
+	results, err := simulate.Run(cfg.Simulation(traffic))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Simulation failed:", err)
+		os.Exit(1)
+	}
+	fmt.Print(simulate.Report(results))
+}